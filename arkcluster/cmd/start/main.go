@@ -39,6 +39,9 @@ func run(ctx context.Context, _ []string, getenv func(string) string, _ io.Reade
   if err := db.AutoMigrate(&models.Deployment{}); err != nil {
     return fmt.Errorf("could not automigrate deployments: %w", err)
   }
+  if err := db.AutoMigrate(&models.Disk{}); err != nil {
+    return fmt.Errorf("could not automigrate disks: %w", err)
+  }
 
   // set up dependencies
 
@@ -5,8 +5,12 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"strconv"
 
+	"github.com/dkimot/ark"
+	"github.com/dkimot/ark/arkcluster/internal/usecase"
 	"github.com/oklog/ulid"
+	"gorm.io/gorm"
 )
 
 func encode[T any](w http.ResponseWriter, r *http.Request, status int, v T) error {
@@ -19,6 +23,11 @@ func encode[T any](w http.ResponseWriter, r *http.Request, status int, v T) erro
 }
 
 func renderErr(w http.ResponseWriter, r *http.Request, err error) error {
+	var verr *ark.ValidationError
+	if errors.As(err, &verr) {
+		return encode(w, r, status(err), errRes{Error: err.Error(), Details: verr.Errors})
+	}
+
 	return encode(w, r, status(err), errRes{Error: err.Error()})
 }
 
@@ -35,6 +44,23 @@ func status(err error) int {
 		return http.StatusBadRequest
 	}
 
+	if errors.Is(err, strconv.ErrSyntax) || errors.Is(err, strconv.ErrRange) {
+		return http.StatusBadRequest
+	}
+
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return http.StatusNotFound
+	}
+
+	var verr *ark.ValidationError
+	if errors.As(err, &verr) {
+		return http.StatusUnprocessableEntity
+	}
+
+	if errors.Is(err, usecase.ErrInvalidDeploymentName) {
+		return http.StatusUnprocessableEntity
+	}
+
 	return http.StatusInternalServerError
 }
 
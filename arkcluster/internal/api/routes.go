@@ -2,7 +2,9 @@ package api
 
 import (
 	"encoding/json"
+	"fmt"
 	"net/http"
+	"strconv"
 
 	"github.com/dkimot/ark"
 	"github.com/dkimot/ark/arkcluster/internal/config"
@@ -23,18 +25,22 @@ func addRoutes(
   mux.Handle("POST /v1/stacks", handleV1CreateStack(db))
   mux.Handle("GET /v1/stacks/{stackName}", handleV1GetStack(db))
   mux.Handle("PUT /v1/stacks/{stackName}/definition", handleV1UpsertStackDefinition(db))
+  mux.Handle("GET /v1/stacks/{stackName}/definitions/{id}/diff", handleV1DiffStackDefinition(db))
   mux.Handle("PUT /v1/stacks/{stackName}/secrets", notImplementedHandler())
   mux.Handle("DELETE /v1/stacks/{stackName}", handleV1DeleteStack(db))
 
   // deployment routes
   mux.Handle("GET /v1/stacks/{stackName}/deployments", handleV1ListDeployments(db))
   mux.Handle("POST /v1/stacks/{stackName}/deployments", handleV1CreateDeployment(db))
-  mux.Handle("GET /v1/stacks/{stackName}/deployments/{deploymentName}", notImplementedHandler())
+  mux.Handle("GET /v1/stacks/{stackName}/deployments/{deploymentName}", handleV1GetDeployment(db))
   mux.Handle("POST /v1/deployments/{deploymentId}/deploy", notImplementedHandler())
   mux.Handle("PUT /v1/deployments/{deploymentId}/stack_definition", notImplementedHandler())
   mux.Handle("PUT /v1/deployments/{deploymentId}/secrets", notImplementedHandler())
   mux.Handle("DELETE /v1/deployments/{deploymentId}", notImplementedHandler())
 
+  // json schema of stack_definition.toml
+  mux.Handle("GET /v1/schema/stack_definition", handleV1StackDefinitionSchema())
+
   // basic healthcheck
   mux.Handle("GET /v1/up", handleV1HealthCheck(config))
 }
@@ -58,6 +64,14 @@ func handleV1HealthCheck(cfg config.Config) http.Handler {
 	})
 }
 
+func handleV1StackDefinitionSchema() http.Handler {
+  schema := ark.StackDefinitionSchema()
+
+  return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    encode(w, r, http.StatusOK, schema)
+  })
+}
+
 func handleV1ListStacks(db *gorm.DB) http.Handler {
   return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
     var stacks []models.Stack
@@ -135,7 +149,15 @@ func handleV1DeleteStack(db *gorm.DB) http.Handler {
 func handleV1UpsertStackDefinition(db *gorm.DB) http.Handler {
   return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
     var body ark.StackDefinition
-    if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+    dec := json.NewDecoder(r.Body)
+    dec.DisallowUnknownFields()
+    if err := dec.Decode(&body); err != nil {
+      renderErr(w, r, err)
+      return
+    }
+
+    // reject bad definitions before they are stored
+    if err := body.Validate(); err != nil {
       renderErr(w, r, err)
       return
     }
@@ -149,6 +171,41 @@ func handleV1UpsertStackDefinition(db *gorm.DB) http.Handler {
   })
 }
 
+func handleV1DiffStackDefinition(db *gorm.DB) http.Handler {
+  return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    stack, err := getStackFromPath(r, db)
+    if err != nil {
+      renderErr(w, r, err)
+      return
+    }
+
+    id, err := strconv.ParseUint(r.PathValue("id"), 10, 64)
+    if err != nil {
+      renderErr(w, r, fmt.Errorf("parsing definition id: %w", err))
+      return
+    }
+
+    var againstId *uint
+    if rawAgainst := r.URL.Query().Get("against"); rawAgainst != "" {
+      against, err := strconv.ParseUint(rawAgainst, 10, 64)
+      if err != nil {
+        renderErr(w, r, fmt.Errorf("parsing against id: %w", err))
+        return
+      }
+      a := uint(against)
+      againstId = &a
+    }
+
+    plan, err := usecase.DiffStackDefinition(r.Context(), db, stack, uint(id), againstId)
+    if err != nil {
+      renderErr(w, r, err)
+      return
+    }
+
+    encode(w, r, http.StatusOK, plan)
+  })
+}
+
 func handleV1ListDeployments(db *gorm.DB) http.Handler {
   return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
     stack, err := getStackFromPath(r, db)
@@ -169,6 +226,43 @@ func handleV1ListDeployments(db *gorm.DB) http.Handler {
 }
 
 func handleV1CreateDeployment(db *gorm.DB) http.Handler {
+  type request struct {
+    Name string `json:"name"`
+    DeployedFor string `json:"deployed_for"`
+  }
+
+  return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    stack, err := getStackFromPath(r, db)
+    if err != nil {
+      renderErr(w, r, err)
+      return
+    }
+
+    var body request
+    if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+      renderErr(w, r, err)
+      return
+    }
+
+    deployment, err := usecase.CreateDeployment(r.Context(), db, stack, body.Name, body.DeployedFor)
+    if err != nil {
+      renderErr(w, r, err)
+      return
+    }
+
+    encode(w, r, http.StatusCreated, deployment)
+  })
+}
+
+func handleV1GetDeployment(db *gorm.DB) http.Handler {
+  type response struct {
+    models.Deployment
+    // the definition with the deployment's overlay merged in
+    StackDefinition ark.StackDefinition `json:"stack_definition"`
+    // the order apps and services are started in
+    DependencyGraph ark.DependencyGraph `json:"dependency_graph"`
+  }
+
   return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
     stack, err := getStackFromPath(r, db)
     if err != nil {
@@ -176,7 +270,29 @@ func handleV1CreateDeployment(db *gorm.DB) http.Handler {
       return
     }
 
-    
+    deployment, err := dao.GetDeploymentByName(r.Context(), db, stack.ID, r.PathValue("deploymentName"))
+    if err != nil {
+      renderErr(w, r, err)
+      return
+    }
+
+    def, err := dao.DecodeStackDefinition(deployment.StackDefRaw)
+    if err != nil {
+      renderErr(w, r, err)
+      return
+    }
+
+    graph, err := def.DependencyGraph()
+    if err != nil {
+      renderErr(w, r, err)
+      return
+    }
+
+    encode(w, r, http.StatusOK, &response{
+      Deployment: *deployment,
+      StackDefinition: def,
+      DependencyGraph: graph,
+    })
   })
 }
 
@@ -1,6 +1,9 @@
 package api
 
+import "github.com/dkimot/ark"
+
 type errRes struct {
-	Error string `json:"error"`
+	Error   string           `json:"error"`
+	Details []ark.FieldError `json:"details,omitempty"`
 }
 
@@ -0,0 +1,19 @@
+package dao
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/dkimot/ark/arkcluster/internal/models"
+	"gorm.io/gorm"
+)
+
+func GetDeploymentByName(ctx context.Context, db *gorm.DB, stackId uint, name string) (*models.Deployment, error) {
+  var deployment models.Deployment
+  result := db.WithContext(ctx).First(&deployment, "stack_id = ? AND name = ?", stackId, name)
+  if result.Error != nil {
+    return nil, fmt.Errorf("could not get deployment by name %s: %w", name, result.Error)
+  }
+
+  return &deployment, nil
+}
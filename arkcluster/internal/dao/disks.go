@@ -0,0 +1,24 @@
+package dao
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/dkimot/ark/arkcluster/internal/models"
+	"gorm.io/gorm"
+)
+
+// UpsertDisk records a disk for a deployment's app or service, keyed by
+// deployment, owner and disk name.
+func UpsertDisk(ctx context.Context, db *gorm.DB, disk models.Disk) (*models.Disk, error) {
+  var existing models.Disk
+  result := db.WithContext(ctx).
+    Where(models.Disk{DeploymentID: disk.DeploymentID, OwnerName: disk.OwnerName, Name: disk.Name}).
+    Assign(models.Disk{WorkerID: disk.WorkerID, MountPath: disk.MountPath, Size: disk.Size}).
+    FirstOrCreate(&existing)
+  if result.Error != nil {
+    return nil, fmt.Errorf("could not upsert disk %s for %s: %w", disk.Name, disk.OwnerName, result.Error)
+  }
+
+  return &existing, nil
+}
@@ -0,0 +1,55 @@
+package dao
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/dkimot/ark"
+	"github.com/dkimot/ark/arkcluster/internal/models"
+	"gorm.io/gorm"
+)
+
+func GetStackDef(ctx context.Context, db *gorm.DB, stackId uint, id uint) (*models.StackDef, error) {
+  var stackDef models.StackDef
+  result := db.WithContext(ctx).First(&stackDef, "stack_id = ? AND id = ?", stackId, id)
+  if result.Error != nil {
+    return nil, fmt.Errorf("could not get stack definition %d: %w", id, result.Error)
+  }
+
+  return &stackDef, nil
+}
+
+// GetPreviousStackDef returns the definition stored for the stack right
+// before the given one, or nil if it is the first.
+func GetPreviousStackDef(ctx context.Context, db *gorm.DB, stackDef *models.StackDef) (*models.StackDef, error) {
+  var prev models.StackDef
+  result := db.WithContext(ctx).
+    Where("stack_id = ? AND id < ?", stackDef.StackID, stackDef.ID).
+    Order("id desc").
+    Limit(1).
+    Find(&prev)
+  if result.Error != nil {
+    return nil, fmt.Errorf("could not get previous stack definition of %d: %w", stackDef.ID, result.Error)
+  }
+  if result.RowsAffected == 0 {
+    return nil, nil
+  }
+
+  return &prev, nil
+}
+
+// DecodeStackDefinition decodes a definition stored on a StackDef or
+// Deployment. an empty raw definition decodes to an empty StackDefinition.
+func DecodeStackDefinition(raw []byte) (ark.StackDefinition, error) {
+  var def ark.StackDefinition
+  if len(raw) == 0 {
+    return def, nil
+  }
+
+  if err := json.Unmarshal(raw, &def); err != nil {
+    return def, fmt.Errorf("invalid stored stack definition: %w", err)
+  }
+
+  return def, nil
+}
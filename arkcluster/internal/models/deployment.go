@@ -6,4 +6,8 @@ type Deployment struct {
   StackID uint
   StackDefRaw []byte
   DeployedFor string
+  // the definition the last successful deploy brought the deployment to
+  DeployedDefRaw []byte
+  // the ark.DeployPlan applied by the last successful deploy
+  LastPlanRaw []byte
 }
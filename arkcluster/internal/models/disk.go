@@ -1,8 +1,14 @@
 package models
 
+// Disk is a persistent volume owned by an app or service of a deployment.
+// it lives on the worker that first ran the owner's task.
 type Disk struct {
   Model
+  Name string
+  OwnerName string
+  MountPath string
   WorkerID string
+  // size in GB
   Size int
   DeploymentID uint
 }
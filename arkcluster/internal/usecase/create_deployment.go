@@ -2,27 +2,59 @@ package usecase
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
 
+	"github.com/dkimot/ark/arkcluster/internal/dao"
 	"github.com/dkimot/ark/arkcluster/internal/models"
 	"gorm.io/gorm"
 )
 
-func CreateDeployment(ctx context.Context, db *gorm.DB, stack *models.Stack) error {
+var ErrInvalidDeploymentName = errors.New("usecase: invalid deployment name")
+
+// CreateDeployment saves a new deployment of the stack's current definition,
+// with the overlay for deployedFor merged in.
+func CreateDeployment(ctx context.Context, db *gorm.DB, stack *models.Stack, name, deployedFor string) (*models.Deployment, error) {
+  if strings.TrimSpace(name) == "" {
+    return nil, fmt.Errorf("%w: name is required", ErrInvalidDeploymentName)
+  }
+
   // get current stack definition
   var stackDef models.StackDef
-  result := db.First(&stackDef, "stack_id = ?", stack.ID)
+  result := db.Order("id desc").First(&stackDef, "stack_id = ?", stack.ID)
   if result.Error != nil {
-    return result.Error
+    return nil, result.Error
+  }
+
+  def, err := dao.DecodeStackDefinition(stackDef.RawDefinition)
+  if err != nil {
+    return nil, err
+  }
+
+  // apply the overlay for what this deployment is for
+  merged, err := def.ForDeployment(deployedFor)
+  if err != nil {
+    return nil, err
+  }
+
+  mergedBytes, err := json.Marshal(&merged)
+  if err != nil {
+    return nil, err
   }
 
   // save deployment to database
-  result = db.Create(&models.Deployment{
+  deployment := &models.Deployment{
+    Name: name,
     StackID: stack.ID,
-    StackDefRaw: stackDef.RawDefinition,
-  })
+    StackDefRaw: mergedBytes,
+    DeployedFor: deployedFor,
+  }
+  result = db.Create(deployment)
   if result.Error != nil {
-    return result.Error
+    return nil, fmt.Errorf("could not create deployment %s: %w", name, result.Error)
   }
 
-  return nil
+  return deployment, nil
 }
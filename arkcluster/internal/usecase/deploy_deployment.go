@@ -3,15 +3,39 @@ package usecase
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"sort"
+	"strconv"
+	"strings"
 
 	"github.com/dkimot/ark"
+	"github.com/dkimot/ark/arkcluster/internal/dao"
 	"github.com/dkimot/ark/arkcluster/internal/models"
 	"github.com/dkimot/ark/arkd"
 	"gorm.io/gorm"
 )
 
-func DeployDeployment(ctx context.Context, db *gorm.DB, arkd arkd.Client, deployment *models.Deployment) error {
+var ErrNoWorkers = errors.New("usecase: no workers available to deploy to")
+
+// ErrReplicatedDisk is returned for apps with disks that are to run more
+// than one task
+var ErrReplicatedDisk = errors.New("usecase: apps with disks can't have more than one task")
+
+// ErrRedeployNotSupported is returned when a deployment that is already
+// running has changes. only the first deploy of a deployment is applied so
+// far, its deployed definition is left as is until changes can be rolled out.
+var ErrRedeployNotSupported = errors.New("usecase: changes to a running deployment can't be deployed yet")
+
+// DeployDeployment runs a deployment on the given workers. services and
+// apps with disks are placed on the first worker, app replicas are spread
+// across all of them. deployments that are already running are left alone
+// and fail with ErrRedeployNotSupported if their definition changed.
+func DeployDeployment(ctx context.Context, db *gorm.DB, workers []arkd.Client, deployment *models.Deployment) error {
+  if len(workers) == 0 {
+    return ErrNoWorkers
+  }
+
   var stack models.Stack
   result := db.First(&stack, deployment.StackID)
   if result.Error != nil {
@@ -25,70 +49,124 @@ func DeployDeployment(ctx context.Context, db *gorm.DB, arkd arkd.Client, deploy
     return fmt.Errorf("invalid stack definition on deployment %d: %w", deployment.ID, err)
   }
 
-  // build images
+  // plan against what was last deployed, it's recorded once it's applied
+  deployedDef, err := dao.DecodeStackDefinition(deployment.DeployedDefRaw)
+  if err != nil {
+    return fmt.Errorf("deployment %d: %w", deployment.ID, err)
+  }
+  plan := ark.DiffStackDefinitions(deployedDef, definition)
 
-  // find worker that can run this deployment
+  env := envResolver(definition, deployment.Name, stackName)
 
-  // request deployment on worker
-  currTasks, err := arkd.ListTasks(ctx, deployment.Name)
-  if err != nil {
-    return err
+  // build images
+
+  // request deployment on workers
+  currTaskCount := 0
+  for _, worker := range workers {
+    currTasks, err := worker.ListTasks(ctx, deployment.Name)
+    if err != nil {
+      return err
+    }
+    currTaskCount += len(currTasks)
+  }
+  if currTaskCount > 0 {
+    if plan.Empty() {
+      return nil
+    }
+    return fmt.Errorf("deployment %d: %w: %s", deployment.ID, ErrRedeployNotSupported, planSummary(plan))
   }
-  firstDeploy := len(currTasks) == 0
+
   var errWhileDeploying error
   defer func() {
     if errWhileDeploying != nil {
-      arkd.DeleteDeployment(ctx, deployment.Name)
+      for _, worker := range workers {
+        worker.DeleteDeployment(ctx, deployment.Name)
+      }
     }
   }()
 
-  if firstDeploy {
-    if err := deployServices(ctx, definition.Services, arkd, deployment.Name, stackName); err != nil {
+  // start apps and services in dependency order, waiting for each level
+  // to be running before moving on to the components that depend on it
+  graph, err := definition.DependencyGraph()
+  if err != nil {
+    return fmt.Errorf("deployment %d: %w", deployment.ID, err)
+  }
+
+  for _, level := range graph.Order {
+    for _, name := range level {
+      if srvDef, ok := definition.Services[name]; ok {
+        srvDef.Name = name
+        err = deployService(ctx, db, deployment, srvDef, workers[0], env, stackName)
+      } else {
+        appDef := definition.Apps[name]
+        appDef.Name = name
+        err = deployApp(ctx, db, deployment, appDef, workers, env, stackName)
+      }
+      if err != nil {
+        errWhileDeploying = err
+        return err
+      }
+    }
+
+    if err := waitForReady(ctx, workers, deployment.Name, definition, level); err != nil {
       errWhileDeploying = err
       return err
     }
   }
 
-  if err := deployApps(ctx, firstDeploy, definition.Apps, arkd, deployment.Name, stackName); err != nil {
-    errWhileDeploying = err
+  planBytes, err := json.Marshal(&plan)
+  if err != nil {
     return err
   }
+  result = db.Model(deployment).Updates(map[string]any{
+    "deployed_def_raw": deployment.StackDefRaw,
+    "last_plan_raw": planBytes,
+  })
+  if result.Error != nil {
+    return fmt.Errorf("could not record deployed definition for deployment %d: %w", deployment.ID, result.Error)
+  }
 
   return nil
 }
 
-func deployApps(ctx context.Context, firstDeploy bool, apps map[string]ark.AppDefinition, arkd arkd.Client, deploymentName, stackName string) error {
-  for appName, appDef := range apps {
-    appDef.Name = appName
-    if firstDeploy {
-      if err := createApp(ctx, arkd, appDef, "image", deploymentName, stackName); err != nil {
-        return err
-      }
-    } else {
-      if err := redeployApp(ctx, arkd, appDef); err != nil {
-        return err
-      }
+func deployApp(ctx context.Context, db *gorm.DB, deployment *models.Deployment, appDef ark.AppDefinition, workers []arkd.Client, env ark.EnvResolver, stackName string) error {
+  // disks live on a single worker and are attached to a single task.
+  // definitions are validated for this, but an overlay can still raise
+  // the count.
+  appWorkers := workers
+  if len(appDef.Disks) > 0 {
+    if appDef.Replicas() > 1 {
+      return fmt.Errorf("%w: app %s has disks and a count of %d", ErrReplicatedDisk, appDef.Name, appDef.Replicas())
     }
+    appWorkers = workers[:1]
   }
 
-  return nil
-}
-
-func deployServices(ctx context.Context, services map[string]ark.ServiceDefinition, arkd arkd.Client, deploymentName, stackName string) error {
-  for srvName, srvDef := range services {
-    srvDef.Name = srvName
-    if err := createService(ctx, arkd, srvDef, deploymentName, stackName); err != nil {
+  for _, worker := range spreadReplicas(appDef.Replicas(), appWorkers) {
+    if err := createApp(ctx, worker, env, appDef, "image", deployment.Name, stackName); err != nil {
       return err
     }
   }
 
-  return nil
+  return recordDisks(ctx, db, appWorkers[0], deployment, appDef.Name, appDef.Disks)
 }
 
-func createApp(ctx context.Context, client arkd.Client, appDef ark.AppDefinition, image, deploymentName, stackName string) error {
+func deployService(ctx context.Context, db *gorm.DB, deployment *models.Deployment, srvDef ark.ServiceDefinition, arkd arkd.Client, env ark.EnvResolver, stackName string) error {
+  if err := createService(ctx, arkd, env, srvDef, deployment.Name, stackName); err != nil {
+    return err
+  }
+
+  return recordDisks(ctx, db, arkd, deployment, srvDef.Name, srvDef.Disks)
+}
+
+func createApp(ctx context.Context, client arkd.Client, env ark.EnvResolver, appDef ark.AppDefinition, image, deploymentName, stackName string) error {
   var expPorts []string
   if appDef.Type == "web" {
-    expPorts = []string{appDef.HttpService.ContainerPort}
+    expPorts = []string{strconv.Itoa(appDef.HttpService.ContainerPort)}
+  }
+
+  appEnv, err := env.Resolve(appDef.Env)
+  if err != nil {
+    return fmt.Errorf("app %s: %w", appDef.Name, err)
   }
 
   return client.CreateTask(ctx, arkd.CreateTaskParams{
@@ -96,15 +174,158 @@ func createApp(ctx context.Context, client arkd.Client, appDef ark.AppDefinition
     DeploymentName: deploymentName,
     StackName: stackName,
     Image: image,
+    Cpu: appDef.Cpu,
+    Mem: appDef.Mem,
+    Schedule: appDef.Schedule,
     ExposedPorts: expPorts,
+    Disks: taskDisks(appDef.Disks),
+    Env: appEnv,
+    HealthCheck: taskHealthCheck(appDef),
+    StopSignal: appDef.Deploy.StopSignal,
+    StopGracePeriod: appDef.Deploy.StopGracePeriod,
+    KeepAlive: appDef.HttpService.KeepAlive,
+    IdleTimeout: appDef.HttpService.IdleTimeout,
+    Restart: taskRestartPolicy(appDef),
+  })
+}
+
+// taskHealthCheck checks apps with an http_service with a GET / unless
+// they configure a check of their own
+func taskHealthCheck(appDef ark.AppDefinition) arkd.TaskHealthCheck {
+  hc := appDef.HealthCheck
+  request := hc.Request
+  if hc.Command == "" && request == "" && appDef.HttpService.ContainerPort != 0 {
+    request = ark.DefaultHealthCheckRequest
+  }
+
+  return arkd.TaskHealthCheck{
+    GracePeriod: hc.GracePeriod,
+    Interval: hc.Interval,
+    Timeout: hc.Timeout,
+    Command: hc.Command,
+    Request: request,
+    Port: appDef.HttpService.ContainerPort,
+  }
+}
+
+// taskRestartPolicy restarts failed tasks unless the app says otherwise.
+// cron apps run to completion, they aren't restarted by default.
+func taskRestartPolicy(appDef ark.AppDefinition) arkd.TaskRestartPolicy {
+  policy := appDef.Deploy.Restart
+  if policy == "" {
+    policy = ark.RestartOnFailure
+    if appDef.Type == ark.AppTypeCron {
+      policy = ark.RestartNever
+    }
+  }
+
+  return arkd.TaskRestartPolicy{
+    Policy: policy,
+    MaxRetries: appDef.Deploy.MaxRetries,
+  }
+}
+
+// spreadReplicas assigns count replicas to workers round robin
+func spreadReplicas(count int, workers []arkd.Client) []arkd.Client {
+  placement := make([]arkd.Client, count)
+  for i := range placement {
+    placement[i] = workers[i%len(workers)]
+  }
+
+  return placement
+}
+
+func createService(ctx context.Context, client arkd.Client, env ark.EnvResolver, srvDef ark.ServiceDefinition, deploymentName, stackName string) error {
+  srvEnv, err := env.Resolve(srvDef.Env)
+  if err != nil {
+    return fmt.Errorf("service %s: %w", srvDef.Name, err)
+  }
+
+  return client.CreateTask(ctx, arkd.CreateTaskParams{
+    AppName: srvDef.Name,
+    DeploymentName: deploymentName,
+    StackName: stackName,
+    Image: srvDef.Image,
+    Disks: taskDisks(srvDef.Disks),
+    Env: srvEnv,
+    Restart: arkd.TaskRestartPolicy{Policy: arkd.RestartOnFailure},
   })
 }
 
+// planSummary lists the apps and services a plan changes, e.g.
+// "apps backend (update), jobs (create); services postgres (update)"
+func planSummary(plan ark.DeployPlan) string {
+  var parts []string
+  for _, group := range []struct{ name string; plans []ark.ComponentPlan }{{"apps", plan.Apps}, {"services", plan.Services}} {
+    if len(group.plans) == 0 {
+      continue
+    }
 
-func redeployApp(ctx context.Context, arkd arkd.Client, appDef ark.AppDefinition) error {
-  return nil
+    names := make([]string, 0, len(group.plans))
+    for _, cp := range group.plans {
+      names = append(names, fmt.Sprintf("%s (%s)", cp.Name, cp.Action))
+    }
+    parts = append(parts, group.name + " " + strings.Join(names, ", "))
+  }
+  if len(plan.Stack) > 0 {
+    parts = append(parts, "stack settings")
+  }
+
+  return strings.Join(parts, "; ")
+}
+
+// envResolver resolves env references to the hostnames the worker gives
+// each task on the deployment's network, which is its qualified name.
+func envResolver(def ark.StackDefinition, deploymentName, stackName string) ark.EnvResolver {
+  return ark.EnvResolver{
+    Def: def,
+    DeploymentName: deploymentName,
+    HostName: func(name string) string {
+      t := arkd.Task{AppName: name, DeploymentName: deploymentName, StackName: stackName}
+      return t.QualifiedName()
+    },
+  }
 }
 
-func createService(ctx context.Context, client arkd.Client, srvDef ark.ServiceDefinition, deploymentName, stackName string) error {
+func taskDisks(disks map[string]ark.AppDiskDefinition) []arkd.TaskDisk {
+  taskDisks := make([]arkd.TaskDisk, 0, len(disks))
+  for name, disk := range disks {
+    taskDisks = append(taskDisks, arkd.TaskDisk{
+      Name: name,
+      MountPath: disk.MountPath,
+      Size: disk.Size,
+    })
+  }
+  sort.Slice(taskDisks, func(i, j int) bool { return taskDisks[i].Name < taskDisks[j].Name })
+
+  return taskDisks
+}
+
+// recordDisks tracks the disks of an app or service against the worker
+// its task was placed on, so later deploys can be pinned to that worker.
+func recordDisks(ctx context.Context, db *gorm.DB, client arkd.Client, deployment *models.Deployment, ownerName string, disks map[string]ark.AppDiskDefinition) error {
+  if len(disks) == 0 {
+    return nil
+  }
+
+  workerId, err := client.GetWorkerId(ctx)
+  if err != nil {
+    return err
+  }
+
+  for name, disk := range disks {
+    _, err := dao.UpsertDisk(ctx, db, models.Disk{
+      Name: name,
+      OwnerName: ownerName,
+      MountPath: disk.MountPath,
+      WorkerID: workerId,
+      Size: disk.Size,
+      DeploymentID: deployment.ID,
+    })
+    if err != nil {
+      return err
+    }
+  }
+
   return nil
 }
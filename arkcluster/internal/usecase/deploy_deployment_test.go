@@ -0,0 +1,107 @@
+package usecase
+
+import (
+	"context"
+	"encoding/json"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/dkimot/ark"
+	"github.com/dkimot/ark/arkcluster/internal/models"
+	"github.com/dkimot/ark/arkd"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+// testWorker stands in for a worker's client, only its id is used
+type testWorker struct {
+	arkd.Client
+	id string
+}
+
+func Test_spreadReplicas(t *testing.T) {
+	workers := []arkd.Client{testWorker{id: "w1"}, testWorker{id: "w2"}, testWorker{id: "w3"}}
+
+	tests := []struct {
+		name    string
+		count   int
+		workers []arkd.Client
+		want    []string
+	}{
+		{"one replica", 1, workers, []string{"w1"}},
+		{"fewer replicas than workers", 2, workers, []string{"w1", "w2"}},
+		{"wraps around", 5, workers, []string{"w1", "w2", "w3", "w1", "w2"}},
+		{"single worker", 3, workers[:1], []string{"w1", "w1", "w1"}},
+		{"no replicas", 0, workers, []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := make([]string, 0)
+			for _, w := range spreadReplicas(tt.count, tt.workers) {
+				got = append(got, w.(testWorker).id)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("spreadReplicas() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_DeployDeployment(t *testing.T) {
+	shortenReadiness(t)
+
+	db, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "ark.db")), &gorm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AutoMigrate(&models.Stack{}, &models.Deployment{}, &models.Disk{}); err != nil {
+		t.Fatal(err)
+	}
+
+	def := ark.StackDefinition{
+		StackName: "shop",
+		RootApp:   "frontend",
+		Apps: map[string]ark.AppDefinition{
+			"frontend": {Type: ark.AppTypeWeb, DependsOn: []string{"backend"}, HttpService: ark.AppHttpServiceDefinition{ContainerPort: 8080}},
+			"backend":  {Type: ark.AppTypePserv, DependsOn: []string{"postgres"}},
+		},
+		Services: map[string]ark.ServiceDefinition{
+			"postgres": {Image: "postgres:15"},
+		},
+	}
+	defRaw, err := json.Marshal(def)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stack := models.Stack{Name: "shop"}
+	if err := db.Create(&stack).Error; err != nil {
+		t.Fatal(err)
+	}
+	deployment := models.Deployment{Name: "prod", StackID: stack.ID, StackDefRaw: defRaw}
+	if err := db.Create(&deployment).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	// every level only becomes running after it was waited on
+	worker := &fakeWorker{status: arkd.TaskStatusStarting}
+	if err := DeployDeployment(context.Background(), db, []arkd.Client{worker}, &deployment); err != nil {
+		t.Fatalf("DeployDeployment() error = %v", err)
+	}
+
+	if want := []string{"postgres", "backend", "frontend"}; !reflect.DeepEqual(worker.created, want) {
+		t.Errorf("created = %v, want %v", worker.created, want)
+	}
+
+	var stored models.Deployment
+	if err := db.First(&stored, deployment.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+	if string(stored.DeployedDefRaw) != string(defRaw) {
+		t.Errorf("deployed definition = %s, want %s", stored.DeployedDefRaw, defRaw)
+	}
+	if len(stored.LastPlanRaw) == 0 {
+		t.Error("plan not recorded")
+	}
+}
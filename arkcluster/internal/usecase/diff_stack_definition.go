@@ -0,0 +1,44 @@
+package usecase
+
+import (
+	"context"
+
+	"github.com/dkimot/ark"
+	"github.com/dkimot/ark/arkcluster/internal/dao"
+	"github.com/dkimot/ark/arkcluster/internal/models"
+	"gorm.io/gorm"
+)
+
+// DiffStackDefinition plans the change from the against definition to the
+// definition with the given id. without an against id the definition is
+// compared to the one stored before it.
+func DiffStackDefinition(ctx context.Context, db *gorm.DB, stack *models.Stack, id uint, againstId *uint) (ark.DeployPlan, error) {
+  stackDef, err := dao.GetStackDef(ctx, db, stack.ID, id)
+  if err != nil {
+    return ark.DeployPlan{}, err
+  }
+
+  var against *models.StackDef
+  if againstId != nil {
+    against, err = dao.GetStackDef(ctx, db, stack.ID, *againstId)
+  } else {
+    against, err = dao.GetPreviousStackDef(ctx, db, stackDef)
+  }
+  if err != nil {
+    return ark.DeployPlan{}, err
+  }
+
+  newDef, err := dao.DecodeStackDefinition(stackDef.RawDefinition)
+  if err != nil {
+    return ark.DeployPlan{}, err
+  }
+
+  var oldDef ark.StackDefinition
+  if against != nil {
+    if oldDef, err = dao.DecodeStackDefinition(against.RawDefinition); err != nil {
+      return ark.DeployPlan{}, err
+    }
+  }
+
+  return ark.DiffStackDefinitions(oldDef, newDef), nil
+}
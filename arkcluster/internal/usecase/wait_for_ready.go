@@ -0,0 +1,97 @@
+package usecase
+
+import (
+  "context"
+  "errors"
+  "fmt"
+  "sort"
+  "time"
+
+  "github.com/dkimot/ark"
+  "github.com/dkimot/ark/arkd"
+)
+
+var ErrDependencyNotReady = errors.New("usecase: dependency did not become ready")
+
+var (
+  readyTimeout = 5 * time.Minute
+  readyPollInterval = 2 * time.Second
+)
+
+// waitForReady blocks until every app and service in names has all of its
+// tasks running across the workers. cron apps only run on their schedule
+// and are never waited on.
+func waitForReady(ctx context.Context, workers []arkd.Client, deploymentName string, def ark.StackDefinition, names []string) error {
+  want := make(map[string]int, len(names))
+  for _, name := range names {
+    if app, ok := def.Apps[name]; ok {
+      if app.Type == ark.AppTypeCron {
+        continue
+      }
+      want[name] = app.Replicas()
+    } else {
+      want[name] = 1
+    }
+  }
+  if len(want) == 0 {
+    return nil
+  }
+
+  ctx, cancel := context.WithTimeout(ctx, readyTimeout)
+  defer cancel()
+
+  ticker := time.NewTicker(readyPollInterval)
+  defer ticker.Stop()
+
+  for {
+    pending, err := pendingComponents(ctx, workers, deploymentName, want)
+    if err != nil {
+      return err
+    }
+    if len(pending) == 0 {
+      return nil
+    }
+
+    select {
+    case <-ctx.Done():
+      return fmt.Errorf("%w: %v: %w", ErrDependencyNotReady, pending, ctx.Err())
+    case <-ticker.C:
+    }
+  }
+}
+
+// pendingComponents returns the names in want that don't have enough
+// running tasks yet. a crashed or exited task fails right away since the
+// level can't become ready.
+func pendingComponents(ctx context.Context, workers []arkd.Client, deploymentName string, want map[string]int) ([]string, error) {
+  running := make(map[string]int, len(want))
+  for _, worker := range workers {
+    tasks, err := worker.ListTasks(ctx, deploymentName)
+    if err != nil {
+      return nil, err
+    }
+
+    for _, task := range tasks {
+      if _, ok := want[task.AppName]; !ok {
+        continue
+      }
+
+      switch task.Status {
+      case arkd.TaskStatusRunning:
+        running[task.AppName]++
+      case arkd.TaskStatusCrashed, arkd.TaskStatusExited:
+        return nil, fmt.Errorf("%w: %s stopped while starting", ErrDependencyNotReady, task.AppName)
+      }
+    }
+  }
+
+  var pending []string
+  for name, count := range want {
+    if running[name] < count {
+      pending = append(pending, name)
+    }
+  }
+  sort.Strings(pending)
+
+  return pending, nil
+}
@@ -0,0 +1,147 @@
+package usecase
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dkimot/ark"
+	"github.com/dkimot/ark/arkd"
+)
+
+// fakeWorker is a worker's client that keeps its tasks in memory. tasks it
+// creates have status, running if it isn't set. starting tasks are running
+// once they have been listed.
+type fakeWorker struct {
+	arkd.Client
+
+	mtx     sync.Mutex
+	status  arkd.TaskStatus
+	tasks   []arkd.Task
+	created []string
+}
+
+func (w *fakeWorker) CreateTask(ctx context.Context, params arkd.CreateTaskParams) error {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+
+	status := w.status
+	if status == arkd.TaskStatusUnknown {
+		status = arkd.TaskStatusRunning
+	}
+	w.tasks = append(w.tasks, arkd.Task{AppName: params.AppName, DeploymentName: params.DeploymentName, Status: status})
+	w.created = append(w.created, params.AppName)
+	return nil
+}
+
+func (w *fakeWorker) ListTasks(ctx context.Context, deploymentName string) ([]arkd.Task, error) {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+
+	tasks := make([]arkd.Task, 0, len(w.tasks))
+	for i, task := range w.tasks {
+		if task.DeploymentName != deploymentName {
+			continue
+		}
+		tasks = append(tasks, task)
+		if task.Status == arkd.TaskStatusStarting {
+			w.tasks[i].Status = arkd.TaskStatusRunning
+		}
+	}
+	return tasks, nil
+}
+
+func (w *fakeWorker) DeleteDeployment(ctx context.Context, deploymentName string) error {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+
+	w.tasks = nil
+	return nil
+}
+
+// shortenReadiness makes waitForReady give up quickly
+func shortenReadiness(t *testing.T) {
+	t.Helper()
+
+	timeout, interval := readyTimeout, readyPollInterval
+	readyTimeout, readyPollInterval = 50*time.Millisecond, 5*time.Millisecond
+	t.Cleanup(func() { readyTimeout, readyPollInterval = timeout, interval })
+}
+
+func Test_waitForReady(t *testing.T) {
+	shortenReadiness(t)
+
+	def := ark.StackDefinition{
+		StackName: "shop",
+		Apps: map[string]ark.AppDefinition{
+			"web":  {Type: ark.AppTypeWeb, Count: 2},
+			"cron": {Type: ark.AppTypeCron, Schedule: "* * * * *"},
+		},
+		Services: map[string]ark.ServiceDefinition{
+			"postgres": {Image: "postgres:15"},
+		},
+	}
+	task := func(appName string, status arkd.TaskStatus) arkd.Task {
+		return arkd.Task{AppName: appName, DeploymentName: "prod", Status: status}
+	}
+
+	tests := []struct {
+		name    string
+		names   []string
+		tasks   [][]arkd.Task
+		wantErr error
+	}{
+		{"all replicas running", []string{"web", "postgres"}, [][]arkd.Task{
+			{task("web", arkd.TaskStatusRunning), task("postgres", arkd.TaskStatusRunning)},
+			{task("web", arkd.TaskStatusRunning)},
+		}, nil},
+		{"cron apps skipped", []string{"cron"}, [][]arkd.Task{{}}, nil},
+		{"other components ignored", []string{"postgres"}, [][]arkd.Task{
+			{task("postgres", arkd.TaskStatusRunning), task("web", arkd.TaskStatusCrashed)},
+		}, nil},
+		{"crashed", []string{"web"}, [][]arkd.Task{
+			{task("web", arkd.TaskStatusRunning), task("web", arkd.TaskStatusCrashed)},
+		}, ErrDependencyNotReady},
+		{"exited", []string{"postgres"}, [][]arkd.Task{
+			{task("postgres", arkd.TaskStatusExited)},
+		}, ErrDependencyNotReady},
+		{"timeout", []string{"web"}, [][]arkd.Task{
+			{task("web", arkd.TaskStatusRunning)},
+			{task("web", arkd.TaskStatusPending)},
+		}, context.DeadlineExceeded},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			workers := make([]arkd.Client, 0, len(tt.tasks))
+			for _, tasks := range tt.tasks {
+				workers = append(workers, &fakeWorker{tasks: tasks})
+			}
+
+			err := waitForReady(context.Background(), workers, "prod", def, tt.names)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("waitForReady() error = %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantErr != nil && !errors.Is(err, ErrDependencyNotReady) {
+				t.Errorf("waitForReady() error = %v, want %v", err, ErrDependencyNotReady)
+			}
+		})
+	}
+}
+
+func Test_waitForReady_failsFast(t *testing.T) {
+	shortenReadiness(t)
+	readyTimeout = time.Minute
+
+	def := ark.StackDefinition{Services: map[string]ark.ServiceDefinition{"postgres": {}}}
+	worker := &fakeWorker{tasks: []arkd.Task{{AppName: "postgres", DeploymentName: "prod", Status: arkd.TaskStatusCrashed}}}
+
+	startedAt := time.Now()
+	if err := waitForReady(context.Background(), []arkd.Client{worker}, "prod", def, []string{"postgres"}); !errors.Is(err, ErrDependencyNotReady) {
+		t.Fatalf("waitForReady() error = %v, want %v", err, ErrDependencyNotReady)
+	}
+	if d := time.Since(startedAt); d > time.Second {
+		t.Errorf("waitForReady() took %s, want it to fail without waiting", d)
+	}
+}
@@ -0,0 +1,26 @@
+package cmd
+
+import (
+	"encoding/json"
+
+	"github.com/dkimot/ark"
+	"github.com/spf13/cobra"
+)
+
+// schemaCmd prints the JSON Schema of the stack definition format
+var schemaCmd = &cobra.Command{
+	Use:   "schema",
+	Short: "Print the JSON Schema for stack definition files",
+	Long: `Print the JSON Schema (draft 2020-12) describing stack_definition.toml,
+for use by editors and CI to validate stack definitions offline.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		enc := json.NewEncoder(cmd.OutOrStdout())
+		enc.SetIndent("", "  ")
+		return enc.Encode(ark.StackDefinitionSchema())
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(schemaCmd)
+}
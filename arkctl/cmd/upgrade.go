@@ -0,0 +1,76 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/dkimot/ark"
+	"github.com/spf13/cobra"
+)
+
+// upgradeCmd rewrites a stack definition file to the latest file_version
+var upgradeCmd = &cobra.Command{
+	Use:   "upgrade [path]",
+	Short: "Upgrade a stack definition file to the latest format",
+	Long: `Rewrite a stack definition file to the latest file_version, reporting
+every upgrade applied. Keys and values are edited in place so comments and
+layout are kept.
+
+The path defaults to ./stack_definition.toml.`,
+	Args:         cobra.MaximumNArgs(1),
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		path := "stack_definition.toml"
+		if len(args) > 0 {
+			path = args[0]
+		}
+
+		dryRun, err := cmd.Flags().GetBool("dry-run")
+		if err != nil {
+			return err
+		}
+
+		info, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+		buf, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+
+		upgraded, applied, err := ark.UpgradeStackDefinition(buf)
+		if err != nil {
+			return err
+		}
+
+		out := cmd.OutOrStdout()
+		if len(applied) == 0 {
+			fmt.Fprintf(out, "%s is already at file_version %s\n", path, ark.CurrentFileVersion)
+			return nil
+		}
+
+		for _, u := range applied {
+			fmt.Fprintf(out, "%s -> %s: %s\n", u.From, u.To, u.Description)
+			for _, c := range u.Changes {
+				fmt.Fprintf(out, "  %s\n", c)
+			}
+		}
+
+		if dryRun {
+			return nil
+		}
+
+		if err := os.WriteFile(path, upgraded, info.Mode().Perm()); err != nil {
+			return err
+		}
+
+		fmt.Fprintf(out, "upgraded %s to file_version %s\n", path, ark.CurrentFileVersion)
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(upgradeCmd)
+	upgradeCmd.Flags().Bool("dry-run", false, "report the upgrades without rewriting the file")
+}
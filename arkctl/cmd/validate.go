@@ -0,0 +1,62 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/dkimot/ark"
+	"github.com/spf13/cobra"
+)
+
+// validateCmd checks a stack definition file without deploying it
+var validateCmd = &cobra.Command{
+	Use:   "validate [path]",
+	Short: "Validate a stack definition file",
+	Long: `Parse and validate a stack definition file, reporting every problem
+found along with the TOML key it was found at.
+
+The path defaults to ./stack_definition.toml.`,
+	Args:         cobra.MaximumNArgs(1),
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		path := "stack_definition.toml"
+		if len(args) > 0 {
+			path = args[0]
+		}
+
+		if _, err := loadStackDefinition(path); err != nil {
+			return err
+		}
+
+		fmt.Fprintf(cmd.OutOrStdout(), "%s is valid\n", path)
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(validateCmd)
+}
+
+// loadStackDefinition reads and validates the stack definition at path.
+// validation errors are printed one per line before returning.
+func loadStackDefinition(path string) (ark.StackDefinition, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return ark.StackDefinition{}, err
+	}
+
+	def, err := ark.ParseStackDefinition(buf)
+	var verr *ark.ValidationError
+	if errors.As(err, &verr) {
+		for _, fe := range verr.Errors {
+			fmt.Fprintln(os.Stderr, fe.Error())
+		}
+		return ark.StackDefinition{}, fmt.Errorf("%s: %d error(s) found", path, len(verr.Errors))
+	}
+	if err != nil {
+		return ark.StackDefinition{}, err
+	}
+
+	return def, nil
+}
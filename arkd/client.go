@@ -1,9 +1,19 @@
 package arkd
 
-import "context"
+import (
+  "bytes"
+  "context"
+  "encoding/json"
+  "fmt"
+  "io"
+  "net/http"
+  "net/url"
+  "strings"
+)
 
 type Client interface {
   GetCapacity(ctx context.Context) error
+  GetWorkerId(ctx context.Context) (string, error)
   ListTasks(ctx context.Context, deploymentName string) ([]Task, error)
   GetTask(ctx context.Context, taskId string) error
   CreateTask(context.Context, CreateTaskParams) error
@@ -13,16 +23,140 @@ type Client interface {
   DeleteDeployment(ctx context.Context, deploymentName string) error
 }
 
-type client struct {}
+// client talks to a worker's API at baseUrl, e.g. http://10.0.0.2:5500
+type client struct {
+  baseUrl string
+  http    *http.Client
+}
+
+func NewClient(baseUrl string) Client {
+  return &client{
+    baseUrl: strings.TrimSuffix(baseUrl, "/"),
+    http:    http.DefaultClient,
+  }
+}
+
+func (c *client) GetCapacity(ctx context.Context) error {
+  return c.do(ctx, http.MethodGet, "/v1/capacity", nil, nil)
+}
+
+func (c *client) GetWorkerId(ctx context.Context) (string, error) {
+  var resp struct {
+    WorkerId string `json:"worker_id"`
+  }
+  if err := c.do(ctx, http.MethodGet, "/v1/up", nil, &resp); err != nil {
+    return "", err
+  }
+
+  return resp.WorkerId, nil
+}
+
+func (c *client) ListTasks(ctx context.Context, deploymentName string) ([]Task, error) {
+  var resp struct {
+    Tasks []Task `json:"tasks"`
+  }
+  path := "/v1/tasks?deployment_name=" + url.QueryEscape(deploymentName)
+  if err := c.do(ctx, http.MethodGet, path, nil, &resp); err != nil {
+    return nil, err
+  }
+
+  return resp.Tasks, nil
+}
+
+func (c *client) GetTask(ctx context.Context, taskId string) error {
+  return c.do(ctx, http.MethodGet, "/v1/tasks/"+url.PathEscape(taskId), nil, nil)
+}
+
+func (c *client) CreateTask(ctx context.Context, params CreateTaskParams) error {
+  body, err := json.Marshal(params)
+  if err != nil {
+    return err
+  }
+
+  return c.do(ctx, http.MethodPost, "/v1/tasks", body, nil)
+}
+
+func (c *client) UpdateTask(ctx context.Context, taskId string, updateParams string) error {
+  return c.do(ctx, http.MethodPut, "/v1/tasks/"+url.PathEscape(taskId), []byte(updateParams), nil)
+}
+
+func (c *client) DeleteTask(ctx context.Context, taskId string) error {
+  return c.do(ctx, http.MethodDelete, "/v1/tasks/"+url.PathEscape(taskId), nil, nil)
+}
+
+// DeleteDeployment deletes every task of the deployment on the worker
+func (c *client) DeleteDeployment(ctx context.Context, deploymentName string) error {
+  tasks, err := c.ListTasks(ctx, deploymentName)
+  if err != nil {
+    return err
+  }
+
+  for _, task := range tasks {
+    if err := c.DeleteTask(ctx, task.ID.String()); err != nil {
+      return err
+    }
+  }
 
-func NewClient() Client {
   return nil
 }
 
+// do sends body to the worker and decodes its response into out, unless
+// out is nil. error responses are returned with the worker's message.
+func (c *client) do(ctx context.Context, method, path string, body []byte, out any) error {
+  var reqBody io.Reader
+  if body != nil {
+    reqBody = bytes.NewReader(body)
+  }
+
+  req, err := http.NewRequestWithContext(ctx, method, c.baseUrl+path, reqBody)
+  if err != nil {
+    return err
+  }
+  if body != nil {
+    req.Header.Set("Content-Type", "application/json")
+  }
+
+  resp, err := c.http.Do(req)
+  if err != nil {
+    return err
+  }
+  defer resp.Body.Close()
+
+  if resp.StatusCode >= 300 {
+    var errResp struct {
+      Error string `json:"error"`
+    }
+    json.NewDecoder(resp.Body).Decode(&errResp)
+    if errResp.Error == "" {
+      errResp.Error = resp.Status
+    }
+    return fmt.Errorf("arkd: %s %s: %s", method, path, errResp.Error)
+  }
+
+  if out == nil {
+    return nil
+  }
+
+  return json.NewDecoder(resp.Body).Decode(out)
+}
+
 type CreateTaskParams struct {
   AppName string `json:"app_name"`
   DeploymentName string `json:"deployment_name"`
   StackName string `json:"stack_name"`
   Image string `json:"image"`
+  Cpu float64 `json:"cpu"`
+  Mem int `json:"mem"`
+  Pids int `json:"pids"`
+  Schedule string `json:"schedule"`
   ExposedPorts []string `json:"exposed_ports"`
+  Disks []TaskDisk `json:"disks"`
+  // env with all ${...} references already resolved
+  Env map[string]string `json:"env"`
+  HealthCheck TaskHealthCheck `json:"health_check"`
+  StopSignal string `json:"stop_signal"`
+  StopGracePeriod string `json:"stop_grace_period"`
+  KeepAlive bool `json:"keep_alive"`
+  IdleTimeout string `json:"idle_timeout"`
+  Restart TaskRestartPolicy `json:"restart"`
 }
@@ -0,0 +1,77 @@
+package arkd
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/oklog/ulid/v2"
+)
+
+func Test_client(t *testing.T) {
+	taskIds := []ulid.ULID{ulid.Make(), ulid.Make()}
+
+	var mtx sync.Mutex
+	var created CreateTaskParams
+	var deleted []string
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /v1/up", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{"api_version": "1", "worker_id": "worker1"})
+	})
+	mux.HandleFunc("POST /v1/tasks", func(w http.ResponseWriter, r *http.Request) {
+		mtx.Lock()
+		defer mtx.Unlock()
+		json.NewDecoder(r.Body).Decode(&created)
+		w.WriteHeader(http.StatusCreated)
+	})
+	mux.HandleFunc("GET /v1/tasks", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("deployment_name") != "preview" {
+			json.NewEncoder(w).Encode(map[string]any{"tasks": []Task{}})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]any{"revision": 3, "tasks": []Task{{ID: taskIds[0]}, {ID: taskIds[1]}}})
+	})
+	mux.HandleFunc("DELETE /v1/tasks/{taskId}", func(w http.ResponseWriter, r *http.Request) {
+		mtx.Lock()
+		defer mtx.Unlock()
+		deleted = append(deleted, r.PathValue("taskId"))
+	})
+	mux.HandleFunc("GET /v1/tasks/{taskId}", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "task store: task not found"})
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	ctx := context.Background()
+	c := NewClient(srv.URL + "/")
+
+	workerId, err := c.GetWorkerId(ctx)
+	if err != nil || workerId != "worker1" {
+		t.Errorf("GetWorkerId() = %q, %v, want worker1", workerId, err)
+	}
+
+	params := CreateTaskParams{AppName: "postgres", Image: "postgres:16", Disks: []TaskDisk{{Name: "pgdata", MountPath: "/data", Size: 5}}}
+	if err := c.CreateTask(ctx, params); err != nil {
+		t.Fatalf("CreateTask() error = %v", err)
+	}
+	if created.AppName != "postgres" || len(created.Disks) != 1 || created.Disks[0].Name != "pgdata" {
+		t.Errorf("worker got %+v", created)
+	}
+
+	if err := c.GetTask(ctx, taskIds[0].String()); err == nil || !strings.Contains(err.Error(), "task not found") {
+		t.Errorf("GetTask() error = %v, want the worker's error", err)
+	}
+
+	if err := c.DeleteDeployment(ctx, "preview"); err != nil {
+		t.Fatalf("DeleteDeployment() error = %v", err)
+	}
+	if len(deleted) != 2 || deleted[0] != taskIds[0].String() || deleted[1] != taskIds[1].String() {
+		t.Errorf("deleted %v, want both tasks", deleted)
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"strconv"
 	"time"
 
 	docker "github.com/docker/docker/client"
@@ -44,7 +45,35 @@ func run(ctx context.Context, _ []string, getenv func(string) string, _ io.Reade
 		return err
 	}
 
-	cfg := config.NewConfig(config.WithApiVersion(ApiVersion), config.WithWorkerId(wid))
+	eventRetention, err := getEventRetention(getenv("ARKD_TASK_EVENT_RETENTION"))
+	if err != nil {
+		return err
+	}
+
+	retentionOpts, err := getTaskRetention(getenv("ARKD_TASK_RETENTION_COUNT"), getenv("ARKD_TASK_RETENTION_AGE"))
+	if err != nil {
+		return err
+	}
+
+	cfg := config.NewConfig(append([]config.ConfigFn{
+		config.WithApiVersion(ApiVersion),
+		config.WithWorkerId(wid),
+		config.WithTaskEventRetention(eventRetention),
+	}, retentionOpts...)...)
+
+	// replace the database with a snapshot taken by GET /v1/admin/backup.
+	// a snapshot is only restored once, it can be left set across restarts.
+	restoreFrom := getenv("ARKD_RESTORE_FROM")
+	restored := false
+	if restoreFrom != "" {
+		restored, err = arkd.RestoreSnapshot(restoreFrom, "arkd.db", l)
+		if err != nil {
+			return err
+		}
+		if !restored {
+			l.Warn().Str("snapshot", restoreFrom).Msg("database was already restored from ARKD_RESTORE_FROM, not restoring it again")
+		}
+	}
 
 	db, err := bbolt.Open("arkd.db", 0600, &bbolt.Options{Timeout: 1 * time.Second})
 	if err != nil {
@@ -54,7 +83,7 @@ func run(ctx context.Context, _ []string, getenv func(string) string, _ io.Reade
 
   pxy := proxy.New(cfg)
 
-	taskStore, err := arkd.NewTaskStore(db, l)
+	taskStore, err := arkd.NewBoltTaskStore(db, l, arkd.WithEventRetention(cfg.TaskEventRetention))
 	if err != nil {
 		return err
 	}
@@ -64,8 +93,18 @@ func run(ctx context.Context, _ []string, getenv func(string) string, _ io.Reade
 		return err
 	}
 	defer moby.Close()
+	runtime := arkd.NewMobyRuntime(moby)
+
+	if restored {
+		if err := taskStore.RebuildIndexes(ctx); err != nil {
+			return err
+		}
+		if err := orca.AdoptContainers(ctx, cfg, l, runtime, taskStore); err != nil {
+			return err
+		}
+	}
 
-	or, err := orca.Start(cfg, l, moby, taskStore, pxy)
+	or, err := orca.Start(cfg, l, runtime, taskStore, pxy)
 	if err != nil {
 		return err
 	}
@@ -98,6 +137,43 @@ func getWorkerId(workerIdEnvVar string) (string, error) {
 	return hn + "-" + fileWid, nil
 }
 
+func getEventRetention(eventRetentionEnvVar string) (int, error) {
+	if eventRetentionEnvVar == "" {
+		return 0, nil
+	}
+
+	n, err := strconv.Atoi(eventRetentionEnvVar)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("ARKD_TASK_EVENT_RETENTION must be a positive number, got %q", eventRetentionEnvVar)
+	}
+
+	return n, nil
+}
+
+// getTaskRetention reads how many finished tasks are kept per app and for
+// how long. unset variables keep the defaults, 0 disables a limit.
+func getTaskRetention(countEnvVar, ageEnvVar string) ([]config.ConfigFn, error) {
+	var opts []config.ConfigFn
+
+	if countEnvVar != "" {
+		n, err := strconv.Atoi(countEnvVar)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("ARKD_TASK_RETENTION_COUNT must be a number of tasks, got %q", countEnvVar)
+		}
+		opts = append(opts, config.WithTaskRetentionCount(n))
+	}
+
+	if ageEnvVar != "" {
+		d, err := time.ParseDuration(ageEnvVar)
+		if err != nil || d < 0 {
+			return nil, fmt.Errorf("ARKD_TASK_RETENTION_AGE must be a duration like 24h, got %q", ageEnvVar)
+		}
+		opts = append(opts, config.WithTaskRetentionAge(d))
+	}
+
+	return opts, nil
+}
+
 func getDockerClient(ctx context.Context) (*docker.Client, error) {
 	dockerClient, err := docker.NewClientWithOpts(docker.FromEnv)
 	if err != nil {
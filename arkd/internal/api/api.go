@@ -20,7 +20,7 @@ func StartHttpServer(
 	logger zerolog.Logger,
 	config config.Config,
 	db *bbolt.DB,
-	taskStore *arkd.TaskStore,
+	taskStore arkd.TaskStore,
 	moby *docker.Client,
 	or orca.Orchestrator,
 ) error {
@@ -5,11 +5,16 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"strconv"
+	"strings"
 
 	"github.com/dkimot/ark/arkd/internal/arkd"
+	"github.com/dkimot/ark/arkd/internal/orca"
 	"github.com/oklog/ulid/v2"
 )
 
+var errInvalidRequest = errors.New("api: invalid request")
+
 func encode[T any](w http.ResponseWriter, r *http.Request, status int, v T) error {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(status)
@@ -36,9 +41,71 @@ func status(err error) int {
 		return http.StatusBadRequest
 	}
 
-  if errors.Is(err, arkd.ErrNilTask) {
+	if errors.Is(err, strconv.ErrSyntax) || errors.Is(err, strconv.ErrRange) {
+		return http.StatusBadRequest
+	}
+
+	if errors.Is(err, errInvalidRequest) {
+		return http.StatusBadRequest
+	}
+
+	if errors.Is(err, arkd.ErrTaskConflict) {
+		return http.StatusPreconditionFailed
+	}
+
+	if errors.Is(err, orca.ErrTaskNotRunning) {
+		return http.StatusConflict
+	}
+
+	if errors.Is(err, orca.ErrInsufficientResourcesAvailable) {
+		return http.StatusServiceUnavailable
+	}
+
+	if errors.Is(err, arkd.ErrRevisionCompacted) {
+		return http.StatusGone
+	}
+
+  if errors.Is(err, arkd.ErrNilTask) || errors.Is(err, arkd.ErrTaskNotFound) {
     return http.StatusNotFound
   }
 
 	return http.StatusInternalServerError
 }
+
+// taskETag is the task's revision as a strong entity tag
+func taskETag(task *arkd.Task) string {
+	return strconv.Quote(strconv.FormatUint(task.Revision, 10))
+}
+
+// matchesETag reports whether an If-Match or If-None-Match header lists etag
+func matchesETag(header, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ifMatchRevision parses an If-Match header into the revision a write
+// expects the task to be at. it returns nil without a header or for "*".
+// writes check a single revision, so only one entity tag is accepted.
+func ifMatchRevision(ifMatch string) (*uint64, error) {
+	ifMatch = strings.TrimSpace(ifMatch)
+	if ifMatch == "" || ifMatch == "*" {
+		return nil, nil
+	}
+
+	unquoted, err := strconv.Unquote(ifMatch)
+	if err != nil {
+		return nil, fmt.Errorf("%w: If-Match: %q is not a single entity tag", errInvalidRequest, ifMatch)
+	}
+	revision, err := strconv.ParseUint(unquoted, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("%w: If-Match: %q is not a task revision", errInvalidRequest, ifMatch)
+	}
+
+	return &revision, nil
+}
@@ -2,19 +2,24 @@ package api
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
+	"strconv"
+	"time"
 
 	"github.com/dkimot/ark/arkd/internal/arkd"
 	"github.com/dkimot/ark/arkd/internal/config"
 	"github.com/dkimot/ark/arkd/internal/orca"
 	"github.com/oklog/ulid/v2"
+	"github.com/rs/zerolog/hlog"
 )
 
 func addRoutes(
 	mux *http.ServeMux,
 	config config.Config,
-	taskStore *arkd.TaskStore,
+	taskStore arkd.TaskStore,
 	orc orca.Orchestrator,
 ) {
 	// get the current capacity of the worker
@@ -22,20 +27,32 @@ func addRoutes(
 	// list tasks and their statuses
 	mux.Handle("GET /v1/tasks", handleV1TaskList(taskStore))
 	// create a new task
-	mux.Handle("POST /v1/tasks", handleV1TaskCreate(orc))
+	mux.Handle("POST /v1/tasks", handleV1TaskCreate(taskStore, orc))
+	// stream task changes as server-sent events
+	mux.Handle("GET /v1/tasks/watch", handleV1TaskWatch(taskStore))
 	// get a specific task
-	mux.Handle("GET /v1/tasks/{taskId}", handleV1TaskGet())
-	// update a task definition
-	mux.Handle("PUT /v1/tasks/{taskId}", handleV1TaskUpdate())
+	mux.Handle("GET /v1/tasks/{taskId}", handleV1TaskGet(taskStore))
+	// get the status history of a task
+	mux.Handle("GET /v1/tasks/{taskId}/events", handleV1TaskEvents(taskStore))
+	// update a task's stop and restart settings
+	mux.Handle("PUT /v1/tasks/{taskId}", handleV1TaskUpdate(taskStore))
+	// stop a task, suspending it if it exits within its grace period
+	mux.Handle("POST /v1/tasks/{taskId}/stop", handleV1TaskStop(taskStore, orc))
 	// delete a task
 	mux.Handle("DELETE /v1/tasks/{taskId}", handleV1TaskDelete(orc))
 	// health check
 	mux.Handle("GET /v1/up", handleV1HealthCheck(config))
 	// get current volumes
-	mux.Handle("GET /v1/volumes", handleV1VolumesGet())
+	mux.Handle("GET /v1/volumes", handleV1VolumesGet(orc))
+	// list the finished tasks the next garbage collection removes
+	mux.Handle("GET /v1/admin/gc", handleV1AdminGc(orc))
+	// download a snapshot of the worker's database
+	if snapshotter, ok := taskStore.(arkd.Snapshotter); ok {
+		mux.Handle("GET /v1/admin/backup", handleV1AdminBackup(config, snapshotter))
+	}
 }
 
-func handleV1CapacityGet(taskStore *arkd.TaskStore) http.Handler {
+func handleV1CapacityGet(taskStore arkd.TaskStore) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		ctx := r.Context()
 
@@ -59,7 +76,9 @@ func handleV1HealthCheck(cfg config.Config) http.Handler {
 	})
 }
 
-func handleV1TaskCreate(orc orca.Orchestrator) http.Handler {
+// handleV1TaskCreate starts a task and returns it with its revision as the
+// ETag
+func handleV1TaskCreate(taskStore arkd.TaskStore, orc orca.Orchestrator) http.Handler {
 	type request struct {
 		AppName        string  `json:"app_name"`
 		StackName      string  `json:"stack_name"`
@@ -67,7 +86,17 @@ func handleV1TaskCreate(orc orca.Orchestrator) http.Handler {
 		Image          string  `json:"image"`
 		Cpu            float64 `json:"cpu"`
 		Mem            int     `json:"mem"`
+		Pids           int     `json:"pids"`
+		Schedule       string  `json:"schedule"`
     ExposedPorts   []string `json:"exposed_ports"`
+		Disks          []arkd.TaskDisk `json:"disks"`
+		Env            map[string]string `json:"env"`
+		HealthCheck    arkd.TaskHealthCheck `json:"health_check"`
+		StopSignal     string `json:"stop_signal"`
+		StopGracePeriod string `json:"stop_grace_period"`
+		KeepAlive      bool   `json:"keep_alive"`
+		IdleTimeout    string `json:"idle_timeout"`
+		Restart        arkd.TaskRestartPolicy `json:"restart"`
 	}
 
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -79,24 +108,81 @@ func handleV1TaskCreate(orc orca.Orchestrator) http.Handler {
 			return
 		}
 
-		_, err := orc.StartTask(ctx, arkd.TaskDefinition{
+		rawTaskId, err := orc.StartTask(ctx, arkd.TaskDefinition{
 			Image:          body.Image,
 			Cpu:            body.Cpu,
 			Memory:         body.Mem,
+			Pids:           body.Pids,
+			Schedule:       body.Schedule,
 			AppName:        body.AppName,
 			StackName:      body.StackName,
 			DeploymentName: body.DeploymentName,
       ExposedPorts:   body.ExposedPorts,
+			Disks:          body.Disks,
+			Env:            body.Env,
+			HealthCheck:    body.HealthCheck,
+			StopSignal:     body.StopSignal,
+			StopGracePeriod: body.StopGracePeriod,
+			KeepAlive:      body.KeepAlive,
+			IdleTimeout:    body.IdleTimeout,
+			Restart:        body.Restart,
 		})
 		if err != nil {
 			renderErr(w, r, err)
 			return
 		}
 
-		w.WriteHeader(http.StatusCreated)
+		var taskId ulid.ULID
+		copy(taskId[:], rawTaskId)
+		task, err := taskStore.GetTask(ctx, taskId)
+		if err != nil {
+			renderErr(w, r, err)
+			return
+		}
+
+		w.Header().Set("ETag", taskETag(task))
+		encode(w, r, http.StatusCreated, task)
 	})
 }
 
+// handleV1TaskStop stops a task with the signal in the body, or the task's
+// stop signal without one. with an If-Match header the task is only stopped
+// if it's still at that revision.
+func handleV1TaskStop(taskStore arkd.TaskStore, orc orca.Orchestrator) http.Handler {
+	type request struct {
+		Signal string `json:"signal"`
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		taskId, err := ulid.Parse(r.PathValue("taskId"))
+		if err != nil {
+			renderErr(w, r, fmt.Errorf("parsing task id: %w", err))
+			return
+		}
+
+		ifRevision, err := ifMatchRevision(r.Header.Get("If-Match"))
+		if err != nil {
+			renderErr(w, r, err)
+			return
+		}
+
+		var body request
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil && !errors.Is(err, io.EOF) {
+			renderErr(w, r, err)
+			return
+		}
+
+		if err := orc.StopTask(r.Context(), taskId, body.Signal, ifRevision); err != nil {
+			renderErr(w, r, err)
+			return
+		}
+
+		renderTask(w, r, taskStore, taskId)
+	})
+}
+
+// handleV1TaskDelete destroys a task. with an If-Match header the task is
+// only destroyed if it's still at that revision.
 func handleV1TaskDelete(orc orca.Orchestrator) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		rawTaskId := r.PathValue("taskId")
@@ -106,7 +192,13 @@ func handleV1TaskDelete(orc orca.Orchestrator) http.Handler {
 			return
 		}
 
-		if err := orc.DestroyTask(r.Context(), taskId, false); err != nil {
+		ifRevision, err := ifMatchRevision(r.Header.Get("If-Match"))
+		if err != nil {
+			renderErr(w, r, err)
+			return
+		}
+
+		if err := orc.DestroyTask(r.Context(), taskId, false, ifRevision); err != nil {
 			renderErr(w, r, err)
 			return
 		}
@@ -115,64 +207,345 @@ func handleV1TaskDelete(orc orca.Orchestrator) http.Handler {
 	})
 }
 
-func handleV1TaskGet() http.Handler {
+// handleV1TaskGet returns a task with its revision as the ETag
+func handleV1TaskGet(taskStore arkd.TaskStore) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(http.StatusTeapot)
+		taskId, err := ulid.Parse(r.PathValue("taskId"))
+		if err != nil {
+			renderErr(w, r, fmt.Errorf("parsing task id: %w", err))
+			return
+		}
+
+		task, err := taskStore.GetTask(r.Context(), taskId)
+		if err != nil {
+			renderErr(w, r, err)
+			return
+		}
+
+		etag := taskETag(task)
+		w.Header().Set("ETag", etag)
+		if matchesETag(r.Header.Get("If-None-Match"), etag) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+
+		encode(w, r, http.StatusOK, task)
 	})
 }
 
-func handleV1TaskList(taskStore *arkd.TaskStore) http.Handler {
+func handleV1TaskEvents(taskStore arkd.TaskStore) http.Handler {
 	type response struct {
-		Tasks []arkd.Task `json:"tasks"`
+		Events []arkd.TaskEvent `json:"events"`
 	}
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		ctx := r.Context()
 
-		tasks, err := taskStore.GetTasks(ctx)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		taskId, err := ulid.Parse(r.PathValue("taskId"))
 		if err != nil {
+			renderErr(w, r, fmt.Errorf("parsing task id: %w", err))
+			return
+		}
+
+		if _, err := taskStore.GetTask(r.Context(), taskId); err != nil {
 			renderErr(w, r, err)
 			return
 		}
 
-		// TODO: filter by app, stack, and deployment names
-		appNameFilter := r.URL.Query().Get("app_name")
-		stackNameFilter := r.URL.Query().Get("stack_name")
-		deploymentNameFilter := r.URL.Query().Get("deployment_name")
-		if appNameFilter != "" || stackNameFilter != "" || deploymentNameFilter != "" {
-			filteredTasks := make([]arkd.Task, 0)
-			for _, t := range tasks {
-				if appNameFilter != "" && t.AppName != appNameFilter {
-					continue
-				}
+		events, err := taskStore.GetTaskEvents(r.Context(), taskId)
+		if err != nil {
+			renderErr(w, r, err)
+			return
+		}
 
-				if stackNameFilter != "" && t.StackName != stackNameFilter {
-					continue
-				}
+		encode(w, r, http.StatusOK, &response{
+			Events: events,
+		})
+	})
+}
 
-				if deploymentNameFilter != "" && t.DeploymentName != deploymentNameFilter {
-					continue
-				}
+func handleV1TaskList(taskStore arkd.TaskStore) http.Handler {
+	type response struct {
+		// watch from this revision to follow changes after the listing
+		Revision uint64      `json:"revision"`
+		Tasks    []arkd.Task `json:"tasks"`
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
 
-				filteredTasks = append(filteredTasks, t)
+		query := r.URL.Query()
+		filter := arkd.TaskFilter{
+			AppName:        query.Get("app_name"),
+			StackName:      query.Get("stack_name"),
+			DeploymentName: query.Get("deployment_name"),
+		}
+		for _, rawStatus := range query["status"] {
+			status, err := strconv.Atoi(rawStatus)
+			if err != nil {
+				renderErr(w, r, fmt.Errorf("parsing status: %w", err))
+				return
 			}
+			filter.Statuses = append(filter.Statuses, arkd.TaskStatus(status))
+		}
 
-			tasks = filteredTasks
+		// read the revision first, changes made while listing are replayed
+		// by a watch from it
+		rev, err := taskStore.Revision(ctx)
+		if err != nil {
+			renderErr(w, r, err)
+			return
+		}
+
+		tasks, err := taskStore.FindTasks(ctx, filter)
+		if err != nil {
+			renderErr(w, r, err)
+			return
 		}
 
 		encode(w, r, http.StatusOK, &response{
-			Tasks: tasks,
+			Revision: rev,
+			Tasks:    tasks,
 		})
 	})
 }
 
-func handleV1TaskUpdate() http.Handler {
+func handleV1AdminGc(orc orca.Orchestrator) http.Handler {
+	type response struct {
+		Expired []arkd.ExpiredTask `json:"expired"`
+	}
+
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(http.StatusTeapot)
+		expired, err := orc.ExpiredTasks(r.Context())
+		if err != nil {
+			renderErr(w, r, err)
+			return
+		}
+
+		encode(w, r, http.StatusOK, &response{
+			Expired: expired,
+		})
 	})
 }
 
-func handleV1VolumesGet() http.Handler {
+// handleV1AdminBackup streams a consistent copy of arkd.db. start arkd with
+// ARKD_RESTORE_FROM set to the file to restore it.
+func handleV1AdminBackup(config config.Config, snapshotter arkd.Snapshotter) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(http.StatusTeapot)
+		filename := fmt.Sprintf("arkd-%s-%s.db", config.WorkerId, time.Now().UTC().Format("20060102T150405Z"))
+
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+		w.WriteHeader(http.StatusOK)
+
+		// the status is already sent, a failed backup shows up as a
+		// truncated snapshot which fails validation on restore
+		if _, err := snapshotter.Backup(r.Context(), w); err != nil {
+			hlog.FromRequest(r).Error().Err(err).Msg("could not write backup")
+		}
+	})
+}
+
+// how often a comment is sent on idle watches so proxies keep them open
+const watchHeartbeatInterval = 15 * time.Second
+
+// handleV1TaskWatch streams task changes after the since query parameter, or
+// the Last-Event-ID header when a client reconnects. without either it
+// starts from the current revision. the stream ends if the watcher falls
+// behind, clients reconnect from the last id they saw.
+func handleV1TaskWatch(taskStore arkd.TaskStore) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		rawSince := r.URL.Query().Get("since")
+		if rawSince == "" {
+			rawSince = r.Header.Get("Last-Event-ID")
+		}
+
+		var since uint64
+		if rawSince != "" {
+			var err error
+			since, err = strconv.ParseUint(rawSince, 10, 64)
+			if err != nil {
+				renderErr(w, r, fmt.Errorf("parsing since: %w", err))
+				return
+			}
+		} else {
+			var err error
+			since, err = taskStore.Revision(ctx)
+			if err != nil {
+				renderErr(w, r, err)
+				return
+			}
+		}
+
+		watch, err := taskStore.Watch(ctx, since)
+		if err != nil {
+			renderErr(w, r, err)
+			return
+		}
+
+		rc := http.NewResponseController(w)
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.WriteHeader(http.StatusOK)
+		if err := rc.Flush(); err != nil {
+			return
+		}
+
+		heartbeat := time.NewTicker(watchHeartbeatInterval)
+		defer heartbeat.Stop()
+
+		for {
+			select {
+			case change, ok := <-watch.C:
+				if !ok {
+					return
+				}
+				data, err := json.Marshal(change)
+				if err != nil {
+					return
+				}
+				if _, err := fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", change.Revision, change.Type, data); err != nil {
+					return
+				}
+			case <-heartbeat.C:
+				if _, err := fmt.Fprint(w, ": heartbeat\n\n"); err != nil {
+					return
+				}
+			}
+
+			if err := rc.Flush(); err != nil {
+				return
+			}
+		}
+	})
+}
+
+// handleV1TaskUpdate changes the settings of a task that are read when
+// they're used: its stop signal, stop grace period and restart policy.
+// fields left out of the body are kept. with an If-Match header the task is
+// only updated if it's still at that revision.
+func handleV1TaskUpdate(taskStore arkd.TaskStore) http.Handler {
+	type request struct {
+		StopSignal      *string                 `json:"stop_signal"`
+		StopGracePeriod *string                 `json:"stop_grace_period"`
+		Restart         *arkd.TaskRestartPolicy `json:"restart"`
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		taskId, err := ulid.Parse(r.PathValue("taskId"))
+		if err != nil {
+			renderErr(w, r, fmt.Errorf("parsing task id: %w", err))
+			return
+		}
+
+		ifRevision, err := ifMatchRevision(r.Header.Get("If-Match"))
+		if err != nil {
+			renderErr(w, r, err)
+			return
+		}
+
+		var body request
+		dec := json.NewDecoder(r.Body)
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&body); err != nil {
+			renderErr(w, r, fmt.Errorf("%w: %w", errInvalidRequest, err))
+			return
+		}
+		if err := validateTaskUpdate(body.StopGracePeriod, body.Restart); err != nil {
+			renderErr(w, r, err)
+			return
+		}
+
+		// without If-Match the update applies to whatever the task is at, a
+		// concurrent write is retried
+		var task *arkd.Task
+		for i := 0; ; i++ {
+			task, err = taskStore.GetTask(ctx, taskId)
+			if err != nil {
+				renderErr(w, r, err)
+				return
+			}
+			if ifRevision != nil {
+				task.Revision = *ifRevision
+			}
+
+			if body.StopSignal != nil {
+				task.StopSignal = *body.StopSignal
+			}
+			if body.StopGracePeriod != nil {
+				task.StopGracePeriod = *body.StopGracePeriod
+			}
+			if body.Restart != nil {
+				task.Restart = *body.Restart
+			}
+
+			err = taskStore.CompareAndUpdateTask(ctx, task)
+			if ifRevision != nil || !errors.Is(err, arkd.ErrTaskConflict) || i == maxUpdateRetries {
+				break
+			}
+		}
+		if err != nil {
+			renderErr(w, r, err)
+			return
+		}
+
+		w.Header().Set("ETag", taskETag(task))
+		encode(w, r, http.StatusOK, task)
+	})
+}
+
+// writes retried on a conflict before giving up
+const maxUpdateRetries = 3
+
+func validateTaskUpdate(stopGracePeriod *string, restart *arkd.TaskRestartPolicy) error {
+	if stopGracePeriod != nil && *stopGracePeriod != "" {
+		if _, err := time.ParseDuration(*stopGracePeriod); err != nil {
+			return fmt.Errorf("%w: stop_grace_period: %w", errInvalidRequest, err)
+		}
+	}
+
+	if restart != nil {
+		switch restart.Policy {
+		case "", arkd.RestartNever, arkd.RestartOnFailure, arkd.RestartAlways:
+		default:
+			return fmt.Errorf("%w: restart.policy: must be one of never, on-failure or always", errInvalidRequest)
+		}
+		if restart.MaxRetries < 0 {
+			return fmt.Errorf("%w: restart.max_retries: must not be negative", errInvalidRequest)
+		}
+	}
+
+	return nil
+}
+
+// renderTask responds with the task as it is after a write, with its
+// revision as the ETag
+func renderTask(w http.ResponseWriter, r *http.Request, taskStore arkd.TaskStore, taskId ulid.ULID) {
+	task, err := taskStore.GetTask(r.Context(), taskId)
+	if err != nil {
+		renderErr(w, r, err)
+		return
+	}
+
+	w.Header().Set("ETag", taskETag(task))
+	encode(w, r, http.StatusOK, task)
+}
+
+func handleV1VolumesGet(orc orca.Orchestrator) http.Handler {
+	type response struct {
+		Volumes []arkd.Volume `json:"volumes"`
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		vols, err := orc.ListVolumes(r.Context())
+		if err != nil {
+			renderErr(w, r, err)
+			return
+		}
+
+		encode(w, r, http.StatusOK, &response{
+			Volumes: vols,
+		})
 	})
 }
@@ -0,0 +1,169 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/dkimot/ark/arkd/internal/arkd"
+	"github.com/dkimot/ark/arkd/internal/config"
+	"github.com/dkimot/ark/arkd/internal/orca"
+	"github.com/rs/zerolog"
+)
+
+type testProxy struct{}
+
+func (testProxy) RegisterApp(id, name, domainName, port string) error { return nil }
+func (testProxy) DelistApp(id string) error                           { return nil }
+
+func newTestServer(t *testing.T) *httptest.Server {
+	t.Helper()
+
+	cfg := config.NewConfig(func(cfg *config.Config) { cfg.WorkerId = "worker1" })
+	taskStore := arkd.NewMemTaskStore()
+	orc, err := orca.Start(cfg, zerolog.Nop(), arkd.NewFakeRuntime(), taskStore, testProxy{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mux := http.NewServeMux()
+	addRoutes(mux, cfg, taskStore, orc)
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+
+	return srv
+}
+
+// do sends a request and returns the response, with the task it holds
+// decoded if it's a success
+func do(t *testing.T, srv *httptest.Server, method, path, ifMatch, body string) (*http.Response, *arkd.Task) {
+	t.Helper()
+
+	req, err := http.NewRequest(method, srv.URL+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ifMatch != "" {
+		req.Header.Set("If-Match", ifMatch)
+	}
+
+	resp, err := srv.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 || method == http.MethodDelete {
+		return resp, nil
+	}
+
+	var task arkd.Task
+	if err := json.NewDecoder(resp.Body).Decode(&task); err != nil {
+		t.Fatalf("%s %s: decoding task: %v", method, path, err)
+	}
+	return resp, &task
+}
+
+func createTestTask(t *testing.T, srv *httptest.Server) (*arkd.Task, string) {
+	t.Helper()
+
+	resp, task := do(t, srv, http.MethodPost, "/v1/tasks", "", `{"app_name": "web", "deployment_name": "prod", "stack_name": "shop", "image": "nginx", "cpu": 0.01, "mem": 64}`)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("POST /v1/tasks status = %d, want %d", resp.StatusCode, http.StatusCreated)
+	}
+	if etag := resp.Header.Get("ETag"); etag != taskETag(task) {
+		t.Fatalf("POST /v1/tasks ETag = %q, want %q", etag, taskETag(task))
+	}
+
+	return task, resp.Header.Get("ETag")
+}
+
+func Test_handleV1TaskUpdate(t *testing.T) {
+	srv := newTestServer(t)
+	task, etag := createTestTask(t, srv)
+	path := "/v1/tasks/" + task.ID.String()
+
+	tests := []struct {
+		name       string
+		ifMatch    string
+		body       string
+		wantStatus int
+	}{
+		{"stale revision", `"0"`, `{"stop_signal": "SIGINT"}`, http.StatusPreconditionFailed},
+		{"unknown field", etag, `{"image": "nginx:2"}`, http.StatusBadRequest},
+		{"invalid grace period", etag, `{"stop_grace_period": "soon"}`, http.StatusBadRequest},
+		{"invalid restart policy", etag, `{"restart": {"policy": "sometimes"}}`, http.StatusBadRequest},
+		{"several entity tags", `"1", "2"`, `{"stop_signal": "SIGINT"}`, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if resp, _ := do(t, srv, http.MethodPut, path, tt.ifMatch, tt.body); resp.StatusCode != tt.wantStatus {
+				t.Errorf("PUT status = %d, want %d", resp.StatusCode, tt.wantStatus)
+			}
+		})
+	}
+
+	resp, updated := do(t, srv, http.MethodPut, path, etag, `{"stop_signal": "SIGINT", "restart": {"policy": "always"}}`)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("PUT status = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+	if updated.StopSignal != "SIGINT" || updated.Restart.Policy != arkd.RestartAlways || updated.AppName != "web" {
+		t.Errorf("PUT task = %+v", updated)
+	}
+	if got := resp.Header.Get("ETag"); got == etag || got != taskETag(updated) {
+		t.Errorf("PUT ETag = %q, want the new revision, was %q", got, etag)
+	}
+
+	// the old revision is gone
+	if resp, _ := do(t, srv, http.MethodPut, path, etag, `{"stop_signal": "SIGTERM"}`); resp.StatusCode != http.StatusPreconditionFailed {
+		t.Errorf("PUT with the replaced ETag status = %d, want %d", resp.StatusCode, http.StatusPreconditionFailed)
+	}
+
+	// without If-Match the update applies to the current revision
+	if resp, updated := do(t, srv, http.MethodPut, path, "", `{"stop_grace_period": "30s"}`); resp.StatusCode != http.StatusOK || updated.StopGracePeriod != "30s" || updated.StopSignal != "SIGINT" {
+		t.Errorf("PUT without If-Match = %d, %+v", resp.StatusCode, updated)
+	}
+}
+
+func Test_handleV1TaskStop(t *testing.T) {
+	srv := newTestServer(t)
+	task, etag := createTestTask(t, srv)
+	path := "/v1/tasks/" + task.ID.String()
+
+	if resp, _ := do(t, srv, http.MethodPost, path+"/stop", `"0"`, ""); resp.StatusCode != http.StatusPreconditionFailed {
+		t.Errorf("POST stop with a stale ETag status = %d, want %d", resp.StatusCode, http.StatusPreconditionFailed)
+	}
+	if _, got := do(t, srv, http.MethodGet, path, "", ""); got.Status != arkd.TaskStatusRunning {
+		t.Errorf("status after a failed stop = %v, want running", got.Status)
+	}
+
+	resp, stopped := do(t, srv, http.MethodPost, path+"/stop", etag, "")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("POST stop status = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+	if stopped.Status == arkd.TaskStatusRunning || resp.Header.Get("ETag") != taskETag(stopped) {
+		t.Errorf("POST stop = %+v, ETag %q", stopped, resp.Header.Get("ETag"))
+	}
+}
+
+func Test_handleV1TaskDelete(t *testing.T) {
+	srv := newTestServer(t)
+	task, etag := createTestTask(t, srv)
+	path := "/v1/tasks/" + task.ID.String()
+
+	if resp, _ := do(t, srv, http.MethodDelete, path, `"0"`, ""); resp.StatusCode != http.StatusPreconditionFailed {
+		t.Errorf("DELETE with a stale ETag status = %d, want %d", resp.StatusCode, http.StatusPreconditionFailed)
+	}
+	if resp, _ := do(t, srv, http.MethodGet, path, "", ""); resp.StatusCode != http.StatusOK {
+		t.Errorf("GET after a failed delete status = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+
+	if resp, _ := do(t, srv, http.MethodDelete, path, etag, ""); resp.StatusCode != http.StatusOK {
+		t.Errorf("DELETE status = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+	if resp, _ := do(t, srv, http.MethodGet, path, "", ""); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("GET after delete status = %d, want %d", resp.StatusCode, http.StatusNotFound)
+	}
+}
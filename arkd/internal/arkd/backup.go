@@ -0,0 +1,211 @@
+package arkd
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/rs/zerolog"
+	"go.etcd.io/bbolt"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var ErrInvalidSnapshot = errors.New("task store: invalid snapshot")
+
+// checksum of the snapshot a database was restored from, in the meta bucket
+var restoredFromKey = []byte("restored_from")
+
+// Backup writes a consistent snapshot of the whole database to w. it runs in
+// a read transaction, so writes carry on while the snapshot is taken.
+func (ts *BoltTaskStore) Backup(ctx context.Context, w io.Writer) (int64, error) {
+  var span trace.Span
+  ctx, span = ts.tracer.Start(ctx, "task_store.backup")
+  defer span.End()
+
+	var n int64
+	err := ts.db.View(func(tx *bbolt.Tx) error {
+		var err error
+		n, err = tx.WriteTo(w)
+		return err
+	})
+
+	return n, err
+}
+
+// RestoreSnapshot replaces the database at dbPath with the snapshot at
+// snapshotPath, after checking the snapshot can be read by this arkd. the
+// database it replaces is kept next to it with a .pre-restore suffix. it
+// must be called before the database is opened.
+//
+// the restored database records the snapshot's checksum. a database that
+// was already restored from the same snapshot is left alone and false is
+// returned, so a restore that is still configured on the next start doesn't
+// throw away everything since.
+func RestoreSnapshot(snapshotPath, dbPath string, logger zerolog.Logger) (bool, error) {
+	sum, err := fileChecksum(snapshotPath)
+	if err != nil {
+		return false, fmt.Errorf("could not read snapshot: %w", err)
+	}
+	if bytes.Equal(restoredFrom(dbPath), sum) {
+		return false, nil
+	}
+
+	tasks, err := validateSnapshot(snapshotPath)
+	if err != nil {
+		return false, err
+	}
+
+	tmpPath := dbPath + ".restore"
+	if err := copyFile(snapshotPath, tmpPath); err != nil {
+		return false, fmt.Errorf("could not copy snapshot: %w", err)
+	}
+	if err := recordRestoredFrom(tmpPath, sum); err != nil {
+		return false, fmt.Errorf("could not record snapshot checksum: %w", err)
+	}
+
+	if _, err := os.Stat(dbPath); err == nil {
+		if err := os.Rename(dbPath, dbPath+".pre-restore"); err != nil {
+			return false, fmt.Errorf("could not move aside current database: %w", err)
+		}
+	}
+	if err := os.Rename(tmpPath, dbPath); err != nil {
+		return false, fmt.Errorf("could not replace database: %w", err)
+	}
+
+	logger.Info().Str("snapshot", snapshotPath).Int("tasks", tasks).Msg("restored task store from snapshot")
+	return true, nil
+}
+
+// restoredFrom returns the checksum of the snapshot the database at path
+// was restored from, nil if it wasn't or can't be read
+func restoredFrom(path string) []byte {
+	if _, err := os.Stat(path); err != nil {
+		return nil
+	}
+
+	db, err := bbolt.Open(path, 0400, &bbolt.Options{ReadOnly: true, Timeout: time.Second})
+	if err != nil {
+		return nil
+	}
+	defer db.Close()
+
+	var sum []byte
+	db.View(func(tx *bbolt.Tx) error {
+		if b := tx.Bucket(metaBucketName); b != nil {
+			sum = bytes.Clone(b.Get(restoredFromKey))
+		}
+		return nil
+	})
+
+	return sum
+}
+
+func recordRestoredFrom(path string, sum []byte) error {
+	db, err := bbolt.Open(path, 0600, &bbolt.Options{Timeout: time.Second})
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	return db.Update(func(tx *bbolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(metaBucketName)
+		if err != nil {
+			return err
+		}
+
+		return b.Put(restoredFromKey, sum)
+	})
+}
+
+func fileChecksum(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return nil, err
+	}
+
+	return h.Sum(nil), nil
+}
+
+// validateSnapshot checks the snapshot's pages and that every task in it
+// can be read. it returns the number of tasks.
+func validateSnapshot(path string) (int, error) {
+	db, err := bbolt.Open(path, 0400, &bbolt.Options{ReadOnly: true, Timeout: time.Second})
+	if err != nil {
+		return 0, fmt.Errorf("%w: %w", ErrInvalidSnapshot, err)
+	}
+	defer db.Close()
+
+	tasks := 0
+	err = db.View(func(tx *bbolt.Tx) error {
+		// Check only stops once its channel is drained, keep the first error
+		var checkErr error
+		for err := range tx.Check() {
+			if checkErr == nil {
+				checkErr = err
+			}
+		}
+		if checkErr != nil {
+			return checkErr
+		}
+
+		version := schemaVersion(tx)
+		if version > SchemaVersion {
+			return fmt.Errorf("%w: schema version %d, want at most %d", ErrUnsupportedSchemaVersion, version, SchemaVersion)
+		}
+
+		b := tx.Bucket(tasksBucketName)
+		if b == nil {
+			return errors.New("no tasks bucket")
+		}
+
+		// records are only versioned from schema version 1 on
+		readTask := readTaskBytes
+		if version == 0 {
+			readTask = readLegacyTaskBytes
+		}
+
+		return b.ForEach(func(k, v []byte) error {
+			if _, err := readTask(v); err != nil {
+				return fmt.Errorf("task %x: %w", k, err)
+			}
+			tasks++
+			return nil
+		})
+	})
+	if err != nil {
+		return 0, fmt.Errorf("%w: %w", ErrInvalidSnapshot, err)
+	}
+
+	return tasks, nil
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	if _, err := io.Copy(out, in); err != nil {
+		return err
+	}
+
+	return out.Sync()
+}
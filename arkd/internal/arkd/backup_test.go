@@ -0,0 +1,140 @@
+package arkd
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"go.etcd.io/bbolt"
+)
+
+func Test_TaskStore_BackupRestore(t *testing.T) {
+	ctx := context.Background()
+	ts, _ := newTestTaskStore(t)
+
+	task, err := ts.CreateTask(ctx, TaskDefinition{AppName: "web", Image: "ubuntu", Cpu: 0.5, Memory: 128})
+	if err != nil {
+		t.Fatalf("CreateTask() error = %v", err)
+	}
+	if err := ts.SetTaskStatus(ctx, task, TaskStatusRunning, StatusChange{}); err != nil {
+		t.Fatalf("SetTaskStatus() error = %v", err)
+	}
+
+	var buf bytes.Buffer
+	if _, err := ts.Backup(ctx, &buf); err != nil {
+		t.Fatalf("Backup() error = %v", err)
+	}
+
+	dir := t.TempDir()
+	snapshotPath := filepath.Join(dir, "snapshot.db")
+	if err := os.WriteFile(snapshotPath, buf.Bytes(), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	dbPath := filepath.Join(dir, "arkd.db")
+	if err := os.WriteFile(dbPath, []byte("current"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if restored, err := RestoreSnapshot(snapshotPath, dbPath, zerolog.Nop()); err != nil || !restored {
+		t.Fatalf("RestoreSnapshot() = %v, %v, want restored", restored, err)
+	}
+	if prev, err := os.ReadFile(dbPath + ".pre-restore"); err != nil || string(prev) != "current" {
+		t.Errorf("previous database = %q, %v, want it kept", prev, err)
+	}
+
+	db, err := bbolt.Open(dbPath, 0600, &bbolt.Options{Timeout: time.Second})
+	if err != nil {
+		t.Fatalf("bbolt.Open() error = %v", err)
+	}
+	defer db.Close()
+
+	restored, err := NewBoltTaskStore(db, zerolog.Nop())
+	if err != nil {
+		t.Fatalf("NewBoltTaskStore() error = %v", err)
+	}
+	if got, err := restored.GetTask(ctx, task.ID); err != nil || got.AppName != "web" {
+		t.Errorf("GetTask() = %+v, %v", got, err)
+	}
+	if m := restored.AggMetrics(ctx); m.TotalTasks != 1 || m.AllocatedCpu != 0.5 || m.AllocatedMem != 128 {
+		t.Errorf("AggMetrics() = %+v", m)
+	}
+}
+
+func Test_RestoreSnapshot_invalid(t *testing.T) {
+	dir := t.TempDir()
+	dbPath := filepath.Join(dir, "arkd.db")
+
+	garbage := filepath.Join(dir, "garbage.db")
+	if err := os.WriteFile(garbage, bytes.Repeat([]byte("x"), 8192), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := RestoreSnapshot(garbage, dbPath, zerolog.Nop()); !errors.Is(err, ErrInvalidSnapshot) {
+		t.Errorf("RestoreSnapshot() error = %v, want %v", err, ErrInvalidSnapshot)
+	}
+	if _, err := os.Stat(dbPath); !os.IsNotExist(err) {
+		t.Errorf("database written from an invalid snapshot")
+	}
+}
+
+func Test_RestoreSnapshot_once(t *testing.T) {
+	ctx := context.Background()
+	ts, _ := newTestTaskStore(t)
+
+	var buf bytes.Buffer
+	if _, err := ts.Backup(ctx, &buf); err != nil {
+		t.Fatalf("Backup() error = %v", err)
+	}
+
+	dir := t.TempDir()
+	snapshotPath := filepath.Join(dir, "snapshot.db")
+	if err := os.WriteFile(snapshotPath, buf.Bytes(), 0600); err != nil {
+		t.Fatal(err)
+	}
+	dbPath := filepath.Join(dir, "arkd.db")
+
+	if restored, err := RestoreSnapshot(snapshotPath, dbPath, zerolog.Nop()); err != nil || !restored {
+		t.Fatalf("RestoreSnapshot() = %v, %v, want restored", restored, err)
+	}
+
+	// the worker runs on and creates a task after the restore
+	db, err := bbolt.Open(dbPath, 0600, &bbolt.Options{Timeout: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	restoredStore, err := NewBoltTaskStore(db, zerolog.Nop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	task, err := restoredStore.CreateTask(ctx, TaskDefinition{AppName: "web", Image: "ubuntu"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	if restored, err := RestoreSnapshot(snapshotPath, dbPath, zerolog.Nop()); err != nil || restored {
+		t.Fatalf("RestoreSnapshot() of the same snapshot = %v, %v, want it skipped", restored, err)
+	}
+	if _, err := os.Stat(dbPath + ".pre-restore"); !os.IsNotExist(err) {
+		t.Errorf("database moved aside for a skipped restore")
+	}
+
+	db, err = bbolt.Open(dbPath, 0600, &bbolt.Options{Timeout: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	restoredStore, err = NewBoltTaskStore(db, zerolog.Nop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := restoredStore.GetTask(ctx, task.ID); err != nil {
+		t.Errorf("task created after the restore is gone: %v", err)
+	}
+}
@@ -1,14 +1,21 @@
 package arkd
 
 import (
+	"bufio"
 	"context"
+	"os"
 	"runtime"
+	"strconv"
+	"strings"
 )
 
 type SystemMetrics struct {
 	// the available system cpu count
 	TotalCpu int `json:"total_cpu"`
-	// TotalMem     uint64  `json:"total_mem"`
+	// system memory in MB, 0 if unknown
+	TotalMem int `json:"total_mem"`
+	// system wide process limit, 0 if unknown
+	TotalPids int `json:"total_pids"`
 
 	// the total count of tasks (includes running and suspended)
 	TotalTasks int `json:"total_tasks"`
@@ -16,23 +23,95 @@ type SystemMetrics struct {
 	AllocatedCpu float64 `json:"allocated_cpu"`
 	// allocated memory
 	AllocatedMem int `json:"allocated_mem"`
+	// allocated processes
+	AllocatedPids int `json:"allocated_pids"`
 	// available cpu's (total - allocated)
 	AvailableCpu float64 `json:"available_cpu"`
+	// available memory and processes, only set if their total is known
+	AvailableMem  int `json:"available_mem"`
+	AvailablePids int `json:"available_pids"`
 }
 
-func GetSystemMetrics(ctx context.Context, ts *TaskStore) SystemMetrics {
-	aggTaskMetrics := ts.AggMetrics(ctx)
+// HostCapacity is what the worker's host has to hand out to tasks
+type HostCapacity struct {
+	Cpu int
+	// in MB, 0 if unknown
+	Mem int
+	// 0 if unknown
+	Pids int
+}
+
+// ReadHostCapacity reads the host's cpus, memory and process limit. memory
+// and processes are only known on linux.
+func ReadHostCapacity() HostCapacity {
+	return HostCapacity{
+		Cpu:  runtime.NumCPU(),
+		Mem:  readMemTotal("/proc/meminfo"),
+		Pids: readIntFile("/proc/sys/kernel/pid_max"),
+	}
+}
+
+func GetSystemMetrics(ctx context.Context, ts TaskStore) SystemMetrics {
+	return NewSystemMetrics(ReadHostCapacity(), ts.AggMetrics(ctx))
+}
+
+func NewSystemMetrics(host HostCapacity, aggTaskMetrics *AggTaskMetrics) SystemMetrics {
+	sm := SystemMetrics{
+		TotalCpu:      host.Cpu,
+		TotalMem:      host.Mem,
+		TotalPids:     host.Pids,
+		TotalTasks:    aggTaskMetrics.TotalTasks,
+		AllocatedMem:  aggTaskMetrics.AllocatedMem,
+		AllocatedCpu:  aggTaskMetrics.AllocatedCpu,
+		AllocatedPids: aggTaskMetrics.AllocatedPids,
+		AvailableCpu:  float64(host.Cpu) - aggTaskMetrics.AllocatedCpu,
+	}
+	if host.Mem > 0 {
+		sm.AvailableMem = host.Mem - aggTaskMetrics.AllocatedMem
+	}
+	if host.Pids > 0 {
+		sm.AvailablePids = host.Pids - aggTaskMetrics.AllocatedPids
+	}
 
-	var memStats runtime.MemStats
-	runtime.ReadMemStats(&memStats)
+	return sm
+}
+
+// readMemTotal returns MemTotal from a meminfo file in MB, or 0
+func readMemTotal(path string) int {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// MemTotal:       16314516 kB
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || fields[0] != "MemTotal:" {
+			continue
+		}
+
+		kb, err := strconv.Atoi(fields[1])
+		if err != nil {
+			return 0
+		}
+		return kb / 1024
+	}
 
-	numCpu := runtime.NumCPU()
+	return 0
+}
 
-	return SystemMetrics{
-		TotalCpu:     numCpu,
-		TotalTasks:   aggTaskMetrics.TotalTasks,
-		AllocatedMem: aggTaskMetrics.AllocatedMem,
-		AllocatedCpu: aggTaskMetrics.AllocatedCpu,
-		AvailableCpu: float64(numCpu) - aggTaskMetrics.AllocatedCpu,
+func readIntFile(path string) int {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return 0
 	}
+
+	n, err := strconv.Atoi(strings.TrimSpace(string(raw)))
+	if err != nil {
+		return 0
+	}
+
+	return n
 }
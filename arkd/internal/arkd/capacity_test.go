@@ -0,0 +1,51 @@
+package arkd
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func Test_readMemTotal(t *testing.T) {
+	tests := []struct {
+		name    string
+		meminfo string
+		want    int
+	}{
+		{"meminfo", "MemTotal:       16314516 kB\nMemFree:         1234567 kB\n", 15932},
+		{"not first", "Foo:  1 kB\nMemTotal:  2097152 kB\n", 2048},
+		{"missing", "MemFree:  1234567 kB\n", 0},
+		{"invalid", "MemTotal:  lots kB\n", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "meminfo")
+			if err := os.WriteFile(path, []byte(tt.meminfo), 0o644); err != nil {
+				t.Fatal(err)
+			}
+
+			if got := readMemTotal(path); got != tt.want {
+				t.Errorf("readMemTotal() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+
+	if got := readMemTotal(filepath.Join(t.TempDir(), "none")); got != 0 {
+		t.Errorf("readMemTotal(missing file) = %d, want 0", got)
+	}
+}
+
+func Test_NewSystemMetrics(t *testing.T) {
+	agg := &AggTaskMetrics{TotalTasks: 2, AllocatedCpu: 1.5, AllocatedMem: 768, AllocatedPids: 1024}
+
+	sm := NewSystemMetrics(HostCapacity{Cpu: 4, Mem: 4096, Pids: 32768}, agg)
+	if sm.AvailableCpu != 2.5 || sm.AvailableMem != 3328 || sm.AvailablePids != 31744 {
+		t.Errorf("NewSystemMetrics() = %+v", sm)
+	}
+
+	// unknown totals leave nothing available to check against
+	sm = NewSystemMetrics(HostCapacity{Cpu: 4}, agg)
+	if sm.TotalMem != 0 || sm.AvailableMem != 0 || sm.AvailablePids != 0 {
+		t.Errorf("NewSystemMetrics(unknown totals) = %+v", sm)
+	}
+}
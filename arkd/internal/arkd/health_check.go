@@ -0,0 +1,108 @@
+package arkd
+
+import (
+	"time"
+)
+
+type HealthStatus string
+
+const (
+	// the task has no health check
+	HealthStatusNone HealthStatus = ""
+	// no check has passed yet
+	HealthStatusStarting  HealthStatus = "starting"
+	HealthStatusHealthy   HealthStatus = "healthy"
+	HealthStatusUnhealthy HealthStatus = "unhealthy"
+)
+
+// failing checks in a row before a task counts as unhealthy
+const UnhealthyThreshold = 3
+
+// checks kept in a task's health history
+const HealthHistorySize = 10
+
+// TaskHealthCheck is how a task's health is checked. durations are strings
+// as written in the stack definition, e.g. "10s".
+type TaskHealthCheck struct {
+	GracePeriod string `json:"grace_period"`
+	Interval    string `json:"interval"`
+	Timeout     string `json:"timeout"`
+	// run in the container via docker exec, passes on exit code 0
+	Command string `json:"command"`
+	// request DSL, see ark.ParseHealthCheckRequest
+	Request string `json:"request"`
+	// container port requests are sent to
+	Port int `json:"port"`
+}
+
+// Enabled reports whether the task has a check to run
+func (hc TaskHealthCheck) Enabled() bool {
+	return hc.Command != "" || hc.Request != ""
+}
+
+// TaskHealth is the outcome of a task's recent health checks
+type TaskHealth struct {
+	Status        HealthStatus        `json:"status"`
+	FailingStreak int                 `json:"failing_streak"`
+	History       []HealthCheckResult `json:"history"`
+}
+
+type HealthCheckResult struct {
+	StartedAt time.Time     `json:"started_at"`
+	Duration  time.Duration `json:"duration"`
+	Passed    bool          `json:"passed"`
+	// truncated command output, response status or error
+	Output string `json:"output"`
+}
+
+// recordHealthCheck applies result to the task. failures during the grace
+// period don't count against the task. the first passing check moves a
+// starting task to running. it reports whether the task's status, health
+// status or failing streak changed, only then is the result added to the
+// history and worth storing, so checks that keep passing don't bump the
+// task's revision.
+func (t *Task) recordHealthCheck(result HealthCheckResult, inGracePeriod bool) bool {
+	status, health, streak := t.Status, t.Health.Status, t.Health.FailingStreak
+
+	switch {
+	case result.Passed:
+		t.Health.Status = HealthStatusHealthy
+		t.Health.FailingStreak = 0
+		if t.Status == TaskStatusStarting {
+			t.Status = TaskStatusRunning
+		}
+	case inGracePeriod:
+		if t.Health.Status == HealthStatusNone {
+			t.Health.Status = HealthStatusStarting
+		}
+	default:
+		t.Health.FailingStreak++
+		if t.Health.FailingStreak >= UnhealthyThreshold {
+			t.Health.Status = HealthStatusUnhealthy
+		}
+	}
+
+	if t.Status == status && t.Health.Status == health && t.Health.FailingStreak == streak {
+		return false
+	}
+
+	t.Health.History = append(t.Health.History, result)
+	if n := len(t.Health.History); n > HealthHistorySize {
+		t.Health.History = t.Health.History[n-HealthHistorySize:]
+	}
+
+	return true
+}
+
+// healthCheckChange is the status change a health check result causes
+func healthCheckChange(result HealthCheckResult) StatusChange {
+	reason := "health check failed"
+	if result.Passed {
+		reason = "health check passed"
+	}
+	if result.Output != "" {
+		reason += ": " + result.Output
+	}
+
+	return StatusChange{Reason: reason}
+}
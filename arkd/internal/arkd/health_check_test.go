@@ -0,0 +1,90 @@
+package arkd
+
+import (
+	"testing"
+)
+
+func Test_Task_recordHealthCheck(t *testing.T) {
+	type check struct {
+		passed        bool
+		inGracePeriod bool
+	}
+
+	tests := []struct {
+		name       string
+		checks     []check
+		wantStatus TaskStatus
+		wantHealth HealthStatus
+	}{
+		{
+			"failures_in_grace_period_dont_count",
+			[]check{{false, true}, {false, true}, {false, true}, {false, true}},
+			TaskStatusStarting,
+			HealthStatusStarting,
+		},
+		{
+			"first_pass_makes_task_running",
+			[]check{{false, true}, {true, true}},
+			TaskStatusRunning,
+			HealthStatusHealthy,
+		},
+		{
+			"unhealthy_after_threshold",
+			[]check{{true, false}, {false, false}, {false, false}, {false, false}},
+			TaskStatusRunning,
+			HealthStatusUnhealthy,
+		},
+		{
+			"pass_resets_streak",
+			[]check{{false, false}, {false, false}, {true, false}, {false, false}},
+			TaskStatusRunning,
+			HealthStatusHealthy,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			task := Task{Status: TaskStatusStarting, Health: TaskHealth{Status: HealthStatusStarting}}
+			for _, c := range tt.checks {
+				task.recordHealthCheck(HealthCheckResult{Passed: c.passed}, c.inGracePeriod)
+			}
+
+			if task.Status != tt.wantStatus {
+				t.Errorf("status = %v, want %v", task.Status, tt.wantStatus)
+			}
+			if task.Health.Status != tt.wantHealth {
+				t.Errorf("health = %q, want %q", task.Health.Status, tt.wantHealth)
+			}
+		})
+	}
+}
+
+func Test_Task_recordHealthCheck_history(t *testing.T) {
+	task := Task{Status: TaskStatusRunning}
+	for i := 0; i < HealthHistorySize+5; i++ {
+		if !task.recordHealthCheck(HealthCheckResult{Passed: false, Output: "connection refused"}, false) {
+			t.Fatalf("recordHealthCheck() of failure %d = false, want true", i+1)
+		}
+	}
+
+	if len(task.Health.History) != HealthHistorySize {
+		t.Errorf("history length = %d, want %d", len(task.Health.History), HealthHistorySize)
+	}
+}
+
+func Test_Task_recordHealthCheck_unchanged(t *testing.T) {
+	task := Task{Status: TaskStatusStarting, Health: TaskHealth{Status: HealthStatusStarting}}
+
+	if !task.recordHealthCheck(HealthCheckResult{Passed: true}, false) {
+		t.Errorf("recordHealthCheck() of first pass = false, want true")
+	}
+	if task.recordHealthCheck(HealthCheckResult{Passed: true}, false) {
+		t.Errorf("recordHealthCheck() of second pass = true, want false")
+	}
+	if task.recordHealthCheck(HealthCheckResult{Passed: false}, true) {
+		t.Errorf("recordHealthCheck() of failure in grace period = true, want false")
+	}
+	if len(task.Health.History) != 1 {
+		t.Errorf("history length = %d, want 1", len(task.Health.History))
+	}
+}
@@ -0,0 +1,68 @@
+package arkd
+
+import "time"
+
+const (
+	RestartNever     = "never"
+	RestartOnFailure = "on-failure"
+	RestartAlways    = "always"
+)
+
+// DefaultMaxRetries is how many times in a row a task is restarted before it
+// counts as crash looping
+const DefaultMaxRetries = 5
+
+// RestartResetAfter is how long a task has to run for its restarts to stop
+// counting against it
+const RestartResetAfter = 10 * time.Minute
+
+// TaskRestartPolicy is when a task is restarted after its container exits.
+// tasks without a policy are never restarted.
+type TaskRestartPolicy struct {
+	// RestartNever, RestartOnFailure or RestartAlways
+	Policy string `json:"policy"`
+	// restarts in a row before the task counts as crash looping, zero for
+	// DefaultMaxRetries
+	MaxRetries int `json:"max_retries"`
+}
+
+// ShouldRestart reports whether a container exiting, failed or not, is
+// restarted
+func (p TaskRestartPolicy) ShouldRestart(failed bool) bool {
+	switch p.Policy {
+	case RestartAlways:
+		return true
+	case RestartOnFailure:
+		return failed
+	}
+
+	return false
+}
+
+// Limit is how many restarts in a row are allowed
+func (p TaskRestartPolicy) Limit() int {
+	if p.MaxRetries > 0 {
+		return p.MaxRetries
+	}
+
+	return DefaultMaxRetries
+}
+
+// RestartBackoff is how long to wait before restarting a task. the delay
+// doubles with every restart in a row, up to Max.
+type RestartBackoff struct {
+	Base time.Duration
+	Max  time.Duration
+}
+
+// Delay is the wait before the restart after restarts earlier ones. jitter
+// in [0, 1) picks a delay between half and all of the exponential one, so
+// tasks that crashed together don't restart together.
+func (b RestartBackoff) Delay(restarts int, jitter float64) time.Duration {
+	d := b.Max
+	if restarts < 32 && b.Base<<restarts > 0 && b.Base<<restarts < b.Max {
+		d = b.Base << restarts
+	}
+
+	return d/2 + time.Duration(jitter*float64(d/2))
+}
@@ -0,0 +1,51 @@
+package arkd
+
+import (
+	"testing"
+	"time"
+)
+
+func Test_TaskRestartPolicy_ShouldRestart(t *testing.T) {
+	tests := []struct {
+		policy string
+		failed bool
+		want   bool
+	}{
+		{"", true, false},
+		{RestartNever, true, false},
+		{RestartOnFailure, true, true},
+		{RestartOnFailure, false, false},
+		{RestartAlways, false, true},
+	}
+	for _, tt := range tests {
+		p := TaskRestartPolicy{Policy: tt.policy}
+		if got := p.ShouldRestart(tt.failed); got != tt.want {
+			t.Errorf("%q.ShouldRestart(%v) = %v, want %v", tt.policy, tt.failed, got, tt.want)
+		}
+	}
+}
+
+func Test_RestartBackoff_Delay(t *testing.T) {
+	b := RestartBackoff{Base: time.Second, Max: time.Minute}
+
+	tests := []struct {
+		name     string
+		restarts int
+		jitter   float64
+		want     time.Duration
+	}{
+		{"first", 0, 0, 500 * time.Millisecond},
+		{"first full jitter", 0, 0.999999, time.Second},
+		{"doubles", 3, 0, 4 * time.Second},
+		{"capped", 10, 0, 30 * time.Second},
+		{"overflow", 100, 0, 30 * time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := b.Delay(tt.restarts, tt.jitter)
+			if got.Round(time.Millisecond) != tt.want {
+				t.Errorf("Delay(%d, %v) = %v, want %v", tt.restarts, tt.jitter, got, tt.want)
+			}
+		})
+	}
+}
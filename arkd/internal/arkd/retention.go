@@ -0,0 +1,61 @@
+package arkd
+
+import (
+	"sort"
+	"time"
+)
+
+// RetentionPolicy decides which finished tasks are garbage collected.
+// a task is expired if either limit says so, zero disables a limit.
+type RetentionPolicy struct {
+	// finished tasks kept per app of a deployment, newest first
+	KeepPerApp int
+	// how long finished tasks are kept
+	MaxAge time.Duration
+}
+
+const (
+	ExpiredByCount = "count"
+	ExpiredByAge   = "age"
+)
+
+// ExpiredTask is a finished task the retention policy doesn't keep
+type ExpiredTask struct {
+	Task Task `json:"task"`
+	// ExpiredByCount or ExpiredByAge
+	Reason string `json:"reason"`
+}
+
+// Expired returns the finished tasks in tasks the policy doesn't keep at
+// now, oldest first. tasks that haven't finished are always kept.
+func (p RetentionPolicy) Expired(tasks []Task, now time.Time) []ExpiredTask {
+	byApp := make(map[string][]Task)
+	for _, t := range tasks {
+		if !t.Status.Finished() {
+			continue
+		}
+		byApp[t.QualifiedName()] = append(byApp[t.QualifiedName()], t)
+	}
+
+	expired := make([]ExpiredTask, 0)
+	for _, finished := range byApp {
+		sort.Slice(finished, func(i, j int) bool {
+			return finished[i].FinishedAt.After(finished[j].FinishedAt)
+		})
+
+		for i, t := range finished {
+			switch {
+			case p.KeepPerApp > 0 && i >= p.KeepPerApp:
+				expired = append(expired, ExpiredTask{Task: t, Reason: ExpiredByCount})
+			case p.MaxAge > 0 && now.Sub(t.FinishedAt) > p.MaxAge:
+				expired = append(expired, ExpiredTask{Task: t, Reason: ExpiredByAge})
+			}
+		}
+	}
+
+	sort.Slice(expired, func(i, j int) bool {
+		return expired[i].Task.FinishedAt.Before(expired[j].Task.FinishedAt)
+	})
+
+	return expired
+}
@@ -0,0 +1,73 @@
+package arkd
+
+import (
+	"testing"
+	"time"
+)
+
+func Test_RetentionPolicy_Expired(t *testing.T) {
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	task := func(app string, status TaskStatus, finishedAgo time.Duration) Task {
+		t := Task{AppName: app, DeploymentName: "main", StackName: "babies-first-ark", Status: status}
+		if status.Finished() {
+			t.FinishedAt = now.Add(-finishedAgo)
+		}
+		return t
+	}
+
+	tasks := []Task{
+		task("web", TaskStatusExited, 3*time.Hour),
+		task("web", TaskStatusCrashed, 2*time.Hour),
+		task("web", TaskStatusExited, time.Hour),
+		task("web", TaskStatusRunning, 0),
+		task("worker", TaskStatusExited, 30*time.Hour),
+	}
+
+	tests := []struct {
+		name   string
+		policy RetentionPolicy
+		want   []ExpiredTask
+	}{
+		{
+			name:   "no limits",
+			policy: RetentionPolicy{},
+			want:   []ExpiredTask{},
+		},
+		{
+			name:   "keep per app",
+			policy: RetentionPolicy{KeepPerApp: 1},
+			want: []ExpiredTask{
+				{Task: tasks[0], Reason: ExpiredByCount},
+				{Task: tasks[1], Reason: ExpiredByCount},
+			},
+		},
+		{
+			name:   "max age",
+			policy: RetentionPolicy{MaxAge: 24 * time.Hour},
+			want: []ExpiredTask{
+				{Task: tasks[4], Reason: ExpiredByAge},
+			},
+		},
+		{
+			name:   "both",
+			policy: RetentionPolicy{KeepPerApp: 2, MaxAge: 150 * time.Minute},
+			want: []ExpiredTask{
+				{Task: tasks[4], Reason: ExpiredByAge},
+				{Task: tasks[0], Reason: ExpiredByCount},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.policy.Expired(tasks, now)
+			if len(got) != len(tt.want) {
+				t.Fatalf("Expired() = %+v, want %+v", got, tt.want)
+			}
+			for i := range got {
+				if got[i].Task.AppName != tt.want[i].Task.AppName || !got[i].Task.FinishedAt.Equal(tt.want[i].Task.FinishedAt) || got[i].Reason != tt.want[i].Reason {
+					t.Errorf("Expired()[%d] = %+v, want %+v", i, got[i], tt.want[i])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,52 @@
+package arkd
+
+import (
+	"context"
+	"errors"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/volume"
+)
+
+// ErrRuntimeNotFound is returned for containers, networks and volumes the
+// runtime doesn't have
+var ErrRuntimeNotFound = errors.New("runtime: not found")
+
+// Runtime runs the worker's containers. MobyRuntime runs them on docker,
+// FakeRuntime in process for tests. containers, networks and volumes are
+// described with docker's types.
+type Runtime interface {
+	// PullImage returns once the image is pulled
+	PullImage(ctx context.Context, ref string) error
+
+	// CreateContainer returns the id of the new container
+	CreateContainer(ctx context.Context, name string, config *container.Config, hostConfig *container.HostConfig) (string, error)
+	StartContainer(ctx context.Context, id string) error
+	// StopContainer sends the stop signal and kills the container after the
+	// timeout, both default to the container's config
+	StopContainer(ctx context.Context, id string, opts container.StopOptions) error
+	KillContainer(ctx context.Context, id, signal string) error
+	UnpauseContainer(ctx context.Context, id string) error
+	// WaitContainer sends the container's exit once it isn't running
+	WaitContainer(ctx context.Context, id string) (<-chan container.WaitResponse, <-chan error)
+	RemoveContainer(ctx context.Context, id string, force bool) error
+	// ListContainers lists all containers, running or not, with label. label
+	// is a key or key=value.
+	ListContainers(ctx context.Context, label string) ([]types.Container, error)
+	InspectContainer(ctx context.Context, id string) (types.ContainerJSON, error)
+	// ExecContainer runs cmd in the container and returns its combined
+	// output and exit code
+	ExecContainer(ctx context.Context, id string, cmd []string) (string, int, error)
+
+	// FindNetwork returns the id of the network called name, or "" if there
+	// is none
+	FindNetwork(ctx context.Context, name string) (string, error)
+	CreateNetwork(ctx context.Context, name string, labels map[string]string) (string, error)
+	ConnectNetwork(ctx context.Context, networkId, containerId string, aliases []string) error
+
+	// CreateVolume creates a volume unless one called name exists
+	CreateVolume(ctx context.Context, name string, labels map[string]string) error
+	// ListVolumes lists the volumes with label, a key or key=value
+	ListVolumes(ctx context.Context, label string) ([]*volume.Volume, error)
+}
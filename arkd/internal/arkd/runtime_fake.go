@@ -0,0 +1,603 @@
+package arkd
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/api/types/volume"
+)
+
+// FakeRuntime is an in memory Runtime for tests. containers don't run
+// anything, they change state when they're told to. images are pulled
+// instantly and containers exit on signals right away, tests use Fail,
+// Exit, IgnoreSignals and the like to simulate everything else.
+type FakeRuntime struct {
+	mtx        sync.Mutex
+	images     map[string]bool
+	containers map[string]*fakeContainer
+	// container ids by creation, so listings are stable
+	order    []string
+	networks map[string]*fakeNetwork
+	volumes  map[string]*volume.Volume
+	failures map[string]error
+	exec     func(id string, cmd []string) (string, int)
+	nextId   int
+}
+
+type fakeContainer struct {
+	id         string
+	name       string
+	config     container.Config
+	hostConfig container.HostConfig
+	state      string
+	exitCode   int
+	oomKilled  bool
+	// ignoring signals other than SIGKILL
+	stubborn bool
+	// network names with the container's aliases on them
+	networks map[string][]string
+	// closed and replaced whenever the container stops running
+	exited chan struct{}
+}
+
+type fakeNetwork struct {
+	id     string
+	labels map[string]string
+}
+
+var _ Runtime = (*FakeRuntime)(nil)
+
+func NewFakeRuntime() *FakeRuntime {
+	return &FakeRuntime{
+		images:     make(map[string]bool),
+		containers: make(map[string]*fakeContainer),
+		networks:   make(map[string]*fakeNetwork),
+		volumes:    make(map[string]*volume.Volume),
+		failures:   make(map[string]error),
+	}
+}
+
+// Fail makes every call of op, a Runtime method name like "PullImage",
+// return err. a nil err lets the calls succeed again.
+func (fr *FakeRuntime) Fail(op string, err error) {
+	fr.mtx.Lock()
+	defer fr.mtx.Unlock()
+
+	if err == nil {
+		delete(fr.failures, op)
+		return
+	}
+	fr.failures[op] = err
+}
+
+// Exit makes a running or paused container exit with code
+func (fr *FakeRuntime) Exit(id string, code int) error {
+	fr.mtx.Lock()
+	defer fr.mtx.Unlock()
+
+	ctr, err := fr.running(id)
+	if err != nil {
+		return err
+	}
+	ctr.exit(code, false)
+
+	return nil
+}
+
+// OOMKill makes a running or paused container exit like the kernel killed
+// it for running out of memory
+func (fr *FakeRuntime) OOMKill(id string) error {
+	fr.mtx.Lock()
+	defer fr.mtx.Unlock()
+
+	ctr, err := fr.running(id)
+	if err != nil {
+		return err
+	}
+	ctr.exit(137, true)
+
+	return nil
+}
+
+// Pause pauses a running container, like docker pause behind arkd's back
+func (fr *FakeRuntime) Pause(id string) error {
+	fr.mtx.Lock()
+	defer fr.mtx.Unlock()
+
+	ctr, ok := fr.containers[id]
+	if !ok {
+		return fmt.Errorf("%w: container %s", ErrRuntimeNotFound, id)
+	}
+	if ctr.state != "running" {
+		return fmt.Errorf("runtime: container %s is not running", id)
+	}
+	ctr.state = "paused"
+
+	return nil
+}
+
+// IgnoreSignals makes a container ignore every signal but SIGKILL, so it's
+// only stopped by being killed
+func (fr *FakeRuntime) IgnoreSignals(id string) error {
+	fr.mtx.Lock()
+	defer fr.mtx.Unlock()
+
+	ctr, ok := fr.containers[id]
+	if !ok {
+		return fmt.Errorf("%w: container %s", ErrRuntimeNotFound, id)
+	}
+	ctr.stubborn = true
+
+	return nil
+}
+
+// HandleExec answers ExecContainer with fn. without it every command exits
+// with 0 and no output.
+func (fr *FakeRuntime) HandleExec(fn func(id string, cmd []string) (string, int)) {
+	fr.mtx.Lock()
+	defer fr.mtx.Unlock()
+
+	fr.exec = fn
+}
+
+// ImagePulled reports whether ref was pulled
+func (fr *FakeRuntime) ImagePulled(ref string) bool {
+	fr.mtx.Lock()
+	defer fr.mtx.Unlock()
+
+	return fr.images[ref]
+}
+
+// ContainerState returns the state of a container, "" if there is none
+func (fr *FakeRuntime) ContainerState(id string) string {
+	fr.mtx.Lock()
+	defer fr.mtx.Unlock()
+
+	if ctr, ok := fr.containers[id]; ok {
+		return ctr.state
+	}
+
+	return ""
+}
+
+func (fr *FakeRuntime) PullImage(ctx context.Context, ref string) error {
+	fr.mtx.Lock()
+	defer fr.mtx.Unlock()
+
+	if err := fr.failure("PullImage"); err != nil {
+		return err
+	}
+	fr.images[ref] = true
+
+	return nil
+}
+
+func (fr *FakeRuntime) CreateContainer(ctx context.Context, name string, config *container.Config, hostConfig *container.HostConfig) (string, error) {
+	fr.mtx.Lock()
+	defer fr.mtx.Unlock()
+
+	if err := fr.failure("CreateContainer"); err != nil {
+		return "", err
+	}
+	if !fr.images[config.Image] {
+		return "", fmt.Errorf("%w: image %s", ErrRuntimeNotFound, config.Image)
+	}
+	for _, ctr := range fr.containers {
+		if name != "" && ctr.name == name {
+			return "", fmt.Errorf("runtime: container name %s is in use", name)
+		}
+	}
+
+	fr.nextId++
+	id := fmt.Sprintf("ctr%d", fr.nextId)
+	if name == "" {
+		name = id
+	}
+	ctr := &fakeContainer{
+		id:       id,
+		name:     name,
+		config:   *config,
+		state:    "created",
+		networks: make(map[string][]string),
+		exited:   make(chan struct{}),
+	}
+	if hostConfig != nil {
+		ctr.hostConfig = *hostConfig
+	}
+	fr.containers[id] = ctr
+	fr.order = append(fr.order, id)
+
+	return id, nil
+}
+
+func (fr *FakeRuntime) StartContainer(ctx context.Context, id string) error {
+	fr.mtx.Lock()
+	defer fr.mtx.Unlock()
+
+	if err := fr.failure("StartContainer"); err != nil {
+		return err
+	}
+	ctr, ok := fr.containers[id]
+	if !ok {
+		return fmt.Errorf("%w: container %s", ErrRuntimeNotFound, id)
+	}
+
+	switch ctr.state {
+	case "running":
+		return nil
+	case "paused":
+		return fmt.Errorf("runtime: cannot start paused container %s", id)
+	}
+	ctr.state = "running"
+	ctr.exitCode = 0
+	ctr.oomKilled = false
+
+	return nil
+}
+
+func (fr *FakeRuntime) StopContainer(ctx context.Context, id string, opts container.StopOptions) error {
+	fr.mtx.Lock()
+	defer fr.mtx.Unlock()
+
+	if err := fr.failure("StopContainer"); err != nil {
+		return err
+	}
+	ctr, ok := fr.containers[id]
+	if !ok {
+		return fmt.Errorf("%w: container %s", ErrRuntimeNotFound, id)
+	}
+	if ctr.state != "running" && ctr.state != "paused" {
+		return nil
+	}
+
+	// a stubborn container is killed once the timeout passes, which the
+	// fake doesn't wait for
+	if ctr.stubborn {
+		ctr.exit(137, false)
+		return nil
+	}
+	ctr.exit(0, false)
+
+	return nil
+}
+
+func (fr *FakeRuntime) KillContainer(ctx context.Context, id, signal string) error {
+	fr.mtx.Lock()
+	defer fr.mtx.Unlock()
+
+	if err := fr.failure("KillContainer"); err != nil {
+		return err
+	}
+	ctr, err := fr.running(id)
+	if err != nil {
+		return err
+	}
+
+	switch strings.TrimPrefix(strings.ToUpper(signal), "SIG") {
+	case "KILL", "9":
+		ctr.exit(137, false)
+	default:
+		if !ctr.stubborn {
+			ctr.exit(0, false)
+		}
+	}
+
+	return nil
+}
+
+func (fr *FakeRuntime) UnpauseContainer(ctx context.Context, id string) error {
+	fr.mtx.Lock()
+	defer fr.mtx.Unlock()
+
+	if err := fr.failure("UnpauseContainer"); err != nil {
+		return err
+	}
+	ctr, ok := fr.containers[id]
+	if !ok {
+		return fmt.Errorf("%w: container %s", ErrRuntimeNotFound, id)
+	}
+	if ctr.state != "paused" {
+		return fmt.Errorf("runtime: container %s is not paused", id)
+	}
+	ctr.state = "running"
+
+	return nil
+}
+
+func (fr *FakeRuntime) WaitContainer(ctx context.Context, id string) (<-chan container.WaitResponse, <-chan error) {
+	resps := make(chan container.WaitResponse, 1)
+	errs := make(chan error, 1)
+
+	fr.mtx.Lock()
+	defer fr.mtx.Unlock()
+
+	if err := fr.failure("WaitContainer"); err != nil {
+		errs <- err
+		return resps, errs
+	}
+	ctr, ok := fr.containers[id]
+	if !ok {
+		errs <- fmt.Errorf("%w: container %s", ErrRuntimeNotFound, id)
+		return resps, errs
+	}
+	if ctr.state != "running" && ctr.state != "paused" {
+		resps <- container.WaitResponse{StatusCode: int64(ctr.exitCode)}
+		return resps, errs
+	}
+
+	exited := ctr.exited
+	go func() {
+		select {
+		case <-exited:
+			fr.mtx.Lock()
+			defer fr.mtx.Unlock()
+			resps <- container.WaitResponse{StatusCode: int64(ctr.exitCode)}
+		case <-ctx.Done():
+			errs <- ctx.Err()
+		}
+	}()
+
+	return resps, errs
+}
+
+func (fr *FakeRuntime) RemoveContainer(ctx context.Context, id string, force bool) error {
+	fr.mtx.Lock()
+	defer fr.mtx.Unlock()
+
+	if err := fr.failure("RemoveContainer"); err != nil {
+		return err
+	}
+	ctr, ok := fr.containers[id]
+	if !ok {
+		return fmt.Errorf("%w: container %s", ErrRuntimeNotFound, id)
+	}
+	if ctr.state == "running" || ctr.state == "paused" {
+		if !force {
+			return fmt.Errorf("runtime: cannot remove running container %s", id)
+		}
+		ctr.exit(137, false)
+	}
+
+	delete(fr.containers, id)
+	for i, ctrId := range fr.order {
+		if ctrId == id {
+			fr.order = append(fr.order[:i], fr.order[i+1:]...)
+			break
+		}
+	}
+
+	return nil
+}
+
+func (fr *FakeRuntime) ListContainers(ctx context.Context, label string) ([]types.Container, error) {
+	fr.mtx.Lock()
+	defer fr.mtx.Unlock()
+
+	if err := fr.failure("ListContainers"); err != nil {
+		return nil, err
+	}
+
+	containers := make([]types.Container, 0, len(fr.order))
+	for _, id := range fr.order {
+		ctr := fr.containers[id]
+		if !hasLabel(ctr.config.Labels, label) {
+			continue
+		}
+
+		labels := make(map[string]string, len(ctr.config.Labels))
+		for k, v := range ctr.config.Labels {
+			labels[k] = v
+		}
+		containers = append(containers, types.Container{
+			ID:     ctr.id,
+			Names:  []string{"/" + ctr.name},
+			Image:  ctr.config.Image,
+			Labels: labels,
+			State:  ctr.state,
+		})
+	}
+
+	return containers, nil
+}
+
+func (fr *FakeRuntime) InspectContainer(ctx context.Context, id string) (types.ContainerJSON, error) {
+	fr.mtx.Lock()
+	defer fr.mtx.Unlock()
+
+	if err := fr.failure("InspectContainer"); err != nil {
+		return types.ContainerJSON{}, err
+	}
+	ctr, ok := fr.containers[id]
+	if !ok {
+		return types.ContainerJSON{}, fmt.Errorf("%w: container %s", ErrRuntimeNotFound, id)
+	}
+
+	// every container gets an address on each of its networks
+	networks := make(map[string]*network.EndpointSettings, len(ctr.networks))
+	i := 0
+	for name, aliases := range ctr.networks {
+		i++
+		networks[name] = &network.EndpointSettings{
+			NetworkID: fr.networks[name].id,
+			Aliases:   append([]string(nil), aliases...),
+			IPAddress: fmt.Sprintf("172.18.%d.%d", i, fr.indexOf(id)+2),
+		}
+	}
+
+	config := ctr.config
+	hostConfig := ctr.hostConfig
+	return types.ContainerJSON{
+		ContainerJSONBase: &types.ContainerJSONBase{
+			ID:   ctr.id,
+			Name: "/" + ctr.name,
+			State: &types.ContainerState{
+				Status:    ctr.state,
+				Running:   ctr.state == "running" || ctr.state == "paused",
+				Paused:    ctr.state == "paused",
+				OOMKilled: ctr.oomKilled,
+				Dead:      ctr.state == "dead",
+				ExitCode:  ctr.exitCode,
+			},
+			HostConfig: &hostConfig,
+		},
+		Config:          &config,
+		NetworkSettings: &types.NetworkSettings{Networks: networks},
+	}, nil
+}
+
+func (fr *FakeRuntime) ExecContainer(ctx context.Context, id string, cmd []string) (string, int, error) {
+	fr.mtx.Lock()
+	if err := fr.failure("ExecContainer"); err != nil {
+		fr.mtx.Unlock()
+		return "", 0, err
+	}
+	_, err := fr.running(id)
+	exec := fr.exec
+	fr.mtx.Unlock()
+
+	if err != nil {
+		return "", 0, err
+	}
+	if exec == nil {
+		return "", 0, nil
+	}
+	output, code := exec(id, cmd)
+
+	return output, code, nil
+}
+
+func (fr *FakeRuntime) FindNetwork(ctx context.Context, name string) (string, error) {
+	fr.mtx.Lock()
+	defer fr.mtx.Unlock()
+
+	if err := fr.failure("FindNetwork"); err != nil {
+		return "", err
+	}
+	if net, ok := fr.networks[name]; ok {
+		return net.id, nil
+	}
+
+	return "", nil
+}
+
+func (fr *FakeRuntime) CreateNetwork(ctx context.Context, name string, labels map[string]string) (string, error) {
+	fr.mtx.Lock()
+	defer fr.mtx.Unlock()
+
+	if err := fr.failure("CreateNetwork"); err != nil {
+		return "", err
+	}
+	if _, ok := fr.networks[name]; ok {
+		return "", fmt.Errorf("runtime: network %s already exists", name)
+	}
+
+	fr.nextId++
+	net := &fakeNetwork{id: fmt.Sprintf("net%d", fr.nextId), labels: labels}
+	fr.networks[name] = net
+
+	return net.id, nil
+}
+
+func (fr *FakeRuntime) ConnectNetwork(ctx context.Context, networkId, containerId string, aliases []string) error {
+	fr.mtx.Lock()
+	defer fr.mtx.Unlock()
+
+	if err := fr.failure("ConnectNetwork"); err != nil {
+		return err
+	}
+	ctr, ok := fr.containers[containerId]
+	if !ok {
+		return fmt.Errorf("%w: container %s", ErrRuntimeNotFound, containerId)
+	}
+	for name, net := range fr.networks {
+		if net.id == networkId {
+			ctr.networks[name] = append([]string(nil), aliases...)
+			return nil
+		}
+	}
+
+	return fmt.Errorf("%w: network %s", ErrRuntimeNotFound, networkId)
+}
+
+func (fr *FakeRuntime) CreateVolume(ctx context.Context, name string, labels map[string]string) error {
+	fr.mtx.Lock()
+	defer fr.mtx.Unlock()
+
+	if err := fr.failure("CreateVolume"); err != nil {
+		return err
+	}
+	if _, ok := fr.volumes[name]; ok {
+		return nil
+	}
+	fr.volumes[name] = &volume.Volume{Name: name, Driver: "local", Labels: labels}
+
+	return nil
+}
+
+func (fr *FakeRuntime) ListVolumes(ctx context.Context, label string) ([]*volume.Volume, error) {
+	fr.mtx.Lock()
+	defer fr.mtx.Unlock()
+
+	if err := fr.failure("ListVolumes"); err != nil {
+		return nil, err
+	}
+
+	vols := make([]*volume.Volume, 0, len(fr.volumes))
+	for _, v := range fr.volumes {
+		if hasLabel(v.Labels, label) {
+			vol := *v
+			vols = append(vols, &vol)
+		}
+	}
+
+	return vols, nil
+}
+
+func (fr *FakeRuntime) failure(op string) error {
+	return fr.failures[op]
+}
+
+// running returns a running or paused container
+func (fr *FakeRuntime) running(id string) (*fakeContainer, error) {
+	ctr, ok := fr.containers[id]
+	if !ok {
+		return nil, fmt.Errorf("%w: container %s", ErrRuntimeNotFound, id)
+	}
+	if ctr.state != "running" && ctr.state != "paused" {
+		return nil, fmt.Errorf("runtime: container %s is not running", id)
+	}
+
+	return ctr, nil
+}
+
+func (fr *FakeRuntime) indexOf(id string) int {
+	for i, ctrId := range fr.order {
+		if ctrId == id {
+			return i
+		}
+	}
+
+	return -1
+}
+
+func (ctr *fakeContainer) exit(code int, oomKilled bool) {
+	ctr.state = "exited"
+	ctr.exitCode = code
+	ctr.oomKilled = oomKilled
+
+	close(ctr.exited)
+	ctr.exited = make(chan struct{})
+}
+
+// hasLabel matches labels against a key or key=value
+func hasLabel(labels map[string]string, label string) bool {
+	key, value, hasValue := strings.Cut(label, "=")
+	v, ok := labels[key]
+
+	return ok && (!hasValue || v == value)
+}
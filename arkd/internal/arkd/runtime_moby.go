@@ -0,0 +1,192 @@
+package arkd
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/image"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/api/types/volume"
+	docker "github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/stdcopy"
+)
+
+// MobyRuntime runs containers on docker
+type MobyRuntime struct {
+	moby *docker.Client
+}
+
+var _ Runtime = (*MobyRuntime)(nil)
+
+func NewMobyRuntime(moby *docker.Client) *MobyRuntime {
+	return &MobyRuntime{moby: moby}
+}
+
+func (mr *MobyRuntime) PullImage(ctx context.Context, ref string) error {
+	rc, err := mr.moby.ImagePull(ctx, ref, image.PullOptions{})
+	if err != nil {
+		return mobyErr(err)
+	}
+	defer rc.Close()
+
+	// the pull is done once its progress is read to the end
+	if _, err := io.ReadAll(rc); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (mr *MobyRuntime) CreateContainer(ctx context.Context, name string, config *container.Config, hostConfig *container.HostConfig) (string, error) {
+	resp, err := mr.moby.ContainerCreate(ctx, config, hostConfig, nil, nil, name)
+	if err != nil {
+		return "", mobyErr(err)
+	}
+
+	return resp.ID, nil
+}
+
+func (mr *MobyRuntime) StartContainer(ctx context.Context, id string) error {
+	return mobyErr(mr.moby.ContainerStart(ctx, id, container.StartOptions{}))
+}
+
+func (mr *MobyRuntime) StopContainer(ctx context.Context, id string, opts container.StopOptions) error {
+	return mobyErr(mr.moby.ContainerStop(ctx, id, opts))
+}
+
+func (mr *MobyRuntime) KillContainer(ctx context.Context, id, signal string) error {
+	return mobyErr(mr.moby.ContainerKill(ctx, id, signal))
+}
+
+func (mr *MobyRuntime) UnpauseContainer(ctx context.Context, id string) error {
+	return mobyErr(mr.moby.ContainerUnpause(ctx, id))
+}
+
+func (mr *MobyRuntime) WaitContainer(ctx context.Context, id string) (<-chan container.WaitResponse, <-chan error) {
+	return mr.moby.ContainerWait(ctx, id, container.WaitConditionNotRunning)
+}
+
+func (mr *MobyRuntime) RemoveContainer(ctx context.Context, id string, force bool) error {
+	return mobyErr(mr.moby.ContainerRemove(ctx, id, container.RemoveOptions{Force: force}))
+}
+
+func (mr *MobyRuntime) ListContainers(ctx context.Context, label string) ([]types.Container, error) {
+	containers, err := mr.moby.ContainerList(ctx, container.ListOptions{
+		All:     true,
+		Filters: filters.NewArgs(filters.Arg("label", label)),
+	})
+	return containers, mobyErr(err)
+}
+
+func (mr *MobyRuntime) InspectContainer(ctx context.Context, id string) (types.ContainerJSON, error) {
+	ctr, err := mr.moby.ContainerInspect(ctx, id)
+	return ctr, mobyErr(err)
+}
+
+func (mr *MobyRuntime) ExecContainer(ctx context.Context, id string, cmd []string) (string, int, error) {
+	exec, err := mr.moby.ContainerExecCreate(ctx, id, container.ExecOptions{
+		Cmd:          cmd,
+		AttachStdout: true,
+		AttachStderr: true,
+	})
+	if err != nil {
+		return "", 0, fmt.Errorf("could not create exec: %w", mobyErr(err))
+	}
+
+	resp, err := mr.moby.ContainerExecAttach(ctx, exec.ID, container.ExecAttachOptions{})
+	if err != nil {
+		return "", 0, fmt.Errorf("could not attach exec: %w", err)
+	}
+	defer resp.Close()
+
+	// the hijacked connection doesn't watch ctx, close it on timeout
+	stop := context.AfterFunc(ctx, resp.Close)
+	defer stop()
+
+	var out bytes.Buffer
+	if _, err := stdcopy.StdCopy(&out, &out, resp.Reader); err != nil && ctx.Err() == nil {
+		return "", 0, fmt.Errorf("could not read exec output: %w", err)
+	}
+	if ctx.Err() != nil {
+		return out.String(), 0, ctx.Err()
+	}
+
+	inspect, err := mr.moby.ContainerExecInspect(ctx, exec.ID)
+	if err != nil {
+		return "", 0, fmt.Errorf("could not inspect exec: %w", err)
+	}
+
+	return out.String(), inspect.ExitCode, nil
+}
+
+func (mr *MobyRuntime) FindNetwork(ctx context.Context, name string) (string, error) {
+	nets, err := mr.moby.NetworkList(ctx, network.ListOptions{
+		Filters: filters.NewArgs(filters.Arg("name", name)),
+	})
+	if err != nil {
+		return "", mobyErr(err)
+	}
+
+	// the name filter matches on substrings
+	for _, net := range nets {
+		if net.Name == name {
+			return net.ID, nil
+		}
+	}
+
+	return "", nil
+}
+
+func (mr *MobyRuntime) CreateNetwork(ctx context.Context, name string, labels map[string]string) (string, error) {
+	resp, err := mr.moby.NetworkCreate(ctx, name, network.CreateOptions{
+		Driver: "bridge",
+		Labels: labels,
+	})
+	if err != nil {
+		return "", mobyErr(err)
+	}
+
+	return resp.ID, nil
+}
+
+func (mr *MobyRuntime) ConnectNetwork(ctx context.Context, networkId, containerId string, aliases []string) error {
+	return mobyErr(mr.moby.NetworkConnect(ctx, networkId, containerId, &network.EndpointSettings{
+		Aliases: aliases,
+	}))
+}
+
+func (mr *MobyRuntime) CreateVolume(ctx context.Context, name string, labels map[string]string) error {
+	// volume create is idempotent, an existing volume with the same name is
+	// returned as is
+	_, err := mr.moby.VolumeCreate(ctx, volume.CreateOptions{
+		Name:   name,
+		Driver: "local",
+		Labels: labels,
+	})
+	return mobyErr(err)
+}
+
+func (mr *MobyRuntime) ListVolumes(ctx context.Context, label string) ([]*volume.Volume, error) {
+	resp, err := mr.moby.VolumeList(ctx, volume.ListOptions{
+		Filters: filters.NewArgs(filters.Arg("label", label)),
+	})
+	if err != nil {
+		return nil, mobyErr(err)
+	}
+
+	return resp.Volumes, nil
+}
+
+// mobyErr marks docker's not found errors with ErrRuntimeNotFound
+func mobyErr(err error) error {
+	if err != nil && docker.IsErrNotFound(err) {
+		return fmt.Errorf("%w: %w", ErrRuntimeNotFound, err)
+	}
+
+	return err
+}
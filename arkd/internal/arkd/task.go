@@ -19,17 +19,53 @@ const (
 	TaskStatusSuspended
 	TaskStatusExited
 	TaskStatusCrashed
+	// the container exited and is restarted after a backoff
+	TaskStatusRestarting
 )
 
+// Finished reports whether a task in this status is done running and can
+// be garbage collected
+func (s TaskStatus) Finished() bool {
+	return s == TaskStatusExited || s == TaskStatusCrashed
+}
+
+// Allocated reports whether a task in this status holds its cpu, memory and
+// pids. suspended and finished tasks free theirs for new tasks.
+func (s TaskStatus) Allocated() bool {
+	return s == TaskStatusStarting || s == TaskStatusRunning || s == TaskStatusRestarting
+}
+
 type TaskDefinition struct {
 	AppName        string      `json:"app_name"`
 	DeploymentName string      `json:"deployment_name"`
 	StackName      string      `json:"stack_name"`
 	Image          string      `json:"image"`
-	HealthCheck    string      `json:"health_check"`
+	HealthCheck    TaskHealthCheck `json:"health_check"`
 	Cpu            float64     `json:"cpu"`
 	Memory         int         `json:"memory"`
+	// max processes in the container, defaults to the worker's default
+	Pids           int         `json:"pids"`
+	Schedule       string      `json:"schedule"`
 	ExposedPorts   []string    `json:"exposed_ports"`
+	Disks          []TaskDisk  `json:"disks"`
+	Env            map[string]string `json:"env"`
+	// signal sent to stop the task, defaults to SIGTERM
+	StopSignal     string      `json:"stop_signal"`
+	// how long the task has to exit before it's killed, e.g. "10s"
+	StopGracePeriod string     `json:"stop_grace_period"`
+	// web tasks with an IdleTimeout and without keep alive are suspended
+	// after IdleTimeout without traffic, e.g. "15m"
+	KeepAlive      bool        `json:"keep_alive"`
+	IdleTimeout    string      `json:"idle_timeout"`
+	Restart        TaskRestartPolicy `json:"restart"`
+}
+
+// TaskDisk is a persistent disk mounted into a task's container
+type TaskDisk struct {
+	Name      string `json:"name"`
+	MountPath string `json:"mount_path"`
+	// size in GB
+	Size int `json:"size"`
 }
 
 func NewTask(taskDef TaskDefinition) (*Task, error) {
@@ -38,6 +74,11 @@ func NewTask(taskDef TaskDefinition) (*Task, error) {
 		return nil, err
 	}
 
+	var health TaskHealth
+	if taskDef.HealthCheck.Enabled() {
+		health.Status = HealthStatusStarting
+	}
+
 	return &Task{
 		ID:             ulid.Make(),
 		AppName:        taskDef.AppName,
@@ -46,21 +87,49 @@ func NewTask(taskDef TaskDefinition) (*Task, error) {
 		Status:         TaskStatusPending,
 		CPU:            taskDef.Cpu,
 		Memory:         taskDef.Memory,
+		Pids:           taskDef.Pids,
+		Schedule:       taskDef.Schedule,
 		Image:          imageRef,
+		Disks:          taskDef.Disks,
+		Env:            taskDef.Env,
+		HealthCheck:    taskDef.HealthCheck,
+		StopSignal:     taskDef.StopSignal,
+		StopGracePeriod: taskDef.StopGracePeriod,
+		KeepAlive:      taskDef.KeepAlive,
+		IdleTimeout:    taskDef.IdleTimeout,
+		Restart:        taskDef.Restart,
+		Health:         health,
 	}, nil
 }
 
 type Task struct {
 	ID             ulid.ULID  `json:"id"`
+	// bumped by every write, see CompareAndUpdateTask
+	Revision       uint64     `json:"revision"`
 	AppName        string     `json:"app_name"`
 	DeploymentName string     `json:"deployment_name"`
 	StackName      string     `json:"stack_name"`
 	ContainerID    string     `json:"container_id"`
 	CPU            float64    `json:"cpu"`
 	StartedAt      time.Time  `json:"started_at"`
+	// set when the task exited or crashed
+	FinishedAt     time.Time  `json:"finished_at"`
 	Status         TaskStatus `json:"status"`
 	Memory         int        `json:"memory"`
+	Pids           int        `json:"pids"`
+	Schedule       string     `json:"schedule"`
 	Image          ImageRef   `json:"image"`
+	Disks          []TaskDisk `json:"disks"`
+	Env            map[string]string `json:"env"`
+	HealthCheck    TaskHealthCheck `json:"health_check"`
+	Health         TaskHealth `json:"health"`
+	StopSignal     string     `json:"stop_signal"`
+	StopGracePeriod string    `json:"stop_grace_period"`
+	KeepAlive      bool       `json:"keep_alive"`
+	IdleTimeout    string     `json:"idle_timeout"`
+	Restart        TaskRestartPolicy `json:"restart"`
+	// restarts in a row, reset once the task runs for RestartResetAfter
+	Restarts       int        `json:"restarts"`
   HostPortBindings   map[string]string `json:"host_port_bindings"`
 }
 
@@ -68,6 +137,7 @@ type AggTaskMetrics struct {
 	TotalTasks   int     `json:"total_tasks"`
 	AllocatedCpu float64 `json:"allocated_cpu"`
 	AllocatedMem int     `json:"allocated_mem"`
+	AllocatedPids int    `json:"allocated_pids"`
 }
 
 func (t *Task) QualifiedName() string {
@@ -77,3 +147,10 @@ func (t *Task) QualifiedName() string {
 func (t *Task) Domain() string {
   return fmt.Sprintf("%s.%s.%s", t.AppName, t.DeploymentName, t.StackName)
 }
+
+// VolumeName is the docker volume backing one of the task's disks. it does
+// not include the task id so the volume outlives the task and is picked up
+// again by its replacement.
+func (t *Task) VolumeName(diskName string) string {
+  return fmt.Sprintf("%s--%s", diskName, t.QualifiedName())
+}
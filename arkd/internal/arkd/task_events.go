@@ -0,0 +1,178 @@
+package arkd
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"time"
+
+	"github.com/oklog/ulid/v2"
+	"go.etcd.io/bbolt"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// events are keyed by task id and a sequence number, so a prefix scan
+// returns a task's events oldest first
+var taskEventsBucketName = []byte("TaskEventsBucket")
+
+// DefaultEventRetention is how many events are kept per task
+const DefaultEventRetention = 100
+
+// TaskEvent is a status transition of a task
+type TaskEvent struct {
+	TaskID ulid.ULID  `json:"task_id"`
+	At     time.Time  `json:"at"`
+	From   TaskStatus `json:"from"`
+	To     TaskStatus `json:"to"`
+	Reason string     `json:"reason"`
+	// set when the transition was caused by the container exiting
+	ExitCode  *int `json:"exit_code,omitempty"`
+	OOMKilled bool `json:"oom_killed,omitempty"`
+}
+
+// StatusChange describes why a task's status changed. it's recorded as a
+// TaskEvent along with the new status.
+type StatusChange struct {
+	Reason    string
+	ExitCode  *int
+	OOMKilled bool
+}
+
+type taskStoreOptions struct {
+	// events kept per task
+	eventRetention int
+}
+
+type TaskStoreOption func(o *taskStoreOptions)
+
+func newTaskStoreOptions(opts []TaskStoreOption) taskStoreOptions {
+	o := taskStoreOptions{
+		eventRetention: DefaultEventRetention,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	return o
+}
+
+// WithEventRetention sets how many events are kept per task. older events
+// are dropped as new ones are recorded.
+func WithEventRetention(n int) TaskStoreOption {
+	return func(o *taskStoreOptions) {
+		if n > 0 {
+			o.eventRetention = n
+		}
+	}
+}
+
+// stampFinishedAt sets when the task finished, keeping the time from old if
+// it had already finished
+func stampFinishedAt(old *Task, task *Task) {
+	switch {
+	case !task.Status.Finished():
+		task.FinishedAt = time.Time{}
+	case old != nil && old.Status.Finished() && !old.FinishedAt.IsZero():
+		task.FinishedAt = old.FinishedAt
+	case task.FinishedAt.IsZero():
+		task.FinishedAt = time.Now().UTC()
+	}
+}
+
+// statusEvent is the event recorded when task replaces old, if its status
+// changed. old is nil for new tasks.
+func statusEvent(old *Task, task Task, change StatusChange) (TaskEvent, bool) {
+	if old != nil && old.Status == task.Status {
+		return TaskEvent{}, false
+	}
+
+	event := TaskEvent{
+		TaskID:    task.ID,
+		At:        time.Now(),
+		To:        task.Status,
+		Reason:    change.Reason,
+		ExitCode:  change.ExitCode,
+		OOMKilled: change.OOMKilled,
+	}
+	if old != nil {
+		event.From = old.Status
+	}
+
+	return event, true
+}
+
+// GetTaskEvents returns the events of a task, oldest first
+func (ts *BoltTaskStore) GetTaskEvents(ctx context.Context, taskId ulid.ULID) ([]TaskEvent, error) {
+  var span trace.Span
+  ctx, span = ts.tracer.Start(ctx, "task_store.get_task_events")
+  defer span.End()
+
+	events := make([]TaskEvent, 0)
+	err := ts.db.View(func(tx *bbolt.Tx) error {
+		c := tx.Bucket(taskEventsBucketName).Cursor()
+		prefix := taskId.Bytes()
+
+		for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+			var event TaskEvent
+			if err := decodeRecord(v, &event); err != nil {
+				return err
+			}
+			events = append(events, event)
+		}
+
+		return nil
+	})
+
+	return events, err
+}
+
+// appendTaskEvent records event and drops the task's oldest events beyond
+// the retention
+func (ts *BoltTaskStore) appendTaskEvent(tx *bbolt.Tx, event TaskEvent) error {
+	b := tx.Bucket(taskEventsBucketName)
+
+	seq, err := b.NextSequence()
+	if err != nil {
+		return err
+	}
+
+	buf, err := encodeRecord(event)
+	if err != nil {
+		return err
+	}
+	if err := b.Put(taskEventKey(event.TaskID, seq), buf); err != nil {
+		return err
+	}
+
+	return trimTaskEvents(tx, event.TaskID, ts.opts.eventRetention)
+}
+
+func trimTaskEvents(tx *bbolt.Tx, taskId ulid.ULID, keep int) error {
+	c := tx.Bucket(taskEventsBucketName).Cursor()
+	prefix := taskId.Bytes()
+
+	var keys [][]byte
+	for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+		keys = append(keys, append([]byte{}, k...))
+	}
+
+	b := tx.Bucket(taskEventsBucketName)
+	for i := 0; i < len(keys)-keep; i++ {
+		if err := b.Delete(keys[i]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func deleteTaskEvents(tx *bbolt.Tx, taskId ulid.ULID) error {
+	return trimTaskEvents(tx, taskId, 0)
+}
+
+func taskEventKey(taskId ulid.ULID, seq uint64) []byte {
+	key := make([]byte, len(taskId), len(taskId)+8)
+	copy(key, taskId[:])
+
+	return binary.BigEndian.AppendUint64(key, seq)
+}
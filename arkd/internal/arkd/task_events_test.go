@@ -0,0 +1,107 @@
+package arkd
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"go.etcd.io/bbolt"
+)
+
+func Test_TaskStore_TaskEvents(t *testing.T) {
+	ctx := context.Background()
+	ts, _ := newTestTaskStore(t)
+
+	task, err := ts.CreateTask(ctx, TaskDefinition{AppName: "web", Image: "ubuntu"})
+	if err != nil {
+		t.Fatalf("CreateTask() error = %v", err)
+	}
+
+	exitCode := 137
+	changes := []struct {
+		status TaskStatus
+		change StatusChange
+	}{
+		{TaskStatusRunning, StatusChange{Reason: "container started"}},
+		// unchanged status, no event
+		{TaskStatusRunning, StatusChange{Reason: "container started"}},
+		{TaskStatusExited, StatusChange{Reason: "container killed, out of memory", ExitCode: &exitCode, OOMKilled: true}},
+	}
+	for _, c := range changes {
+		if err := ts.SetTaskStatus(ctx, task, c.status, c.change); err != nil {
+			t.Fatalf("SetTaskStatus() error = %v", err)
+		}
+	}
+
+	events, err := ts.GetTaskEvents(ctx, task.ID)
+	if err != nil {
+		t.Fatalf("GetTaskEvents() error = %v", err)
+	}
+
+	want := []TaskEvent{
+		{From: TaskStatusUnknown, To: TaskStatusPending, Reason: "task created"},
+		{From: TaskStatusPending, To: TaskStatusRunning, Reason: "container started"},
+		{From: TaskStatusRunning, To: TaskStatusExited, Reason: "container killed, out of memory", ExitCode: &exitCode, OOMKilled: true},
+	}
+	if len(events) != len(want) {
+		t.Fatalf("GetTaskEvents() returned %d events, want %d: %+v", len(events), len(want), events)
+	}
+	for i, e := range events {
+		w := want[i]
+		if e.TaskID != task.ID || e.From != w.From || e.To != w.To || e.Reason != w.Reason || e.OOMKilled != w.OOMKilled {
+			t.Errorf("event %d = %+v, want %+v", i, e, w)
+		}
+		if (e.ExitCode == nil) != (w.ExitCode == nil) || (e.ExitCode != nil && *e.ExitCode != *w.ExitCode) {
+			t.Errorf("event %d exit code = %v, want %v", i, e.ExitCode, w.ExitCode)
+		}
+	}
+
+	if err := ts.DeleteTask(ctx, task.ID); err != nil {
+		t.Fatalf("DeleteTask() error = %v", err)
+	}
+	events, err = ts.GetTaskEvents(ctx, task.ID)
+	if err != nil {
+		t.Fatalf("GetTaskEvents() error = %v", err)
+	}
+	if len(events) != 0 {
+		t.Errorf("GetTaskEvents() after delete returned %d events, want 0", len(events))
+	}
+}
+
+func Test_TaskStore_TaskEvents_retention(t *testing.T) {
+	ctx := context.Background()
+
+	db, err := bbolt.Open(filepath.Join(t.TempDir(), "arkd.db"), 0600, &bbolt.Options{Timeout: time.Second})
+	if err != nil {
+		t.Fatalf("bbolt.Open() error = %v", err)
+	}
+	defer db.Close()
+
+	ts, err := NewBoltTaskStore(db, zerolog.Nop(), WithEventRetention(3))
+	if err != nil {
+		t.Fatalf("NewBoltTaskStore() error = %v", err)
+	}
+
+	task, err := ts.CreateTask(ctx, TaskDefinition{AppName: "web", Image: "ubuntu"})
+	if err != nil {
+		t.Fatalf("CreateTask() error = %v", err)
+	}
+	for _, status := range []TaskStatus{TaskStatusImagePull, TaskStatusCreating, TaskStatusStarting, TaskStatusRunning} {
+		if err := ts.SetTaskStatus(ctx, task, status, StatusChange{}); err != nil {
+			t.Fatalf("SetTaskStatus() error = %v", err)
+		}
+	}
+
+	events, err := ts.GetTaskEvents(ctx, task.ID)
+	if err != nil {
+		t.Fatalf("GetTaskEvents() error = %v", err)
+	}
+	if len(events) != 3 {
+		t.Fatalf("GetTaskEvents() returned %d events, want 3", len(events))
+	}
+	if events[0].To != TaskStatusCreating || events[2].To != TaskStatusRunning {
+		t.Errorf("GetTaskEvents() kept %+v, want the 3 newest events", events)
+	}
+}
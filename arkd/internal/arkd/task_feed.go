@@ -0,0 +1,279 @@
+package arkd
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"sync"
+
+	"go.etcd.io/bbolt"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// every task write appends a change keyed by its revision, so watchers can
+// resume from the revision they last saw
+var taskChangesBucketName = []byte("TaskChangesBucket")
+
+// changes kept in the change log. watchers further behind have to list
+// tasks again.
+const ChangeLogRetention = 1000
+
+// buffered changes per watcher before it's dropped for falling behind
+const watchBufferSize = 256
+
+var (
+	ErrRevisionCompacted = errors.New("task store: revision is no longer in the change log")
+	ErrWatchLagged       = errors.New("task store: watcher fell behind")
+)
+
+type TaskChangeType string
+
+const (
+	TaskChangeCreate TaskChangeType = "create"
+	TaskChangeUpdate TaskChangeType = "update"
+	TaskChangeDelete TaskChangeType = "delete"
+)
+
+// TaskChange is a write to the task store. revisions increase by one with
+// every change.
+type TaskChange struct {
+	Revision uint64         `json:"revision"`
+	Type     TaskChangeType `json:"type"`
+	// the task after the change, or the deleted task
+	Task Task `json:"task"`
+}
+
+// TaskWatch delivers changes in revision order. C is closed when the watch
+// ends, after which Err says why.
+type TaskWatch struct {
+	C <-chan TaskChange
+
+	mtx sync.Mutex
+	err error
+}
+
+func (w *TaskWatch) Err() error {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+
+	return w.err
+}
+
+func (w *TaskWatch) setErr(err error) {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+
+	if w.err == nil {
+		w.err = err
+	}
+}
+
+// taskFeed fans committed changes out to watchers. bbolt runs commit
+// handlers after releasing the write lock, so changes can arrive out of
+// order and are held back until every earlier revision has been delivered.
+type taskFeed struct {
+	mtx      sync.Mutex
+	next     uint64
+	pending  map[uint64]TaskChange
+	watchers map[chan TaskChange]*TaskWatch
+}
+
+func newTaskFeed(revision uint64) *taskFeed {
+	return &taskFeed{
+		next:     revision + 1,
+		pending:  make(map[uint64]TaskChange),
+		watchers: make(map[chan TaskChange]*TaskWatch),
+	}
+}
+
+func (f *taskFeed) publish(change TaskChange) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	f.pending[change.Revision] = change
+	for {
+		c, ok := f.pending[f.next]
+		if !ok {
+			return
+		}
+		delete(f.pending, f.next)
+		f.next++
+
+		for ch, w := range f.watchers {
+			select {
+			case ch <- c:
+			default:
+				w.setErr(ErrWatchLagged)
+				delete(f.watchers, ch)
+				close(ch)
+			}
+		}
+	}
+}
+
+func (f *taskFeed) subscribe() (chan TaskChange, *TaskWatch) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	ch := make(chan TaskChange, watchBufferSize)
+	w := &TaskWatch{}
+	f.watchers[ch] = w
+
+	return ch, w
+}
+
+func (f *taskFeed) unsubscribe(ch chan TaskChange) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	if _, ok := f.watchers[ch]; ok {
+		delete(f.watchers, ch)
+		close(ch)
+	}
+}
+
+// Revision returns the revision of the latest change
+func (ts *BoltTaskStore) Revision(ctx context.Context) (uint64, error) {
+  var span trace.Span
+  ctx, span = ts.tracer.Start(ctx, "task_store.revision")
+  defer span.End()
+
+	var rev uint64
+	err := ts.db.View(func(tx *bbolt.Tx) error {
+		rev = tx.Bucket(taskChangesBucketName).Sequence()
+		return nil
+	})
+
+	return rev, err
+}
+
+// Watch streams every change after revision since. changes still in the
+// change log are replayed first. it fails with ErrRevisionCompacted if
+// changes after since were already dropped from the log, or since is past
+// the current revision.
+func (ts *BoltTaskStore) Watch(ctx context.Context, since uint64) (*TaskWatch, error) {
+	// subscribe before reading the log so nothing committed in between is
+	// missed. duplicates are skipped by revision below.
+	live, liveWatch := ts.feed.subscribe()
+
+	var backlog []TaskChange
+	err := ts.db.View(func(tx *bbolt.Tx) error {
+		b := tx.Bucket(taskChangesBucketName)
+		// revisions only go backwards when the database was restored from
+		// a snapshot, the watcher has to list tasks again
+		if since > b.Sequence() {
+			return ErrRevisionCompacted
+		}
+
+		c := b.Cursor()
+		if k, _ := c.First(); k != nil && binary.BigEndian.Uint64(k) > since+1 {
+			return ErrRevisionCompacted
+		}
+
+		for k, v := c.Seek(revisionKey(since + 1)); k != nil; k, v = c.Next() {
+			var change TaskChange
+			if err := decodeRecord(v, &change); err != nil {
+				return err
+			}
+			backlog = append(backlog, change)
+		}
+
+		return nil
+	})
+	if err != nil {
+		ts.feed.unsubscribe(live)
+		return nil, err
+	}
+
+	return ts.feed.stream(ctx, live, liveWatch, since, backlog), nil
+}
+
+// stream sends backlog and then the changes on live, a subscription taken
+// before the backlog was read, skipping anything at or before since
+func (f *taskFeed) stream(ctx context.Context, live chan TaskChange, liveWatch *TaskWatch, since uint64, backlog []TaskChange) *TaskWatch {
+	out := make(chan TaskChange)
+	w := &TaskWatch{C: out}
+
+	go func() {
+		defer close(out)
+		defer f.unsubscribe(live)
+
+		last := since
+		send := func(change TaskChange) bool {
+			if change.Revision <= last {
+				return true
+			}
+			select {
+			case out <- change:
+				last = change.Revision
+				return true
+			case <-ctx.Done():
+				w.setErr(ctx.Err())
+				return false
+			}
+		}
+
+		for _, change := range backlog {
+			if !send(change) {
+				return
+			}
+		}
+
+		for {
+			select {
+			case change, ok := <-live:
+				if !ok {
+					w.setErr(liveWatch.Err())
+					return
+				}
+				if !send(change) {
+					return
+				}
+			case <-ctx.Done():
+				w.setErr(ctx.Err())
+				return
+			}
+		}
+	}()
+
+	return w
+}
+
+// appendTaskChange adds a change to the log and publishes it to watchers
+// once the transaction commits
+func (ts *BoltTaskStore) appendTaskChange(tx *bbolt.Tx, changeType TaskChangeType, task Task) error {
+	b := tx.Bucket(taskChangesBucketName)
+
+	rev, err := b.NextSequence()
+	if err != nil {
+		return err
+	}
+
+	change := TaskChange{Revision: rev, Type: changeType, Task: task}
+	buf, err := encodeRecord(change)
+	if err != nil {
+		return err
+	}
+	if err := b.Put(revisionKey(rev), buf); err != nil {
+		return err
+	}
+
+	// revisions are dense, so anything older than the retention is dropped
+	var expired [][]byte
+	c := b.Cursor()
+	for k, _ := c.First(); k != nil && binary.BigEndian.Uint64(k)+ChangeLogRetention <= rev; k, _ = c.Next() {
+		expired = append(expired, append([]byte{}, k...))
+	}
+	for _, k := range expired {
+		if err := b.Delete(k); err != nil {
+			return err
+		}
+	}
+
+	tx.OnCommit(func() { ts.feed.publish(change) })
+	return nil
+}
+
+func revisionKey(rev uint64) []byte {
+	return binary.BigEndian.AppendUint64(nil, rev)
+}
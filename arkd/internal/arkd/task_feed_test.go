@@ -0,0 +1,160 @@
+package arkd
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"go.etcd.io/bbolt"
+)
+
+// next reads a change from the watch or fails the test after a second
+func next(t *testing.T, w *TaskWatch) TaskChange {
+	t.Helper()
+
+	select {
+	case change, ok := <-w.C:
+		if !ok {
+			t.Fatalf("watch closed: %v", w.Err())
+		}
+		return change
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for a change")
+	}
+
+	return TaskChange{}
+}
+
+func Test_TaskStore_Watch(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ts, _ := newTestTaskStore(t)
+
+	task, err := ts.CreateTask(ctx, TaskDefinition{AppName: "web", Image: "ubuntu"})
+	if err != nil {
+		t.Fatalf("CreateTask() error = %v", err)
+	}
+	if err := ts.SetTaskStatus(ctx, task, TaskStatusRunning, StatusChange{Reason: "container started"}); err != nil {
+		t.Fatalf("SetTaskStatus() error = %v", err)
+	}
+
+	rev, err := ts.Revision(ctx)
+	if err != nil {
+		t.Fatalf("Revision() error = %v", err)
+	}
+	if rev != 2 {
+		t.Fatalf("Revision() = %d, want 2", rev)
+	}
+
+	// replays the log after since, then follows live writes
+	w, err := ts.Watch(ctx, 0)
+	if err != nil {
+		t.Fatalf("Watch() error = %v", err)
+	}
+
+	if c := next(t, w); c.Revision != 1 || c.Type != TaskChangeCreate || c.Task.Status != TaskStatusPending {
+		t.Errorf("change 1 = %+v", c)
+	}
+	if c := next(t, w); c.Revision != 2 || c.Type != TaskChangeUpdate || c.Task.Status != TaskStatusRunning {
+		t.Errorf("change 2 = %+v", c)
+	}
+
+	// writes that don't change the task aren't changes
+	if err := ts.SetTaskStatus(ctx, task, TaskStatusRunning, StatusChange{Reason: "container started"}); err != nil {
+		t.Fatalf("SetTaskStatus() error = %v", err)
+	}
+	if err := ts.DeleteTask(ctx, task.ID); err != nil {
+		t.Fatalf("DeleteTask() error = %v", err)
+	}
+	if c := next(t, w); c.Revision != 3 || c.Type != TaskChangeDelete || c.Task.ID != task.ID {
+		t.Errorf("change 3 = %+v", c)
+	}
+
+	// resuming from a revision skips what was already seen
+	resumed, err := ts.Watch(ctx, 2)
+	if err != nil {
+		t.Fatalf("Watch() error = %v", err)
+	}
+	if c := next(t, resumed); c.Revision != 3 {
+		t.Errorf("resumed change = %+v, want revision 3", c)
+	}
+
+	cancel()
+	for range w.C {
+	}
+	if !errors.Is(w.Err(), context.Canceled) {
+		t.Errorf("Err() = %v, want %v", w.Err(), context.Canceled)
+	}
+}
+
+func Test_TaskStore_Watch_order(t *testing.T) {
+	ctx := context.Background()
+	ts, _ := newTestTaskStore(t)
+
+	w, err := ts.Watch(ctx, 0)
+	if err != nil {
+		t.Fatalf("Watch() error = %v", err)
+	}
+
+	const writers, writes = 4, 10
+	errs := make(chan error, writers)
+	for i := 0; i < writers; i++ {
+		go func() {
+			for j := 0; j < writes; j++ {
+				if _, err := ts.CreateTask(ctx, TaskDefinition{AppName: "web", Image: "ubuntu"}); err != nil {
+					errs <- err
+					return
+				}
+			}
+			errs <- nil
+		}()
+	}
+	for i := 0; i < writers; i++ {
+		if err := <-errs; err != nil {
+			t.Fatalf("CreateTask() error = %v", err)
+		}
+	}
+
+	for rev := uint64(1); rev <= writers*writes; rev++ {
+		if c := next(t, w); c.Revision != rev {
+			t.Fatalf("change revision = %d, want %d", c.Revision, rev)
+		}
+	}
+}
+
+func Test_TaskStore_Watch_compacted(t *testing.T) {
+	ctx := context.Background()
+	ts, db := newTestTaskStore(t)
+
+	task, err := ts.CreateTask(ctx, TaskDefinition{AppName: "web", Image: "ubuntu"})
+	if err != nil {
+		t.Fatalf("CreateTask() error = %v", err)
+	}
+
+	// push the first changes out of the log
+	err = db.Update(func(tx *bbolt.Tx) error {
+		for i := 0; i < ChangeLogRetention+1; i++ {
+			task.CPU = float64(i)
+			if _, err := ts.putTask(tx, task, StatusChange{}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := ts.Watch(ctx, 0); !errors.Is(err, ErrRevisionCompacted) {
+		t.Errorf("Watch(0) error = %v, want %v", err, ErrRevisionCompacted)
+	}
+
+	rev, err := ts.Revision(ctx)
+	if err != nil {
+		t.Fatalf("Revision() error = %v", err)
+	}
+	if _, err := ts.Watch(ctx, rev-ChangeLogRetention); err != nil {
+		t.Errorf("Watch(oldest) error = %v", err)
+	}
+}
@@ -0,0 +1,237 @@
+package arkd
+
+import (
+	"bytes"
+	"context"
+	"sort"
+	"strconv"
+
+	"github.com/oklog/ulid/v2"
+	"go.etcd.io/bbolt"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// indexes live in a bucket per index inside indexesBucketName. keys are the
+// indexed value, a 0 byte and the task id, so a prefix scan finds every
+// task with a value. values are empty.
+var indexesBucketName = []byte("TaskIndexesBucket")
+
+type taskIndex struct {
+	name  []byte
+	value func(t Task) string
+}
+
+var (
+	deploymentIndex = taskIndex{name: []byte("deployment"), value: func(t Task) string { return t.DeploymentName }}
+	stackIndex      = taskIndex{name: []byte("stack"), value: func(t Task) string { return t.StackName }}
+	appIndex        = taskIndex{name: []byte("app"), value: func(t Task) string { return t.AppName }}
+	statusIndex     = taskIndex{name: []byte("status"), value: func(t Task) string { return strconv.Itoa(int(t.Status)) }}
+
+	taskIndexes = []taskIndex{deploymentIndex, stackIndex, appIndex, statusIndex}
+)
+
+// TaskFilter narrows FindTasks. empty fields match every task.
+type TaskFilter struct {
+	AppName        string
+	StackName      string
+	DeploymentName string
+	// matches tasks in any of the statuses
+	Statuses []TaskStatus
+}
+
+func (f TaskFilter) empty() bool {
+	return f.AppName == "" && f.StackName == "" && f.DeploymentName == "" && len(f.Statuses) == 0
+}
+
+func (f TaskFilter) matches(t Task) bool {
+	if f.AppName != "" && t.AppName != f.AppName {
+		return false
+	}
+	if f.StackName != "" && t.StackName != f.StackName {
+		return false
+	}
+	if f.DeploymentName != "" && t.DeploymentName != f.DeploymentName {
+		return false
+	}
+	if len(f.Statuses) == 0 {
+		return true
+	}
+	for _, s := range f.Statuses {
+		if t.Status == s {
+			return true
+		}
+	}
+
+	return false
+}
+
+// FindTasks returns the tasks matching filter, oldest first, using the
+// index buckets instead of scanning every task
+func (ts *BoltTaskStore) FindTasks(ctx context.Context, filter TaskFilter) ([]Task, error) {
+  var span trace.Span
+  ctx, span = ts.tracer.Start(ctx, "task_store.find_tasks")
+  defer span.End()
+
+	if filter.empty() {
+		return ts.GetTasks(ctx)
+	}
+
+	type lookup struct {
+		index  taskIndex
+		values []string
+	}
+	var lookups []lookup
+	if filter.DeploymentName != "" {
+		lookups = append(lookups, lookup{deploymentIndex, []string{filter.DeploymentName}})
+	}
+	if filter.StackName != "" {
+		lookups = append(lookups, lookup{stackIndex, []string{filter.StackName}})
+	}
+	if filter.AppName != "" {
+		lookups = append(lookups, lookup{appIndex, []string{filter.AppName}})
+	}
+	if len(filter.Statuses) > 0 {
+		statuses := make([]string, len(filter.Statuses))
+		for i, s := range filter.Statuses {
+			statuses[i] = strconv.Itoa(int(s))
+		}
+		lookups = append(lookups, lookup{statusIndex, statuses})
+	}
+
+	tasks := make([]Task, 0)
+	err := ts.db.View(func(tx *bbolt.Tx) error {
+		var ids map[ulid.ULID]struct{}
+		for _, l := range lookups {
+			found := make(map[ulid.ULID]struct{})
+			for _, v := range l.values {
+				for _, id := range scanIndex(tx, l.index, v) {
+					if _, ok := ids[id]; ids == nil || ok {
+						found[id] = struct{}{}
+					}
+				}
+			}
+			ids = found
+
+			if len(ids) == 0 {
+				return nil
+			}
+		}
+
+		sorted := make([]ulid.ULID, 0, len(ids))
+		for id := range ids {
+			sorted = append(sorted, id)
+		}
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i].Compare(sorted[j]) < 0 })
+
+		b := tx.Bucket(tasksBucketName)
+		for _, id := range sorted {
+			task, err := readTaskBytes(b.Get(id.Bytes()))
+			if err != nil {
+				return err
+			}
+			tasks = append(tasks, task)
+		}
+
+		return nil
+	})
+
+	return tasks, err
+}
+
+// RebuildIndexes drops and recreates every index from the tasks bucket
+func (ts *BoltTaskStore) RebuildIndexes(ctx context.Context) error {
+  var span trace.Span
+  ctx, span = ts.tracer.Start(ctx, "task_store.rebuild_indexes")
+  defer span.End()
+
+	return ts.db.Update(func(tx *bbolt.Tx) error {
+		n, err := rebuildIndexes(tx)
+		if err != nil {
+			return err
+		}
+
+		ts.logger.Info().Int("tasks", n).Msg("rebuilt task indexes")
+		return nil
+	})
+}
+
+func rebuildIndexes(tx *bbolt.Tx) (int, error) {
+	if err := tx.DeleteBucket(indexesBucketName); err != nil && err != bbolt.ErrBucketNotFound {
+		return 0, err
+	}
+	if err := createIndexBuckets(tx); err != nil {
+		return 0, err
+	}
+
+	tasks, err := listTasksFromBucket(tx)
+	if err != nil {
+		return 0, err
+	}
+	for i := range tasks {
+		if err := updateIndexes(tx, nil, &tasks[i]); err != nil {
+			return 0, err
+		}
+	}
+
+	return len(tasks), nil
+}
+
+func createIndexBuckets(tx *bbolt.Tx) error {
+	root, err := tx.CreateBucketIfNotExists(indexesBucketName)
+	if err != nil {
+		return err
+	}
+
+	for _, idx := range taskIndexes {
+		if _, err := root.CreateBucketIfNotExists(idx.name); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// updateIndexes moves a task's index entries from old to new. old is nil
+// for new tasks and new is nil for deleted ones.
+func updateIndexes(tx *bbolt.Tx, old, new *Task) error {
+	root := tx.Bucket(indexesBucketName)
+
+	for _, idx := range taskIndexes {
+		b := root.Bucket(idx.name)
+
+		if old != nil && (new == nil || idx.value(*old) != idx.value(*new)) {
+			if err := b.Delete(indexKey(idx.value(*old), old.ID)); err != nil {
+				return err
+			}
+		}
+		if new != nil {
+			if err := b.Put(indexKey(idx.value(*new), new.ID), []byte{}); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func scanIndex(tx *bbolt.Tx, idx taskIndex, value string) []ulid.ULID {
+	c := tx.Bucket(indexesBucketName).Bucket(idx.name).Cursor()
+	prefix := indexKey(value, ulid.ULID{})[:len(value)+1]
+
+	var ids []ulid.ULID
+	for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+		var id ulid.ULID
+		copy(id[:], k[len(prefix):])
+		ids = append(ids, id)
+	}
+
+	return ids
+}
+
+func indexKey(value string, id ulid.ULID) []byte {
+	key := make([]byte, 0, len(value)+1+len(id))
+	key = append(key, value...)
+	key = append(key, 0)
+
+	return append(key, id[:]...)
+}
@@ -0,0 +1,111 @@
+package arkd
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"go.etcd.io/bbolt"
+)
+
+func newTestTaskStore(t *testing.T) (*BoltTaskStore, *bbolt.DB) {
+	t.Helper()
+
+	db, err := bbolt.Open(filepath.Join(t.TempDir(), "arkd.db"), 0600, &bbolt.Options{Timeout: time.Second})
+	if err != nil {
+		t.Fatalf("bbolt.Open() error = %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	ts, err := NewBoltTaskStore(db, zerolog.Nop())
+	if err != nil {
+		t.Fatalf("NewBoltTaskStore() error = %v", err)
+	}
+
+	return ts, db
+}
+
+func Test_TaskStore_FindTasks(t *testing.T) {
+	ctx := context.Background()
+	ts, db := newTestTaskStore(t)
+
+	create := func(app, deployment string) *Task {
+		task, err := ts.CreateTask(ctx, TaskDefinition{
+			AppName:        app,
+			DeploymentName: deployment,
+			StackName:      "babies-first-ark",
+			Image:          "ubuntu",
+		})
+		if err != nil {
+			t.Fatalf("CreateTask() error = %v", err)
+		}
+		return task
+	}
+
+	webMain := create("web", "main")
+	apiMain := create("api", "main")
+	webPreview := create("web", "preview")
+
+	if err := ts.SetTaskStatus(ctx, apiMain, TaskStatusRunning, StatusChange{}); err != nil {
+		t.Fatalf("SetTaskStatus() error = %v", err)
+	}
+	if err := ts.DeleteTask(ctx, webPreview.ID); err != nil {
+		t.Fatalf("DeleteTask() error = %v", err)
+	}
+
+	assertFound := func(t *testing.T, filter TaskFilter, want ...*Task) {
+		t.Helper()
+
+		got, err := ts.FindTasks(ctx, filter)
+		if err != nil {
+			t.Fatalf("FindTasks() error = %v", err)
+		}
+		if len(got) != len(want) {
+			t.Fatalf("FindTasks(%+v) returned %d tasks, want %d", filter, len(got), len(want))
+		}
+		for i := range want {
+			if got[i].ID != want[i].ID {
+				t.Errorf("FindTasks(%+v)[%d] = %s, want %s", filter, i, got[i].ID, want[i].ID)
+			}
+		}
+	}
+
+	tests := []struct {
+		name   string
+		filter TaskFilter
+		want   []*Task
+	}{
+		{"all", TaskFilter{}, []*Task{webMain, apiMain}},
+		{"deployment", TaskFilter{DeploymentName: "main"}, []*Task{webMain, apiMain}},
+		{"deleted", TaskFilter{DeploymentName: "preview"}, nil},
+		{"app_and_stack", TaskFilter{AppName: "web", StackName: "babies-first-ark"}, []*Task{webMain}},
+		{"status", TaskFilter{Statuses: []TaskStatus{TaskStatusRunning}}, []*Task{apiMain}},
+		{"old_status", TaskFilter{Statuses: []TaskStatus{TaskStatusPending}}, []*Task{webMain}},
+		{"any_status", TaskFilter{Statuses: []TaskStatus{TaskStatusPending, TaskStatusRunning}}, []*Task{webMain, apiMain}},
+		{"no_match", TaskFilter{AppName: "api", DeploymentName: "preview"}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assertFound(t, tt.filter, tt.want...)
+		})
+	}
+
+	t.Run("rebuild", func(t *testing.T) {
+		// indexes lost, e.g. after restoring only the tasks bucket
+		err := db.Update(func(tx *bbolt.Tx) error {
+			return tx.DeleteBucket(indexesBucketName)
+		})
+		if err != nil {
+			t.Fatalf("DeleteBucket() error = %v", err)
+		}
+
+		if err := ts.RebuildIndexes(ctx); err != nil {
+			t.Fatalf("RebuildIndexes() error = %v", err)
+		}
+
+		assertFound(t, TaskFilter{DeploymentName: "main"}, webMain, apiMain)
+		assertFound(t, TaskFilter{Statuses: []TaskStatus{TaskStatusRunning}}, apiMain)
+	})
+}
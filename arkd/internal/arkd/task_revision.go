@@ -0,0 +1,149 @@
+package arkd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/oklog/ulid/v2"
+	"go.etcd.io/bbolt"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var ErrTaskConflict = errors.New("task store: task was changed by someone else")
+
+// TaskConflictError is returned by the compare-and-swap writes when the
+// stored task is at a different revision than the caller's copy. reload the
+// task and try again.
+type TaskConflictError struct {
+	TaskID   ulid.ULID
+	Expected uint64
+	Actual   uint64
+}
+
+func (e *TaskConflictError) Error() string {
+	return fmt.Sprintf("%s: task %s is at revision %d, expected %d", ErrTaskConflict, e.TaskID, e.Actual, e.Expected)
+}
+
+func (e *TaskConflictError) Unwrap() error {
+	return ErrTaskConflict
+}
+
+// CompareAndUpdateTask overwrites the stored task if it's still at
+// task.Revision, and sets task.Revision to the new revision
+func (ts *BoltTaskStore) CompareAndUpdateTask(ctx context.Context, task *Task) error {
+  var span trace.Span
+  ctx, span = ts.tracer.Start(ctx, "task_store.compare_and_update_task")
+  defer span.End()
+
+	return ts.updateTask(ctx, task, true)
+}
+
+// CompareAndSetTaskStatus moves the task to status if it's still at
+// task.Revision, and sets task.Revision to the new revision
+func (ts *BoltTaskStore) CompareAndSetTaskStatus(ctx context.Context, task *Task, status TaskStatus, change StatusChange) error {
+  var span trace.Span
+  ctx, span = ts.tracer.Start(ctx, "task_store.compare_and_set_task_status")
+  defer span.End()
+
+	return ts.setTaskStatus(ctx, task, status, change, true)
+}
+
+// CompareAndDeleteTask deletes the task if it's still at task.Revision
+func (ts *BoltTaskStore) CompareAndDeleteTask(ctx context.Context, task *Task) error {
+  var span trace.Span
+  ctx, span = ts.tracer.Start(ctx, "task_store.compare_and_delete_task")
+  defer span.End()
+
+	var old *Task
+	err := ts.db.Update(func(tx *bbolt.Tx) error {
+		if _, err := loadTask(tx, task.ID, &task.Revision); err != nil {
+			return err
+		}
+
+		var err error
+		old, err = ts.removeTask(tx, task.ID)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	if old != nil {
+		ts.applyAggDelta(ctx, old, nil)
+		ts.tasksCountUpDown.Add(ctx, -1)
+	}
+	return nil
+}
+
+func (ts *BoltTaskStore) updateTask(ctx context.Context, task *Task, compare bool) error {
+	t := *task
+
+	var old *Task
+	err := ts.db.Update(func(tx *bbolt.Tx) error {
+		if compare {
+			if _, err := loadTask(tx, task.ID, &task.Revision); err != nil {
+				return err
+			}
+		}
+
+		var err error
+		old, err = ts.putTask(tx, &t, StatusChange{})
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	task.Revision = t.Revision
+	ts.applyAggDelta(ctx, old, task)
+	return nil
+}
+
+func (ts *BoltTaskStore) setTaskStatus(ctx context.Context, task *Task, status TaskStatus, change StatusChange, compare bool) error {
+	var expected *uint64
+	if compare {
+		expected = &task.Revision
+	}
+
+	var old, t Task
+	err := ts.db.Update(func(tx *bbolt.Tx) error {
+		var err error
+		t, err = loadTask(tx, task.ID, expected)
+		if err != nil {
+			return err
+		}
+
+		old = t
+		t.Status = status
+		_, err = ts.putTask(tx, &t, change)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	// the whole record, a copy that only got the new revision would pass
+	// the next compare and swap with stale fields
+	*task = t
+	ts.applyAggDelta(ctx, &old, &t)
+	return nil
+}
+
+// loadTask reads a task for a write. if expected isn't nil the task has to
+// be at that revision.
+func loadTask(tx *bbolt.Tx, id ulid.ULID, expected *uint64) (Task, error) {
+	t, err := readTaskBytes(tx.Bucket(tasksBucketName).Get(id.Bytes()))
+	if errors.Is(err, ErrNilTask) {
+		return Task{}, ErrTaskNotFound
+	}
+	if err != nil {
+		return Task{}, err
+	}
+
+	if expected != nil && t.Revision != *expected {
+		return Task{}, &TaskConflictError{TaskID: id, Expected: *expected, Actual: t.Revision}
+	}
+
+	return t, nil
+}
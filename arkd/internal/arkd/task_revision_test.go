@@ -0,0 +1,69 @@
+package arkd
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func Test_TaskStore_CompareAndUpdateTask(t *testing.T) {
+	ctx := context.Background()
+	ts, _ := newTestTaskStore(t)
+
+	task, err := ts.CreateTask(ctx, TaskDefinition{AppName: "web", Image: "ubuntu"})
+	if err != nil {
+		t.Fatalf("CreateTask() error = %v", err)
+	}
+	if task.Revision != 1 {
+		t.Fatalf("created task revision = %d, want 1", task.Revision)
+	}
+
+	// a second copy read at the same revision
+	stale := *task
+
+	task.ContainerID = "c1"
+	if err := ts.CompareAndUpdateTask(ctx, task); err != nil {
+		t.Fatalf("CompareAndUpdateTask() error = %v", err)
+	}
+	if task.Revision != 2 {
+		t.Errorf("revision after update = %d, want 2", task.Revision)
+	}
+
+	stale.ContainerID = "c2"
+	err = ts.CompareAndUpdateTask(ctx, &stale)
+	var conflict *TaskConflictError
+	if !errors.As(err, &conflict) || !errors.Is(err, ErrTaskConflict) {
+		t.Fatalf("CompareAndUpdateTask(stale) error = %v, want a conflict", err)
+	}
+	if conflict.Expected != 1 || conflict.Actual != 2 {
+		t.Errorf("conflict = %+v, want expected 1, actual 2", conflict)
+	}
+
+	if err := ts.CompareAndSetTaskStatus(ctx, &stale, TaskStatusRunning, StatusChange{}); !errors.Is(err, ErrTaskConflict) {
+		t.Errorf("CompareAndSetTaskStatus(stale) error = %v, want %v", err, ErrTaskConflict)
+	}
+
+	got, err := ts.GetTask(ctx, task.ID)
+	if err != nil {
+		t.Fatalf("GetTask() error = %v", err)
+	}
+	if got.ContainerID != "c1" || got.Status != TaskStatusPending || got.Revision != 2 {
+		t.Errorf("stored task = %+v, want the first update only", got)
+	}
+
+	// blind writes keep the caller's copy at the stored revision
+	if err := ts.SetTaskStatus(ctx, &stale, TaskStatusRunning, StatusChange{}); err != nil {
+		t.Fatalf("SetTaskStatus() error = %v", err)
+	}
+	if stale.Revision != 3 {
+		t.Errorf("revision after SetTaskStatus = %d, want 3", stale.Revision)
+	}
+
+	// writes that change nothing keep the revision
+	if err := ts.CompareAndSetTaskStatus(ctx, &stale, TaskStatusRunning, StatusChange{}); err != nil {
+		t.Fatalf("CompareAndSetTaskStatus() error = %v", err)
+	}
+	if stale.Revision != 3 {
+		t.Errorf("revision after no-op write = %d, want 3", stale.Revision)
+	}
+}
@@ -1,11 +1,11 @@
 package arkd
 
 import (
+	"bytes"
 	"context"
-	"encoding/json"
 	"errors"
 	"fmt"
-	"strconv"
+	"io"
 	"sync"
 
 	"github.com/oklog/ulid/v2"
@@ -22,17 +22,43 @@ var otelName = "task_store"
 var ErrTaskNotFound = errors.New("task not found")
 var ErrNilTask = errors.New("nil task")
 
-func NewTaskStore(db *bbolt.DB, logger zerolog.Logger) (*TaskStore, error) {
-	// ensure tasks bucket exists
-	err := db.Update(func(tx *bbolt.Tx) error {
-		_, err := tx.CreateBucket(tasksBucketName)
-		if err != nil && err != bbolt.ErrBucketExists {
-			return fmt.Errorf("create bucket: %s", err)
-		}
+// TaskStore keeps the tasks of a worker along with their status history and
+// a feed of changes. writes bump a task's revision, the CompareAnd variants
+// only write if the caller's copy is still at the stored revision.
+type TaskStore interface {
+	CreateTask(ctx context.Context, taskDef TaskDefinition) (*Task, error)
+	AdoptTask(ctx context.Context, task Task, change StatusChange) error
+	GetTask(ctx context.Context, taskId ulid.ULID) (*Task, error)
+	GetTasks(ctx context.Context) ([]Task, error)
+	FindTasks(ctx context.Context, filter TaskFilter) ([]Task, error)
+	UpdateTask(ctx context.Context, task *Task) error
+	CompareAndUpdateTask(ctx context.Context, task *Task) error
+	SetTaskStatus(ctx context.Context, task *Task, status TaskStatus, change StatusChange) error
+	CompareAndSetTaskStatus(ctx context.Context, task *Task, status TaskStatus, change StatusChange) error
+	RecordHealthCheck(ctx context.Context, taskId ulid.ULID, result HealthCheckResult, inGracePeriod bool) (*Task, error)
+	DeleteTask(ctx context.Context, id ulid.ULID) error
+	CompareAndDeleteTask(ctx context.Context, task *Task) error
+
+	AggMetrics(ctx context.Context) *AggTaskMetrics
+	GetTaskEvents(ctx context.Context, taskId ulid.ULID) ([]TaskEvent, error)
+	Revision(ctx context.Context) (uint64, error)
+	Watch(ctx context.Context, since uint64) (*TaskWatch, error)
+}
 
-		return nil
-	})
-	if err != nil {
+// Snapshotter is implemented by task stores that can write a snapshot of
+// their data, restored with RestoreSnapshot
+type Snapshotter interface {
+	Backup(ctx context.Context, w io.Writer) (int64, error)
+}
+
+var (
+	_ TaskStore   = (*BoltTaskStore)(nil)
+	_ Snapshotter = (*BoltTaskStore)(nil)
+)
+
+func NewBoltTaskStore(db *bbolt.DB, logger zerolog.Logger, opts ...TaskStoreOption) (*BoltTaskStore, error) {
+	// create buckets and upgrade records written by older versions
+	if err := migrateTaskStore(db, logger); err != nil {
 		return nil, err
 	}
 
@@ -46,15 +72,22 @@ func NewTaskStore(db *bbolt.DB, logger zerolog.Logger) (*TaskStore, error) {
     return nil, err
   }
 
-	taskStore := &TaskStore{
+	taskStore := &BoltTaskStore{
 		db:         db,
 		logger:     logger,
 		aggMetrics: &AggTaskMetrics{},
+		opts:       newTaskStoreOptions(opts),
     tracer: otel.Tracer(otelName),
     tasksCountGauge: tasksCountGauge,
     tasksCountUpDown: tasksCountUpDown,
 	}
 
+	rev, err := taskStore.Revision(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	taskStore.feed = newTaskFeed(rev)
+
 	tasks, err := taskStore.GetTasks(context.Background())
 	if err != nil {
 		return nil, err
@@ -66,11 +99,14 @@ func NewTaskStore(db *bbolt.DB, logger zerolog.Logger) (*TaskStore, error) {
 	return taskStore, nil
 }
 
-type TaskStore struct {
+// BoltTaskStore keeps tasks in a bbolt database
+type BoltTaskStore struct {
 	db         *bbolt.DB
 	logger     zerolog.Logger
 	metricsMtx sync.RWMutex
 	aggMetrics *AggTaskMetrics
+	opts       taskStoreOptions
+	feed       *taskFeed
 
   // observability
   tracer trace.Tracer
@@ -78,15 +114,21 @@ type TaskStore struct {
   tasksCountUpDown metric.Int64UpDownCounter
 }
 
-// heads up, this locks the metrics mutex and is potentially called
-// within a bolt tx. this might cause deadlocks
-func (ts *TaskStore) updateAggMetrics(ctx context.Context, tasks []Task) error {
+// updateAggMetrics recomputes the aggregates from every task, only the ones
+// with an allocated status count towards the allocation. it's only used on
+// startup, writes apply a delta with applyAggDelta instead.
+func (ts *BoltTaskStore) updateAggMetrics(ctx context.Context, tasks []Task) error {
 	allocCpu := 0.0
 	allocMem := 0
+	allocPids := 0
 
 	for _, t := range tasks {
+		if !t.Status.Allocated() {
+			continue
+		}
 		allocCpu += t.CPU
 		allocMem += t.Memory
+		allocPids += t.Pids
 	}
 
 	ts.metricsMtx.Lock()
@@ -96,11 +138,38 @@ func (ts *TaskStore) updateAggMetrics(ctx context.Context, tasks []Task) error {
 	ts.aggMetrics.TotalTasks = len(tasks)
 	ts.aggMetrics.AllocatedCpu = allocCpu
 	ts.aggMetrics.AllocatedMem = allocMem
+	ts.aggMetrics.AllocatedPids = allocPids
 
 	return nil
 }
 
-func (ts *TaskStore) CreateTask(ctx context.Context, taskDef TaskDefinition) (*Task, error) {
+// applyAggDelta swaps old for new in the aggregates. old is nil for new
+// tasks and new is nil for deleted ones. call it after the write commits.
+func (ts *BoltTaskStore) applyAggDelta(ctx context.Context, old, new *Task) {
+	ts.metricsMtx.Lock()
+	defer ts.metricsMtx.Unlock()
+
+	if old != nil {
+		ts.aggMetrics.TotalTasks--
+	}
+	if old != nil && old.Status.Allocated() {
+		ts.aggMetrics.AllocatedCpu -= old.CPU
+		ts.aggMetrics.AllocatedMem -= old.Memory
+		ts.aggMetrics.AllocatedPids -= old.Pids
+	}
+	if new != nil {
+		ts.aggMetrics.TotalTasks++
+	}
+	if new != nil && new.Status.Allocated() {
+		ts.aggMetrics.AllocatedCpu += new.CPU
+		ts.aggMetrics.AllocatedMem += new.Memory
+		ts.aggMetrics.AllocatedPids += new.Pids
+	}
+
+  ts.tasksCountGauge.Record(ctx, int64(ts.aggMetrics.TotalTasks))
+}
+
+func (ts *BoltTaskStore) CreateTask(ctx context.Context, taskDef TaskDefinition) (*Task, error) {
   var span trace.Span
   ctx, span = ts.tracer.Start(ctx, "task_store.create_task")
   defer span.End()
@@ -111,56 +180,42 @@ func (ts *TaskStore) CreateTask(ctx context.Context, taskDef TaskDefinition) (*T
 	}
 
 	err = ts.db.Update(func(tx *bbolt.Tx) error {
-		b := tx.Bucket(tasksBucketName)
-
-		buf, err := writeTaskBytes(*t)
-		if err != nil {
-			return err
-		}
-
-		err = b.Put(t.ID.Bytes(), buf)
-		if err != nil {
-			return err
-		}
-
-		tasks, err := listTasksFromBucket(tx)
-		if err != nil {
-			return err
-		}
-
-		return ts.updateAggMetrics(ctx, tasks)
+		_, err := ts.putTask(tx, t, StatusChange{Reason: "task created"})
+		return err
 	})
 
 	if err != nil {
 		return nil, err
 	}
 
+  ts.applyAggDelta(ctx, nil, t)
   ts.tasksCountUpDown.Add(ctx, 1)
 	return t, nil
 }
 
-func (ts *TaskStore) DeleteTask(ctx context.Context, id ulid.ULID) error {
+func (ts *BoltTaskStore) DeleteTask(ctx context.Context, id ulid.ULID) error {
   var span trace.Span
   ctx, span = ts.tracer.Start(ctx, "task_store.delete_task")
   defer span.End()
 
-	return ts.db.Update(func(tx *bbolt.Tx) error {
-		b := tx.Bucket(tasksBucketName)
-
-		if err := b.Delete(id.Bytes()); err != nil {
-			return err
-		}
-
-		tasks, err := listTasksFromBucket(tx)
-		if err != nil {
-			return err
-		}
-
-		return ts.updateAggMetrics(ctx, tasks)
+	var old *Task
+	err := ts.db.Update(func(tx *bbolt.Tx) error {
+		var err error
+		old, err = ts.removeTask(tx, id)
+		return err
 	})
+	if err != nil {
+		return err
+	}
+
+	if old != nil {
+		ts.applyAggDelta(ctx, old, nil)
+		ts.tasksCountUpDown.Add(ctx, -1)
+	}
+	return nil
 }
 
-func (ts *TaskStore) GetTask(ctx context.Context, taskId ulid.ULID) (*Task, error) {
+func (ts *BoltTaskStore) GetTask(ctx context.Context, taskId ulid.ULID) (*Task, error) {
   var span trace.Span
   ctx, span = ts.tracer.Start(ctx, "task_store.get_task")
   defer span.End()
@@ -171,6 +226,9 @@ func (ts *TaskStore) GetTask(ctx context.Context, taskId ulid.ULID) (*Task, erro
 
 		buf := b.Get(taskId.Bytes())
 		t, err := readTaskBytes(buf)
+		if errors.Is(err, ErrNilTask) {
+			return ErrTaskNotFound
+		}
 		if err != nil {
 			return err
 		}
@@ -185,7 +243,7 @@ func (ts *TaskStore) GetTask(ctx context.Context, taskId ulid.ULID) (*Task, erro
 	return task, nil
 }
 
-func (ts *TaskStore) GetTasks(ctx context.Context) ([]Task, error) {
+func (ts *BoltTaskStore) GetTasks(ctx context.Context) ([]Task, error) {
   var span trace.Span
   ctx, span = ts.tracer.Start(ctx, "task_store.get_tasks")
   defer span.End()
@@ -210,53 +268,117 @@ func (ts *TaskStore) GetTasks(ctx context.Context) ([]Task, error) {
 	return tasks, err
 }
 
-func (ts *TaskStore) SetTaskStatus(ctx context.Context, task *Task, status TaskStatus) error {
+// SetTaskStatus moves the task to status and records the change as a
+// TaskEvent. it changes only the status, whatever revision of the task is
+// stored. see CompareAndSetTaskStatus.
+func (ts *BoltTaskStore) SetTaskStatus(ctx context.Context, task *Task, status TaskStatus, change StatusChange) error {
   var span trace.Span
   ctx, span = ts.tracer.Start(ctx, "task_store.set_task_status")
   defer span.End()
 
-	return ts.db.Update(func(tx *bbolt.Tx) error {
-		taskId := task.ID.Bytes()
+	return ts.setTaskStatus(ctx, task, status, change, false)
+}
 
-		b := tx.Bucket(tasksBucketName)
+// UpdateTask overwrites the stored task, whatever its revision. see
+// CompareAndUpdateTask.
+func (ts *BoltTaskStore) UpdateTask(ctx context.Context, task *Task) error {
+  var span trace.Span
+  ctx, span = ts.tracer.Start(ctx, "task_store.update_task")
+  defer span.End()
 
-		taskB := b.Get(taskId)
+	return ts.updateTask(ctx, task, false)
+}
 
-		taskB[0] = []byte(strconv.Itoa(int(status)))[0]
+// AdoptTask writes task as it is, keeping its id, whether or not the store
+// already has it. it's used to take over containers the store lost track
+// of, e.g. after a restore.
+func (ts *BoltTaskStore) AdoptTask(ctx context.Context, task Task, change StatusChange) error {
+  var span trace.Span
+  ctx, span = ts.tracer.Start(ctx, "task_store.adopt_task")
+  defer span.End()
 
-		task.Status = status
-		return b.Put(taskId, taskB)
+	var old *Task
+	err := ts.db.Update(func(tx *bbolt.Tx) error {
+		var err error
+		old, err = ts.putTask(tx, &task, change)
+		return err
 	})
+	if err != nil {
+		return err
+	}
+
+	ts.applyAggDelta(ctx, old, &task)
+	if old == nil {
+		ts.tasksCountUpDown.Add(ctx, 1)
+	}
+	return nil
 }
 
-func (ts *TaskStore) UpdateTask(ctx context.Context, task *Task) error {
+// RecordHealthCheck adds a health check result to the task and returns the
+// updated task. the task is only written if the result changed its status,
+// health status or failing streak. it reads and writes the task in one
+// transaction so it doesn't race with other updates.
+func (ts *BoltTaskStore) RecordHealthCheck(ctx context.Context, taskId ulid.ULID, result HealthCheckResult, inGracePeriod bool) (*Task, error) {
   var span trace.Span
-  ctx, span = ts.tracer.Start(ctx, "task_store.update_task")
+  ctx, span = ts.tracer.Start(ctx, "task_store.record_health_check")
   defer span.End()
 
-	return ts.db.Update(func(tx *bbolt.Tx) error {
-		b := tx.Bucket(tasksBucketName)
+	readTask := func(tx *bbolt.Tx) (Task, error) {
+		t, err := readTaskBytes(tx.Bucket(tasksBucketName).Get(taskId.Bytes()))
+		if errors.Is(err, ErrNilTask) {
+			return t, ErrTaskNotFound
+		}
+		return t, err
+	}
 
-		buf, err := writeTaskBytes(*task)
+	// most checks change nothing, look before taking the write lock
+	var task, old Task
+	var changed bool
+	err := ts.db.View(func(tx *bbolt.Tx) error {
+		t, err := readTask(tx)
 		if err != nil {
 			return err
 		}
 
-		err = b.Put(task.ID.Bytes(), buf)
+		changed = t.recordHealthCheck(result, inGracePeriod)
+		task = t
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !changed {
+		return &task, nil
+	}
+
+	err = ts.db.Update(func(tx *bbolt.Tx) error {
+		t, err := readTask(tx)
 		if err != nil {
 			return err
 		}
 
-		tasks, err := listTasksFromBucket(tx)
-		if err != nil {
-			return err
+		old = t
+		changed = t.recordHealthCheck(result, inGracePeriod)
+		if changed {
+			if _, err := ts.putTask(tx, &t, healthCheckChange(result)); err != nil {
+				return err
+			}
 		}
 
-		return ts.updateAggMetrics(ctx, tasks)
+		task = t
+		return nil
 	})
+	if err != nil {
+		return nil, err
+	}
+
+	if changed {
+		ts.applyAggDelta(ctx, &old, &task)
+	}
+	return &task, nil
 }
 
-func (ts *TaskStore) AggMetrics(ctx context.Context) *AggTaskMetrics {
+func (ts *BoltTaskStore) AggMetrics(ctx context.Context) *AggTaskMetrics {
   var span trace.Span
   ctx, span = ts.tracer.Start(ctx, "task_store.get_agg_metrics")
   defer span.End()
@@ -267,6 +389,91 @@ func (ts *TaskStore) AggMetrics(ctx context.Context) *AggTaskMetrics {
 	return ts.aggMetrics
 }
 
+// putTask writes task, moves its index entries, appends to the change log
+// and records an event if its status changed. the task's revision is set
+// to the stored one, bumped if anything changed. it returns the task it
+// replaced, or nil if the task is new.
+func (ts *BoltTaskStore) putTask(tx *bbolt.Tx, task *Task, change StatusChange) (*Task, error) {
+	b := tx.Bucket(tasksBucketName)
+
+	var old *Task
+	task.Revision = 0
+	raw := b.Get(task.ID.Bytes())
+	if raw != nil {
+		t, err := readTaskBytes(raw)
+		if err != nil {
+			return nil, err
+		}
+		old = &t
+		task.Revision = old.Revision
+	}
+	stampFinishedAt(old, task)
+
+	// nothing changed, don't bump the revision or emit a change for it
+	if old != nil {
+		buf, err := writeTaskBytes(*task)
+		if err != nil {
+			return nil, err
+		}
+		if bytes.Equal(raw, buf) {
+			return old, nil
+		}
+	}
+
+	task.Revision++
+	buf, err := writeTaskBytes(*task)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := b.Put(task.ID.Bytes(), buf); err != nil {
+		return nil, err
+	}
+
+	if event, ok := statusEvent(old, *task, change); ok {
+		if err := ts.appendTaskEvent(tx, event); err != nil {
+			return nil, err
+		}
+	}
+
+	changeType := TaskChangeUpdate
+	if old == nil {
+		changeType = TaskChangeCreate
+	}
+	if err := ts.appendTaskChange(tx, changeType, *task); err != nil {
+		return nil, err
+	}
+
+	return old, updateIndexes(tx, old, task)
+}
+
+// removeTask deletes a task along with its index entries and events. it
+// returns the deleted task, or nil if there was none.
+func (ts *BoltTaskStore) removeTask(tx *bbolt.Tx, id ulid.ULID) (*Task, error) {
+	b := tx.Bucket(tasksBucketName)
+
+	raw := b.Get(id.Bytes())
+	if raw == nil {
+		return nil, nil
+	}
+	old, err := readTaskBytes(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := b.Delete(id.Bytes()); err != nil {
+		return nil, err
+	}
+	if err := deleteTaskEvents(tx, id); err != nil {
+		return nil, err
+	}
+	if err := ts.appendTaskChange(tx, TaskChangeDelete, old); err != nil {
+		return nil, err
+	}
+
+	return &old, updateIndexes(tx, &old, nil)
+}
+
 func listTasksFromBucket(tx *bbolt.Tx) ([]Task, error) {
 	tasks := make([]Task, 0)
 	b := tx.Bucket(tasksBucketName)
@@ -289,30 +496,19 @@ func readTaskBytes(raw []byte) (Task, error) {
     return Task{}, ErrNilTask
   }
 
-	status, err := strconv.ParseInt(string(raw[0]), 10, 64)
-	if err != nil {
-		return Task{}, err
-	}
-
 	var task Task
-	if err := json.Unmarshal(raw[1:], &task); err != nil {
-		return Task{}, err
+	if err := decodeRecord(raw, &task); err != nil {
+		return Task{}, fmt.Errorf("readTaskBytes: %w", err)
 	}
 
-	task.Status = TaskStatus(status)
-
 	return task, nil
 }
 
 func writeTaskBytes(task Task) ([]byte, error) {
-	status := task.Status
-	taskStr, err := json.Marshal(task)
+	buf, err := encodeRecord(task)
 	if err != nil {
 		return nil, fmt.Errorf("writeTaskBytes: %w", err)
 	}
 
-	s := strconv.Itoa(int(status))
-	buf := append([]byte(s), taskStr...)
-
 	return buf, nil
 }
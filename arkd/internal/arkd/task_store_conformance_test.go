@@ -0,0 +1,452 @@
+package arkd
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/oklog/ulid/v2"
+	"github.com/rs/zerolog"
+	"go.etcd.io/bbolt"
+)
+
+// testTaskStore runs the behaviour every TaskStore implementation shares
+func testTaskStore(t *testing.T, newStore func(t *testing.T, opts ...TaskStoreOption) TaskStore) {
+	ctx := context.Background()
+
+	t.Run("create and get", func(t *testing.T) {
+		ts := newStore(t)
+
+		created, err := ts.CreateTask(ctx, TaskDefinition{AppName: "web", Image: "ubuntu", Env: map[string]string{"A": "1"}})
+		if err != nil {
+			t.Fatalf("CreateTask() error = %v", err)
+		}
+		if created.Status != TaskStatusPending || created.Revision != 1 {
+			t.Errorf("CreateTask() = %+v, want pending at revision 1", created)
+		}
+
+		got, err := ts.GetTask(ctx, created.ID)
+		if err != nil {
+			t.Fatalf("GetTask() error = %v", err)
+		}
+		if got.ID != created.ID || got.AppName != "web" || got.Env["A"] != "1" {
+			t.Errorf("GetTask() = %+v", got)
+		}
+
+		// the returned task is a copy
+		got.Env["A"] = "2"
+		again, _ := ts.GetTask(ctx, created.ID)
+		if again.Env["A"] != "1" {
+			t.Errorf("changing a returned task changed the store")
+		}
+
+		if _, err := ts.GetTask(ctx, ulid.Make()); !errors.Is(err, ErrTaskNotFound) {
+			t.Errorf("GetTask(missing) error = %v, want %v", err, ErrTaskNotFound)
+		}
+	})
+
+	t.Run("list and find", func(t *testing.T) {
+		ts := newStore(t)
+
+		var ids []ulid.ULID
+		for _, app := range []string{"web", "worker", "web"} {
+			task, err := ts.CreateTask(ctx, TaskDefinition{AppName: app, DeploymentName: "main", Image: "ubuntu"})
+			if err != nil {
+				t.Fatalf("CreateTask() error = %v", err)
+			}
+			ids = append(ids, task.ID)
+		}
+		if err := ts.SetTaskStatus(ctx, &Task{ID: ids[2]}, TaskStatusRunning, StatusChange{}); err != nil {
+			t.Fatalf("SetTaskStatus() error = %v", err)
+		}
+
+		all, err := ts.GetTasks(ctx)
+		if err != nil {
+			t.Fatalf("GetTasks() error = %v", err)
+		}
+		if len(all) != 3 || all[0].ID != ids[0] || all[2].ID != ids[2] {
+			t.Errorf("GetTasks() = %+v, want 3 tasks oldest first", all)
+		}
+
+		tests := []struct {
+			name   string
+			filter TaskFilter
+			want   []ulid.ULID
+		}{
+			{"app", TaskFilter{AppName: "web"}, []ulid.ULID{ids[0], ids[2]}},
+			{"app and status", TaskFilter{AppName: "web", Statuses: []TaskStatus{TaskStatusRunning}}, []ulid.ULID{ids[2]}},
+			{"statuses", TaskFilter{Statuses: []TaskStatus{TaskStatusPending, TaskStatusRunning}}, ids},
+			{"no match", TaskFilter{DeploymentName: "other"}, nil},
+		}
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				got, err := ts.FindTasks(ctx, tt.filter)
+				if err != nil {
+					t.Fatalf("FindTasks() error = %v", err)
+				}
+				if len(got) != len(tt.want) {
+					t.Fatalf("FindTasks() returned %d tasks, want %d", len(got), len(tt.want))
+				}
+				for i := range got {
+					if got[i].ID != tt.want[i] {
+						t.Errorf("task %d = %s, want %s", i, got[i].ID, tt.want[i])
+					}
+				}
+			})
+		}
+	})
+
+	t.Run("update and aggregates", func(t *testing.T) {
+		ts := newStore(t)
+
+		task, err := ts.CreateTask(ctx, TaskDefinition{AppName: "web", Image: "ubuntu", Cpu: 0.5, Memory: 128, Pids: 64})
+		if err != nil {
+			t.Fatalf("CreateTask() error = %v", err)
+		}
+		// a pending task doesn't hold resources yet
+		if m := ts.AggMetrics(ctx); m.TotalTasks != 1 || m.AllocatedCpu != 0 || m.AllocatedMem != 0 || m.AllocatedPids != 0 {
+			t.Errorf("AggMetrics() after create = %+v", m)
+		}
+
+		if err := ts.SetTaskStatus(ctx, task, TaskStatusRunning, StatusChange{}); err != nil {
+			t.Fatalf("SetTaskStatus() error = %v", err)
+		}
+		if m := ts.AggMetrics(ctx); m.TotalTasks != 1 || m.AllocatedCpu != 0.5 || m.AllocatedMem != 128 || m.AllocatedPids != 64 {
+			t.Errorf("AggMetrics() after running = %+v", m)
+		}
+
+		task.Memory = 256
+		if err := ts.UpdateTask(ctx, task); err != nil {
+			t.Fatalf("UpdateTask() error = %v", err)
+		}
+		if task.Revision != 3 {
+			t.Errorf("revision after update = %d, want 3", task.Revision)
+		}
+		if m := ts.AggMetrics(ctx); m.TotalTasks != 1 || m.AllocatedMem != 256 {
+			t.Errorf("AggMetrics() after update = %+v", m)
+		}
+
+		// a suspended task frees its resources
+		if err := ts.SetTaskStatus(ctx, task, TaskStatusSuspended, StatusChange{}); err != nil {
+			t.Fatalf("SetTaskStatus() error = %v", err)
+		}
+		if m := ts.AggMetrics(ctx); m.TotalTasks != 1 || m.AllocatedCpu != 0 || m.AllocatedMem != 0 || m.AllocatedPids != 0 {
+			t.Errorf("AggMetrics() after suspend = %+v", m)
+		}
+
+		if err := ts.DeleteTask(ctx, task.ID); err != nil {
+			t.Fatalf("DeleteTask() error = %v", err)
+		}
+		if m := ts.AggMetrics(ctx); m.TotalTasks != 0 || m.AllocatedCpu != 0 || m.AllocatedMem != 0 || m.AllocatedPids != 0 {
+			t.Errorf("AggMetrics() after delete = %+v", m)
+		}
+		if _, err := ts.GetTask(ctx, task.ID); !errors.Is(err, ErrTaskNotFound) {
+			t.Errorf("GetTask(deleted) error = %v, want %v", err, ErrTaskNotFound)
+		}
+		if err := ts.DeleteTask(ctx, task.ID); err != nil {
+			t.Errorf("DeleteTask(deleted) error = %v", err)
+		}
+	})
+
+	t.Run("status and events", func(t *testing.T) {
+		ts := newStore(t, WithEventRetention(2))
+
+		task, err := ts.CreateTask(ctx, TaskDefinition{AppName: "web", Image: "ubuntu"})
+		if err != nil {
+			t.Fatalf("CreateTask() error = %v", err)
+		}
+		for _, status := range []TaskStatus{TaskStatusStarting, TaskStatusRunning, TaskStatusRunning} {
+			if err := ts.SetTaskStatus(ctx, task, status, StatusChange{Reason: "test"}); err != nil {
+				t.Fatalf("SetTaskStatus() error = %v", err)
+			}
+		}
+		if task.Status != TaskStatusRunning || task.Revision != 3 {
+			t.Errorf("task after SetTaskStatus = %+v, want running at revision 3", task)
+		}
+
+		events, err := ts.GetTaskEvents(ctx, task.ID)
+		if err != nil {
+			t.Fatalf("GetTaskEvents() error = %v", err)
+		}
+		if len(events) != 2 || events[0].To != TaskStatusStarting || events[1].From != TaskStatusStarting || events[1].To != TaskStatusRunning {
+			t.Errorf("GetTaskEvents() = %+v, want the last 2 transitions", events)
+		}
+
+		if err := ts.SetTaskStatus(ctx, &Task{ID: ulid.Make()}, TaskStatusRunning, StatusChange{}); !errors.Is(err, ErrTaskNotFound) {
+			t.Errorf("SetTaskStatus(missing) error = %v, want %v", err, ErrTaskNotFound)
+		}
+	})
+
+	t.Run("finished at", func(t *testing.T) {
+		ts := newStore(t)
+
+		task, err := ts.CreateTask(ctx, TaskDefinition{AppName: "web", Image: "ubuntu"})
+		if err != nil {
+			t.Fatalf("CreateTask() error = %v", err)
+		}
+		if err := ts.SetTaskStatus(ctx, task, TaskStatusExited, StatusChange{}); err != nil {
+			t.Fatalf("SetTaskStatus() error = %v", err)
+		}
+		exited, _ := ts.GetTask(ctx, task.ID)
+		if exited.FinishedAt.IsZero() {
+			t.Fatalf("FinishedAt not set when the task exited")
+		}
+
+		// finishing again keeps the first time
+		if err := ts.SetTaskStatus(ctx, task, TaskStatusCrashed, StatusChange{}); err != nil {
+			t.Fatalf("SetTaskStatus() error = %v", err)
+		}
+		crashed, _ := ts.GetTask(ctx, task.ID)
+		if !crashed.FinishedAt.Equal(exited.FinishedAt) {
+			t.Errorf("FinishedAt = %v, want %v", crashed.FinishedAt, exited.FinishedAt)
+		}
+
+		if err := ts.SetTaskStatus(ctx, task, TaskStatusRunning, StatusChange{}); err != nil {
+			t.Fatalf("SetTaskStatus() error = %v", err)
+		}
+		if running, _ := ts.GetTask(ctx, task.ID); !running.FinishedAt.IsZero() {
+			t.Errorf("FinishedAt = %v after the task ran again, want zero", running.FinishedAt)
+		}
+	})
+
+	t.Run("compare and swap", func(t *testing.T) {
+		ts := newStore(t)
+
+		task, err := ts.CreateTask(ctx, TaskDefinition{AppName: "web", Image: "ubuntu"})
+		if err != nil {
+			t.Fatalf("CreateTask() error = %v", err)
+		}
+		stale := *task
+
+		task.ContainerID = "c1"
+		if err := ts.CompareAndUpdateTask(ctx, task); err != nil {
+			t.Fatalf("CompareAndUpdateTask() error = %v", err)
+		}
+
+		stale.ContainerID = "c2"
+		var conflict *TaskConflictError
+		if err := ts.CompareAndUpdateTask(ctx, &stale); !errors.As(err, &conflict) || conflict.Actual != 2 {
+			t.Errorf("CompareAndUpdateTask(stale) error = %v, want a conflict at revision 2", err)
+		}
+		if err := ts.CompareAndSetTaskStatus(ctx, &stale, TaskStatusRunning, StatusChange{}); !errors.Is(err, ErrTaskConflict) {
+			t.Errorf("CompareAndSetTaskStatus(stale) error = %v, want %v", err, ErrTaskConflict)
+		}
+		if err := ts.CompareAndSetTaskStatus(ctx, task, TaskStatusRunning, StatusChange{}); err != nil {
+			t.Errorf("CompareAndSetTaskStatus() error = %v", err)
+		}
+
+		if err := ts.CompareAndDeleteTask(ctx, &stale); !errors.Is(err, ErrTaskConflict) {
+			t.Errorf("CompareAndDeleteTask(stale) error = %v, want %v", err, ErrTaskConflict)
+		}
+		if err := ts.CompareAndDeleteTask(ctx, task); err != nil {
+			t.Errorf("CompareAndDeleteTask() error = %v", err)
+		}
+		if _, err := ts.GetTask(ctx, task.ID); !errors.Is(err, ErrTaskNotFound) {
+			t.Errorf("GetTask(deleted) error = %v, want %v", err, ErrTaskNotFound)
+		}
+		if m := ts.AggMetrics(ctx); m.TotalTasks != 0 {
+			t.Errorf("AggMetrics() after delete = %+v", m)
+		}
+	})
+
+	t.Run("compare and swap after a status change", func(t *testing.T) {
+		ts := newStore(t)
+
+		task, err := ts.CreateTask(ctx, TaskDefinition{AppName: "web", Image: "ubuntu"})
+		if err != nil {
+			t.Fatalf("CreateTask() error = %v", err)
+		}
+		stale := *task
+
+		// someone else changes the status, the copy is now stale
+		if err := ts.SetTaskStatus(ctx, task, TaskStatusStarting, StatusChange{}); err != nil {
+			t.Fatalf("SetTaskStatus() error = %v", err)
+		}
+		stale.ContainerID = "c2"
+		if err := ts.CompareAndUpdateTask(ctx, &stale); !errors.Is(err, ErrTaskConflict) {
+			t.Errorf("CompareAndUpdateTask(stale) error = %v, want %v", err, ErrTaskConflict)
+		}
+
+		// a plain status change through a stale copy refreshes all of it, not
+		// just the revision
+		task.ContainerID = "c1"
+		if err := ts.CompareAndUpdateTask(ctx, task); err != nil {
+			t.Fatalf("CompareAndUpdateTask() error = %v", err)
+		}
+		if err := ts.SetTaskStatus(ctx, &stale, TaskStatusRunning, StatusChange{}); err != nil {
+			t.Fatalf("SetTaskStatus() error = %v", err)
+		}
+		if stale.ContainerID != "c1" || stale.Status != TaskStatusRunning {
+			t.Errorf("copy after SetTaskStatus() = %+v, want the stored task", stale)
+		}
+		if err := ts.CompareAndUpdateTask(ctx, task); !errors.Is(err, ErrTaskConflict) {
+			t.Errorf("CompareAndUpdateTask() after a status change error = %v, want %v", err, ErrTaskConflict)
+		}
+	})
+
+	t.Run("health checks", func(t *testing.T) {
+		ts := newStore(t)
+
+		task, err := ts.CreateTask(ctx, TaskDefinition{AppName: "web", Image: "ubuntu"})
+		if err != nil {
+			t.Fatalf("CreateTask() error = %v", err)
+		}
+		if err := ts.SetTaskStatus(ctx, task, TaskStatusStarting, StatusChange{}); err != nil {
+			t.Fatalf("SetTaskStatus() error = %v", err)
+		}
+
+		got, err := ts.RecordHealthCheck(ctx, task.ID, HealthCheckResult{StartedAt: time.Now(), Passed: true, Output: "200 OK"}, false)
+		if err != nil {
+			t.Fatalf("RecordHealthCheck() error = %v", err)
+		}
+		if got.Health.Status != HealthStatusHealthy || len(got.Health.History) != 1 {
+			t.Errorf("RecordHealthCheck() health = %+v", got.Health)
+		}
+
+		events, err := ts.GetTaskEvents(ctx, task.ID)
+		if err != nil {
+			t.Fatalf("GetTaskEvents() error = %v", err)
+		}
+		if last := events[len(events)-1]; last.To != TaskStatusRunning || last.Reason != "health check passed: 200 OK" {
+			t.Errorf("last event = %+v, want running with the check's output", last)
+		}
+
+		// a check that changes nothing isn't written
+		again, err := ts.RecordHealthCheck(ctx, task.ID, HealthCheckResult{StartedAt: time.Now(), Passed: true, Output: "200 OK"}, false)
+		if err != nil {
+			t.Fatalf("RecordHealthCheck() error = %v", err)
+		}
+		stored, err := ts.GetTask(ctx, task.ID)
+		if err != nil {
+			t.Fatalf("GetTask() error = %v", err)
+		}
+		if again.Revision != got.Revision || stored.Revision != got.Revision || len(stored.Health.History) != 1 {
+			t.Errorf("passing again moved the task from revision %d to %d (stored %d), history %d", got.Revision, again.Revision, stored.Revision, len(stored.Health.History))
+		}
+	})
+
+	t.Run("adopt", func(t *testing.T) {
+		ts := newStore(t)
+
+		task := Task{ID: ulid.Make(), AppName: "web", Status: TaskStatusRunning, CPU: 1}
+		if err := ts.AdoptTask(ctx, task, StatusChange{Reason: "adopted"}); err != nil {
+			t.Fatalf("AdoptTask() error = %v", err)
+		}
+
+		got, err := ts.GetTask(ctx, task.ID)
+		if err != nil {
+			t.Fatalf("GetTask() error = %v", err)
+		}
+		if got.Status != TaskStatusRunning || got.Revision != 1 {
+			t.Errorf("adopted task = %+v", got)
+		}
+		if m := ts.AggMetrics(ctx); m.TotalTasks != 1 || m.AllocatedCpu != 1 {
+			t.Errorf("AggMetrics() = %+v", m)
+		}
+	})
+
+	t.Run("watch", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		ts := newStore(t)
+
+		task, err := ts.CreateTask(ctx, TaskDefinition{AppName: "web", Image: "ubuntu"})
+		if err != nil {
+			t.Fatalf("CreateTask() error = %v", err)
+		}
+
+		w, err := ts.Watch(ctx, 0)
+		if err != nil {
+			t.Fatalf("Watch() error = %v", err)
+		}
+		if err := ts.DeleteTask(ctx, task.ID); err != nil {
+			t.Fatalf("DeleteTask() error = %v", err)
+		}
+
+		if c := next(t, w); c.Revision != 1 || c.Type != TaskChangeCreate {
+			t.Errorf("change 1 = %+v", c)
+		}
+		if c := next(t, w); c.Revision != 2 || c.Type != TaskChangeDelete {
+			t.Errorf("change 2 = %+v", c)
+		}
+
+		if rev, err := ts.Revision(ctx); err != nil || rev != 2 {
+			t.Errorf("Revision() = %d, %v, want 2", rev, err)
+		}
+		if _, err := ts.Watch(ctx, 3); !errors.Is(err, ErrRevisionCompacted) {
+			t.Errorf("Watch(future) error = %v, want %v", err, ErrRevisionCompacted)
+		}
+	})
+
+	t.Run("concurrent writes", func(t *testing.T) {
+		ts := newStore(t)
+
+		task, err := ts.CreateTask(ctx, TaskDefinition{AppName: "web", Image: "ubuntu"})
+		if err != nil {
+			t.Fatalf("CreateTask() error = %v", err)
+		}
+
+		// every writer retries on conflict, so no increment is lost
+		const writers, increments = 4, 10
+		var wg sync.WaitGroup
+		for i := 0; i < writers; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < increments; j++ {
+					for {
+						cur, err := ts.GetTask(ctx, task.ID)
+						if err != nil {
+							t.Error(err)
+							return
+						}
+						cur.Memory++
+						err = ts.CompareAndUpdateTask(ctx, cur)
+						if errors.Is(err, ErrTaskConflict) {
+							continue
+						}
+						if err != nil {
+							t.Error(err)
+						}
+						break
+					}
+				}
+			}()
+		}
+		wg.Wait()
+
+		got, err := ts.GetTask(ctx, task.ID)
+		if err != nil {
+			t.Fatalf("GetTask() error = %v", err)
+		}
+		if got.Memory != writers*increments {
+			t.Errorf("memory = %d, want %d", got.Memory, writers*increments)
+		}
+	})
+}
+
+func Test_BoltTaskStore(t *testing.T) {
+	testTaskStore(t, func(t *testing.T, opts ...TaskStoreOption) TaskStore {
+		db, err := bbolt.Open(filepath.Join(t.TempDir(), "arkd.db"), 0600, &bbolt.Options{Timeout: time.Second})
+		if err != nil {
+			t.Fatalf("bbolt.Open() error = %v", err)
+		}
+		t.Cleanup(func() { db.Close() })
+
+		ts, err := NewBoltTaskStore(db, zerolog.Nop(), opts...)
+		if err != nil {
+			t.Fatalf("NewBoltTaskStore() error = %v", err)
+		}
+
+		return ts
+	})
+}
+
+func Test_MemTaskStore(t *testing.T) {
+	testTaskStore(t, func(t *testing.T, opts ...TaskStoreOption) TaskStore {
+		return NewMemTaskStore(opts...)
+	})
+}
@@ -0,0 +1,349 @@
+package arkd
+
+import (
+	"bytes"
+	"context"
+	"sort"
+	"sync"
+
+	"github.com/oklog/ulid/v2"
+)
+
+// MemTaskStore keeps tasks in memory. tasks are held as encoded records like
+// in BoltTaskStore, so callers never share maps or slices with the store.
+// it's meant for tests and nothing survives a restart.
+type MemTaskStore struct {
+	mtx      sync.RWMutex
+	tasks    map[ulid.ULID][]byte
+	events   map[ulid.ULID][]TaskEvent
+	changes  []TaskChange
+	revision uint64
+	opts     taskStoreOptions
+	feed     *taskFeed
+}
+
+var _ TaskStore = (*MemTaskStore)(nil)
+
+func NewMemTaskStore(opts ...TaskStoreOption) *MemTaskStore {
+	return &MemTaskStore{
+		tasks:  make(map[ulid.ULID][]byte),
+		events: make(map[ulid.ULID][]TaskEvent),
+		opts:   newTaskStoreOptions(opts),
+		feed:   newTaskFeed(0),
+	}
+}
+
+func (ms *MemTaskStore) CreateTask(ctx context.Context, taskDef TaskDefinition) (*Task, error) {
+	t, err := NewTask(taskDef)
+	if err != nil {
+		return nil, err
+	}
+
+	ms.mtx.Lock()
+	defer ms.mtx.Unlock()
+
+	if err := ms.putTask(t, StatusChange{Reason: "task created"}); err != nil {
+		return nil, err
+	}
+
+	return t, nil
+}
+
+func (ms *MemTaskStore) AdoptTask(ctx context.Context, task Task, change StatusChange) error {
+	ms.mtx.Lock()
+	defer ms.mtx.Unlock()
+
+	return ms.putTask(&task, change)
+}
+
+func (ms *MemTaskStore) GetTask(ctx context.Context, taskId ulid.ULID) (*Task, error) {
+	ms.mtx.RLock()
+	defer ms.mtx.RUnlock()
+
+	t, err := ms.loadTask(taskId, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return &t, nil
+}
+
+func (ms *MemTaskStore) GetTasks(ctx context.Context) ([]Task, error) {
+	return ms.FindTasks(ctx, TaskFilter{})
+}
+
+// FindTasks returns the tasks matching filter, oldest first
+func (ms *MemTaskStore) FindTasks(ctx context.Context, filter TaskFilter) ([]Task, error) {
+	ms.mtx.RLock()
+	defer ms.mtx.RUnlock()
+
+	ids := make([]ulid.ULID, 0, len(ms.tasks))
+	for id := range ms.tasks {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i].Compare(ids[j]) < 0 })
+
+	tasks := make([]Task, 0)
+	for _, id := range ids {
+		t, err := readTaskBytes(ms.tasks[id])
+		if err != nil {
+			return nil, err
+		}
+		if filter.matches(t) {
+			tasks = append(tasks, t)
+		}
+	}
+
+	return tasks, nil
+}
+
+func (ms *MemTaskStore) UpdateTask(ctx context.Context, task *Task) error {
+	return ms.updateTask(task, false)
+}
+
+func (ms *MemTaskStore) CompareAndUpdateTask(ctx context.Context, task *Task) error {
+	return ms.updateTask(task, true)
+}
+
+func (ms *MemTaskStore) SetTaskStatus(ctx context.Context, task *Task, status TaskStatus, change StatusChange) error {
+	return ms.setTaskStatus(task, status, change, false)
+}
+
+func (ms *MemTaskStore) CompareAndSetTaskStatus(ctx context.Context, task *Task, status TaskStatus, change StatusChange) error {
+	return ms.setTaskStatus(task, status, change, true)
+}
+
+func (ms *MemTaskStore) RecordHealthCheck(ctx context.Context, taskId ulid.ULID, result HealthCheckResult, inGracePeriod bool) (*Task, error) {
+	ms.mtx.Lock()
+	defer ms.mtx.Unlock()
+
+	t, err := ms.loadTask(taskId, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if !t.recordHealthCheck(result, inGracePeriod) {
+		return &t, nil
+	}
+	if err := ms.putTask(&t, healthCheckChange(result)); err != nil {
+		return nil, err
+	}
+
+	return &t, nil
+}
+
+func (ms *MemTaskStore) DeleteTask(ctx context.Context, id ulid.ULID) error {
+	ms.mtx.Lock()
+	defer ms.mtx.Unlock()
+
+	raw, ok := ms.tasks[id]
+	if !ok {
+		return nil
+	}
+	old, err := readTaskBytes(raw)
+	if err != nil {
+		return err
+	}
+
+	delete(ms.tasks, id)
+	delete(ms.events, id)
+	ms.appendTaskChange(TaskChangeDelete, old)
+	return nil
+}
+
+func (ms *MemTaskStore) CompareAndDeleteTask(ctx context.Context, task *Task) error {
+	ms.mtx.Lock()
+	defer ms.mtx.Unlock()
+
+	old, err := ms.loadTask(task.ID, &task.Revision)
+	if err != nil {
+		return err
+	}
+
+	delete(ms.tasks, task.ID)
+	delete(ms.events, task.ID)
+	ms.appendTaskChange(TaskChangeDelete, old)
+	return nil
+}
+
+func (ms *MemTaskStore) AggMetrics(ctx context.Context) *AggTaskMetrics {
+	ms.mtx.RLock()
+	defer ms.mtx.RUnlock()
+
+	agg := &AggTaskMetrics{}
+	for _, raw := range ms.tasks {
+		t, err := readTaskBytes(raw)
+		if err != nil {
+			continue
+		}
+		agg.TotalTasks++
+		if !t.Status.Allocated() {
+			continue
+		}
+		agg.AllocatedCpu += t.CPU
+		agg.AllocatedMem += t.Memory
+		agg.AllocatedPids += t.Pids
+	}
+
+	return agg
+}
+
+func (ms *MemTaskStore) GetTaskEvents(ctx context.Context, taskId ulid.ULID) ([]TaskEvent, error) {
+	ms.mtx.RLock()
+	defer ms.mtx.RUnlock()
+
+	return append(make([]TaskEvent, 0, len(ms.events[taskId])), ms.events[taskId]...), nil
+}
+
+func (ms *MemTaskStore) Revision(ctx context.Context) (uint64, error) {
+	ms.mtx.RLock()
+	defer ms.mtx.RUnlock()
+
+	return ms.revision, nil
+}
+
+func (ms *MemTaskStore) Watch(ctx context.Context, since uint64) (*TaskWatch, error) {
+	ms.mtx.RLock()
+	defer ms.mtx.RUnlock()
+
+	if since > ms.revision || (len(ms.changes) > 0 && ms.changes[0].Revision > since+1) {
+		return nil, ErrRevisionCompacted
+	}
+
+	var backlog []TaskChange
+	for _, change := range ms.changes {
+		if change.Revision > since {
+			backlog = append(backlog, change)
+		}
+	}
+
+	// changes are published under the write lock, so nothing is missed
+	// between reading the backlog and subscribing
+	live, liveWatch := ms.feed.subscribe()
+	return ms.feed.stream(ctx, live, liveWatch, since, backlog), nil
+}
+
+func (ms *MemTaskStore) updateTask(task *Task, compare bool) error {
+	ms.mtx.Lock()
+	defer ms.mtx.Unlock()
+
+	if compare {
+		if _, err := ms.loadTask(task.ID, &task.Revision); err != nil {
+			return err
+		}
+	}
+
+	t := *task
+	if err := ms.putTask(&t, StatusChange{}); err != nil {
+		return err
+	}
+
+	task.Revision = t.Revision
+	return nil
+}
+
+func (ms *MemTaskStore) setTaskStatus(task *Task, status TaskStatus, change StatusChange, compare bool) error {
+	var expected *uint64
+	if compare {
+		expected = &task.Revision
+	}
+
+	ms.mtx.Lock()
+	defer ms.mtx.Unlock()
+
+	t, err := ms.loadTask(task.ID, expected)
+	if err != nil {
+		return err
+	}
+
+	t.Status = status
+	if err := ms.putTask(&t, change); err != nil {
+		return err
+	}
+
+	// the whole record, a copy that only got the new revision would pass
+	// the next compare and swap with stale fields
+	*task = t
+	return nil
+}
+
+// loadTask reads a task. if expected isn't nil the task has to be at that
+// revision. callers hold the lock.
+func (ms *MemTaskStore) loadTask(id ulid.ULID, expected *uint64) (Task, error) {
+	raw, ok := ms.tasks[id]
+	if !ok {
+		return Task{}, ErrTaskNotFound
+	}
+
+	t, err := readTaskBytes(raw)
+	if err != nil {
+		return Task{}, err
+	}
+
+	if expected != nil && t.Revision != *expected {
+		return Task{}, &TaskConflictError{TaskID: id, Expected: *expected, Actual: t.Revision}
+	}
+
+	return t, nil
+}
+
+// putTask mirrors BoltTaskStore.putTask. callers hold the write lock.
+func (ms *MemTaskStore) putTask(task *Task, change StatusChange) error {
+	var old *Task
+	task.Revision = 0
+	raw, ok := ms.tasks[task.ID]
+	if ok {
+		t, err := readTaskBytes(raw)
+		if err != nil {
+			return err
+		}
+		old = &t
+		task.Revision = old.Revision
+	}
+	stampFinishedAt(old, task)
+
+	if old != nil {
+		buf, err := writeTaskBytes(*task)
+		if err != nil {
+			return err
+		}
+		if bytes.Equal(raw, buf) {
+			return nil
+		}
+	}
+
+	task.Revision++
+	buf, err := writeTaskBytes(*task)
+	if err != nil {
+		return err
+	}
+	ms.tasks[task.ID] = buf
+
+	if event, ok := statusEvent(old, *task, change); ok {
+		events := append(ms.events[task.ID], event)
+		if len(events) > ms.opts.eventRetention {
+			events = events[len(events)-ms.opts.eventRetention:]
+		}
+		ms.events[task.ID] = events
+	}
+
+	changeType := TaskChangeUpdate
+	if old == nil {
+		changeType = TaskChangeCreate
+	}
+	ms.appendTaskChange(changeType, *task)
+
+	return nil
+}
+
+func (ms *MemTaskStore) appendTaskChange(changeType TaskChangeType, task Task) {
+	ms.revision++
+	change := TaskChange{Revision: ms.revision, Type: changeType, Task: task}
+
+	ms.changes = append(ms.changes, change)
+	if len(ms.changes) > ChangeLogRetention {
+		ms.changes = ms.changes[len(ms.changes)-ChangeLogRetention:]
+	}
+
+	ms.feed.publish(change)
+}
@@ -0,0 +1,209 @@
+package arkd
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/rs/zerolog"
+	"go.etcd.io/bbolt"
+)
+
+// stored records start with a byte giving the encoding of the rest of the
+// record, so the encoding can change without rewriting every record at once
+const recordVersionJSON byte = 1
+
+var ErrUnknownRecordVersion = errors.New("unknown record version")
+
+func encodeRecord(v any) ([]byte, error) {
+	payload, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	return append([]byte{recordVersionJSON}, payload...), nil
+}
+
+func decodeRecord(raw []byte, v any) error {
+	if len(raw) == 0 {
+		return fmt.Errorf("%w: empty record", ErrUnknownRecordVersion)
+	}
+
+	switch raw[0] {
+	case recordVersionJSON:
+		return json.Unmarshal(raw[1:], v)
+	}
+
+	return fmt.Errorf("%w: %d", ErrUnknownRecordVersion, raw[0])
+}
+
+var metaBucketName = []byte("MetaBucket")
+var schemaVersionKey = []byte("schema_version")
+
+var ErrUnsupportedSchemaVersion = errors.New("task store: database was written by a newer arkd")
+
+type migration struct {
+	description string
+	migrate     func(tx *bbolt.Tx) error
+}
+
+// migrations[i] takes the database from schema version i to i+1. databases
+// without a schema version are at 0. migrations must be safe to run on an
+// empty database.
+var migrations = []migration{
+	{"store tasks in versioned records", migrateRecordEnvelope},
+	{"index tasks by deployment, stack, app and status", func(tx *bbolt.Tx) error {
+		_, err := rebuildIndexes(tx)
+		return err
+	}},
+	{"add the task event log", migrateEventRecords},
+	{"add the task change log", func(tx *bbolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(taskChangesBucketName)
+		return err
+	}},
+}
+
+// SchemaVersion is the version of the database layout written by this arkd
+var SchemaVersion = uint64(len(migrations))
+
+// migrateTaskStore runs every migration the database hasn't seen yet, each
+// in its own transaction along with the version bump
+func migrateTaskStore(db *bbolt.DB, logger zerolog.Logger) error {
+	var version uint64
+	err := db.View(func(tx *bbolt.Tx) error {
+		version = schemaVersion(tx)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if version > SchemaVersion {
+		return fmt.Errorf("%w: schema version %d, want at most %d", ErrUnsupportedSchemaVersion, version, SchemaVersion)
+	}
+
+	for ; version < SchemaVersion; version++ {
+		m := migrations[version]
+
+		err := db.Update(func(tx *bbolt.Tx) error {
+			if err := m.migrate(tx); err != nil {
+				return err
+			}
+
+			return setSchemaVersion(tx, version+1)
+		})
+		if err != nil {
+			return fmt.Errorf("could not migrate task store to version %d (%s): %w", version+1, m.description, err)
+		}
+
+		logger.Info().Uint64("schema_version", version+1).Str("migration", m.description).Msg("migrated task store")
+	}
+
+	return nil
+}
+
+func schemaVersion(tx *bbolt.Tx) uint64 {
+	b := tx.Bucket(metaBucketName)
+	if b == nil {
+		return 0
+	}
+
+	raw := b.Get(schemaVersionKey)
+	if len(raw) != 8 {
+		return 0
+	}
+
+	return binary.BigEndian.Uint64(raw)
+}
+
+func setSchemaVersion(tx *bbolt.Tx, version uint64) error {
+	b, err := tx.CreateBucketIfNotExists(metaBucketName)
+	if err != nil {
+		return err
+	}
+
+	return b.Put(schemaVersionKey, binary.BigEndian.AppendUint64(nil, version))
+}
+
+// migrateRecordEnvelope rewrites tasks stored as an ascii status digit
+// followed by json into versioned records
+func migrateRecordEnvelope(tx *bbolt.Tx) error {
+	b, err := tx.CreateBucketIfNotExists(tasksBucketName)
+	if err != nil {
+		return err
+	}
+
+	updates := make(map[string][]byte)
+	err = b.ForEach(func(k, v []byte) error {
+		if len(v) > 0 && v[0] == recordVersionJSON {
+			return nil
+		}
+
+		task, err := readLegacyTaskBytes(v)
+		if err != nil {
+			return fmt.Errorf("task %x: %w", k, err)
+		}
+
+		buf, err := writeTaskBytes(task)
+		if err != nil {
+			return err
+		}
+		updates[string(k)] = buf
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// buckets can't be written while iterating them
+	for k, v := range updates {
+		if err := b.Put([]byte(k), v); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func readLegacyTaskBytes(raw []byte) (Task, error) {
+	if len(raw) < 2 || raw[0] < '0' || raw[0] > '9' {
+		return Task{}, fmt.Errorf("%w: not a legacy task record", ErrUnknownRecordVersion)
+	}
+
+	var task Task
+	if err := json.Unmarshal(raw[1:], &task); err != nil {
+		return Task{}, err
+	}
+	task.Status = TaskStatus(raw[0] - '0')
+
+	return task, nil
+}
+
+// migrateEventRecords creates the event log, wrapping events written as
+// plain json before records were versioned
+func migrateEventRecords(tx *bbolt.Tx) error {
+	b, err := tx.CreateBucketIfNotExists(taskEventsBucketName)
+	if err != nil {
+		return err
+	}
+
+	updates := make(map[string][]byte)
+	err = b.ForEach(func(k, v []byte) error {
+		if len(v) > 0 && v[0] == '{' {
+			updates[string(k)] = append([]byte{recordVersionJSON}, v...)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for k, v := range updates {
+		if err := b.Put([]byte(k), v); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,146 @@
+package arkd
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/oklog/ulid/v2"
+	"github.com/rs/zerolog"
+	"go.etcd.io/bbolt"
+)
+
+// openFixture opens a copy of a fixture database from testdata, see
+// testdata/gen_fixtures.go
+func openFixture(t *testing.T, name string) *bbolt.DB {
+	t.Helper()
+
+	src, err := os.Open(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatalf("open fixture: %v", err)
+	}
+	defer src.Close()
+
+	path := filepath.Join(t.TempDir(), name)
+	dst, err := os.Create(path)
+	if err != nil {
+		t.Fatalf("create fixture copy: %v", err)
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		t.Fatalf("copy fixture: %v", err)
+	}
+	dst.Close()
+
+	db, err := bbolt.Open(path, 0600, &bbolt.Options{Timeout: time.Second})
+	if err != nil {
+		t.Fatalf("bbolt.Open() error = %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	return db
+}
+
+func Test_migrateTaskStore_v0(t *testing.T) {
+	ctx := context.Background()
+	db := openFixture(t, "arkd_v0.db")
+
+	ts, err := NewBoltTaskStore(db, zerolog.Nop())
+	if err != nil {
+		t.Fatalf("NewBoltTaskStore() error = %v", err)
+	}
+
+	err = db.View(func(tx *bbolt.Tx) error {
+		if v := schemaVersion(tx); v != SchemaVersion {
+			t.Errorf("schema version = %d, want %d", v, SchemaVersion)
+		}
+		return tx.Bucket(tasksBucketName).ForEach(func(k, v []byte) error {
+			if v[0] != recordVersionJSON {
+				t.Errorf("task %x not rewritten, starts with %q", k, v[0])
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	web, err := ts.GetTask(ctx, ulid.MustParse("01J0000000000000000000000A"))
+	if err != nil {
+		t.Fatalf("GetTask() error = %v", err)
+	}
+	if web.Status != TaskStatusRunning || web.AppName != "web" || web.ContainerID != "c1" || web.Image.Repository != "library/ubuntu" {
+		t.Errorf("migrated task = %+v", web)
+	}
+
+	exited, err := ts.FindTasks(ctx, TaskFilter{Statuses: []TaskStatus{TaskStatusExited}})
+	if err != nil {
+		t.Fatalf("FindTasks() error = %v", err)
+	}
+	if len(exited) != 1 || exited[0].AppName != "worker" {
+		t.Errorf("FindTasks(exited) = %+v, want the worker task", exited)
+	}
+
+	// only the running task holds resources, not the exited or pending one
+	if m := ts.AggMetrics(ctx); m.TotalTasks != 3 || m.AllocatedCpu != 1 || m.AllocatedMem != 256 {
+		t.Errorf("AggMetrics() = %+v", m)
+	}
+
+	// new writes work on a migrated database
+	if err := ts.SetTaskStatus(ctx, web, TaskStatusExited, StatusChange{Reason: "container exited"}); err != nil {
+		t.Fatalf("SetTaskStatus() error = %v", err)
+	}
+	events, err := ts.GetTaskEvents(ctx, web.ID)
+	if err != nil {
+		t.Fatalf("GetTaskEvents() error = %v", err)
+	}
+	if len(events) != 1 || events[0].From != TaskStatusRunning || events[0].To != TaskStatusExited {
+		t.Errorf("GetTaskEvents() = %+v", events)
+	}
+}
+
+func Test_migrateTaskStore_idempotent(t *testing.T) {
+	db := openFixture(t, "arkd_v0.db")
+
+	for i := 0; i < 2; i++ {
+		if _, err := NewBoltTaskStore(db, zerolog.Nop()); err != nil {
+			t.Fatalf("NewBoltTaskStore() run %d error = %v", i+1, err)
+		}
+	}
+}
+
+func Test_migrateTaskStore_newer_schema(t *testing.T) {
+	_, db := newTestTaskStore(t)
+
+	err := db.Update(func(tx *bbolt.Tx) error {
+		return setSchemaVersion(tx, SchemaVersion+1)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := NewBoltTaskStore(db, zerolog.Nop()); !errors.Is(err, ErrUnsupportedSchemaVersion) {
+		t.Errorf("NewBoltTaskStore() error = %v, want %v", err, ErrUnsupportedSchemaVersion)
+	}
+}
+
+func Test_decodeRecord(t *testing.T) {
+	var task Task
+	if err := decodeRecord([]byte(`5{"app_name":"web"}`), &task); !errors.Is(err, ErrUnknownRecordVersion) {
+		t.Errorf("decodeRecord(legacy) error = %v, want %v", err, ErrUnknownRecordVersion)
+	}
+
+	raw, err := encodeRecord(Task{AppName: "web", Status: TaskStatusCrashed})
+	if err != nil {
+		t.Fatalf("encodeRecord() error = %v", err)
+	}
+	if err := decodeRecord(raw, &task); err != nil {
+		t.Fatalf("decodeRecord() error = %v", err)
+	}
+	if task.AppName != "web" || task.Status != TaskStatusCrashed {
+		t.Errorf("decodeRecord() = %+v", task)
+	}
+}
@@ -0,0 +1,79 @@
+//go:build ignore
+
+// gen_fixtures writes the fixture databases used by the task store migration
+// tests. the records are written the way older versions of arkd wrote them,
+// so don't change existing fixtures, add new ones.
+//
+//	go run testdata/gen_fixtures.go
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/oklog/ulid/v2"
+	"go.etcd.io/bbolt"
+)
+
+// legacyTask is the task record as written before versioned records
+type legacyTask struct {
+	ID               string            `json:"id"`
+	AppName          string            `json:"app_name"`
+	DeploymentName   string            `json:"deployment_name"`
+	StackName        string            `json:"stack_name"`
+	ContainerID      string            `json:"container_id"`
+	CPU              float64           `json:"cpu"`
+	StartedAt        time.Time         `json:"started_at"`
+	Status           int               `json:"status"`
+	Memory           int               `json:"memory"`
+	Image            map[string]string `json:"image"`
+	HostPortBindings map[string]string `json:"host_port_bindings"`
+}
+
+func main() {
+	writeV0("testdata/arkd_v0.db")
+}
+
+// writeV0 writes a database with only a tasks bucket, each task stored as an
+// ascii status digit followed by json
+func writeV0(path string) {
+	os.Remove(path)
+	db, err := bbolt.Open(path, 0600, nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+
+	startedAt := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	tasks := []legacyTask{
+		{ID: "01J0000000000000000000000A", AppName: "web", DeploymentName: "main", StackName: "babies-first-ark", Status: 5, CPU: 1, Memory: 256, ContainerID: "c1", StartedAt: startedAt},
+		{ID: "01J0000000000000000000000B", AppName: "worker", DeploymentName: "main", StackName: "babies-first-ark", Status: 7, CPU: 0.5, Memory: 128, ContainerID: "c2", StartedAt: startedAt},
+		{ID: "01J0000000000000000000000C", AppName: "web", DeploymentName: "preview", StackName: "babies-first-ark", Status: 1, CPU: 1, Memory: 256},
+	}
+
+	err = db.Update(func(tx *bbolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("TasksBucket"))
+		if err != nil {
+			return err
+		}
+
+		for _, t := range tasks {
+			t.Image = map[string]string{"full_name": "registry-1.docker.io/library/ubuntu:latest", "registry": "registry-1.docker.io", "repository": "library/ubuntu", "tag": "latest"}
+			raw, err := json.Marshal(t)
+			if err != nil {
+				return err
+			}
+			if err := b.Put(ulid.MustParse(t.ID).Bytes(), append([]byte(strconv.Itoa(t.Status)), raw...)); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,14 @@
+package arkd
+
+// Volume is a docker volume backing a task disk. volumes are named after
+// the disk and the task's qualified name so they survive task replacement.
+type Volume struct {
+	Name           string `json:"name"`
+	DiskName       string `json:"disk_name"`
+	AppName        string `json:"app_name"`
+	DeploymentName string `json:"deployment_name"`
+	StackName      string `json:"stack_name"`
+	WorkerId       string `json:"worker_id"`
+	// size in GB
+	Size int `json:"size"`
+}
@@ -1,26 +1,42 @@
 package config
 
+import "time"
+
 const (
-	DefaultPort = 5500
-	DefaultCpu  = 1.0             // 1 vCPU
-	DefaultMem  = 256 / (1 << 20) // 256 MB
+	DefaultPort               = 5500
+	DefaultCpu                = 1.0 // 1 vCPU
+	DefaultMem                = 256 // 256 MB
+	DefaultPids               = 512 // processes per task
+	DefaultTaskEventRetention = 100 // events kept per task
+	DefaultTaskRetentionCount = 10  // finished tasks kept per app
+	DefaultTaskRetentionAge   = 0   // finished tasks are kept until the count is reached
 )
 
 type Config struct {
-	ApiVersion     string  `json:"api_version"`
-	ApiPort        int     `json:"api_port"`
-	DefaultTaskCpu float64 `json:"default_task_cpu"`
-	DefaultTaskMem int     `json:"default_task_mem"`
-	WorkerId       string  `json:"worker_id"`
+	ApiVersion         string  `json:"api_version"`
+	ApiPort            int     `json:"api_port"`
+	DefaultTaskCpu     float64 `json:"default_task_cpu"`
+	DefaultTaskMem     int     `json:"default_task_mem"`
+	DefaultTaskPids    int     `json:"default_task_pids"`
+	WorkerId           string  `json:"worker_id"`
+	TaskEventRetention int     `json:"task_event_retention"`
+	// finished tasks kept per app and how long they're kept for, zero
+	// disables either limit
+	TaskRetentionCount int           `json:"task_retention_count"`
+	TaskRetentionAge   time.Duration `json:"task_retention_age"`
 }
 
 type ConfigFn func(cfg *Config)
 
 func NewConfig(options ...ConfigFn) Config {
 	cfg := Config{
-		ApiPort:        DefaultPort,
-		DefaultTaskCpu: DefaultCpu,
-		DefaultTaskMem: DefaultMem,
+		ApiPort:            DefaultPort,
+		DefaultTaskCpu:     DefaultCpu,
+		DefaultTaskMem:     DefaultMem,
+		DefaultTaskPids:    DefaultPids,
+		TaskEventRetention: DefaultTaskEventRetention,
+		TaskRetentionCount: DefaultTaskRetentionCount,
+		TaskRetentionAge:   DefaultTaskRetentionAge,
 	}
 
 	for _, opt := range options {
@@ -41,3 +57,27 @@ func WithWorkerId(wid string) ConfigFn {
 		cfg.WorkerId = wid
 	}
 }
+
+func WithTaskEventRetention(n int) ConfigFn {
+	return func(cfg *Config) {
+		if n > 0 {
+			cfg.TaskEventRetention = n
+		}
+	}
+}
+
+func WithTaskRetentionCount(n int) ConfigFn {
+	return func(cfg *Config) {
+		if n >= 0 {
+			cfg.TaskRetentionCount = n
+		}
+	}
+}
+
+func WithTaskRetentionAge(d time.Duration) ConfigFn {
+	return func(cfg *Config) {
+		if d >= 0 {
+			cfg.TaskRetentionAge = d
+		}
+	}
+}
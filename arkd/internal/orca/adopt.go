@@ -0,0 +1,132 @@
+package orca
+
+import (
+	"context"
+	"strings"
+
+	"github.com/dkimot/ark/arkd/internal/arkd"
+	"github.com/dkimot/ark/arkd/internal/config"
+	"github.com/oklog/ulid/v2"
+	"github.com/rs/zerolog"
+)
+
+// AdoptContainers brings the task store in line with the containers arkd
+// created, after it was restored from a snapshot. containers carrying the
+// arkd_task_id label are taken over by their task, which is recreated from
+// the container if the snapshot predates it. tasks whose container is gone
+// are marked exited. it must run before Start.
+func AdoptContainers(ctx context.Context, cfg config.Config, logger zerolog.Logger, runtime arkd.Runtime, taskStore arkd.TaskStore) error {
+	containers, err := runtime.ListContainers(ctx, "arkd_task_id")
+	if err != nil {
+		return err
+	}
+
+	seen := make(map[ulid.ULID]bool)
+	for _, ctr := range containers {
+		taskId, err := ulid.Parse(ctr.Labels["arkd_task_id"])
+		if err != nil {
+			logger.Warn().Err(err).Str("container_id", ctr.ID).Msg("container has an invalid task id, not adopting it")
+			continue
+		}
+		seen[taskId] = true
+
+		task, err := taskStore.GetTask(ctx, taskId)
+		if err != nil {
+			task, err = taskFromContainer(ctx, cfg, runtime, taskId, ctr.ID)
+			if err != nil {
+				return err
+			}
+		}
+
+		task.ContainerID = ctr.ID
+		status, reason := adoptedStatus(ctr.State, task.HealthCheck.Enabled())
+		task.Status = status
+
+		if err := taskStore.AdoptTask(ctx, *task, arkd.StatusChange{Reason: reason}); err != nil {
+			return err
+		}
+		logger.Info().Str("task_id", taskId.String()).Str("container_id", ctr.ID).Msg("adopted container")
+	}
+
+	tasks, err := taskStore.FindTasks(ctx, arkd.TaskFilter{
+		Statuses: []arkd.TaskStatus{arkd.TaskStatusCreating, arkd.TaskStatusStarting, arkd.TaskStatusRunning},
+	})
+	if err != nil {
+		return err
+	}
+	for _, task := range tasks {
+		if seen[task.ID] || task.ContainerID == "" {
+			continue
+		}
+
+		if err := taskStore.SetTaskStatus(ctx, &task, arkd.TaskStatusExited, arkd.StatusChange{Reason: "container missing after restore"}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// taskFromContainer rebuilds a task the store doesn't know about from its
+// container's labels and config
+func taskFromContainer(ctx context.Context, cfg config.Config, runtime arkd.Runtime, taskId ulid.ULID, containerId string) (*arkd.Task, error) {
+	ctr, err := runtime.InspectContainer(ctx, containerId)
+	if err != nil {
+		return nil, err
+	}
+
+	image, err := arkd.NewImageRef(ctr.Config.Image)
+	if err != nil {
+		return nil, err
+	}
+
+	env := make(map[string]string)
+	for _, kv := range ctr.Config.Env {
+		if k, v, ok := strings.Cut(kv, "="); ok {
+			env[k] = v
+		}
+	}
+
+	task := &arkd.Task{
+		ID:             taskId,
+		AppName:        ctr.Config.Labels["arkd_app"],
+		DeploymentName: ctr.Config.Labels["arkd_deployment"],
+		StackName:      ctr.Config.Labels["arkd_stack"],
+		CPU:            cfg.DefaultTaskCpu,
+		Memory:         cfg.DefaultTaskMem,
+		Pids:           cfg.DefaultTaskPids,
+		Image:          image,
+		Env:            env,
+	}
+
+	// containers created with limits keep them, so they're accounted for
+	if hc := ctr.HostConfig; hc != nil {
+		if hc.NanoCPUs > 0 {
+			task.CPU = float64(hc.NanoCPUs) / 1e9
+		}
+		if hc.Memory > 0 {
+			task.Memory = int(hc.Memory >> 20)
+		}
+		if hc.PidsLimit != nil && *hc.PidsLimit > 0 {
+			task.Pids = int(*hc.PidsLimit)
+		}
+	}
+
+	return task, nil
+}
+
+// adoptedStatus maps a docker container state to a task status
+func adoptedStatus(state string, healthChecked bool) (arkd.TaskStatus, string) {
+	switch state {
+	case "created":
+		return arkd.TaskStatusStarting, "adopted created container"
+	case "running", "restarting", "paused":
+		// the health checker moves it to running once a check passes
+		if healthChecked {
+			return arkd.TaskStatusStarting, "adopted running container"
+		}
+		return arkd.TaskStatusRunning, "adopted running container"
+	}
+
+	return arkd.TaskStatusExited, "adopted exited container"
+}
@@ -0,0 +1,80 @@
+package orca
+
+import (
+	"context"
+	"time"
+
+	"github.com/dkimot/ark/arkd/internal/arkd"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// how often finished tasks are garbage collected
+const gcInterval = time.Minute
+
+func (o *Orca) retentionPolicy() arkd.RetentionPolicy {
+	return arkd.RetentionPolicy{
+		KeepPerApp: o.cfg.TaskRetentionCount,
+		MaxAge:     o.cfg.TaskRetentionAge,
+	}
+}
+
+// ExpiredTasks lists the finished tasks the next garbage collection removes
+func (o *Orca) ExpiredTasks(ctx context.Context) ([]arkd.ExpiredTask, error) {
+  var span trace.Span
+  ctx, span = o.tracer.Start(ctx, "expired_tasks")
+  defer span.End()
+
+	tasks, err := o.taskStore.FindTasks(ctx, arkd.TaskFilter{
+		Statuses: []arkd.TaskStatus{arkd.TaskStatusExited, arkd.TaskStatusCrashed},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return o.retentionPolicy().Expired(tasks, time.Now()), nil
+}
+
+func (o *Orca) startCollector() {
+	for range time.Tick(gcInterval) {
+		if err := o.collectTasks(context.Background()); err != nil {
+			o.l.Error().Err(err).Msg("could not garbage collect tasks")
+		}
+	}
+}
+
+// collectTasks destroys the expired tasks, removing their containers, proxy
+// registrations and records
+func (o *Orca) collectTasks(ctx context.Context) error {
+  var span trace.Span
+  ctx, span = o.tracer.Start(ctx, "collect_tasks")
+  defer span.End()
+
+	expired, err := o.ExpiredTasks(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, e := range expired {
+		// skip tasks that were started again since they were listed
+		task, err := o.taskStore.GetTask(ctx, e.Task.ID)
+		if err != nil || !task.Status.Finished() {
+			continue
+		}
+
+		if err := o.DestroyTask(ctx, task.ID, true, nil); err != nil {
+			o.l.Error().Err(err).Str("task_id", task.ID.String()).Msg("could not garbage collect task")
+			continue
+		}
+
+		o.gcRemoved.Add(ctx, 1, metric.WithAttributes(attribute.String("reason", e.Reason)))
+		o.l.Info().
+			Str("task_id", task.ID.String()).
+			Str("app_name", task.AppName).
+			Str("reason", e.Reason).
+			Msg("garbage collected task")
+	}
+
+	return nil
+}
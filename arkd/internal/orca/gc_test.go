@@ -0,0 +1,50 @@
+package orca
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/dkimot/ark/arkd/internal/arkd"
+)
+
+func Test_Orca_collectTasks(t *testing.T) {
+	o, runtime, pxy := newTestOrca(t)
+	o.cfg.TaskRetentionCount = 1
+
+	taskDef := testTaskDef()
+	taskDef.ExposedPorts = []string{"8080"}
+	oldest := startTestTask(t, o, taskDef)
+	newest := startTestTask(t, o, taskDef)
+	running := startTestTask(t, o, taskDef)
+
+	for _, task := range []*arkd.Task{oldest, newest} {
+		runtime.Exit(task.ContainerID, 0)
+		o.reconcile(context.Background())
+		waitForStatus(t, o, task.ID, arkd.TaskStatusExited)
+	}
+
+	// the containers have exited, nothing should be stopped
+	runtime.Fail("StopContainer", errors.New("runtime failure"))
+	if err := o.collectTasks(context.Background()); err != nil {
+		t.Fatalf("collectTasks() error = %v", err)
+	}
+
+	if _, err := o.taskStore.GetTask(context.Background(), oldest.ID); !errors.Is(err, arkd.ErrTaskNotFound) {
+		t.Errorf("GetTask() error = %v, want %v", err, arkd.ErrTaskNotFound)
+	}
+	if state := runtime.ContainerState(oldest.ContainerID); state != "" {
+		t.Errorf("container state = %q, want it removed", state)
+	}
+	if pxy.registered(oldest.ID) {
+		t.Error("task still registered with the proxy")
+	}
+
+	// the newest finished task is retained, running tasks aren't collected
+	for _, task := range []*arkd.Task{newest, running} {
+		getTestTask(t, o, task.ID)
+		if state := runtime.ContainerState(task.ContainerID); state == "" {
+			t.Errorf("container of task %s was removed", task.ID)
+		}
+	}
+}
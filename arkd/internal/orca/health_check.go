@@ -0,0 +1,305 @@
+package orca
+
+import (
+  "context"
+  "errors"
+  "fmt"
+  "io"
+  "net"
+  "net/http"
+  "strconv"
+  "sync"
+  "time"
+
+  "github.com/dkimot/ark"
+  "github.com/dkimot/ark/arkd/internal/arkd"
+  "github.com/oklog/ulid/v2"
+  "github.com/rs/zerolog"
+)
+
+var ErrHealthCheckFailed = errors.New("orca: health check failed")
+
+const (
+  defaultHealthCheckInterval = 30 * time.Second
+  defaultHealthCheckTimeout = 5 * time.Second
+  // until the first check passes, checks run at most this far apart so
+  // tasks become running soon after they are ready
+  startingHealthCheckInterval = 2 * time.Second
+  // output kept per check result
+  maxHealthCheckOutput = 256
+)
+
+// healthChecker runs the health checks of the worker's tasks, one goroutine
+// per task
+type healthChecker struct {
+  l         zerolog.Logger
+  runtime   arkd.Runtime
+  taskStore arkd.TaskStore
+  http      *http.Client
+
+  mtx  sync.Mutex
+  runs map[ulid.ULID]*healthCheckRun
+}
+
+// healthCheckRun is the goroutine checking a task. a stopped run may still
+// be winding down when the task is started again, so runs are told apart
+// by identity.
+type healthCheckRun struct {
+  cancel context.CancelFunc
+}
+
+func newHealthChecker(logger zerolog.Logger, runtime arkd.Runtime, taskStore arkd.TaskStore) *healthChecker {
+  return &healthChecker{
+    l: logger,
+    runtime: runtime,
+    taskStore: taskStore,
+    http: &http.Client{
+      // a redirect is a response like any other, its status is checked
+      CheckRedirect: func(*http.Request, []*http.Request) error {
+        return http.ErrUseLastResponse
+      },
+    },
+    runs: make(map[ulid.ULID]*healthCheckRun),
+  }
+}
+
+// start begins checking task. it does nothing if the task has no health
+// check or is already being checked.
+func (hc *healthChecker) start(task arkd.Task) error {
+  if !task.HealthCheck.Enabled() {
+    return nil
+  }
+
+  cfg, err := parseHealthCheck(task.HealthCheck)
+  if err != nil {
+    return err
+  }
+
+  hc.mtx.Lock()
+  defer hc.mtx.Unlock()
+
+  if _, ok := hc.runs[task.ID]; ok {
+    return nil
+  }
+
+  ctx, cancel := context.WithCancel(context.Background())
+  r := &healthCheckRun{cancel: cancel}
+  hc.runs[task.ID] = r
+  go hc.run(ctx, r, task, cfg)
+
+  return nil
+}
+
+// stop stops checking the task
+func (hc *healthChecker) stop(taskId ulid.ULID) {
+  hc.mtx.Lock()
+  defer hc.mtx.Unlock()
+
+  if r, ok := hc.runs[taskId]; ok {
+    r.cancel()
+    delete(hc.runs, taskId)
+  }
+}
+
+// done removes r once its goroutine exits, unless the task was stopped and
+// started again meanwhile and the entry is a newer run's
+func (hc *healthChecker) done(taskId ulid.ULID, r *healthCheckRun) {
+  hc.mtx.Lock()
+  defer hc.mtx.Unlock()
+
+  r.cancel()
+  if hc.runs[taskId] == r {
+    delete(hc.runs, taskId)
+  }
+}
+
+type healthCheckConfig struct {
+  gracePeriod time.Duration
+  interval    time.Duration
+  timeout     time.Duration
+  command     string
+  request     *ark.HealthCheckRequest
+  port        int
+}
+
+func parseHealthCheck(hc arkd.TaskHealthCheck) (healthCheckConfig, error) {
+  cfg := healthCheckConfig{
+    interval: defaultHealthCheckInterval,
+    timeout: defaultHealthCheckTimeout,
+    command: hc.Command,
+    port: hc.Port,
+  }
+
+  for _, d := range []struct {
+    raw string
+    dst *time.Duration
+  }{
+    {hc.GracePeriod, &cfg.gracePeriod},
+    {hc.Interval, &cfg.interval},
+    {hc.Timeout, &cfg.timeout},
+  } {
+    if d.raw == "" {
+      continue
+    }
+    parsed, err := time.ParseDuration(d.raw)
+    if err != nil {
+      return cfg, fmt.Errorf("invalid health check duration %q: %w", d.raw, err)
+    }
+    *d.dst = parsed
+  }
+
+  if hc.Request != "" {
+    req, err := ark.ParseHealthCheckRequest(hc.Request)
+    if err != nil {
+      return cfg, err
+    }
+    cfg.request = &req
+  }
+
+  return cfg, nil
+}
+
+func (hc *healthChecker) run(ctx context.Context, r *healthCheckRun, task arkd.Task, cfg healthCheckConfig) {
+  defer hc.done(task.ID, r)
+
+  startedAt := task.StartedAt
+  if startedAt.IsZero() {
+    startedAt = time.Now()
+  }
+
+  for {
+    result := hc.check(ctx, task, cfg)
+    if ctx.Err() != nil {
+      return
+    }
+
+    inGracePeriod := time.Since(startedAt) < cfg.gracePeriod
+    updated, err := hc.taskStore.RecordHealthCheck(ctx, task.ID, result, inGracePeriod)
+    if errors.Is(err, arkd.ErrTaskNotFound) {
+      return
+    }
+    if err != nil {
+      hc.l.Error().Err(err).Str("task_id", task.ID.String()).Msg("could not record health check")
+    } else {
+      if updated.Health.Status != task.Health.Status {
+        hc.l.Info().
+          Str("task_id", task.ID.String()).
+          Str("health", string(updated.Health.Status)).
+          Msg("task health changed")
+      }
+      task = *updated
+    }
+
+    interval := cfg.interval
+    if task.Health.Status != arkd.HealthStatusHealthy && interval > startingHealthCheckInterval {
+      interval = startingHealthCheckInterval
+    }
+
+    select {
+    case <-ctx.Done():
+      return
+    case <-time.After(interval):
+    }
+  }
+}
+
+// check runs a single health check
+func (hc *healthChecker) check(ctx context.Context, task arkd.Task, cfg healthCheckConfig) arkd.HealthCheckResult {
+  ctx, cancel := context.WithTimeout(ctx, cfg.timeout)
+  defer cancel()
+
+  result := arkd.HealthCheckResult{StartedAt: time.Now()}
+
+  var output string
+  var err error
+  if cfg.command != "" {
+    output, err = execHealthCheck(ctx, hc.runtime, task.ContainerID, cfg.command)
+  } else {
+    output, err = hc.httpHealthCheck(ctx, task, *cfg.request, cfg.port)
+  }
+
+  result.Duration = time.Since(result.StartedAt)
+  result.Passed = err == nil
+  if err != nil {
+    output = err.Error()
+  }
+  if len(output) > maxHealthCheckOutput {
+    output = output[:maxHealthCheckOutput]
+  }
+  result.Output = output
+
+  return result
+}
+
+// execHealthCheck runs command in the container. it passes if the command
+// exits with 0.
+func execHealthCheck(ctx context.Context, runtime arkd.Runtime, containerId, command string) (string, error) {
+  output, exitCode, err := runtime.ExecContainer(ctx, containerId, []string{"sh", "-c", command})
+  if ctx.Err() != nil {
+    return output, fmt.Errorf("%w: timed out", ErrHealthCheckFailed)
+  }
+  if err != nil {
+    return "", err
+  }
+  if exitCode != 0 {
+    return output, fmt.Errorf("%w: exit code %d: %s", ErrHealthCheckFailed, exitCode, output)
+  }
+
+  return output, nil
+}
+
+// httpHealthCheck sends req to the container on the deployment's network
+func (hc *healthChecker) httpHealthCheck(ctx context.Context, task arkd.Task, req ark.HealthCheckRequest, port int) (string, error) {
+  if port == 0 {
+    return "", fmt.Errorf("%w: no port to send %s %s to", ErrHealthCheckFailed, req.Method, req.Path)
+  }
+
+  ip, err := containerIP(ctx, hc.runtime, task)
+  if err != nil {
+    return "", err
+  }
+
+  url := "http://" + net.JoinHostPort(ip, strconv.Itoa(port)) + req.Path
+  httpReq, err := http.NewRequestWithContext(ctx, req.Method, url, nil)
+  if err != nil {
+    return "", err
+  }
+  for name, value := range req.Headers {
+    httpReq.Header.Set(name, value)
+  }
+
+  resp, err := hc.http.Do(httpReq)
+  if err != nil {
+    return "", fmt.Errorf("%w: %w", ErrHealthCheckFailed, err)
+  }
+  defer resp.Body.Close()
+  io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+  if !req.Accepts(resp.StatusCode) {
+    return "", fmt.Errorf("%w: %s %s returned %s", ErrHealthCheckFailed, req.Method, req.Path, resp.Status)
+  }
+
+  return resp.Status, nil
+}
+
+// containerIP returns the task's address on its deployment network
+func containerIP(ctx context.Context, runtime arkd.Runtime, task arkd.Task) (string, error) {
+  ctr, err := runtime.InspectContainer(ctx, task.ContainerID)
+  if err != nil {
+    return "", fmt.Errorf("could not inspect container %s: %w", task.ContainerID, err)
+  }
+  if ctr.NetworkSettings == nil {
+    return "", fmt.Errorf("%w: container %s has no network", ErrHealthCheckFailed, task.ContainerID)
+  }
+
+  if net, ok := ctr.NetworkSettings.Networks[deploymentNetworkName(task)]; ok && net.IPAddress != "" {
+    return net.IPAddress, nil
+  }
+  for _, net := range ctr.NetworkSettings.Networks {
+    if net.IPAddress != "" {
+      return net.IPAddress, nil
+    }
+  }
+
+  return "", fmt.Errorf("%w: container %s has no ip address", ErrHealthCheckFailed, task.ContainerID)
+}
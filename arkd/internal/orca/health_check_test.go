@@ -0,0 +1,42 @@
+package orca
+
+import (
+	"context"
+	"testing"
+
+	"github.com/dkimot/ark/arkd/internal/arkd"
+	"github.com/rs/zerolog"
+)
+
+func Test_healthChecker_restart(t *testing.T) {
+	ctx := context.Background()
+	store := arkd.NewMemTaskStore()
+	hc := newHealthChecker(zerolog.Nop(), arkd.NewFakeRuntime(), store)
+
+	task, err := store.CreateTask(ctx, arkd.TaskDefinition{AppName: "web", Image: "nginx:1.25", HealthCheck: arkd.TaskHealthCheck{Command: "true"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := hc.start(*task); err != nil {
+		t.Fatalf("start() error = %v", err)
+	}
+	hc.mtx.Lock()
+	first := hc.runs[task.ID]
+	hc.mtx.Unlock()
+
+	// the task is stopped and started again before the first run exits
+	hc.stop(task.ID)
+	if err := hc.start(*task); err != nil {
+		t.Fatalf("start() error = %v", err)
+	}
+	defer hc.stop(task.ID)
+
+	hc.done(task.ID, first)
+
+	hc.mtx.Lock()
+	defer hc.mtx.Unlock()
+	if r, ok := hc.runs[task.ID]; !ok || r == first {
+		t.Error("first run exiting removed the second one")
+	}
+}
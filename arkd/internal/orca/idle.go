@@ -0,0 +1,384 @@
+package orca
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/dkimot/ark/arkd/internal/arkd"
+	"github.com/oklog/ulid/v2"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+var ErrTaskNotSuspended = errors.New("orca: task is not suspended")
+
+const (
+	// how often fronted tasks are checked for being idle
+	idleCheckInterval = 30 * time.Second
+	// how long a held request waits for its task to wake
+	wakeTimeout = 2 * time.Minute
+	// how often a waking task is checked for being running
+	wakePollInterval = 250 * time.Millisecond
+)
+
+// scalesToZero reports whether the task is suspended when idle. it's opt-in,
+// only web tasks, the ones with ports on the proxy, with an idle timeout are.
+func scalesToZero(task arkd.Task) bool {
+	return !task.KeepAlive && task.IdleTimeout != "" && len(task.HostPortBindings) > 0
+}
+
+func idleTimeout(task arkd.Task) (time.Duration, error) {
+	d, err := time.ParseDuration(task.IdleTimeout)
+	if err != nil {
+		return 0, fmt.Errorf("invalid idle timeout %q: %w", task.IdleTimeout, err)
+	}
+
+	return d, nil
+}
+
+// taskFront sits between the proxy and a task that scales to zero. it
+// forwards requests to the task's container and tracks when the task last
+// served one. while the task is suspended requests are held until it's
+// woken again.
+type taskFront struct {
+	taskId      ulid.ULID
+	idleTimeout time.Duration
+	// starts the task and waits until it's running
+	wake     func(ctx context.Context) error
+	listener net.Listener
+	server   *http.Server
+	proxy    *httputil.ReverseProxy
+
+	mtx        sync.Mutex
+	lastActive time.Time
+	inFlight   int
+	suspended  bool
+	// closed once the task being suspended is stopped, it's only woken after
+	stopping chan struct{}
+	// closed when the wake started by a held request is done
+	waking  chan struct{}
+	wakeErr error
+}
+
+func newTaskFront(task arkd.Task, suspended bool, wake func(ctx context.Context) error) (*taskFront, error) {
+	timeout, err := idleTimeout(task)
+	if err != nil {
+		return nil, err
+	}
+
+	// the proxy has one port per task, so does the front
+	hostPorts := make([]string, 0, len(task.HostPortBindings))
+	for hostPort := range task.HostPortBindings {
+		hostPorts = append(hostPorts, hostPort)
+	}
+	sort.Strings(hostPorts)
+	target := &url.URL{Scheme: "http", Host: "localhost:" + hostPorts[0]}
+
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		return nil, fmt.Errorf("could not listen for task %s: %w", task.ID, err)
+	}
+
+	f := &taskFront{
+		taskId:      task.ID,
+		idleTimeout: timeout,
+		wake:        wake,
+		listener:    listener,
+		proxy:       httputil.NewSingleHostReverseProxy(target),
+		lastActive:  time.Now(),
+		suspended:   suspended,
+	}
+	f.server = &http.Server{
+		Handler:           f,
+		ReadHeaderTimeout: 3 * time.Second,
+	}
+	go f.server.Serve(listener)
+
+	return f, nil
+}
+
+// port is what the proxy sends the task's requests to
+func (f *taskFront) port() string {
+	return strconv.Itoa(f.listener.Addr().(*net.TCPAddr).Port)
+}
+
+func (f *taskFront) close() error {
+	return f.server.Close()
+}
+
+func (f *taskFront) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if err := f.acquire(r.Context()); err != nil {
+		http.Error(w, "task unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	defer f.release()
+
+	f.proxy.ServeHTTP(w, r)
+}
+
+// acquire waits until the task is running, waking it if it's suspended
+func (f *taskFront) acquire(ctx context.Context) error {
+	f.mtx.Lock()
+	for f.suspended {
+		waking := f.waking
+		if waking == nil {
+			waking = make(chan struct{})
+			f.waking = waking
+			go f.runWake(waking)
+		}
+		f.mtx.Unlock()
+
+		select {
+		case <-waking:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+
+		f.mtx.Lock()
+		if f.suspended && f.wakeErr != nil {
+			err := f.wakeErr
+			f.mtx.Unlock()
+			return err
+		}
+	}
+
+	f.inFlight++
+	f.lastActive = time.Now()
+	f.mtx.Unlock()
+
+	return nil
+}
+
+func (f *taskFront) release() {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	f.inFlight--
+	f.lastActive = time.Now()
+}
+
+// runWake wakes the task for every request held meanwhile. it isn't tied to
+// the request that started it, which may give up before the task is up.
+func (f *taskFront) runWake(done chan struct{}) {
+	ctx, cancel := context.WithTimeout(context.Background(), wakeTimeout)
+	defer cancel()
+
+	f.mtx.Lock()
+	stopping := f.stopping
+	f.mtx.Unlock()
+
+	var err error
+	if stopping != nil {
+		select {
+		case <-stopping:
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+	}
+	if err == nil {
+		err = f.wake(ctx)
+	}
+
+	f.mtx.Lock()
+	f.waking = nil
+	f.wakeErr = err
+	if err == nil {
+		f.suspended = false
+		f.lastActive = time.Now()
+	}
+	f.mtx.Unlock()
+
+	close(done)
+}
+
+// suspendIfIdle holds new requests and reports true if the task has
+// served none for its idle timeout
+func (f *taskFront) suspendIfIdle(now time.Time) bool {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	if f.suspended || f.inFlight > 0 || now.Sub(f.lastActive) < f.idleTimeout {
+		return false
+	}
+
+	f.suspendLocked()
+	return true
+}
+
+// suspend holds new requests until the task is stopped and woken again
+func (f *taskFront) suspend() {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	f.suspendLocked()
+}
+
+func (f *taskFront) suspendLocked() {
+	f.suspended = true
+	if f.stopping == nil {
+		f.stopping = make(chan struct{})
+	}
+}
+
+// stopped lets held requests wake the task
+func (f *taskFront) stopped() {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	f.stoppedLocked()
+}
+
+func (f *taskFront) stoppedLocked() {
+	if f.stopping != nil {
+		close(f.stopping)
+		f.stopping = nil
+	}
+}
+
+// resume lets requests through again after a suspend that didn't stop the
+// task
+func (f *taskFront) resume() {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	f.suspended = false
+	f.lastActive = time.Now()
+	f.stoppedLocked()
+}
+
+// openFront puts a front between the proxy and the task if it scales to
+// zero
+func (o *Orca) openFront(task arkd.Task) error {
+	if !scalesToZero(task) {
+		return nil
+	}
+
+	o.frontsMtx.Lock()
+	defer o.frontsMtx.Unlock()
+
+	if _, ok := o.fronts[task.ID]; ok {
+		return nil
+	}
+
+	taskId := task.ID
+	front, err := newTaskFront(task, task.Status == arkd.TaskStatusSuspended, func(ctx context.Context) error {
+		return o.wakeAndWait(ctx, taskId)
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := o.proxy.RegisterApp(task.ID.String(), task.QualifiedName(), task.Domain(), front.port()); err != nil {
+		front.close()
+		return err
+	}
+	o.fronts[task.ID] = front
+
+	return nil
+}
+
+func (o *Orca) closeFront(taskId ulid.ULID) {
+	o.frontsMtx.Lock()
+	defer o.frontsMtx.Unlock()
+
+	if front, ok := o.fronts[taskId]; ok {
+		front.close()
+		delete(o.fronts, taskId)
+	}
+}
+
+func (o *Orca) front(taskId ulid.ULID) (*taskFront, bool) {
+	o.frontsMtx.Lock()
+	defer o.frontsMtx.Unlock()
+
+	front, ok := o.fronts[taskId]
+	return front, ok
+}
+
+// wakeAndWait wakes a suspended task and waits for it to be running, which
+// for tasks with a health check is once a check passed. the time it takes
+// is the task's cold start.
+func (o *Orca) wakeAndWait(ctx context.Context, taskId ulid.ULID) error {
+	startedAt := time.Now()
+	if err := o.WakeTask(ctx, taskId); err != nil {
+		return err
+	}
+
+	ticker := time.NewTicker(wakePollInterval)
+	defer ticker.Stop()
+
+	for {
+		task, err := o.taskStore.GetTask(ctx, taskId)
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case task.Status == arkd.TaskStatusRunning:
+			o.wakeDuration.Record(ctx, time.Since(startedAt).Seconds(), metric.WithAttributes(attribute.String("app_name", task.AppName)))
+			o.l.Info().
+				Str("task_id", taskId.String()).
+				Dur("took", time.Since(startedAt)).
+				Msg("woke task")
+			return nil
+		case task.Status.Finished():
+			return fmt.Errorf("task %s exited while waking", taskId)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+func (o *Orca) startIdler() {
+	for range time.Tick(idleCheckInterval) {
+		o.suspendIdleTasks(context.Background())
+	}
+}
+
+// suspendIdleTasks stops the running fronted tasks that have been idle for
+// their idle timeout
+func (o *Orca) suspendIdleTasks(ctx context.Context) {
+	o.frontsMtx.Lock()
+	fronts := make([]*taskFront, 0, len(o.fronts))
+	for _, front := range o.fronts {
+		fronts = append(fronts, front)
+	}
+	o.frontsMtx.Unlock()
+
+	now := time.Now()
+	for _, front := range fronts {
+		task, err := o.taskStore.GetTask(ctx, front.taskId)
+		if err != nil || task.Status != arkd.TaskStatusRunning {
+			continue
+		}
+
+		if !front.suspendIfIdle(now) {
+			continue
+		}
+
+		if err := o.stopTask(ctx, task.ID, "", nil, true); err != nil {
+			front.resume()
+			o.l.Error().Err(err).Str("task_id", task.ID.String()).Msg("could not suspend idle task")
+			continue
+		}
+
+		o.l.Info().
+			Str("task_id", task.ID.String()).
+			Str("app_name", task.AppName).
+			Dur("idle_timeout", front.idleTimeout).
+			Msg("suspended idle task")
+	}
+}
@@ -0,0 +1,195 @@
+package orca
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/dkimot/ark/arkd/internal/arkd"
+	"github.com/oklog/ulid/v2"
+)
+
+func Test_scalesToZero(t *testing.T) {
+	ports := map[string]string{"49152": "8080"}
+
+	tests := []struct {
+		name string
+		task arkd.Task
+		want bool
+	}{
+		{"idle timeout", arkd.Task{IdleTimeout: "15m", HostPortBindings: ports}, true},
+		{"no idle timeout", arkd.Task{HostPortBindings: ports}, false},
+		{"keep alive", arkd.Task{KeepAlive: true, IdleTimeout: "15m", HostPortBindings: ports}, false},
+		{"no ports", arkd.Task{IdleTimeout: "15m"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := scalesToZero(tt.task); got != tt.want {
+				t.Errorf("scalesToZero() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// newTestFront fronts an upstream answering "ok", wake is called to wake
+// the task
+func newTestFront(t *testing.T, suspended bool, wake func(ctx context.Context) error) *taskFront {
+	t.Helper()
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	t.Cleanup(upstream.Close)
+
+	u, err := url.Parse(upstream.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	task := arkd.Task{
+		ID:               ulid.Make(),
+		IdleTimeout:      "1m",
+		HostPortBindings: map[string]string{u.Port(): "8080"},
+	}
+
+	front, err := newTaskFront(task, suspended, wake)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { front.close() })
+
+	return front
+}
+
+// getFront sends a request through the front and returns the response's
+// status and body
+func getFront(t *testing.T, front *taskFront) (int, string) {
+	t.Helper()
+
+	resp, err := http.Get("http://localhost:" + front.port())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(resp.Body)
+	return resp.StatusCode, string(body)
+}
+
+func Test_taskFront(t *testing.T) {
+	t.Run("hold and wake", func(t *testing.T) {
+		var wakes atomic.Int32
+		front := newTestFront(t, true, func(ctx context.Context) error {
+			wakes.Add(1)
+			time.Sleep(50 * time.Millisecond)
+			return nil
+		})
+
+		// requests held while suspended share one wake
+		codes := make(chan int)
+		for i := 0; i < 3; i++ {
+			go func() {
+				code, _ := getFront(t, front)
+				codes <- code
+			}()
+		}
+		for i := 0; i < 3; i++ {
+			if code := <-codes; code != http.StatusOK {
+				t.Errorf("status = %d, want 200", code)
+			}
+		}
+		if n := wakes.Load(); n != 1 {
+			t.Errorf("woke %d times, want 1", n)
+		}
+
+		// a running task isn't woken again
+		if code, body := getFront(t, front); code != http.StatusOK || body != "ok" {
+			t.Errorf("got %d %q, want 200 \"ok\"", code, body)
+		}
+		if n := wakes.Load(); n != 1 {
+			t.Errorf("woke %d times, want 1", n)
+		}
+	})
+
+	t.Run("wake failure", func(t *testing.T) {
+		var fail atomic.Bool
+		fail.Store(true)
+		front := newTestFront(t, true, func(ctx context.Context) error {
+			if fail.Load() {
+				return errors.New("wake failure")
+			}
+			return nil
+		})
+
+		if code, _ := getFront(t, front); code != http.StatusServiceUnavailable {
+			t.Errorf("status = %d, want 503", code)
+		}
+
+		// the next request tries to wake the task again
+		fail.Store(false)
+		if code, _ := getFront(t, front); code != http.StatusOK {
+			t.Errorf("status = %d, want 200", code)
+		}
+	})
+
+	t.Run("suspend", func(t *testing.T) {
+		var wakes atomic.Int32
+		front := newTestFront(t, false, func(ctx context.Context) error {
+			wakes.Add(1)
+			return nil
+		})
+
+		if code, _ := getFront(t, front); code != http.StatusOK {
+			t.Fatalf("status = %d, want 200", code)
+		}
+		if n := wakes.Load(); n != 0 {
+			t.Errorf("woke %d times, want 0", n)
+		}
+
+		if front.suspendIfIdle(time.Now()) {
+			t.Error("suspendIfIdle() = true right after a request")
+		}
+		if !front.suspendIfIdle(time.Now().Add(2 * time.Minute)) {
+			t.Fatal("suspendIfIdle() = false after the idle timeout")
+		}
+		if front.suspendIfIdle(time.Now().Add(2 * time.Minute)) {
+			t.Error("suspendIfIdle() = true while suspended")
+		}
+
+		// a held request waits for the task to be stopped before waking it
+		go func() {
+			time.Sleep(50 * time.Millisecond)
+			if n := wakes.Load(); n != 0 {
+				t.Errorf("woke %d times before the task stopped, want 0", n)
+			}
+			front.stopped()
+		}()
+		if code, _ := getFront(t, front); code != http.StatusOK {
+			t.Errorf("status = %d, want 200", code)
+		}
+		if n := wakes.Load(); n != 1 {
+			t.Errorf("woke %d times, want 1", n)
+		}
+	})
+
+	t.Run("resume", func(t *testing.T) {
+		front := newTestFront(t, false, func(ctx context.Context) error {
+			return nil
+		})
+
+		// a suspend that didn't stop the task lets held requests through
+		front.suspend()
+		go func() {
+			time.Sleep(50 * time.Millisecond)
+			front.resume()
+		}()
+		if code, _ := getFront(t, front); code != http.StatusOK {
+			t.Errorf("status = %d, want 200", code)
+		}
+	})
+}
@@ -4,18 +4,16 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"strings"
 	"sync"
 	"time"
 
 	"github.com/dkimot/ark/arkd/internal/arkd"
 	"github.com/dkimot/ark/arkd/internal/config"
 	"github.com/dkimot/ark/arkd/internal/proxy"
-	"github.com/docker/docker/api/types/container"
-	docker "github.com/docker/docker/client"
 	"github.com/oklog/ulid/v2"
 	"github.com/rs/zerolog"
 	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/metric"
 	"go.opentelemetry.io/otel/trace"
 )
 
@@ -28,98 +26,203 @@ type Orchestrator interface {
 	InspectTask(ctx context.Context, taskId ulid.ULID) (*arkd.Task, error)
 
 	StartTask(ctx context.Context, taskDef arkd.TaskDefinition) ([]byte, error)
-	StopTask(ctx context.Context, taskId ulid.ULID, signal string) error
+	// StopTask and DestroyTask fail with an arkd.TaskConflictError if
+	// ifRevision isn't nil and the task is at a different revision
+	StopTask(ctx context.Context, taskId ulid.ULID, signal string, ifRevision *uint64) error
 	WakeTask(ctx context.Context, taskId ulid.ULID) error
-	DestroyTask(ctx context.Context, taskId ulid.ULID, force bool) error
+	DestroyTask(ctx context.Context, taskId ulid.ULID, force bool, ifRevision *uint64) error
+	ExpiredTasks(ctx context.Context) ([]arkd.ExpiredTask, error)
+
+	ListVolumes(ctx context.Context) ([]arkd.Volume, error)
+}
+
+func Start(cfg config.Config, logger zerolog.Logger, runtime arkd.Runtime, taskStore arkd.TaskStore, pxy proxy.Proxy) (Orchestrator, error) {
+  o, err := newOrca(cfg, logger, runtime, taskStore, pxy)
+  if err != nil {
+    return nil, err
+  }
+
+  // pick up checking tasks started before a restart
+  tasks, err := taskStore.FindTasks(context.Background(), arkd.TaskFilter{
+    Statuses: []arkd.TaskStatus{arkd.TaskStatusStarting, arkd.TaskStatusRunning},
+  })
+  if err != nil {
+    return nil, err
+  }
+  for _, task := range tasks {
+    if task.ContainerID == "" {
+      continue
+    }
+    if err := o.health.start(task); err != nil {
+      o.l.Error().Err(err).Str("task_id", task.ID.String()).Msg("could not start health check")
+    }
+  }
+
+  // suspended tasks are woken by their fronts, so they need one too
+  tasks, err = taskStore.FindTasks(context.Background(), arkd.TaskFilter{
+    Statuses: []arkd.TaskStatus{arkd.TaskStatusStarting, arkd.TaskStatusRunning, arkd.TaskStatusSuspended},
+  })
+  if err != nil {
+    return nil, err
+  }
+  for _, task := range tasks {
+    if err := o.openFront(task); err != nil {
+      o.l.Error().Err(err).Str("task_id", task.ID.String()).Msg("could not open task front")
+    }
+  }
+
+	go o.startReconciler()
+	go o.startCollector()
+	go o.startIdler()
+
+	return o, nil
 }
 
-func Start(cfg config.Config, logger zerolog.Logger, moby *docker.Client, taskStore *arkd.TaskStore, pxy proxy.Proxy) (Orchestrator, error) {
+// newOrca sets up an orca without starting its background loops, tests
+// drive those themselves
+func newOrca(cfg config.Config, logger zerolog.Logger, runtime arkd.Runtime, taskStore arkd.TaskStore, pxy proxy.Proxy) (*Orca, error) {
+  meter := otel.Meter(otelName)
+  gcRemoved, err := meter.Int64Counter("orca.gc.tasks.removed", metric.WithDescription("Finished tasks removed by garbage collection."))
+  if err != nil {
+    return nil, err
+  }
+  reconcileErrors, err := meter.Int64Counter("orca.reconcile.errors", metric.WithDescription("Errors reconciling tasks with their containers."))
+  if err != nil {
+    return nil, err
+  }
+  reconcileChanges, err := meter.Int64Counter("orca.reconcile.changes", metric.WithDescription("Tasks and containers changed by reconciliation."))
+  if err != nil {
+    return nil, err
+  }
+  restarts, err := meter.Int64Counter("orca.task.restarts", metric.WithDescription("Tasks restarted after their container exited."))
+  if err != nil {
+    return nil, err
+  }
+  crashLoops, err := meter.Int64Counter("orca.task.crash_loops", metric.WithDescription("Tasks marked crashed after restarting too often in a row."))
+  if err != nil {
+    return nil, err
+  }
+  wakeDuration, err := meter.Float64Histogram("orca.wake.duration", metric.WithDescription("Time from a request waking a suspended task until it's running."), metric.WithUnit("s"))
+  if err != nil {
+    return nil, err
+  }
+
   o := &Orca{
     cfg: cfg, 
     l: logger, 
-    moby: moby, 
+    runtime: runtime, 
     taskStore: taskStore, 
     proxy: pxy,
+    health: newHealthChecker(logger, runtime, taskStore),
+    fronts: make(map[ulid.ULID]*taskFront),
+    busy: make(map[ulid.ULID]int),
+    ignored: make(map[string]bool),
+    restartBackoff: defaultRestartBackoff,
+    host: arkd.ReadHostCapacity(),
 
     tracer: otel.Tracer(otelName),
+    gcRemoved: gcRemoved,
+    wakeDuration: wakeDuration,
+    reconcileErrors: reconcileErrors,
+    reconcileChanges: reconcileChanges,
+    restarts: restarts,
+    crashLoops: crashLoops,
   }
 
-	go o.startWatcher()
-
-	return o, nil
+  return o, nil
 }
 
 type Orca struct {
 	cfg       config.Config
   l         zerolog.Logger
-	moby      *docker.Client
+	runtime   arkd.Runtime
 	mtx       sync.Mutex
-	taskStore *arkd.TaskStore
+	taskStore arkd.TaskStore
   proxy     proxy.Proxy
+  health    *healthChecker
+  // fronts of the tasks that scale to zero
+  frontsMtx sync.Mutex
+  fronts    map[ulid.ULID]*taskFront
+  // tasks being stopped, woken or restarted, see markBusy
+  busyMtx   sync.Mutex
+  busy      map[ulid.ULID]int
+  // containers the reconciler leaves alone, so they're only logged once.
+  // only used by reconcile
+  ignored   map[string]bool
+  // delays between restarts of a crashing task
+  restartBackoff arkd.RestartBackoff
+  // what tasks are admitted against
+  host      arkd.HostCapacity
 
   // observability
   tracer    trace.Tracer
+  gcRemoved metric.Int64Counter
+  wakeDuration metric.Float64Histogram
+  reconcileErrors  metric.Int64Counter
+  reconcileChanges metric.Int64Counter
+  restarts         metric.Int64Counter
+  crashLoops       metric.Int64Counter
 }
 
-func (o *Orca) startWatcher() {
-	for range time.Tick(time.Second) {
-		ctx := context.Background()
+// exitChange describes how a container exited, for the task's event log
+func (o *Orca) exitChange(ctx context.Context, containerId string) arkd.StatusChange {
+	change := arkd.StatusChange{Reason: "container exited"}
 
-		containers, err := o.moby.ContainerList(ctx, container.ListOptions{All: true})
-		if err != nil {
-			panic(err)
-		}
+	ctr, err := o.runtime.InspectContainer(ctx, containerId)
+	if err != nil || ctr.State == nil {
+		o.l.Warn().Err(err).Str("container_id", containerId).Msg("could not inspect exited container")
+		return change
+	}
 
-		for _, ctr := range containers {
-			if ctr.Labels["arkd"] == "1" && len(ctr.Names) > 0 {
-				taskId := ulid.MustParse(ctr.Names[0][1:])
-				task, err := o.taskStore.GetTask(ctx, taskId)
-				if err != nil {
-					panic(err)
-				}
-
-				// update status
-				var taskStatus arkd.TaskStatus
-				switch ctr.Status {
-				case "Created":
-					taskStatus = arkd.TaskStatusStarting
-				}
-
-				if strings.HasPrefix(ctr.Status, "Exited") {
-					taskStatus = arkd.TaskStatusExited
-				}
-
-				if err := o.taskStore.SetTaskStatus(ctx, task, taskStatus); err != nil {
-					panic(err)
-				}
-			}
-		}
+	exitCode := ctr.State.ExitCode
+	change.ExitCode = &exitCode
+	change.OOMKilled = ctr.State.OOMKilled
+	if ctr.State.OOMKilled {
+		change.Reason = "container killed, out of memory"
 	}
+
+	return change
 }
 
-func (o *Orca) DestroyTask(ctx context.Context, taskId ulid.ULID, force bool) error {
+func (o *Orca) DestroyTask(ctx context.Context, taskId ulid.ULID, force bool, ifRevision *uint64) error {
   var span trace.Span
   ctx, span = o.tracer.Start(ctx, "destroy_task")
   defer span.End()
 
+	// the reconciler leaves the task alone while it's destroyed, so the
+	// revision only moves if someone else writes it
+	defer o.markBusy(taskId)()
+
 	task, err := o.taskStore.GetTask(ctx, taskId)
 	if err != nil {
 		return err
 	}
+	if err := checkRevision(task, ifRevision); err != nil {
+		return err
+	}
 
-  if task.ContainerID == "" {
-    if err := o.taskStore.DeleteTask(ctx, taskId); err != nil {
-      return err
-    }
+  o.health.stop(taskId)
+  o.closeFront(taskId)
 
-    return nil
+  if task.ContainerID == "" {
+    return o.deleteTask(ctx, task, ifRevision)
   }
 
-	if err := o.moby.ContainerStop(ctx, task.ContainerID, container.StopOptions{}); err != nil {
-    return fmt.Errorf("could not stop container %s: %w", task.ContainerID, err)
+	// a finished task's container has already exited. with force a running
+	// one is killed by removing it instead of being stopped gracefully.
+	if !force && !task.Status.Finished() {
+		stopOpts, err := stopOptions(*task)
+		if err != nil {
+			return err
+		}
+
+		// the container may already be gone, the task is still cleaned up
+		if err := o.runtime.StopContainer(ctx, task.ContainerID, stopOpts); err != nil && !errors.Is(err, arkd.ErrRuntimeNotFound) {
+			return fmt.Errorf("could not stop container %s: %w", task.ContainerID, err)
+		}
 	}
 
-	if err := o.moby.ContainerRemove(ctx, task.ContainerID, container.RemoveOptions{}); err != nil {
+	if err := o.runtime.RemoveContainer(ctx, task.ContainerID, force); err != nil && !errors.Is(err, arkd.ErrRuntimeNotFound) {
     return fmt.Errorf("could not remove container %s: %w", task.ContainerID, err)
 	}
 
@@ -127,11 +230,27 @@ func (o *Orca) DestroyTask(ctx context.Context, taskId ulid.ULID, force bool) er
     return err
   }
 
-	if err := o.taskStore.DeleteTask(ctx, taskId); err != nil {
-		return err
+	return o.deleteTask(ctx, task, ifRevision)
+}
+
+// deleteTask removes the task's record, in the same write as the revision
+// check if there is one
+func (o *Orca) deleteTask(ctx context.Context, task *arkd.Task, ifRevision *uint64) error {
+	if ifRevision != nil {
+		return o.taskStore.CompareAndDeleteTask(ctx, task)
 	}
 
-	return nil
+	return o.taskStore.DeleteTask(ctx, task.ID)
+}
+
+// checkRevision fails with a conflict if ifRevision is set and the task is
+// at another revision
+func checkRevision(task *arkd.Task, ifRevision *uint64) error {
+	if ifRevision == nil || task.Revision == *ifRevision {
+		return nil
+	}
+
+	return &arkd.TaskConflictError{TaskID: task.ID, Expected: *ifRevision, Actual: task.Revision}
 }
 
 func (o *Orca) InspectTask(ctx context.Context, taskId ulid.ULID) (*arkd.Task, error) {
@@ -150,6 +269,14 @@ func (o *Orca) ListTasks(ctx context.Context) ([]arkd.Task, error) {
 	panic("unimplemented")
 }
 
+func (o *Orca) ListVolumes(ctx context.Context) ([]arkd.Volume, error) {
+  var span trace.Span
+  ctx, span = o.tracer.Start(ctx, "list_volumes")
+  defer span.End()
+
+  return listVolumes(ctx, o.runtime)
+}
+
 func (o *Orca) StartTask(ctx context.Context, taskDef arkd.TaskDefinition) ([]byte, error) {
   var span trace.Span
   ctx, span = o.tracer.Start(ctx, "start_task")
@@ -172,30 +299,112 @@ func (o *Orca) StartTask(ctx context.Context, taskDef arkd.TaskDefinition) ([]by
 	if taskDef.Memory == 0 {
 		taskDef.Memory = o.cfg.DefaultTaskMem
 	}
+	if taskDef.Pids == 0 {
+		taskDef.Pids = o.cfg.DefaultTaskPids
+	}
 
 	o.mtx.Lock()
 	defer o.mtx.Unlock()
 
 	// verify capacity
-	if arkd.GetSystemMetrics(ctx, o.taskStore).AvailableCpu < taskDef.Cpu {
-		return nil, ErrInsufficientResourcesAvailable
+	if err := admit(arkd.NewSystemMetrics(o.host, o.taskStore.AggMetrics(ctx)), taskDef); err != nil {
+		return nil, err
 	}
 
-  return startTask(ctx, o.cfg.WorkerId, taskDef, o.moby, o.taskStore, o.proxy)
+  rawTaskId, err := startTask(ctx, o.cfg.WorkerId, taskDef, o.runtime, o.taskStore, o.proxy)
+  if err != nil {
+    return nil, err
+  }
+
+  var taskId ulid.ULID
+  copy(taskId[:], rawTaskId)
+  task, err := o.taskStore.GetTask(ctx, taskId)
+  if err != nil {
+    return nil, err
+  }
+  if err := o.health.start(*task); err != nil {
+    return nil, err
+  }
+  if err := o.openFront(*task); err != nil {
+    return nil, err
+  }
+
+  return rawTaskId, nil
 }
 
-func (o *Orca) StopTask(ctx context.Context, taskId ulid.ULID, signal string) error {
+func (o *Orca) StopTask(ctx context.Context, taskId ulid.ULID, signal string, ifRevision *uint64) error {
   var span trace.Span
   ctx, span = o.tracer.Start(ctx, "stop_task")
   defer span.End()
 
-	// verify task exists
+	return o.stopTask(ctx, taskId, signal, ifRevision, false)
+}
 
-	// stop container
+// stopTask stops the task's container. a task stopped by the idler is
+// suspended and woken by the next request, any other stopped task exits.
+func (o *Orca) stopTask(ctx context.Context, taskId ulid.ULID, signal string, ifRevision *uint64, idle bool) error {
+	defer o.markBusy(taskId)()
 
-	// update task status
+	task, err := o.taskStore.GetTask(ctx, taskId)
+	if err != nil {
+		return err
+	}
 
-	panic("unimplemented")
+	if err := checkRevision(task, ifRevision); err != nil {
+		return err
+	}
+
+	switch {
+	case task.Status != arkd.TaskStatusStarting && task.Status != arkd.TaskStatusRunning:
+		return fmt.Errorf("%w: task %s", ErrTaskNotRunning, taskId)
+	case task.ContainerID == "":
+		return fmt.Errorf("%w: task %s has no container", ErrTaskNotRunning, taskId)
+	}
+
+	if signal == "" {
+		signal = stopSignal(*task)
+	}
+	gracePeriod, err := stopGracePeriod(*task)
+	if err != nil {
+		return err
+	}
+
+	// stop routing new requests first, in-flight ones finish while the task
+	// handles the signal. an idle task's front holds new requests instead,
+	// the next one wakes the task.
+	o.health.stop(taskId)
+	if front, ok := o.front(taskId); ok && idle {
+		front.suspend()
+		defer front.stopped()
+	} else {
+		if err := o.proxy.DelistApp(task.ID.String()); err != nil {
+			return err
+		}
+		defer o.closeFront(taskId)
+	}
+
+	killed, err := stopContainer(ctx, o.runtime, task.ContainerID, signal, gracePeriod)
+	if err != nil {
+		return err
+	}
+
+	// an idle task that exits in its grace period can be woken again, one
+	// that had to be killed is done
+	change := o.exitChange(ctx, task.ContainerID)
+	status := arkd.TaskStatusExited
+	change.Reason = fmt.Sprintf("stopped with %s", signal)
+	switch {
+	case killed:
+		change.Reason = fmt.Sprintf("killed, did not exit within %s of %s", gracePeriod, signal)
+	case idle:
+		status = arkd.TaskStatusSuspended
+		change.Reason = fmt.Sprintf("idle, stopped with %s", signal)
+	}
+
+	if ifRevision != nil {
+		return o.taskStore.CompareAndSetTaskStatus(ctx, task, status, change)
+	}
+	return o.taskStore.SetTaskStatus(ctx, task, status, change)
 }
 
 func (o *Orca) WakeTask(ctx context.Context, taskId ulid.ULID) error {
@@ -203,11 +412,76 @@ func (o *Orca) WakeTask(ctx context.Context, taskId ulid.ULID) error {
   ctx, span = o.tracer.Start(ctx, "wake_task")
   defer span.End()
 
-	// find stopped task
+	defer o.markBusy(taskId)()
+
+	task, err := o.taskStore.GetTask(ctx, taskId)
+	if err != nil {
+		return err
+	}
+
+	switch task.Status {
+	case arkd.TaskStatusStarting, arkd.TaskStatusRunning:
+		return nil
+	case arkd.TaskStatusSuspended:
+	default:
+		return fmt.Errorf("%w: task %s", ErrTaskNotSuspended, taskId)
+	}
 
-	// start container
+	// a suspended task's resources may have gone to other tasks since, it's
+	// admitted like a new one. the lock is held until it's allocated again.
+	o.mtx.Lock()
+	defer o.mtx.Unlock()
 
-	// update task status
+	taskDef := arkd.TaskDefinition{Cpu: task.CPU, Memory: task.Memory, Pids: task.Pids}
+	if err := admit(arkd.NewSystemMetrics(o.host, o.taskStore.AggMetrics(ctx)), taskDef); err != nil {
+		return err
+	}
 
-	panic("unimplemented")
+	// the reconciler suspends tasks whose container was paused
+	ctr, err := o.runtime.InspectContainer(ctx, task.ContainerID)
+	if err != nil {
+		return fmt.Errorf("could not inspect container %s: %w", task.ContainerID, err)
+	}
+	if ctr.State != nil && ctr.State.Paused {
+		if err := o.runtime.UnpauseContainer(ctx, task.ContainerID); err != nil {
+			return fmt.Errorf("could not unpause container %s: %w", task.ContainerID, err)
+		}
+	} else if err := o.runtime.StartContainer(ctx, task.ContainerID); err != nil {
+		return fmt.Errorf("could not start container %s: %w", task.ContainerID, err)
+	}
+
+	// the health check starts over like for a new task
+	startedAt := time.Now()
+	err = updateTask(ctx, o.taskStore, task, func(t *arkd.Task) {
+		t.StartedAt = startedAt
+		if t.HealthCheck.Enabled() {
+			t.Health.Status = arkd.HealthStatusStarting
+			t.Health.FailingStreak = 0
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	status := arkd.TaskStatusRunning
+	if task.HealthCheck.Enabled() {
+		status = arkd.TaskStatusStarting
+	}
+	if err := o.taskStore.SetTaskStatus(ctx, task, status, arkd.StatusChange{Reason: "task woken"}); err != nil {
+		return err
+	}
+	if err := o.health.start(*task); err != nil {
+		return err
+	}
+
+	// tasks without a front were delisted when they were stopped
+	if _, ok := o.front(taskId); !ok {
+		for hostPort := range task.HostPortBindings {
+			if err := o.proxy.RegisterApp(task.ID.String(), task.QualifiedName(), task.Domain(), hostPort); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
 }
@@ -0,0 +1,574 @@
+package orca
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dkimot/ark/arkd/internal/arkd"
+	"github.com/dkimot/ark/arkd/internal/config"
+	"github.com/docker/docker/api/types/container"
+	"github.com/oklog/ulid/v2"
+	"github.com/rs/zerolog"
+)
+
+// testProxy records the apps registered with it
+type testProxy struct {
+	mtx  sync.Mutex
+	apps map[string]string
+}
+
+func (p *testProxy) RegisterApp(id, name, domainName, port string) error {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	p.apps[id] = port
+	return nil
+}
+
+func (p *testProxy) DelistApp(id string) error {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	delete(p.apps, id)
+	return nil
+}
+
+func (p *testProxy) registered(id ulid.ULID) bool {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	_, ok := p.apps[id.String()]
+	return ok
+}
+
+func newTestOrca(t *testing.T) (*Orca, *arkd.FakeRuntime, *testProxy) {
+	t.Helper()
+
+	runtime := arkd.NewFakeRuntime()
+	pxy := &testProxy{apps: make(map[string]string)}
+	cfg := config.NewConfig(func(cfg *config.Config) { cfg.WorkerId = "worker1" })
+
+	o, err := newOrca(cfg, zerolog.Nop(), runtime, arkd.NewMemTaskStore(), pxy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	o.restartBackoff = arkd.RestartBackoff{Base: time.Millisecond, Max: time.Millisecond}
+	o.host = arkd.HostCapacity{Cpu: 4, Mem: 4096, Pids: 32768}
+
+	return o, runtime, pxy
+}
+
+func testTaskDef() arkd.TaskDefinition {
+	return arkd.TaskDefinition{
+		AppName:        "web",
+		DeploymentName: "prod",
+		StackName:      "shop",
+		Image:          "nginx:1.25",
+		Cpu:            0.01,
+		Memory:         64,
+		KeepAlive:      true,
+		Restart:        arkd.TaskRestartPolicy{Policy: arkd.RestartNever},
+	}
+}
+
+// startTestTask starts a task and returns it as stored
+func startTestTask(t *testing.T, o *Orca, taskDef arkd.TaskDefinition) *arkd.Task {
+	t.Helper()
+
+	rawTaskId, err := o.StartTask(context.Background(), taskDef)
+	if err != nil {
+		t.Fatalf("StartTask() error = %v", err)
+	}
+
+	var taskId ulid.ULID
+	copy(taskId[:], rawTaskId)
+	return getTestTask(t, o, taskId)
+}
+
+func getTestTask(t *testing.T, o *Orca, taskId ulid.ULID) *arkd.Task {
+	t.Helper()
+
+	task, err := o.taskStore.GetTask(context.Background(), taskId)
+	if err != nil {
+		t.Fatalf("GetTask() error = %v", err)
+	}
+	return task
+}
+
+// waitForStatus polls the task until it has status, scheduled restarts
+// happen in the background
+func waitForStatus(t *testing.T, o *Orca, taskId ulid.ULID, status arkd.TaskStatus) *arkd.Task {
+	t.Helper()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		task := getTestTask(t, o, taskId)
+		if task.Status == status {
+			return task
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("task status = %v, want %v", task.Status, status)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func Test_Orca_StartTask(t *testing.T) {
+	o, runtime, pxy := newTestOrca(t)
+
+	taskDef := testTaskDef()
+	taskDef.ExposedPorts = []string{"8080"}
+	taskDef.Env = map[string]string{"B": "2", "A": "1"}
+	task := startTestTask(t, o, taskDef)
+
+	if task.Status != arkd.TaskStatusRunning {
+		t.Errorf("status = %v, want running", task.Status)
+	}
+	if !runtime.ImagePulled("nginx:1.25") {
+		t.Error("image not pulled")
+	}
+	if state := runtime.ContainerState(task.ContainerID); state != "running" {
+		t.Errorf("container state = %q, want running", state)
+	}
+	if len(task.HostPortBindings) != 1 || !pxy.registered(task.ID) {
+		t.Errorf("port bindings = %v, registered = %v, want one registered binding", task.HostPortBindings, pxy.registered(task.ID))
+	}
+
+	ctr, err := runtime.InspectContainer(context.Background(), task.ContainerID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := ctr.Config.Labels["arkd_task_id"]; got != task.ID.String() {
+		t.Errorf("arkd_task_id label = %q, want %q", got, task.ID)
+	}
+	if res := ctr.HostConfig.Resources; res.NanoCPUs != 10_000_000 || res.Memory != 64<<20 || res.PidsLimit == nil || *res.PidsLimit != int64(o.cfg.DefaultTaskPids) {
+		t.Errorf("resources = %+v, want the task's cpu, memory and the default pids", res)
+	}
+	if got := ctr.Config.Env; len(got) != 2 || got[0] != "A=1" || got[1] != "B=2" {
+		t.Errorf("env = %v, want [A=1 B=2]", got)
+	}
+	net, ok := ctr.NetworkSettings.Networks[deploymentNetworkName(*task)]
+	if !ok || len(net.Aliases) != 2 || net.Aliases[0] != task.QualifiedName() {
+		t.Errorf("networks = %v, want the deployment network with the task's aliases", ctr.NetworkSettings.Networks)
+	}
+
+	// the deployment's next task shares the network
+	other := startTestTask(t, o, testTaskDef())
+	ctr, err = runtime.InspectContainer(context.Background(), other.ContainerID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ctr.NetworkSettings.Networks) != 1 || ctr.NetworkSettings.Networks[deploymentNetworkName(*other)] == nil {
+		t.Errorf("networks = %v, want the deployment network", ctr.NetworkSettings.Networks)
+	}
+}
+
+func Test_Orca_StartTask_insufficientResources(t *testing.T) {
+	o, runtime, _ := newTestOrca(t)
+	o.host.Mem = 100
+
+	startTestTask(t, o, testTaskDef())
+
+	_, err := o.StartTask(context.Background(), testTaskDef())
+	if !errors.Is(err, ErrInsufficientResourcesAvailable) || !strings.Contains(err.Error(), "memory") {
+		t.Fatalf("StartTask() error = %v, want %v for memory", err, ErrInsufficientResourcesAvailable)
+	}
+	if tasks, _ := o.taskStore.GetTasks(context.Background()); len(tasks) != 1 {
+		t.Errorf("got %d tasks, want the rejected one not created", len(tasks))
+	}
+	if containers, _ := runtime.ListContainers(context.Background(), "arkd=1"); len(containers) != 1 {
+		t.Errorf("got %d containers, want 1", len(containers))
+	}
+}
+
+func Test_Orca_StartTask_suspendedFreesCapacity(t *testing.T) {
+	o, _, _ := newTestOrca(t)
+	o.host.Mem = 100
+
+	task := startTestTask(t, o, testTaskDef())
+	if _, err := o.StartTask(context.Background(), testTaskDef()); !errors.Is(err, ErrInsufficientResourcesAvailable) {
+		t.Fatalf("StartTask() error = %v, want %v", err, ErrInsufficientResourcesAvailable)
+	}
+
+	if err := o.stopTask(context.Background(), task.ID, "", nil, true); err != nil {
+		t.Fatalf("stopTask() error = %v", err)
+	}
+	if _, err := o.StartTask(context.Background(), testTaskDef()); err != nil {
+		t.Errorf("StartTask() after suspend error = %v", err)
+	}
+}
+
+func Test_Orca_WakeTask_insufficientResources(t *testing.T) {
+	o, runtime, _ := newTestOrca(t)
+	o.host.Mem = 100
+
+	task := startTestTask(t, o, testTaskDef())
+	if err := o.stopTask(context.Background(), task.ID, "", nil, true); err != nil {
+		t.Fatalf("stopTask() error = %v", err)
+	}
+	startTestTask(t, o, testTaskDef())
+
+	err := o.WakeTask(context.Background(), task.ID)
+	if !errors.Is(err, ErrInsufficientResourcesAvailable) || !strings.Contains(err.Error(), "memory") {
+		t.Fatalf("WakeTask() error = %v, want %v for memory", err, ErrInsufficientResourcesAvailable)
+	}
+	if got := getTestTask(t, o, task.ID).Status; got != arkd.TaskStatusSuspended {
+		t.Errorf("status = %v, want suspended", got)
+	}
+	if state := runtime.ContainerState(task.ContainerID); state != "exited" {
+		t.Errorf("container state = %q, want exited", state)
+	}
+}
+
+func Test_Orca_StartTask_failure(t *testing.T) {
+	errRuntime := errors.New("runtime failure")
+
+	tests := []struct {
+		name          string
+		op            string
+		wantStatus    arkd.TaskStatus
+		wantContainer string
+	}{
+		{"pull", "PullImage", arkd.TaskStatusImagePull, ""},
+		{"network", "CreateNetwork", arkd.TaskStatusImagePull, ""},
+		{"create", "CreateContainer", arkd.TaskStatusCreating, ""},
+		{"start", "StartContainer", arkd.TaskStatusStarting, "created"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o, runtime, _ := newTestOrca(t)
+			runtime.Fail(tt.op, errRuntime)
+
+			_, err := o.StartTask(context.Background(), testTaskDef())
+			if !errors.Is(err, errRuntime) {
+				t.Fatalf("StartTask() error = %v, want %v", err, errRuntime)
+			}
+
+			tasks, err := o.taskStore.GetTasks(context.Background())
+			if err != nil || len(tasks) != 1 {
+				t.Fatalf("GetTasks() = %v, %v, want one task", tasks, err)
+			}
+			if tasks[0].Status != tt.wantStatus {
+				t.Errorf("status = %v, want %v", tasks[0].Status, tt.wantStatus)
+			}
+			if state := runtime.ContainerState(tasks[0].ContainerID); state != tt.wantContainer {
+				t.Errorf("container state = %q, want %q", state, tt.wantContainer)
+			}
+		})
+	}
+}
+
+func Test_Orca_DestroyTask(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup func(runtime *arkd.FakeRuntime, task *arkd.Task)
+	}{
+		{"running", func(*arkd.FakeRuntime, *arkd.Task) {}},
+		{"exited", func(runtime *arkd.FakeRuntime, task *arkd.Task) {
+			runtime.Exit(task.ContainerID, 1)
+		}},
+		{"container gone", func(runtime *arkd.FakeRuntime, task *arkd.Task) {
+			runtime.RemoveContainer(context.Background(), task.ContainerID, true)
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o, runtime, pxy := newTestOrca(t)
+
+			taskDef := testTaskDef()
+			taskDef.ExposedPorts = []string{"8080"}
+			task := startTestTask(t, o, taskDef)
+			tt.setup(runtime, task)
+
+			if err := o.DestroyTask(context.Background(), task.ID, false, nil); err != nil {
+				t.Fatalf("DestroyTask() error = %v", err)
+			}
+
+			if _, err := o.taskStore.GetTask(context.Background(), task.ID); !errors.Is(err, arkd.ErrTaskNotFound) {
+				t.Errorf("GetTask() error = %v, want %v", err, arkd.ErrTaskNotFound)
+			}
+			if state := runtime.ContainerState(task.ContainerID); state != "" {
+				t.Errorf("container state = %q, want it removed", state)
+			}
+			if pxy.registered(task.ID) {
+				t.Error("task still registered with the proxy")
+			}
+		})
+	}
+
+	t.Run("remove failure", func(t *testing.T) {
+		o, runtime, _ := newTestOrca(t)
+		task := startTestTask(t, o, testTaskDef())
+
+		errRuntime := errors.New("runtime failure")
+		runtime.Fail("RemoveContainer", errRuntime)
+		if err := o.DestroyTask(context.Background(), task.ID, false, nil); !errors.Is(err, errRuntime) {
+			t.Fatalf("DestroyTask() error = %v, want %v", err, errRuntime)
+		}
+		getTestTask(t, o, task.ID)
+	})
+
+	t.Run("force", func(t *testing.T) {
+		o, runtime, _ := newTestOrca(t)
+		task := startTestTask(t, o, testTaskDef())
+
+		// a forced destroy removes the running container without stopping it
+		runtime.Fail("StopContainer", errors.New("runtime failure"))
+		if err := o.DestroyTask(context.Background(), task.ID, true, nil); err != nil {
+			t.Fatalf("DestroyTask() error = %v", err)
+		}
+		if state := runtime.ContainerState(task.ContainerID); state != "" {
+			t.Errorf("container state = %q, want it removed", state)
+		}
+	})
+}
+
+func Test_Orca_reconcile(t *testing.T) {
+	onFailure := arkd.TaskRestartPolicy{Policy: arkd.RestartOnFailure, MaxRetries: 3}
+
+	tests := []struct {
+		name       string
+		restart    arkd.TaskRestartPolicy
+		change     func(runtime *arkd.FakeRuntime, containerId string)
+		wantStatus arkd.TaskStatus
+		wantExit   *int
+	}{
+		{"running", arkd.TaskRestartPolicy{}, func(*arkd.FakeRuntime, string) {}, arkd.TaskStatusRunning, nil},
+		{"exit 0", arkd.TaskRestartPolicy{Policy: arkd.RestartNever}, func(runtime *arkd.FakeRuntime, id string) {
+			runtime.Exit(id, 0)
+		}, arkd.TaskStatusExited, intPtr(0)},
+		{"exit 1", arkd.TaskRestartPolicy{Policy: arkd.RestartNever}, func(runtime *arkd.FakeRuntime, id string) {
+			runtime.Exit(id, 1)
+		}, arkd.TaskStatusCrashed, intPtr(1)},
+		{"exit 0 on failure", onFailure, func(runtime *arkd.FakeRuntime, id string) {
+			runtime.Exit(id, 0)
+		}, arkd.TaskStatusExited, intPtr(0)},
+		{"oom killed on failure", onFailure, func(runtime *arkd.FakeRuntime, id string) {
+			runtime.OOMKill(id)
+		}, arkd.TaskStatusRestarting, intPtr(137)},
+		{"paused", arkd.TaskRestartPolicy{}, func(runtime *arkd.FakeRuntime, id string) {
+			runtime.Pause(id)
+		}, arkd.TaskStatusSuspended, nil},
+		{"container gone", onFailure, func(runtime *arkd.FakeRuntime, id string) {
+			runtime.RemoveContainer(context.Background(), id, true)
+		}, arkd.TaskStatusExited, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o, runtime, _ := newTestOrca(t)
+
+			taskDef := testTaskDef()
+			taskDef.Restart = tt.restart
+			task := startTestTask(t, o, taskDef)
+
+			// a restart scheduled by reconcile shouldn't run before the
+			// status is checked
+			o.restartBackoff = arkd.RestartBackoff{Base: time.Hour, Max: time.Hour}
+
+			tt.change(runtime, task.ContainerID)
+			o.reconcile(context.Background())
+
+			task = getTestTask(t, o, task.ID)
+			if task.Status != tt.wantStatus {
+				t.Errorf("status = %v, want %v", task.Status, tt.wantStatus)
+			}
+
+			events, err := o.taskStore.GetTaskEvents(context.Background(), task.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			last := events[len(events)-1]
+			switch {
+			case tt.wantExit == nil && last.ExitCode != nil:
+				t.Errorf("exit code = %d, want none", *last.ExitCode)
+			case tt.wantExit != nil && (last.ExitCode == nil || *last.ExitCode != *tt.wantExit):
+				t.Errorf("exit code = %v, want %d", last.ExitCode, *tt.wantExit)
+			}
+		})
+	}
+}
+
+func Test_Orca_reconcile_restart(t *testing.T) {
+	o, runtime, _ := newTestOrca(t)
+
+	taskDef := testTaskDef()
+	taskDef.Restart = arkd.TaskRestartPolicy{Policy: arkd.RestartOnFailure, MaxRetries: 1}
+	task := startTestTask(t, o, taskDef)
+
+	runtime.Exit(task.ContainerID, 1)
+	o.reconcile(context.Background())
+	task = waitForStatus(t, o, task.ID, arkd.TaskStatusRunning)
+	if task.Restarts != 1 {
+		t.Errorf("restarts = %d, want 1", task.Restarts)
+	}
+	if state := runtime.ContainerState(task.ContainerID); state != "running" {
+		t.Errorf("container state = %q, want running", state)
+	}
+
+	// exiting again right away exceeds max retries
+	for o.isBusy(task.ID) {
+		time.Sleep(time.Millisecond)
+	}
+	runtime.Exit(task.ContainerID, 1)
+	o.reconcile(context.Background())
+	if task := getTestTask(t, o, task.ID); task.Status != arkd.TaskStatusCrashed {
+		t.Errorf("status = %v, want crashed", task.Status)
+	}
+}
+
+func Test_Orca_reconcile_orphans(t *testing.T) {
+	o, runtime, _ := newTestOrca(t)
+	ctx := context.Background()
+
+	if err := runtime.PullImage(ctx, "nginx:1.25"); err != nil {
+		t.Fatal(err)
+	}
+	createContainer := func(taskId, workerId string, start bool) string {
+		t.Helper()
+
+		id, err := runtime.CreateContainer(ctx, "", &container.Config{
+			Image: "nginx:1.25",
+			Labels: map[string]string{
+				"arkd":            "1",
+				"arkd_task_id":    taskId,
+				"arkd_worker_id":  workerId,
+				"arkd_app":        "web",
+				"arkd_deployment": "prod",
+				"arkd_stack":      "shop",
+			},
+		}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if start {
+			if err := runtime.StartContainer(ctx, id); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return id
+	}
+
+	adoptId := ulid.Make()
+	adopted := createContainer(adoptId.String(), "worker1", true)
+	stopped := createContainer(ulid.Make().String(), "worker1", false)
+	invalid := createContainer("postgres", "worker1", true)
+	foreign := createContainer(ulid.Make().String(), "worker2", true)
+	legacy := createContainer("postgres", "", true)
+
+	o.reconcile(ctx)
+
+	task := getTestTask(t, o, adoptId)
+	if task.ContainerID != adopted || task.Status != arkd.TaskStatusRunning || task.AppName != "web" {
+		t.Errorf("adopted task = %s %v %s, want %s running web", task.ContainerID, task.Status, task.AppName, adopted)
+	}
+	for _, id := range []string{stopped, invalid} {
+		if state := runtime.ContainerState(id); state != "" {
+			t.Errorf("container %s state = %q, want it removed", id, state)
+		}
+	}
+	if state := runtime.ContainerState(foreign); state != "running" {
+		t.Errorf("other worker's container state = %q, want running", state)
+	}
+	if state := runtime.ContainerState(legacy); state != "running" {
+		t.Errorf("legacy container state = %q, want running", state)
+	}
+}
+
+func Test_Orca_StopTask(t *testing.T) {
+	tests := []struct {
+		name       string
+		stubborn   bool
+		idle       bool
+		wantStatus arkd.TaskStatus
+		wantExit   int
+	}{
+		{"graceful", false, false, arkd.TaskStatusExited, 0},
+		{"killed", true, false, arkd.TaskStatusExited, 137},
+		{"idle", false, true, arkd.TaskStatusSuspended, 0},
+		{"idle killed", true, true, arkd.TaskStatusExited, 137},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o, runtime, pxy := newTestOrca(t)
+
+			taskDef := testTaskDef()
+			taskDef.ExposedPorts = []string{"8080"}
+			taskDef.StopGracePeriod = "10ms"
+			task := startTestTask(t, o, taskDef)
+			if tt.stubborn {
+				runtime.IgnoreSignals(task.ContainerID)
+			}
+
+			if err := o.stopTask(context.Background(), task.ID, "", nil, tt.idle); err != nil {
+				t.Fatalf("stopTask() error = %v", err)
+			}
+
+			task = getTestTask(t, o, task.ID)
+			if task.Status != tt.wantStatus {
+				t.Errorf("status = %v, want %v", task.Status, tt.wantStatus)
+			}
+			ctr, err := runtime.InspectContainer(context.Background(), task.ContainerID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ctr.State.Status != "exited" || ctr.State.ExitCode != tt.wantExit {
+				t.Errorf("container = %s %d, want exited %d", ctr.State.Status, ctr.State.ExitCode, tt.wantExit)
+			}
+			if pxy.registered(task.ID) {
+				t.Error("task still registered with the proxy")
+			}
+
+			// the reconciler leaves the stopped task be
+			o.reconcile(context.Background())
+			if got := getTestTask(t, o, task.ID).Status; got != tt.wantStatus {
+				t.Errorf("status after reconcile = %v, want %v", got, tt.wantStatus)
+			}
+
+			if err := o.StopTask(context.Background(), task.ID, "", nil); !errors.Is(err, ErrTaskNotRunning) {
+				t.Errorf("StopTask() again error = %v, want %v", err, ErrTaskNotRunning)
+			}
+		})
+	}
+}
+
+func Test_Orca_WakeTask(t *testing.T) {
+	o, runtime, pxy := newTestOrca(t)
+
+	taskDef := testTaskDef()
+	taskDef.ExposedPorts = []string{"8080"}
+	task := startTestTask(t, o, taskDef)
+	if err := o.stopTask(context.Background(), task.ID, "", nil, true); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := o.WakeTask(context.Background(), task.ID); err != nil {
+		t.Fatalf("WakeTask() error = %v", err)
+	}
+	if got := getTestTask(t, o, task.ID).Status; got != arkd.TaskStatusRunning {
+		t.Errorf("status = %v, want running", got)
+	}
+	if state := runtime.ContainerState(task.ContainerID); state != "running" {
+		t.Errorf("container state = %q, want running", state)
+	}
+	if !pxy.registered(task.ID) {
+		t.Error("task not registered with the proxy again")
+	}
+
+	// a paused container is unpaused
+	runtime.Pause(task.ContainerID)
+	o.reconcile(context.Background())
+	if err := o.WakeTask(context.Background(), task.ID); err != nil {
+		t.Fatalf("WakeTask() error = %v", err)
+	}
+	if state := runtime.ContainerState(task.ContainerID); state != "running" {
+		t.Errorf("container state = %q, want running", state)
+	}
+}
+
+func intPtr(i int) *int {
+	return &i
+}
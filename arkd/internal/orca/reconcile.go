@@ -0,0 +1,289 @@
+package orca
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/dkimot/ark/arkd/internal/arkd"
+	"github.com/docker/docker/api/types"
+	"github.com/oklog/ulid/v2"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// how often the task store is reconciled with docker
+const reconcileInterval = time.Second
+
+// reconciled tasks, the ones the reconciler compares with their container.
+// tasks before starting are still owned by startTask.
+var reconciledStatuses = []arkd.TaskStatus{
+	arkd.TaskStatusStarting,
+	arkd.TaskStatusRunning,
+	arkd.TaskStatusSuspended,
+	arkd.TaskStatusRestarting,
+}
+
+func (o *Orca) startReconciler() {
+	for range time.Tick(reconcileInterval) {
+		o.reconcile(context.Background())
+	}
+}
+
+// reconcile brings the task store in line with the worker's containers.
+// containers without a task are adopted if they're running and removed
+// otherwise, tasks whose container is gone are marked exited, exited
+// containers are handed to handleExit and every other task gets the status
+// of its container. containers with neither a worker id nor a valid task id
+// are left alone. errors are logged and counted, the next pass tries again.
+func (o *Orca) reconcile(ctx context.Context) {
+	var span trace.Span
+	ctx, span = o.tracer.Start(ctx, "reconcile")
+	defer span.End()
+
+	// tasks are read before containers, so a task with a container id has
+	// its container in the listing unless it's gone
+	tasks, err := o.taskStore.FindTasks(ctx, arkd.TaskFilter{Statuses: reconciledStatuses})
+	if err != nil {
+		o.reconcileErr(ctx, "find_tasks", err, ulid.ULID{})
+		return
+	}
+
+	containers, err := o.runtime.ListContainers(ctx, "arkd=1")
+	if err != nil {
+		o.reconcileErr(ctx, "list_containers", err, ulid.ULID{})
+		return
+	}
+
+	byTask := make(map[ulid.ULID]types.Container, len(containers))
+	for _, ctr := range containers {
+		// other workers sharing the docker host keep theirs
+		if workerId := ctr.Labels["arkd_worker_id"]; workerId != "" && workerId != o.cfg.WorkerId {
+			continue
+		}
+
+		taskId, ok := containerTaskId(ctr)
+		switch {
+		case !ok && ctr.Labels["arkd_worker_id"] == "":
+			// containers of older arkd versions may not be tasks at all
+			o.ignoreContainer(ctr, "container has no worker id and no valid task id")
+			continue
+		case !ok:
+			o.removeOrphan(ctx, ctr, "container has no valid task id")
+			continue
+		}
+		byTask[taskId] = ctr
+	}
+
+	known := make(map[ulid.ULID]bool, len(tasks))
+	for _, task := range tasks {
+		known[task.ID] = true
+		if o.isBusy(task.ID) || task.ContainerID == "" {
+			continue
+		}
+
+		ctr, ok := byTask[task.ID]
+		if !ok {
+			o.reconcileTask(ctx, task, arkd.TaskStatusExited, arkd.StatusChange{Reason: "container disappeared"}, "missing")
+			continue
+		}
+
+		// the idler suspended the task, its container exiting is expected
+		if (ctr.State == "exited" || ctr.State == "dead") && task.Status != arkd.TaskStatusSuspended {
+			o.handleExit(ctx, task, ctr)
+			continue
+		}
+
+		status, change, ok := o.containerStatus(task, ctr)
+		if ok {
+			o.reconcileTask(ctx, task, status, change, "status")
+		}
+	}
+
+	for taskId, ctr := range byTask {
+		if known[taskId] {
+			continue
+		}
+
+		// tasks that are still being started or are finished aren't
+		// orphans, their containers are handled by startTask and gc
+		_, err := o.taskStore.GetTask(ctx, taskId)
+		if err == nil {
+			continue
+		}
+		if !errors.Is(err, arkd.ErrTaskNotFound) {
+			o.reconcileErr(ctx, "get_task", err, taskId)
+			continue
+		}
+
+		if ctr.State != "running" {
+			o.removeOrphan(ctx, ctr, "container has no task")
+			continue
+		}
+		o.adoptOrphan(ctx, taskId, ctr)
+	}
+}
+
+// containerStatus maps the state of a task's container to the status the
+// task should have. it reports false if the task's status is right. exited
+// containers are left to handleExit.
+func (o *Orca) containerStatus(task arkd.Task, ctr types.Container) (arkd.TaskStatus, arkd.StatusChange, bool) {
+	switch ctr.State {
+	case "created", "restarting":
+		if task.Status == arkd.TaskStatusStarting {
+			return 0, arkd.StatusChange{}, false
+		}
+		return arkd.TaskStatusStarting, arkd.StatusChange{Reason: "container " + ctr.State}, true
+	case "running":
+		// tasks with a health check are moved to running by the health
+		// checker. a suspended or restarting task's container was started
+		// behind orca's back, it's taken over like an adopted one.
+		switch {
+		case task.Status == arkd.TaskStatusSuspended || task.Status == arkd.TaskStatusRestarting:
+			status, reason := adoptedStatus(ctr.State, task.HealthCheck.Enabled())
+			return status, arkd.StatusChange{Reason: reason}, true
+		case task.Status == arkd.TaskStatusStarting && !task.HealthCheck.Enabled():
+			return arkd.TaskStatusRunning, arkd.StatusChange{Reason: "container running"}, true
+		}
+		return 0, arkd.StatusChange{}, false
+	case "paused":
+		if task.Status == arkd.TaskStatusSuspended {
+			return 0, arkd.StatusChange{}, false
+		}
+		return arkd.TaskStatusSuspended, arkd.StatusChange{Reason: "container paused"}, true
+	}
+
+	// exited, dead or removing, the container is gone on the next pass
+	return 0, arkd.StatusChange{}, false
+}
+
+// reconcileTask sets the task's status unless it changed since it was read.
+// it reports whether the status was set.
+func (o *Orca) reconcileTask(ctx context.Context, task arkd.Task, status arkd.TaskStatus, change arkd.StatusChange, action string) bool {
+	err := o.taskStore.CompareAndSetTaskStatus(ctx, &task, status, change)
+	if errors.Is(err, arkd.ErrTaskConflict) || errors.Is(err, arkd.ErrTaskNotFound) {
+		return false
+	}
+	if err != nil {
+		o.reconcileErr(ctx, "set_task_status", err, task.ID)
+		return false
+	}
+
+	front, fronted := o.front(task.ID)
+	switch status {
+	case arkd.TaskStatusStarting, arkd.TaskStatusRunning:
+		if err := o.health.start(task); err != nil {
+			o.reconcileErr(ctx, "start_health_check", err, task.ID)
+		}
+		if fronted {
+			front.resume()
+		}
+	case arkd.TaskStatusSuspended:
+		o.health.stop(task.ID)
+		// held requests wake the task like one suspended by the idler
+		if fronted {
+			front.suspend()
+			front.stopped()
+		}
+	default:
+		o.health.stop(task.ID)
+	}
+
+	o.reconcileChanges.Add(ctx, 1, metric.WithAttributes(attribute.String("action", action)))
+	o.l.Info().
+		Str("task_id", task.ID.String()).
+		Str("reason", change.Reason).
+		Int("status", int(status)).
+		Msg("reconciled task")
+
+	return true
+}
+
+// adoptOrphan takes over a running container whose task the store doesn't
+// know, like AdoptContainers does after a restore
+func (o *Orca) adoptOrphan(ctx context.Context, taskId ulid.ULID, ctr types.Container) {
+	task, err := taskFromContainer(ctx, o.cfg, o.runtime, taskId, ctr.ID)
+	if err != nil {
+		o.reconcileErr(ctx, "adopt_container", err, taskId)
+		return
+	}
+
+	task.ContainerID = ctr.ID
+	status, reason := adoptedStatus(ctr.State, task.HealthCheck.Enabled())
+	task.Status = status
+
+	if err := o.taskStore.AdoptTask(ctx, *task, arkd.StatusChange{Reason: reason}); err != nil {
+		o.reconcileErr(ctx, "adopt_container", err, taskId)
+		return
+	}
+
+	o.reconcileChanges.Add(ctx, 1, metric.WithAttributes(attribute.String("action", "adopted")))
+	o.l.Info().Str("task_id", taskId.String()).Str("container_id", ctr.ID).Msg("adopted orphaned container")
+}
+
+func (o *Orca) removeOrphan(ctx context.Context, ctr types.Container, reason string) {
+	if err := o.runtime.RemoveContainer(ctx, ctr.ID, true); err != nil {
+		o.reconcileErr(ctx, "remove_container", err, ulid.ULID{})
+		return
+	}
+
+	o.reconcileChanges.Add(ctx, 1, metric.WithAttributes(attribute.String("action", "removed")))
+	o.l.Info().Str("container_id", ctr.ID).Str("reason", reason).Msg("removed orphaned container")
+}
+
+// ignoreContainer logs a container the reconciler leaves alone, once
+func (o *Orca) ignoreContainer(ctr types.Container, reason string) {
+	if o.ignored[ctr.ID] {
+		return
+	}
+	o.ignored[ctr.ID] = true
+
+	o.l.Warn().Str("container_id", ctr.ID).Str("reason", reason).Msg("leaving unknown container alone")
+}
+
+func (o *Orca) reconcileErr(ctx context.Context, op string, err error, taskId ulid.ULID) {
+	o.reconcileErrors.Add(ctx, 1, metric.WithAttributes(attribute.String("op", op)))
+
+	event := o.l.Error().Err(err).Str("op", op)
+	if taskId != (ulid.ULID{}) {
+		event = event.Str("task_id", taskId.String())
+	}
+	event.Msg("could not reconcile")
+}
+
+// containerTaskId reads the task id of a container from its label, or its
+// name for containers created before the label
+func containerTaskId(ctr types.Container) (ulid.ULID, bool) {
+	raw := ctr.Labels["arkd_task_id"]
+	if raw == "" && len(ctr.Names) > 0 {
+		raw = ctr.Names[0][1:]
+	}
+
+	taskId, err := ulid.Parse(raw)
+	return taskId, err == nil
+}
+
+// markBusy keeps the reconciler away from a task while StopTask, WakeTask
+// or a scheduled restart change it. the returned func releases it.
+func (o *Orca) markBusy(taskId ulid.ULID) func() {
+	o.busyMtx.Lock()
+	defer o.busyMtx.Unlock()
+
+	o.busy[taskId]++
+	return func() {
+		o.busyMtx.Lock()
+		defer o.busyMtx.Unlock()
+
+		if o.busy[taskId]--; o.busy[taskId] <= 0 {
+			delete(o.busy, taskId)
+		}
+	}
+}
+
+func (o *Orca) isBusy(taskId ulid.ULID) bool {
+	o.busyMtx.Lock()
+	defer o.busyMtx.Unlock()
+
+	return o.busy[taskId] > 0
+}
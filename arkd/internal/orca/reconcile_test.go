@@ -0,0 +1,69 @@
+package orca
+
+import (
+	"testing"
+
+	"github.com/dkimot/ark/arkd/internal/arkd"
+	"github.com/docker/docker/api/types"
+	"github.com/oklog/ulid/v2"
+)
+
+func Test_containerTaskId(t *testing.T) {
+	id := ulid.Make()
+
+	tests := []struct {
+		name   string
+		ctr    types.Container
+		want   ulid.ULID
+		wantOk bool
+	}{
+		{"label", types.Container{Labels: map[string]string{"arkd_task_id": id.String()}, Names: []string{"/other"}}, id, true},
+		{"name", types.Container{Names: []string{"/" + id.String()}}, id, true},
+		{"invalid", types.Container{Names: []string{"/postgres"}}, ulid.ULID{}, false},
+		{"no name", types.Container{}, ulid.ULID{}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := containerTaskId(tt.ctr)
+			if ok != tt.wantOk || (ok && got != tt.want) {
+				t.Errorf("containerTaskId() = %v, %v, want %v, %v", got, ok, tt.want, tt.wantOk)
+			}
+		})
+	}
+}
+
+func Test_Orca_containerStatus(t *testing.T) {
+	checked := arkd.TaskHealthCheck{Request: "http GET /"}
+
+	tests := []struct {
+		name        string
+		state       string
+		status      arkd.TaskStatus
+		healthCheck arkd.TaskHealthCheck
+		want        arkd.TaskStatus
+		wantChange  bool
+	}{
+		{"created", "created", arkd.TaskStatusRunning, arkd.TaskHealthCheck{}, arkd.TaskStatusStarting, true},
+		{"created starting", "created", arkd.TaskStatusStarting, arkd.TaskHealthCheck{}, 0, false},
+		{"restarting", "restarting", arkd.TaskStatusRunning, checked, arkd.TaskStatusStarting, true},
+		{"running", "running", arkd.TaskStatusRunning, arkd.TaskHealthCheck{}, 0, false},
+		{"running unchecked starting", "running", arkd.TaskStatusStarting, arkd.TaskHealthCheck{}, arkd.TaskStatusRunning, true},
+		{"running checked starting", "running", arkd.TaskStatusStarting, checked, 0, false},
+		{"running suspended", "running", arkd.TaskStatusSuspended, checked, arkd.TaskStatusStarting, true},
+		{"paused", "paused", arkd.TaskStatusRunning, arkd.TaskHealthCheck{}, arkd.TaskStatusSuspended, true},
+		{"running restarting", "running", arkd.TaskStatusRestarting, arkd.TaskHealthCheck{}, arkd.TaskStatusRunning, true},
+		{"exited", "exited", arkd.TaskStatusRunning, arkd.TaskHealthCheck{}, 0, false},
+		{"removing", "removing", arkd.TaskStatusRunning, arkd.TaskHealthCheck{}, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o := &Orca{}
+			task := arkd.Task{Status: tt.status, HealthCheck: tt.healthCheck}
+
+			got, _, changed := o.containerStatus(task, types.Container{State: tt.state})
+			if changed != tt.wantChange || (changed && got != tt.want) {
+				t.Errorf("containerStatus() = %v, %v, want %v, %v", got, changed, tt.want, tt.wantChange)
+			}
+		})
+	}
+}
@@ -0,0 +1,41 @@
+package orca
+
+import (
+	"fmt"
+
+	"github.com/dkimot/ark/arkd/internal/arkd"
+	"github.com/docker/docker/api/types/container"
+)
+
+// admit checks the worker has room for the task, it returns an error naming
+// the first resource that ran out. memory and processes are only checked if
+// the host's totals are known.
+func admit(sm arkd.SystemMetrics, taskDef arkd.TaskDefinition) error {
+	switch {
+	case sm.AvailableCpu < taskDef.Cpu:
+		return fmt.Errorf("%w: cpu, %g requested, %g available", ErrInsufficientResourcesAvailable, taskDef.Cpu, max(sm.AvailableCpu, 0))
+	case sm.TotalMem > 0 && sm.AvailableMem < taskDef.Memory:
+		return fmt.Errorf("%w: memory, %d MB requested, %d MB available", ErrInsufficientResourcesAvailable, taskDef.Memory, max(sm.AvailableMem, 0))
+	case sm.TotalPids > 0 && sm.AvailablePids < taskDef.Pids:
+		return fmt.Errorf("%w: pids, %d requested, %d available", ErrInsufficientResourcesAvailable, taskDef.Pids, max(sm.AvailablePids, 0))
+	}
+
+	return nil
+}
+
+// containerResources are the task's cgroup limits. a task over its memory
+// limit is oom killed, it gets no swap on top.
+func containerResources(task arkd.Task) container.Resources {
+	mem := int64(task.Memory) << 20
+	res := container.Resources{
+		NanoCPUs:   int64(task.CPU * 1e9),
+		Memory:     mem,
+		MemorySwap: mem,
+	}
+	if task.Pids > 0 {
+		pids := int64(task.Pids)
+		res.PidsLimit = &pids
+	}
+
+	return res
+}
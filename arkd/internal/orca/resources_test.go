@@ -0,0 +1,58 @@
+package orca
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/dkimot/ark/arkd/internal/arkd"
+)
+
+func Test_admit(t *testing.T) {
+	host := arkd.HostCapacity{Cpu: 2, Mem: 1024, Pids: 1000}
+	taskDef := arkd.TaskDefinition{Cpu: 0.5, Memory: 256, Pids: 100}
+
+	tests := []struct {
+		name    string
+		host    arkd.HostCapacity
+		agg     arkd.AggTaskMetrics
+		wantErr string
+	}{
+		{"room", host, arkd.AggTaskMetrics{AllocatedCpu: 1, AllocatedMem: 512, AllocatedPids: 500}, ""},
+		{"exactly full", host, arkd.AggTaskMetrics{AllocatedCpu: 1.5, AllocatedMem: 768, AllocatedPids: 900}, ""},
+		{"cpu", host, arkd.AggTaskMetrics{AllocatedCpu: 1.75}, "cpu, 0.5 requested, 0.25 available"},
+		{"memory", host, arkd.AggTaskMetrics{AllocatedMem: 1000}, "memory, 256 MB requested, 24 MB available"},
+		{"memory overcommitted", host, arkd.AggTaskMetrics{AllocatedMem: 2048}, "memory, 256 MB requested, 0 MB available"},
+		{"pids", host, arkd.AggTaskMetrics{AllocatedPids: 950}, "pids, 100 requested, 50 available"},
+		{"unknown memory and pids", arkd.HostCapacity{Cpu: 2}, arkd.AggTaskMetrics{AllocatedMem: 4096, AllocatedPids: 5000}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := admit(arkd.NewSystemMetrics(tt.host, &tt.agg), taskDef)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("admit() error = %v", err)
+				}
+				return
+			}
+
+			if !errors.Is(err, ErrInsufficientResourcesAvailable) || !strings.HasSuffix(err.Error(), tt.wantErr) {
+				t.Errorf("admit() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_containerResources(t *testing.T) {
+	res := containerResources(arkd.Task{CPU: 0.5, Memory: 256, Pids: 100})
+	if res.NanoCPUs != 500_000_000 || res.Memory != 256<<20 || res.MemorySwap != res.Memory {
+		t.Errorf("containerResources() = %+v", res)
+	}
+	if res.PidsLimit == nil || *res.PidsLimit != 100 {
+		t.Errorf("PidsLimit = %v, want 100", res.PidsLimit)
+	}
+
+	if res := containerResources(arkd.Task{}); res.PidsLimit != nil || res.Memory != 0 {
+		t.Errorf("containerResources(no limits) = %+v", res)
+	}
+}
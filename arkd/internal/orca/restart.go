@@ -0,0 +1,128 @@
+package orca
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"time"
+
+	"github.com/dkimot/ark/arkd/internal/arkd"
+	"github.com/docker/docker/api/types"
+	"github.com/oklog/ulid/v2"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+var defaultRestartBackoff = arkd.RestartBackoff{Base: time.Second, Max: 5 * time.Minute}
+
+// handleExit decides what happens to a task whose container exited. it's
+// restarted after a backoff if its policy says so, marked crashed once it
+// restarted too often in a row, and exited or crashed otherwise.
+func (o *Orca) handleExit(ctx context.Context, task arkd.Task, ctr types.Container) {
+	change := o.exitChange(ctx, ctr.ID)
+	failed := ctr.State == "dead" || change.OOMKilled || (change.ExitCode != nil && *change.ExitCode != 0)
+
+	if !task.Restart.ShouldRestart(failed) {
+		status := arkd.TaskStatusExited
+		if failed {
+			status = arkd.TaskStatusCrashed
+		}
+		o.reconcileTask(ctx, task, status, change, "status")
+		return
+	}
+
+	// a task that ran for a while before exiting starts counting again
+	restarts := task.Restarts
+	if task.Status != arkd.TaskStatusRestarting && time.Since(task.StartedAt) >= arkd.RestartResetAfter {
+		restarts = 0
+	}
+
+	limit := task.Restart.Limit()
+	if restarts >= limit {
+		change.Reason = fmt.Sprintf("crash loop, restarted %d times in a row", restarts)
+		if o.reconcileTask(ctx, task, arkd.TaskStatusCrashed, change, "crash_loop") {
+			o.crashLoops.Add(ctx, 1, metric.WithAttributes(attribute.String("app_name", task.AppName)))
+		}
+		return
+	}
+
+	delay := o.restartBackoff.Delay(restarts, rand.Float64())
+	change.Reason = fmt.Sprintf("container exited, restart %d of %d in %s", restarts+1, limit, delay.Round(time.Millisecond))
+	if task.Status != arkd.TaskStatusRestarting && !o.reconcileTask(ctx, task, arkd.TaskStatusRestarting, change, "restarting") {
+		return
+	}
+
+	o.scheduleRestart(task.ID, restarts+1, delay)
+}
+
+// scheduleRestart restarts the task after delay. the reconciler leaves the
+// task be until then.
+func (o *Orca) scheduleRestart(taskId ulid.ULID, restarts int, delay time.Duration) {
+	release := o.markBusy(taskId)
+
+	go func() {
+		defer release()
+
+		time.Sleep(delay)
+		if err := o.restartTask(context.Background(), taskId, restarts); err != nil {
+			o.reconcileErr(context.Background(), "restart_task", err, taskId)
+		}
+	}()
+}
+
+// restartTask starts the container of a restarting task again
+func (o *Orca) restartTask(ctx context.Context, taskId ulid.ULID, restarts int) error {
+	task, err := o.taskStore.GetTask(ctx, taskId)
+	if errors.Is(err, arkd.ErrTaskNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	// destroyed or stopped meanwhile
+	if task.Status != arkd.TaskStatusRestarting {
+		return nil
+	}
+
+	if err := o.runtime.StartContainer(ctx, task.ContainerID); err != nil {
+		return fmt.Errorf("could not start container %s: %w", task.ContainerID, err)
+	}
+
+	startedAt := time.Now()
+	err = updateTask(ctx, o.taskStore, task, func(t *arkd.Task) {
+		t.StartedAt = startedAt
+		t.Restarts = restarts
+		if t.HealthCheck.Enabled() {
+			t.Health.Status = arkd.HealthStatusStarting
+			t.Health.FailingStreak = 0
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	status := arkd.TaskStatusRunning
+	if task.HealthCheck.Enabled() {
+		status = arkd.TaskStatusStarting
+	}
+	reason := fmt.Sprintf("container restarted, restart %d of %d", restarts, task.Restart.Limit())
+	if err := o.taskStore.SetTaskStatus(ctx, task, status, arkd.StatusChange{Reason: reason}); err != nil {
+		return err
+	}
+	if err := o.health.start(*task); err != nil {
+		return err
+	}
+
+	o.restarts.Add(ctx, 1, metric.WithAttributes(
+		attribute.String("app_name", task.AppName),
+		attribute.String("policy", task.Restart.Policy),
+	))
+	o.l.Info().
+		Str("task_id", taskId.String()).
+		Str("app_name", task.AppName).
+		Int("restarts", restarts).
+		Msg("restarted task")
+
+	return nil
+}
@@ -2,8 +2,9 @@ package orca
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"io"
+	"sort"
 	"strconv"
 	"time"
 
@@ -11,10 +12,6 @@ import (
 	"github.com/dkimot/ark/arkd/internal/proxy"
 	"github.com/dkimot/ark/arkd/pkg"
 	"github.com/docker/docker/api/types/container"
-	"github.com/docker/docker/api/types/filters"
-	"github.com/docker/docker/api/types/image"
-	"github.com/docker/docker/api/types/network"
-	docker "github.com/docker/docker/client"
 	"github.com/docker/go-connections/nat"
 	"github.com/kozhurkin/pipers"
 )
@@ -23,8 +20,8 @@ func startTask(
   ctx context.Context, 
   workerId string,
   taskDef arkd.TaskDefinition, 
-  moby *docker.Client, 
-  taskStore *arkd.TaskStore,
+  runtime arkd.Runtime, 
+  taskStore arkd.TaskStore,
   proxy     proxy.Proxy,
 ) ([]byte, error) {
 	// add task to task storage
@@ -33,21 +30,21 @@ func startTask(
 		return nil, err
 	}
 
-	if err := taskStore.SetTaskStatus(ctx, task, arkd.TaskStatusImagePull); err != nil {
+	if err := taskStore.SetTaskStatus(ctx, task, arkd.TaskStatusImagePull, arkd.StatusChange{Reason: "pulling image"}); err != nil {
 		return nil, err
 	}
 
 	var networkId string
-	desiredNetworkName := fmt.Sprintf("%s-%s-net", taskDef.DeploymentName, taskDef.StackName)
+	desiredNetworkName := deploymentNetworkName(*task)
 
 	pp := pipers.FromFuncs(
 		// pull image
 		func() (interface{}, error) {
-			return nil, pullImage(ctx, task.Image.FullName, moby)
+			return nil, pullImage(ctx, task.Image.FullName, runtime)
 		},
 		// ensure network is created
 		func() (interface{}, error) {
-      netId, err := findOrCreateNetwork(ctx, desiredNetworkName, moby)
+      netId, err := findOrCreateNetwork(ctx, desiredNetworkName, runtime)
       if err != nil {
         return nil, err
       }
@@ -61,7 +58,7 @@ func startTask(
 		return nil, err
 	}
 
-	if err := taskStore.SetTaskStatus(ctx, task, arkd.TaskStatusCreating); err != nil {
+	if err := taskStore.SetTaskStatus(ctx, task, arkd.TaskStatusCreating, arkd.StatusChange{Reason: "creating container"}); err != nil {
 		return nil, err
 	}
 
@@ -74,11 +71,27 @@ func startTask(
     return nil, err
   }
 
-	ccResp, err := moby.ContainerCreate(
+  mounts, err := setupContainerMounts(ctx, workerId, task, runtime)
+  if err != nil {
+    return nil, err
+  }
+
+  // docker stops the container the same way on ContainerStop or when the
+  // daemon shuts down
+  stopOpts, err := stopOptions(*task)
+  if err != nil {
+    return nil, err
+  }
+
+	containerId, err := runtime.CreateContainer(
     ctx, 
+    task.ID.String(),
     &container.Config{
       AttachStdout: true,
       Image:        task.Image.FullName,
+      Env:          containerEnv(task.Env),
+      StopSignal:   stopOpts.Signal,
+      StopTimeout:  stopOpts.Timeout,
       Labels: map[string]string{
         "arkd": "1",
         "arkd_task_id": task.ID.String(),
@@ -92,39 +105,78 @@ func startTask(
     &container.HostConfig{
       NetworkMode: "bridge",
       PortBindings: portMap,
-    }, 
-    nil,
-    nil,
-    task.ID.String(),
+      Mounts: mounts,
+      Resources: containerResources(*task),
+    },
     )
 	if err != nil {
     return nil, fmt.Errorf("could not create container: %w", err)
 	}
-	task.ContainerID = ccResp.ID
-	task.Status = arkd.TaskStatusStarting
-	if err := taskStore.UpdateTask(ctx, task); err != nil {
+	// the watcher can set the status of the created container meanwhile
+	hostPortBindings := task.HostPortBindings
+	err = updateTask(ctx, taskStore, task, func(t *arkd.Task) {
+		t.ContainerID = containerId
+		t.HostPortBindings = hostPortBindings
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := taskStore.SetTaskStatus(ctx, task, arkd.TaskStatusStarting, arkd.StatusChange{Reason: "starting container"}); err != nil {
 		return nil, err
 	}
 
-	if err := moby.NetworkConnect(ctx, networkId, ccResp.ID, nil); err != nil {
+	// other tasks of the deployment reach this one by its qualified name
+	aliases := []string{task.QualifiedName(), task.Domain()}
+	if err := runtime.ConnectNetwork(ctx, networkId, containerId, aliases); err != nil {
 		return nil, fmt.Errorf("could not connect network: %w", err)
 	}
 
 	// start container
-	if err := moby.ContainerStart(ctx, ccResp.ID, container.StartOptions{}); err != nil {
+	if err := runtime.StartContainer(ctx, containerId); err != nil {
 		return nil, fmt.Errorf("could not start container: %w", err)
 	}
 
-	task.StartedAt = time.Now()
-	task.Status = arkd.TaskStatusRunning
-	if err := taskStore.UpdateTask(ctx, task); err != nil {
+	// tasks with a health check stay starting until their first check passes
+	startedAt := time.Now()
+	if err := updateTask(ctx, taskStore, task, func(t *arkd.Task) { t.StartedAt = startedAt }); err != nil {
 		return nil, err
 	}
+	if !task.HealthCheck.Enabled() {
+		if err := taskStore.SetTaskStatus(ctx, task, arkd.TaskStatusRunning, arkd.StatusChange{Reason: "container started"}); err != nil {
+			return nil, err
+		}
+	}
 
 	// return task id
 	return task.ID.Bytes(), nil
 }
 
+// times updateTask reloads a task changed concurrently before giving up
+const maxConflictRetries = 5
+
+// updateTask applies fn to the task and writes it. if the task was changed
+// since it was read, it's reloaded and fn applied again.
+func updateTask(ctx context.Context, taskStore arkd.TaskStore, task *arkd.Task, fn func(t *arkd.Task)) error {
+	for i := 0; ; i++ {
+		fn(task)
+		err := taskStore.CompareAndUpdateTask(ctx, task)
+		if !errors.Is(err, arkd.ErrTaskConflict) || i == maxConflictRetries {
+			return err
+		}
+
+		fresh, err := taskStore.GetTask(ctx, task.ID)
+		if err != nil {
+			return err
+		}
+		*task = *fresh
+	}
+}
+
+// deploymentNetworkName is the docker network shared by a deployment's tasks
+func deploymentNetworkName(task arkd.Task) string {
+  return fmt.Sprintf("%s-%s-net", task.DeploymentName, task.StackName)
+}
+
 func setupContainerPortMap(
   _ context.Context, 
   task *arkd.Task, 
@@ -152,40 +204,37 @@ func setupContainerPortMap(
   return portMap, nil
 }
 
-func pullImage(ctx context.Context, imageName string, moby *docker.Client) error {
-  rc, err := moby.ImagePull(ctx, imageName, image.PullOptions{})
-  if err != nil {
-    return err
+func containerEnv(env map[string]string) []string {
+  vars := make([]string, 0, len(env))
+  for k, v := range env {
+    vars = append(vars, k+"="+v)
   }
-  defer rc.Close()
+  sort.Strings(vars)
+
+  return vars
+}
 
-  if _, err := io.ReadAll(rc); err != nil {
-    return err
+func pullImage(ctx context.Context, imageName string, runtime arkd.Runtime) error {
+  if err := runtime.PullImage(ctx, imageName); err != nil {
+    return fmt.Errorf("could not pull image %s: %w", imageName, err)
   }
 
   return nil
 }
 
-func findOrCreateNetwork(ctx context.Context, desiredNetworkName string, moby *docker.Client) (string, error) {
-			nets, err := moby.NetworkList(ctx, network.ListOptions{
-				Filters: filters.NewArgs(filters.Arg("name", desiredNetworkName)),
-			})
-			if err != nil {
-				return "", err
-			}
-
-			if len(nets) > 0 {
-        return nets[0].ID, nil
-			}
-
-      netCreateOpts := network.CreateOptions{
-        Driver: "bridge",
-        Labels: map[string]string{"arkd": "1"},
-      }
-			netCreateResp, err := moby.NetworkCreate(ctx, desiredNetworkName, netCreateOpts)
-			if err != nil {
-        return "", fmt.Errorf("could not create network: %w", err)
-			}
+func findOrCreateNetwork(ctx context.Context, desiredNetworkName string, runtime arkd.Runtime) (string, error) {
+  netId, err := runtime.FindNetwork(ctx, desiredNetworkName)
+  if err != nil {
+    return "", err
+  }
+  if netId != "" {
+    return netId, nil
+  }
+
+  netId, err = runtime.CreateNetwork(ctx, desiredNetworkName, map[string]string{"arkd": "1"})
+  if err != nil {
+    return "", fmt.Errorf("could not create network: %w", err)
+  }
 
-			return netCreateResp.ID, nil
+  return netId, nil
 }
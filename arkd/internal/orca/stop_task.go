@@ -0,0 +1,92 @@
+package orca
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/dkimot/ark/arkd/internal/arkd"
+	"github.com/docker/docker/api/types/container"
+)
+
+var ErrTaskNotRunning = errors.New("orca: task is not running")
+
+const (
+	defaultStopSignal      = "SIGTERM"
+	defaultStopGracePeriod = 10 * time.Second
+)
+
+// stopContainer sends signal to the container and waits up to gracePeriod
+// for it to exit before killing it. it reports whether the container had to
+// be killed.
+func stopContainer(ctx context.Context, runtime arkd.Runtime, containerId, signal string, gracePeriod time.Duration) (bool, error) {
+	waitCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// wait before signalling so a quick exit isn't missed
+	exited, waitErr := runtime.WaitContainer(waitCtx, containerId)
+
+	if err := runtime.KillContainer(ctx, containerId, signal); err != nil {
+		return false, fmt.Errorf("could not send %s to container %s: %w", signal, containerId, err)
+	}
+
+	timer := time.NewTimer(gracePeriod)
+	defer timer.Stop()
+
+	select {
+	case <-exited:
+		return false, nil
+	case err := <-waitErr:
+		return false, fmt.Errorf("could not wait for container %s: %w", containerId, err)
+	case <-ctx.Done():
+		return false, ctx.Err()
+	case <-timer.C:
+	}
+
+	if err := runtime.KillContainer(ctx, containerId, "SIGKILL"); err != nil {
+		return false, fmt.Errorf("could not kill container %s: %w", containerId, err)
+	}
+
+	select {
+	case <-exited:
+		return true, nil
+	case err := <-waitErr:
+		return false, fmt.Errorf("could not wait for container %s: %w", containerId, err)
+	case <-ctx.Done():
+		return false, ctx.Err()
+	}
+}
+
+func stopSignal(task arkd.Task) string {
+	if task.StopSignal != "" {
+		return task.StopSignal
+	}
+
+	return defaultStopSignal
+}
+
+func stopGracePeriod(task arkd.Task) (time.Duration, error) {
+	if task.StopGracePeriod == "" {
+		return defaultStopGracePeriod, nil
+	}
+
+	d, err := time.ParseDuration(task.StopGracePeriod)
+	if err != nil {
+		return 0, fmt.Errorf("invalid stop grace period %q: %w", task.StopGracePeriod, err)
+	}
+
+	return d, nil
+}
+
+// stopOptions are the task's stop settings for docker, which stops
+// containers itself on ContainerStop and daemon shutdown
+func stopOptions(task arkd.Task) (container.StopOptions, error) {
+	gracePeriod, err := stopGracePeriod(task)
+	if err != nil {
+		return container.StopOptions{}, err
+	}
+	timeout := int(gracePeriod.Round(time.Second) / time.Second)
+
+	return container.StopOptions{Signal: stopSignal(task), Timeout: &timeout}, nil
+}
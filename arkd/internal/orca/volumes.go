@@ -0,0 +1,67 @@
+package orca
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	"github.com/dkimot/ark/arkd/internal/arkd"
+	"github.com/docker/docker/api/types/mount"
+)
+
+// setupContainerMounts makes sure a named volume exists for each of the
+// task's disks and returns the mounts for the container. volumes are never
+// removed along with the task.
+func setupContainerMounts(ctx context.Context, workerId string, task *arkd.Task, runtime arkd.Runtime) ([]mount.Mount, error) {
+	mounts := make([]mount.Mount, 0, len(task.Disks))
+
+	for _, disk := range task.Disks {
+		volName := task.VolumeName(disk.Name)
+
+		err := runtime.CreateVolume(ctx, volName, map[string]string{
+			"arkd":                "1",
+			"arkd_qualified_name": task.QualifiedName(),
+			"arkd_disk":           disk.Name,
+			"arkd_deployment":     task.DeploymentName,
+			"arkd_stack":          task.StackName,
+			"arkd_app":            task.AppName,
+			"arkd_worker_id":      workerId,
+			"arkd_size_gb":        strconv.Itoa(disk.Size),
+		})
+		if err != nil {
+			return nil, fmt.Errorf("could not create volume %s: %w", volName, err)
+		}
+
+		mounts = append(mounts, mount.Mount{
+			Type:   mount.TypeVolume,
+			Source: volName,
+			Target: disk.MountPath,
+		})
+	}
+
+	return mounts, nil
+}
+
+func listVolumes(ctx context.Context, runtime arkd.Runtime) ([]arkd.Volume, error) {
+	volumes, err := runtime.ListVolumes(ctx, "arkd=1")
+	if err != nil {
+		return nil, fmt.Errorf("could not list volumes: %w", err)
+	}
+
+	vols := make([]arkd.Volume, 0, len(volumes))
+	for _, v := range volumes {
+		size, _ := strconv.Atoi(v.Labels["arkd_size_gb"])
+
+		vols = append(vols, arkd.Volume{
+			Name:           v.Name,
+			DiskName:       v.Labels["arkd_disk"],
+			AppName:        v.Labels["arkd_app"],
+			DeploymentName: v.Labels["arkd_deployment"],
+			StackName:      v.Labels["arkd_stack"],
+			WorkerId:       v.Labels["arkd_worker_id"],
+			Size:           size,
+		})
+	}
+
+	return vols, nil
+}
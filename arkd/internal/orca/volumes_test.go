@@ -0,0 +1,60 @@
+package orca
+
+import (
+	"context"
+	"testing"
+
+	"github.com/dkimot/ark/arkd/internal/arkd"
+	"github.com/docker/docker/api/types/mount"
+	"github.com/oklog/ulid/v2"
+)
+
+func Test_setupContainerMounts(t *testing.T) {
+	ctx := context.Background()
+	runtime := arkd.NewFakeRuntime()
+
+	task := &arkd.Task{
+		ID:             ulid.Make(),
+		AppName:        "db",
+		DeploymentName: "prod",
+		StackName:      "shop",
+		Disks:          []arkd.TaskDisk{{Name: "pgdata", MountPath: "/var/lib/postgresql/data", Size: 5}},
+	}
+
+	if got, want := task.VolumeName("pgdata"), "pgdata--db--prod--shop"; got != want {
+		t.Fatalf("VolumeName() = %q, want %q", got, want)
+	}
+
+	mounts, err := setupContainerMounts(ctx, "worker1", task, runtime)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := mount.Mount{Type: mount.TypeVolume, Source: "pgdata--db--prod--shop", Target: "/var/lib/postgresql/data"}
+	if len(mounts) != 1 || mounts[0] != want {
+		t.Errorf("mounts = %+v, want %+v", mounts, want)
+	}
+
+	// the replacement task gets the same volume
+	replacement := *task
+	replacement.ID = ulid.Make()
+	if _, err := setupContainerMounts(ctx, "worker1", &replacement, runtime); err != nil {
+		t.Fatal(err)
+	}
+
+	vols, err := listVolumes(ctx, runtime)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantVol := arkd.Volume{
+		Name:           "pgdata--db--prod--shop",
+		DiskName:       "pgdata",
+		AppName:        "db",
+		DeploymentName: "prod",
+		StackName:      "shop",
+		WorkerId:       "worker1",
+		Size:           5,
+	}
+	if len(vols) != 1 || vols[0] != wantVol {
+		t.Errorf("listVolumes() = %+v, want %+v", vols, wantVol)
+	}
+}
@@ -1,16 +1,29 @@
 package proxy
 
+import "sort"
+
 const ProxyListenPort = 8080
 const ProxyListenPortTls = 4443
 
-func newAppConfig(app AppDefinition) ProxyConfigApp {
+// newAppConfig builds the config for all registered replicas of an app,
+// which share a name and domain. requests are balanced across them.
+func newAppConfig(replicas []AppDefinition) ProxyConfigApp {
+  upstreams := make([]ProxyConfigUpstream, 0, len(replicas))
+  for _, app := range replicas {
+    upstreams = append(upstreams, ProxyConfigUpstream{
+      Location: "localhost:" + app.Port,
+    })
+  }
+  sort.Slice(upstreams, func(i, j int) bool { return upstreams[i].Location < upstreams[j].Location })
+
+  reverseProxy := ProxyConfigAppReverseProxy{Upstream: upstreams}
+  if len(upstreams) > 1 {
+    reverseProxy.LoadBalance = "round_robin"
+  }
+
   return ProxyConfigApp{
-    ServerName: app.DomainName,
-    ReverseProxy: []ProxyConfigAppReverseProxy{{
-      Upstream: []ProxyConfigUpstream{{
-        Location: "localhost:" + app.Port,
-      }},
-    }},
+    ServerName: replicas[0].DomainName,
+    ReverseProxy: []ProxyConfigAppReverseProxy{reverseProxy},
   }
 }
 
@@ -20,7 +33,8 @@ type ProxyConfigUpstream struct {
 
 type ProxyConfigAppReverseProxy struct {
   Upstream []ProxyConfigUpstream `toml:"upstream"`
-  }
+  LoadBalance string `toml:"load_balance,omitempty"`
+}
 
 type ProxyConfigApp struct {
   ServerName string `toml:"server_name"`
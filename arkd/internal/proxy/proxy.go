@@ -55,20 +55,27 @@ func (p *proxy) DelistApp(id string) error {
   return p.writeConfig()
 }
 
-func (p *proxy) writeConfig() error {
-  cfgApps := map[string]ProxyConfigApp{}
-
+func (p *proxy) config() ProxyConfig {
+  // replicas of an app are registered under their own ids but share a name
+  replicas := map[string][]AppDefinition{}
   for _, app := range p.registeredApps {
-    cfgApps[app.Name] = newAppConfig(app)
+    replicas[app.Name] = append(replicas[app.Name], app)
+  }
+
+  cfgApps := map[string]ProxyConfigApp{}
+  for name, apps := range replicas {
+    cfgApps[name] = newAppConfig(apps)
   }
 
-  cfg := ProxyConfig{
+  return ProxyConfig{
     ListenPort: ProxyListenPort,
     ListenPortTls: ProxyListenPortTls,
     Apps: cfgApps,
   }
+}
 
-  buf, err := toml.Marshal(cfg)
+func (p *proxy) writeConfig() error {
+  buf, err := toml.Marshal(p.config())
   if err != nil {
     return err
   }
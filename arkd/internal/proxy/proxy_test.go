@@ -0,0 +1,46 @@
+package proxy
+
+import (
+	"reflect"
+	"testing"
+)
+
+func Test_proxy_config(t *testing.T) {
+	p := &proxy{registeredApps: make(map[string]AppDefinition)}
+
+	p.RegisterApp("01", "web--prod--shop", "web.prod.shop", "32001")
+	p.RegisterApp("02", "web--prod--shop", "web.prod.shop", "32000")
+	p.RegisterApp("03", "api--prod--shop", "api.prod.shop", "32002")
+
+	want := map[string]ProxyConfigApp{
+		"web--prod--shop": {
+			ServerName: "web.prod.shop.internal",
+			ReverseProxy: []ProxyConfigAppReverseProxy{{
+				Upstream:    []ProxyConfigUpstream{{Location: "localhost:32000"}, {Location: "localhost:32001"}},
+				LoadBalance: "round_robin",
+			}},
+		},
+		"api--prod--shop": {
+			ServerName: "api.prod.shop.internal",
+			ReverseProxy: []ProxyConfigAppReverseProxy{{
+				Upstream: []ProxyConfigUpstream{{Location: "localhost:32002"}},
+			}},
+		},
+	}
+	if got := p.config().Apps; !reflect.DeepEqual(got, want) {
+		t.Errorf("config().Apps = %+v, want %+v", got, want)
+	}
+
+	// the last replica is served without balancing
+	p.DelistApp("02")
+	got := p.config().Apps["web--prod--shop"].ReverseProxy[0]
+	wantWeb := ProxyConfigAppReverseProxy{Upstream: []ProxyConfigUpstream{{Location: "localhost:32001"}}}
+	if !reflect.DeepEqual(got, wantWeb) {
+		t.Errorf("config() after delist = %+v, want %+v", got, wantWeb)
+	}
+
+	p.DelistApp("01")
+	if _, ok := p.config().Apps["web--prod--shop"]; ok {
+		t.Errorf("config() still has web--prod--shop after all replicas were delisted")
+	}
+}
@@ -19,6 +19,8 @@ const (
 	TaskStatusSuspended
 	TaskStatusExited
 	TaskStatusCrashed
+	// the container exited and is restarted after a backoff
+	TaskStatusRestarting
 )
 
 type TaskDefinition struct {
@@ -26,10 +28,108 @@ type TaskDefinition struct {
 	DeploymentName string      `json:"deployment_name"`
 	StackName      string      `json:"stack_name"`
 	Image          string      `json:"image"`
-	HealthCheck    string      `json:"health_check"`
+	HealthCheck    TaskHealthCheck `json:"health_check"`
 	Cpu            float64     `json:"cpu"`
 	Memory         int         `json:"memory"`
+	// max processes in the container, defaults to the worker's default
+	Pids           int         `json:"pids"`
+	Schedule       string      `json:"schedule"`
 	ExposedPorts   []string    `json:"exposed_ports"`
+	Disks          []TaskDisk  `json:"disks"`
+	Env            map[string]string `json:"env"`
+	// signal sent to stop the task, defaults to SIGTERM
+	StopSignal     string      `json:"stop_signal"`
+	// how long the task has to exit before it's killed, e.g. "10s"
+	StopGracePeriod string     `json:"stop_grace_period"`
+	// web tasks with an IdleTimeout and without keep alive are suspended
+	// after IdleTimeout without traffic, e.g. "15m"
+	KeepAlive      bool        `json:"keep_alive"`
+	IdleTimeout    string      `json:"idle_timeout"`
+	Restart        TaskRestartPolicy `json:"restart"`
+}
+
+// TaskDisk is a persistent disk mounted into a task's container
+type TaskDisk struct {
+	Name      string `json:"name"`
+	MountPath string `json:"mount_path"`
+	// size in GB
+	Size int `json:"size"`
+}
+
+const (
+	RestartNever     = "never"
+	RestartOnFailure = "on-failure"
+	RestartAlways    = "always"
+)
+
+// TaskRestartPolicy is when a task is restarted after its container exits
+type TaskRestartPolicy struct {
+	Policy     string `json:"policy"`
+	MaxRetries int    `json:"max_retries"`
+}
+
+// TaskHealthCheck is how a task's health is checked. durations are strings
+// as written in the stack definition, e.g. "10s".
+type TaskHealthCheck struct {
+	GracePeriod string `json:"grace_period"`
+	Interval    string `json:"interval"`
+	Timeout     string `json:"timeout"`
+	// run in the container via docker exec, passes on exit code 0
+	Command string `json:"command"`
+	// request DSL, see ark.ParseHealthCheckRequest
+	Request string `json:"request"`
+	// container port requests are sent to
+	Port int `json:"port"`
+}
+
+type HealthStatus string
+
+const (
+	HealthStatusNone      HealthStatus = ""
+	HealthStatusStarting  HealthStatus = "starting"
+	HealthStatusHealthy   HealthStatus = "healthy"
+	HealthStatusUnhealthy HealthStatus = "unhealthy"
+)
+
+// TaskHealth is the outcome of a task's recent health checks
+type TaskHealth struct {
+	Status        HealthStatus        `json:"status"`
+	FailingStreak int                 `json:"failing_streak"`
+	History       []HealthCheckResult `json:"history"`
+}
+
+type HealthCheckResult struct {
+	StartedAt time.Time     `json:"started_at"`
+	Duration  time.Duration `json:"duration"`
+	Passed    bool          `json:"passed"`
+	Output    string        `json:"output"`
+}
+
+// TaskEvent is a status transition of a task
+type TaskEvent struct {
+	TaskID    ulid.ULID  `json:"task_id"`
+	At        time.Time  `json:"at"`
+	From      TaskStatus `json:"from"`
+	To        TaskStatus `json:"to"`
+	Reason    string     `json:"reason"`
+	ExitCode  *int       `json:"exit_code,omitempty"`
+	OOMKilled bool       `json:"oom_killed,omitempty"`
+}
+
+type TaskChangeType string
+
+const (
+	TaskChangeCreate TaskChangeType = "create"
+	TaskChangeUpdate TaskChangeType = "update"
+	TaskChangeDelete TaskChangeType = "delete"
+)
+
+// TaskChange is sent by GET /v1/tasks/watch for every write to a worker's
+// tasks. revisions increase by one with every change.
+type TaskChange struct {
+	Revision uint64         `json:"revision"`
+	Type     TaskChangeType `json:"type"`
+	Task     Task           `json:"task"`
 }
 
 func NewTask(taskDef TaskDefinition) (*Task, error) {
@@ -46,21 +146,46 @@ func NewTask(taskDef TaskDefinition) (*Task, error) {
 		Status:         TaskStatusPending,
 		CPU:            taskDef.Cpu,
 		Memory:         taskDef.Memory,
+		Pids:           taskDef.Pids,
+		Schedule:       taskDef.Schedule,
 		Image:          imageRef,
+		Disks:          taskDef.Disks,
+		Env:            taskDef.Env,
+		HealthCheck:    taskDef.HealthCheck,
+		StopSignal:     taskDef.StopSignal,
+		StopGracePeriod: taskDef.StopGracePeriod,
+		KeepAlive:      taskDef.KeepAlive,
+		IdleTimeout:    taskDef.IdleTimeout,
+		Restart:        taskDef.Restart,
 	}, nil
 }
 
 type Task struct {
 	ID             ulid.ULID  `json:"id"`
+	Revision       uint64     `json:"revision"`
 	AppName        string     `json:"app_name"`
 	DeploymentName string     `json:"deployment_name"`
 	StackName      string     `json:"stack_name"`
 	ContainerID    string     `json:"container_id"`
 	CPU            float64    `json:"cpu"`
 	StartedAt      time.Time  `json:"started_at"`
+	FinishedAt     time.Time  `json:"finished_at"`
 	Status         TaskStatus `json:"status"`
 	Memory         int        `json:"memory"`
+	Pids           int        `json:"pids"`
+	Schedule       string     `json:"schedule"`
 	Image          ImageRef   `json:"image"`
+	Disks          []TaskDisk `json:"disks"`
+	Env            map[string]string `json:"env"`
+	HealthCheck    TaskHealthCheck `json:"health_check"`
+	Health         TaskHealth `json:"health"`
+	StopSignal     string     `json:"stop_signal"`
+	StopGracePeriod string    `json:"stop_grace_period"`
+	KeepAlive      bool       `json:"keep_alive"`
+	IdleTimeout    string     `json:"idle_timeout"`
+	Restart        TaskRestartPolicy `json:"restart"`
+	// restarts in a row, reset once the task runs for RestartResetAfter
+	Restarts       int        `json:"restarts"`
   HostPortBindings   map[string]string `json:"host_port_bindings"`
 }
 
@@ -7,12 +7,27 @@ type StackDefinition struct {
   RootApp string `toml:"root_app"`
   Apps   map[string]AppDefinition `toml:"apps"`
   Services map[string]ServiceDefinition `toml:"services"`
+  // per deployment overrides, keyed by what a deployment is deployed for
+  Deployments map[string]DeploymentOverlay `toml:"deployments"`
 }
 
 type AppDefinition struct {
   Name string `toml:"-"`
   Type string `toml:"type"`
   RepoUrl string `toml:"repo_url"`
+  // cpu's requested for each task of this app
+  Cpu float64 `toml:"cpu"`
+  // memory requested for each task of this app, in MB
+  Mem int `toml:"mem"`
+  // cron schedule, only valid if type = "cron"
+  Schedule string `toml:"schedule"`
+  // number of tasks to run per deployment, defaults to 1
+  Count int `toml:"count"`
+  // bounds for count, 0 means unbounded
+  Min int `toml:"min"`
+  Max int `toml:"max"`
+  // apps and services that have to be healthy before this app starts
+  DependsOn []string `toml:"depends_on"`
   Build AppBuildDefinition `toml:"build"`
   Deploy AppDeployDefinition `toml:"deploy"`
   Env map[string]string `toml:"env"`
@@ -21,9 +36,28 @@ type AppDefinition struct {
   Disks map[string]AppDiskDefinition `toml:"disks"`
 }
 
+// Replicas is the number of tasks to run for the app
+func (a AppDefinition) Replicas() int {
+  if a.Count == 0 {
+    return 1
+  }
+
+  return a.Count
+}
+
 type AppDeployDefinition struct {
   Command string `toml:"command"`
   ReleaseCommand string `toml:"release_command"`
+  // signal sent to stop the app's containers, defaults to SIGTERM
+  StopSignal string `toml:"stop_signal"`
+  // time given to exit after the stop signal before the container is
+  // killed, e.g. "30s"
+  StopGracePeriod string `toml:"stop_grace_period"`
+  // when the app's tasks are restarted after their container exits: never,
+  // on-failure or always. defaults to on-failure, never for cron apps
+  Restart string `toml:"restart"`
+  // restarts in a row before a task counts as crash looping, defaults to 5
+  MaxRetries int `toml:"max_retries"`
 }
 
 type AppBuildDefinition struct {
@@ -35,7 +69,8 @@ type AppBuildDefinition struct {
 
 type AppDiskDefinition struct {
   MountPath string `toml:"mount_path"`
-  Size string `toml:"size"`
+  // size of the disk in GB
+  Size int `toml:"size"`
 }
 
 type AppHealthCheckDefinition struct {
@@ -47,8 +82,11 @@ type AppHealthCheckDefinition struct {
 }
 
 type AppHttpServiceDefinition struct {
-  ContainerPort string `toml:"container_port"`
+  ContainerPort int `toml:"container_port"`
   KeepAlive bool `toml:"keep_alive"`
+  // how long a task without traffic runs before it's suspended, unless
+  // keep_alive is set. tasks are only suspended if it's set
+  IdleTimeout string `toml:"idle_timeout"`
 }
 
 type ServiceDefinition struct {
@@ -56,5 +94,31 @@ type ServiceDefinition struct {
   Image string `toml:"image"`
   RepoUrl string `toml:"repo_url"`
   Dockerfile string `toml:"dockerfile"`
+  // apps and services that have to be healthy before this service starts
+  DependsOn []string `toml:"depends_on"`
+  Env map[string]string `toml:"env"`
+  Disks map[string]AppDiskDefinition `toml:"disks"`
+}
+
+type DeploymentOverlay struct {
+  Apps map[string]AppOverlay `toml:"apps"`
+  Services map[string]ServiceOverlay `toml:"services"`
+}
+
+type AppOverlay struct {
+  Cpu float64 `toml:"cpu"`
+  Mem int `toml:"mem"`
+  Count int `toml:"count"`
+  Build AppBuildOverlay `toml:"build"`
   Env map[string]string `toml:"env"`
+  Disks map[string]AppDiskDefinition `toml:"disks"`
+}
+
+type AppBuildOverlay struct {
+  Args map[string]string `toml:"args"`
+}
+
+type ServiceOverlay struct {
+  Env map[string]string `toml:"env"`
+  Disks map[string]AppDiskDefinition `toml:"disks"`
 }
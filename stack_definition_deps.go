@@ -0,0 +1,172 @@
+package ark
+
+import (
+	"errors"
+	"sort"
+	"strings"
+)
+
+var ErrDependencyCycle = errors.New("dependency cycle")
+
+const (
+	ComponentKindApp     = "app"
+	ComponentKindService = "service"
+)
+
+// DependencyGraph is the depends_on graph of a stack's apps and services,
+// along with the order they are deployed in
+type DependencyGraph struct {
+	Nodes []DependencyNode `json:"nodes"`
+	// Order groups names into levels. everything in a level only depends on
+	// earlier levels and can be started at the same time.
+	Order [][]string `json:"order"`
+}
+
+type DependencyNode struct {
+	Name      string   `json:"name"`
+	Kind      string   `json:"kind"`
+	DependsOn []string `json:"depends_on"`
+}
+
+// DependencyGraph returns the stack's dependency graph. It fails with
+// ErrDependencyCycle if depends_on forms a cycle.
+func (sd StackDefinition) DependencyGraph() (DependencyGraph, error) {
+	deps := sd.dependencies()
+
+	graph := DependencyGraph{
+		Nodes: make([]DependencyNode, 0, len(deps)),
+		Order: make([][]string, 0),
+	}
+	for _, name := range sortedKeys(deps) {
+		kind := ComponentKindApp
+		if _, ok := sd.Services[name]; ok {
+			kind = ComponentKindService
+		}
+		graph.Nodes = append(graph.Nodes, DependencyNode{Name: name, Kind: kind, DependsOn: deps[name]})
+	}
+
+	// kahn's algorithm, one level at a time so the order is deterministic
+	remaining := make(map[string]int, len(deps))
+	dependents := make(map[string][]string)
+	for name, nameDeps := range deps {
+		remaining[name] = 0
+		for _, dep := range nameDeps {
+			if _, ok := deps[dep]; !ok {
+				continue
+			}
+			remaining[name]++
+			dependents[dep] = append(dependents[dep], name)
+		}
+	}
+
+	for len(remaining) > 0 {
+		var level []string
+		for name, count := range remaining {
+			if count == 0 {
+				level = append(level, name)
+			}
+		}
+		if len(level) == 0 {
+			return graph, ErrDependencyCycle
+		}
+		sort.Strings(level)
+
+		for _, name := range level {
+			delete(remaining, name)
+			for _, dependent := range dependents[name] {
+				remaining[dependent]--
+			}
+		}
+		graph.Order = append(graph.Order, level)
+	}
+
+	return graph, nil
+}
+
+// dependencies maps every app and service to its depends_on list
+func (sd StackDefinition) dependencies() map[string][]string {
+	deps := make(map[string][]string, len(sd.Apps)+len(sd.Services))
+	for name, app := range sd.Apps {
+		deps[name] = app.DependsOn
+	}
+	for name, srv := range sd.Services {
+		deps[name] = srv.DependsOn
+	}
+
+	return deps
+}
+
+// validateDependencies reports unknown dependencies and cycles
+func validateDependencies(verr *ValidationError, sd StackDefinition) {
+	deps := sd.dependencies()
+
+	for _, name := range sortedKeys(deps) {
+		path := "apps." + name + ".depends_on"
+		if _, ok := sd.Services[name]; ok {
+			path = "services." + name + ".depends_on"
+		}
+
+		for _, dep := range deps[name] {
+			if dep == name {
+				verr.add(path, "%q can not depend on itself", name)
+			} else if _, ok := deps[dep]; !ok {
+				verr.add(path, "%q is not a defined app or service", dep)
+			}
+		}
+	}
+
+	if cycle := findCycle(deps); cycle != nil {
+		verr.add("depends_on", "%s: %s", ErrDependencyCycle, strings.Join(cycle, " -> "))
+	}
+}
+
+// findCycle returns the first cycle found in deps, e.g. [a b a], or nil.
+// self dependencies are reported separately and skipped here.
+func findCycle(deps map[string][]string) []string {
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := make(map[string]int, len(deps))
+	var stack []string
+
+	var visit func(name string) []string
+	visit = func(name string) []string {
+		state[name] = visiting
+		stack = append(stack, name)
+
+		for _, dep := range deps[name] {
+			if _, ok := deps[dep]; !ok || dep == name {
+				continue
+			}
+
+			switch state[dep] {
+			case visiting:
+				for i, n := range stack {
+					if n == dep {
+						return append(append([]string{}, stack[i:]...), dep)
+					}
+				}
+			case unvisited:
+				if cycle := visit(dep); cycle != nil {
+					return cycle
+				}
+			}
+		}
+
+		stack = stack[:len(stack)-1]
+		state[name] = visited
+		return nil
+	}
+
+	for _, name := range sortedKeys(deps) {
+		if state[name] == unvisited {
+			if cycle := visit(name); cycle != nil {
+				return cycle
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,90 @@
+package ark
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func Test_StackDefinition_DependencyGraph(t *testing.T) {
+	tests := []struct {
+		name      string
+		def       StackDefinition
+		wantOrder [][]string
+		wantErr   error
+	}{
+		{
+			name: "no_dependencies",
+			def: StackDefinition{
+				Apps:     map[string]AppDefinition{"web": {}, "worker": {}},
+				Services: map[string]ServiceDefinition{"postgres": {}},
+			},
+			wantOrder: [][]string{{"postgres", "web", "worker"}},
+		},
+		{
+			name: "levels",
+			def: StackDefinition{
+				Apps: map[string]AppDefinition{
+					"web":    {DependsOn: []string{"api"}},
+					"api":    {DependsOn: []string{"postgres", "redis"}},
+					"worker": {DependsOn: []string{"redis"}},
+				},
+				Services: map[string]ServiceDefinition{"postgres": {}, "redis": {}},
+			},
+			wantOrder: [][]string{{"postgres", "redis"}, {"api", "worker"}, {"web"}},
+		},
+		{
+			name: "cycle",
+			def: StackDefinition{
+				Apps: map[string]AppDefinition{
+					"a": {DependsOn: []string{"b"}},
+					"b": {DependsOn: []string{"a"}},
+				},
+			},
+			wantErr: ErrDependencyCycle,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			graph, err := tt.def.DependencyGraph()
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("DependencyGraph() error = %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantErr != nil {
+				return
+			}
+			if !reflect.DeepEqual(graph.Order, tt.wantOrder) {
+				t.Errorf("DependencyGraph() order = %v, want %v", graph.Order, tt.wantOrder)
+			}
+		})
+	}
+}
+
+func Test_validateDependencies(t *testing.T) {
+	def := StackDefinition{
+		Apps: map[string]AppDefinition{
+			"a":   {DependsOn: []string{"b"}},
+			"b":   {DependsOn: []string{"c"}},
+			"c":   {DependsOn: []string{"a"}},
+			"web": {DependsOn: []string{"web", "missing"}},
+		},
+	}
+
+	verr := &ValidationError{}
+	validateDependencies(verr, def)
+
+	var got []string
+	for _, fe := range verr.Errors {
+		got = append(got, fe.Path+": "+fe.Message)
+	}
+	want := []string{
+		`apps.web.depends_on: "web" can not depend on itself`,
+		`apps.web.depends_on: "missing" is not a defined app or service`,
+		`depends_on: dependency cycle: a -> b -> c -> a`,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("validateDependencies() =\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
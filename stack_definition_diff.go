@@ -0,0 +1,292 @@
+package ark
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type PlanAction string
+
+const (
+	PlanActionCreate PlanAction = "create"
+	PlanActionRemove PlanAction = "remove"
+	PlanActionUpdate PlanAction = "update"
+)
+
+// DeployPlan describes what changes between two stack definitions. apps
+// and services without changes are left out.
+type DeployPlan struct {
+	Stack    []FieldChange   `json:"stack,omitempty"`
+	Apps     []ComponentPlan `json:"apps"`
+	Services []ComponentPlan `json:"services"`
+}
+
+// ComponentPlan is the planned change for a single app or service
+type ComponentPlan struct {
+	Name   string     `json:"name"`
+	Action PlanAction `json:"action"`
+	// the image has to be rebuilt (or re-pulled) because of Build changes
+	Rebuild   bool          `json:"rebuild"`
+	Build     []FieldChange `json:"build,omitempty"`
+	BuildArgs []KeyChange   `json:"build_args,omitempty"`
+	Resources []FieldChange `json:"resources,omitempty"`
+	Config    []FieldChange `json:"config,omitempty"`
+	Env       []KeyChange   `json:"env,omitempty"`
+	Disks     []DiskChange  `json:"disks,omitempty"`
+}
+
+// FieldChange is a changed field, identified by its TOML key path relative
+// to the app or service
+type FieldChange struct {
+	Path string `json:"path"`
+	Old  string `json:"old"`
+	New  string `json:"new"`
+}
+
+// KeyChange is an added, removed or changed env or build arg key. values
+// are left out since they often hold credentials.
+type KeyChange struct {
+	Key    string     `json:"key"`
+	Action PlanAction `json:"action"`
+}
+
+type DiskChange struct {
+	Name   string     `json:"name"`
+	Action PlanAction `json:"action"`
+	// the change loses data stored on the disk
+	Destructive bool   `json:"destructive"`
+	Reason      string `json:"reason,omitempty"`
+}
+
+// Empty reports whether the plan has nothing to do
+func (p DeployPlan) Empty() bool {
+	return len(p.Stack) == 0 && len(p.Apps) == 0 && len(p.Services) == 0
+}
+
+// Destructive reports whether executing the plan loses disk data
+func (p DeployPlan) Destructive() bool {
+	for _, cps := range [][]ComponentPlan{p.Apps, p.Services} {
+		for _, cp := range cps {
+			for _, dc := range cp.Disks {
+				if dc.Destructive {
+					return true
+				}
+			}
+		}
+	}
+
+	return false
+}
+
+// DiffStackDefinitions returns the plan that takes a stack from old to new.
+// Diffing against an empty StackDefinition plans the creation of everything.
+func DiffStackDefinitions(old, new StackDefinition) DeployPlan {
+	plan := DeployPlan{
+		Apps:     make([]ComponentPlan, 0),
+		Services: make([]ComponentPlan, 0),
+	}
+
+	plan.Stack = appendChange(plan.Stack, "stack", old.StackName, new.StackName)
+	plan.Stack = appendChange(plan.Stack, "root_app", old.RootApp, new.RootApp)
+
+	for _, name := range unionKeys(old.Apps, new.Apps) {
+		oldApp, inOld := old.Apps[name]
+		newApp, inNew := new.Apps[name]
+
+		var cp ComponentPlan
+		switch {
+		case !inOld:
+			cp = diffApp(name, PlanActionCreate, AppDefinition{}, newApp)
+		case !inNew:
+			cp = diffApp(name, PlanActionRemove, oldApp, AppDefinition{})
+		default:
+			cp = diffApp(name, PlanActionUpdate, oldApp, newApp)
+		}
+
+		if cp.Action != PlanActionUpdate || cp.hasChanges() {
+			plan.Apps = append(plan.Apps, cp)
+		}
+	}
+
+	for _, name := range unionKeys(old.Services, new.Services) {
+		oldSrv, inOld := old.Services[name]
+		newSrv, inNew := new.Services[name]
+
+		var cp ComponentPlan
+		switch {
+		case !inOld:
+			cp = diffService(name, PlanActionCreate, ServiceDefinition{}, newSrv)
+		case !inNew:
+			cp = diffService(name, PlanActionRemove, oldSrv, ServiceDefinition{})
+		default:
+			cp = diffService(name, PlanActionUpdate, oldSrv, newSrv)
+		}
+
+		if cp.Action != PlanActionUpdate || cp.hasChanges() {
+			plan.Services = append(plan.Services, cp)
+		}
+	}
+
+	return plan
+}
+
+func diffApp(name string, action PlanAction, old, new AppDefinition) ComponentPlan {
+	cp := ComponentPlan{Name: name, Action: action}
+
+	cp.Build = appendChange(cp.Build, "repo_url", old.RepoUrl, new.RepoUrl)
+	cp.Build = appendChange(cp.Build, "build.dockerfile", old.Build.Dockerfile, new.Build.Dockerfile)
+	cp.Build = appendChange(cp.Build, "build.ignorefile", old.Build.Ignorefile, new.Build.Ignorefile)
+	cp.Build = appendChange(cp.Build, "build.build_target", old.Build.BuildTarget, new.Build.BuildTarget)
+	cp.BuildArgs = diffKeys(old.Build.Args, new.Build.Args)
+
+	cp.Resources = appendChange(cp.Resources, "cpu", formatFloat(old.Cpu), formatFloat(new.Cpu))
+	cp.Resources = appendChange(cp.Resources, "mem", formatInt(old.Mem), formatInt(new.Mem))
+	cp.Resources = appendChange(cp.Resources, "count", formatInt(old.Count), formatInt(new.Count))
+	cp.Resources = appendChange(cp.Resources, "min", formatInt(old.Min), formatInt(new.Min))
+	cp.Resources = appendChange(cp.Resources, "max", formatInt(old.Max), formatInt(new.Max))
+
+	cp.Config = appendChange(cp.Config, "type", old.Type, new.Type)
+	cp.Config = appendChange(cp.Config, "schedule", old.Schedule, new.Schedule)
+	cp.Config = appendChange(cp.Config, "depends_on", strings.Join(old.DependsOn, ", "), strings.Join(new.DependsOn, ", "))
+	cp.Config = appendChange(cp.Config, "deploy.command", old.Deploy.Command, new.Deploy.Command)
+	cp.Config = appendChange(cp.Config, "deploy.release_command", old.Deploy.ReleaseCommand, new.Deploy.ReleaseCommand)
+	cp.Config = appendChange(cp.Config, "deploy.stop_signal", old.Deploy.StopSignal, new.Deploy.StopSignal)
+	cp.Config = appendChange(cp.Config, "deploy.stop_grace_period", old.Deploy.StopGracePeriod, new.Deploy.StopGracePeriod)
+	cp.Config = appendChange(cp.Config, "deploy.restart", old.Deploy.Restart, new.Deploy.Restart)
+	cp.Config = appendChange(cp.Config, "deploy.max_retries", formatInt(old.Deploy.MaxRetries), formatInt(new.Deploy.MaxRetries))
+	cp.Config = appendChange(cp.Config, "http_service.container_port", formatInt(old.HttpService.ContainerPort), formatInt(new.HttpService.ContainerPort))
+	cp.Config = appendChange(cp.Config, "http_service.keep_alive", strconv.FormatBool(old.HttpService.KeepAlive), strconv.FormatBool(new.HttpService.KeepAlive))
+	cp.Config = appendChange(cp.Config, "http_service.idle_timeout", old.HttpService.IdleTimeout, new.HttpService.IdleTimeout)
+	cp.Config = appendChange(cp.Config, "health_check.grace_period", old.HealthCheck.GracePeriod, new.HealthCheck.GracePeriod)
+	cp.Config = appendChange(cp.Config, "health_check.interval", old.HealthCheck.Interval, new.HealthCheck.Interval)
+	cp.Config = appendChange(cp.Config, "health_check.timeout", old.HealthCheck.Timeout, new.HealthCheck.Timeout)
+	cp.Config = appendChange(cp.Config, "health_check.command", old.HealthCheck.Command, new.HealthCheck.Command)
+	cp.Config = appendChange(cp.Config, "health_check.request", old.HealthCheck.Request, new.HealthCheck.Request)
+
+	cp.Env = diffKeys(old.Env, new.Env)
+	cp.Disks = diffDisks(old.Disks, new.Disks)
+	cp.Rebuild = action == PlanActionCreate || (action == PlanActionUpdate && (len(cp.Build) > 0 || len(cp.BuildArgs) > 0))
+
+	return cp
+}
+
+func diffService(name string, action PlanAction, old, new ServiceDefinition) ComponentPlan {
+	cp := ComponentPlan{Name: name, Action: action}
+
+	cp.Build = appendChange(cp.Build, "image", old.Image, new.Image)
+	cp.Build = appendChange(cp.Build, "repo_url", old.RepoUrl, new.RepoUrl)
+	cp.Build = appendChange(cp.Build, "dockerfile", old.Dockerfile, new.Dockerfile)
+
+	cp.Config = appendChange(cp.Config, "depends_on", strings.Join(old.DependsOn, ", "), strings.Join(new.DependsOn, ", "))
+
+	cp.Env = diffKeys(old.Env, new.Env)
+	cp.Disks = diffDisks(old.Disks, new.Disks)
+	cp.Rebuild = action == PlanActionCreate || (action == PlanActionUpdate && len(cp.Build) > 0)
+
+	return cp
+}
+
+func diffDisks(old, new map[string]AppDiskDefinition) []DiskChange {
+	var changes []DiskChange
+
+	for _, name := range unionKeys(old, new) {
+		oldDisk, inOld := old[name]
+		newDisk, inNew := new[name]
+
+		switch {
+		case !inOld:
+			changes = append(changes, DiskChange{Name: name, Action: PlanActionCreate})
+		case !inNew:
+			changes = append(changes, DiskChange{Name: name, Action: PlanActionRemove, Destructive: true, Reason: "disk and its data are removed"})
+		case newDisk.Size < oldDisk.Size:
+			changes = append(changes, DiskChange{
+				Name:        name,
+				Action:      PlanActionUpdate,
+				Destructive: true,
+				Reason:      fmt.Sprintf("size shrinks from %dGB to %dGB", oldDisk.Size, newDisk.Size),
+			})
+		case newDisk.Size > oldDisk.Size:
+			changes = append(changes, DiskChange{
+				Name:   name,
+				Action: PlanActionUpdate,
+				Reason: fmt.Sprintf("size grows from %dGB to %dGB", oldDisk.Size, newDisk.Size),
+			})
+		case newDisk.MountPath != oldDisk.MountPath:
+			changes = append(changes, DiskChange{
+				Name:   name,
+				Action: PlanActionUpdate,
+				Reason: fmt.Sprintf("mount path moves from %s to %s", oldDisk.MountPath, newDisk.MountPath),
+			})
+		}
+	}
+
+	return changes
+}
+
+func diffKeys(old, new map[string]string) []KeyChange {
+	var changes []KeyChange
+
+	for _, key := range unionKeys(old, new) {
+		oldVal, inOld := old[key]
+		newVal, inNew := new[key]
+
+		switch {
+		case !inOld:
+			changes = append(changes, KeyChange{Key: key, Action: PlanActionCreate})
+		case !inNew:
+			changes = append(changes, KeyChange{Key: key, Action: PlanActionRemove})
+		case oldVal != newVal:
+			changes = append(changes, KeyChange{Key: key, Action: PlanActionUpdate})
+		}
+	}
+
+	return changes
+}
+
+func (cp ComponentPlan) hasChanges() bool {
+	return len(cp.Build) > 0 || len(cp.BuildArgs) > 0 || len(cp.Resources) > 0 || len(cp.Config) > 0 || len(cp.Env) > 0 || len(cp.Disks) > 0
+}
+
+func appendChange(changes []FieldChange, path, old, new string) []FieldChange {
+	if old == new {
+		return changes
+	}
+
+	return append(changes, FieldChange{Path: path, Old: old, New: new})
+}
+
+func formatInt(i int) string {
+	if i == 0 {
+		return ""
+	}
+
+	return strconv.Itoa(i)
+}
+
+func formatFloat(f float64) string {
+	if f == 0 {
+		return ""
+	}
+
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+func unionKeys[T any](a, b map[string]T) []string {
+	seen := make(map[string]struct{}, len(a)+len(b))
+	for k := range a {
+		seen[k] = struct{}{}
+	}
+	for k := range b {
+		seen[k] = struct{}{}
+	}
+
+	keys := make([]string, 0, len(seen))
+	for k := range seen {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
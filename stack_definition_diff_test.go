@@ -0,0 +1,120 @@
+package ark
+
+import (
+	"reflect"
+	"testing"
+)
+
+func Test_DiffStackDefinitions(t *testing.T) {
+	old := StackDefinition{
+		StackName: "babies-first-ark",
+		RootApp:   "frontend",
+		Apps: map[string]AppDefinition{
+			"frontend": {Type: AppTypeWeb, Cpu: 1, Build: AppBuildDefinition{Dockerfile: "Dockerfile"}},
+			"backend":  {Type: AppTypePserv, Env: map[string]string{"LOG_LEVEL": "info", "OLD": "1"}},
+			"api":      {Type: AppTypePserv, Build: AppBuildDefinition{Args: map[string]string{"NPM_TOKEN": "old-secret"}}},
+			"worker":   {Type: AppTypeWorker},
+		},
+		Services: map[string]ServiceDefinition{
+			"postgres": {Image: "postgres:15", Disks: map[string]AppDiskDefinition{"pgdata": {MountPath: "/data", Size: 5}}},
+		},
+	}
+	new := StackDefinition{
+		StackName: "babies-first-ark",
+		RootApp:   "frontend",
+		Apps: map[string]AppDefinition{
+			"frontend": {Type: AppTypeWeb, Cpu: 2, Build: AppBuildDefinition{Dockerfile: "Dockerfile.prod"}},
+			"backend":  {Type: AppTypePserv, Env: map[string]string{"LOG_LEVEL": "debug", "NEW": "1"}},
+			"api":      {Type: AppTypePserv, Build: AppBuildDefinition{Args: map[string]string{"NPM_TOKEN": "new-secret"}}},
+			"jobs":     {Type: AppTypeWorker},
+		},
+		Services: map[string]ServiceDefinition{
+			"postgres": {Image: "postgres:15", Disks: map[string]AppDiskDefinition{"pgdata": {MountPath: "/data", Size: 2}}},
+		},
+	}
+
+	want := DeployPlan{
+		Apps: []ComponentPlan{
+			{
+				Name:      "api",
+				Action:    PlanActionUpdate,
+				Rebuild:   true,
+				BuildArgs: []KeyChange{{Key: "NPM_TOKEN", Action: PlanActionUpdate}},
+			},
+			{
+				Name:   "backend",
+				Action: PlanActionUpdate,
+				Env: []KeyChange{
+					{Key: "LOG_LEVEL", Action: PlanActionUpdate},
+					{Key: "NEW", Action: PlanActionCreate},
+					{Key: "OLD", Action: PlanActionRemove},
+				},
+			},
+			{
+				Name:      "frontend",
+				Action:    PlanActionUpdate,
+				Rebuild:   true,
+				Build:     []FieldChange{{Path: "build.dockerfile", Old: "Dockerfile", New: "Dockerfile.prod"}},
+				Resources: []FieldChange{{Path: "cpu", Old: "1", New: "2"}},
+			},
+			{
+				Name:    "jobs",
+				Action:  PlanActionCreate,
+				Rebuild: true,
+				Config:  []FieldChange{{Path: "type", Old: "", New: "worker"}},
+			},
+			{
+				Name:   "worker",
+				Action: PlanActionRemove,
+				Config: []FieldChange{{Path: "type", Old: "worker", New: ""}},
+			},
+		},
+		Services: []ComponentPlan{
+			{
+				Name:   "postgres",
+				Action: PlanActionUpdate,
+				Disks: []DiskChange{
+					{Name: "pgdata", Action: PlanActionUpdate, Destructive: true, Reason: "size shrinks from 5GB to 2GB"},
+				},
+			},
+		},
+	}
+
+	got := DiffStackDefinitions(old, new)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("DiffStackDefinitions() = %+v, want %+v", got, want)
+	}
+	if !got.Destructive() {
+		t.Errorf("Destructive() = false, want true")
+	}
+	if !DiffStackDefinitions(new, new).Empty() {
+		t.Errorf("DiffStackDefinitions() of identical definitions is not empty")
+	}
+}
+
+func Test_DiffStackDefinitions_deploy(t *testing.T) {
+	tests := []struct {
+		name   string
+		old    AppDeployDefinition
+		new    AppDeployDefinition
+		change FieldChange
+	}{
+		{"stop signal", AppDeployDefinition{StopSignal: "SIGTERM"}, AppDeployDefinition{StopSignal: "SIGQUIT"}, FieldChange{Path: "deploy.stop_signal", Old: "SIGTERM", New: "SIGQUIT"}},
+		{"stop grace period", AppDeployDefinition{}, AppDeployDefinition{StopGracePeriod: "30s"}, FieldChange{Path: "deploy.stop_grace_period", Old: "", New: "30s"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			old := StackDefinition{StackName: "shop", Apps: map[string]AppDefinition{"web": {Type: AppTypeWeb, Deploy: tt.old}}}
+			new := StackDefinition{StackName: "shop", Apps: map[string]AppDefinition{"web": {Type: AppTypeWeb, Deploy: tt.new}}}
+
+			got := DiffStackDefinitions(old, new)
+			if got.Empty() {
+				t.Fatal("DiffStackDefinitions() is empty")
+			}
+			want := []ComponentPlan{{Name: "web", Action: PlanActionUpdate, Config: []FieldChange{tt.change}}}
+			if !reflect.DeepEqual(got.Apps, want) {
+				t.Errorf("DiffStackDefinitions() apps = %+v, want %+v", got.Apps, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,128 @@
+package ark
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// matches ${ref} references and the $${ escape. a $$ not followed by {
+// is left alone.
+var envRefPattern = regexp.MustCompile(`\$\$\{|\$\{([^}]*)\}`)
+
+// EnvResolver resolves ${...} references in app and service env values for
+// a single deployment of a stack. Supported references are
+//
+//	${stack.name}
+//	${deployment.name}
+//	${apps.<name>.host}
+//	${apps.<name>.port}
+//	${apps.<name>.internal_url}
+//	${services.<name>.host}
+//
+// A literal "${" is written as "$${".
+type EnvResolver struct {
+	Def            StackDefinition
+	DeploymentName string
+	// HostName returns the hostname an app or service is reachable at from
+	// the other containers on the deployment's network.
+	HostName func(name string) string
+}
+
+// Resolve returns a copy of env with every reference replaced.
+func (r EnvResolver) Resolve(env map[string]string) (map[string]string, error) {
+	resolved := make(map[string]string, len(env))
+	for key, value := range env {
+		v, err := r.expand(value)
+		if err != nil {
+			return nil, fmt.Errorf("env %s: %w", key, err)
+		}
+		resolved[key] = v
+	}
+
+	return resolved, nil
+}
+
+func (r EnvResolver) expand(value string) (string, error) {
+	var firstErr error
+	expanded := envRefPattern.ReplaceAllStringFunc(value, func(match string) string {
+		if match == "$${" {
+			return "${"
+		}
+
+		v, err := r.lookup(match[2 : len(match)-1])
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+		return v
+	})
+
+	return expanded, firstErr
+}
+
+func (r EnvResolver) lookup(ref string) (string, error) {
+	parts := strings.Split(ref, ".")
+
+	switch {
+	case ref == "stack.name":
+		return r.Def.StackName, nil
+	case ref == "deployment.name":
+		return r.DeploymentName, nil
+	case len(parts) == 3 && parts[0] == "apps":
+		app, ok := r.Def.Apps[parts[1]]
+		if !ok {
+			return "", fmt.Errorf("${%s}: app %q is not defined", ref, parts[1])
+		}
+
+		return r.appAttr(ref, parts[1], parts[2], app)
+	case len(parts) == 3 && parts[0] == "services":
+		if _, ok := r.Def.Services[parts[1]]; !ok {
+			return "", fmt.Errorf("${%s}: service %q is not defined", ref, parts[1])
+		}
+		if parts[2] != "host" {
+			return "", fmt.Errorf("${%s}: unknown service attribute %q", ref, parts[2])
+		}
+
+		return r.host(parts[1]), nil
+	}
+
+	return "", fmt.Errorf("${%s}: unknown reference", ref)
+}
+
+func (r EnvResolver) appAttr(ref, name, attr string, app AppDefinition) (string, error) {
+	switch attr {
+	case "host":
+		return r.host(name), nil
+	case "port", "internal_url":
+		if app.HttpService.ContainerPort == 0 {
+			return "", fmt.Errorf("${%s}: app %q has no http_service.container_port", ref, name)
+		}
+
+		port := strconv.Itoa(app.HttpService.ContainerPort)
+		if attr == "port" {
+			return port, nil
+		}
+		return "http://" + r.host(name) + ":" + port, nil
+	}
+
+	return "", fmt.Errorf("${%s}: unknown app attribute %q", ref, attr)
+}
+
+func (r EnvResolver) host(name string) string {
+	if r.HostName == nil {
+		return name
+	}
+
+	return r.HostName(name)
+}
+
+// validateEnv reports references that can never be resolved
+func validateEnv(verr *ValidationError, path string, env map[string]string, sd StackDefinition) {
+	r := EnvResolver{Def: sd}
+	for _, key := range sortedKeys(env) {
+		if _, err := r.expand(env[key]); err != nil {
+			verr.add(path+"."+key, "%s", err)
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package ark
+
+import (
+	"reflect"
+	"testing"
+)
+
+func Test_EnvResolver_Resolve(t *testing.T) {
+	r := EnvResolver{
+		Def: StackDefinition{
+			StackName: "babies-first-ark",
+			Apps: map[string]AppDefinition{
+				"backend": {Type: AppTypePserv, HttpService: AppHttpServiceDefinition{ContainerPort: 3000}},
+			},
+			Services: map[string]ServiceDefinition{
+				"postgres": {Image: "postgres"},
+			},
+		},
+		DeploymentName: "preview-1",
+		HostName: func(name string) string {
+			return name + "--preview-1--babies-first-ark"
+		},
+	}
+
+	tests := []struct {
+		name    string
+		env     map[string]string
+		want    map[string]string
+		wantErr bool
+	}{
+		{
+			"references",
+			map[string]string{
+				"DATABASE_URL": "postgres://${services.postgres.host}:5432",
+				"API_URL":      "${apps.backend.internal_url}/v1",
+				"RELEASE":      "${stack.name}/${deployment.name}",
+				"LITERAL":      "$${HOME}",
+			},
+			map[string]string{
+				"DATABASE_URL": "postgres://postgres--preview-1--babies-first-ark:5432",
+				"API_URL":      "http://backend--preview-1--babies-first-ark:3000/v1",
+				"RELEASE":      "babies-first-ark/preview-1",
+				"LITERAL":      "${HOME}",
+			},
+			false,
+		},
+		{
+			"dollars",
+			map[string]string{"PASSWORD": "a$$b", "PRICE": "$5", "TRAILING": "$$"},
+			map[string]string{"PASSWORD": "a$$b", "PRICE": "$5", "TRAILING": "$$"},
+			false,
+		},
+		{
+			"unknown_service",
+			map[string]string{"DATABASE_URL": "${services.redis.host}"},
+			nil,
+			true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := r.Resolve(tt.env)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Resolve() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Resolve() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,141 @@
+package ark
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// DefaultHealthCheckRequest is checked for apps with an http_service and no
+// health_check command or request
+const DefaultHealthCheckRequest = "http GET /"
+
+var ErrInvalidHealthCheckRequest = errors.New("invalid health check request")
+
+// HealthCheckRequest is a parsed health_check.request. The request DSL is
+//
+//	http <METHOD> <path> [<status>] [<header>...]
+//
+// where status is the expected response status (any 2xx if left out) and
+// each header is written as "Name: value". Headers containing spaces are
+// quoted with ' or ", e.g.
+//
+//	http GET /up 204 'Authorization: Bearer token'
+type HealthCheckRequest struct {
+	Method string `json:"method"`
+	Path   string `json:"path"`
+	// expected response status, 0 accepts any 2xx
+	Status  int               `json:"status"`
+	Headers map[string]string `json:"headers"`
+}
+
+var healthCheckMethods = []string{
+	http.MethodGet,
+	http.MethodHead,
+	http.MethodPost,
+	http.MethodPut,
+	http.MethodPatch,
+	http.MethodDelete,
+	http.MethodOptions,
+}
+
+// ParseHealthCheckRequest parses the health_check.request DSL
+func ParseHealthCheckRequest(s string) (HealthCheckRequest, error) {
+	tokens, err := splitHealthCheckRequest(s)
+	if err != nil {
+		return HealthCheckRequest{}, err
+	}
+	if len(tokens) < 3 {
+		return HealthCheckRequest{}, fmt.Errorf("%w: want \"http <METHOD> <path>\", got %q", ErrInvalidHealthCheckRequest, s)
+	}
+
+	if tokens[0] != "http" {
+		return HealthCheckRequest{}, fmt.Errorf("%w: unsupported protocol %q", ErrInvalidHealthCheckRequest, tokens[0])
+	}
+
+	req := HealthCheckRequest{
+		Method:  strings.ToUpper(tokens[1]),
+		Path:    tokens[2],
+		Headers: make(map[string]string),
+	}
+	if !slices.Contains(healthCheckMethods, req.Method) {
+		return HealthCheckRequest{}, fmt.Errorf("%w: unsupported method %q", ErrInvalidHealthCheckRequest, tokens[1])
+	}
+	if !strings.HasPrefix(req.Path, "/") {
+		return HealthCheckRequest{}, fmt.Errorf("%w: path %q must start with /", ErrInvalidHealthCheckRequest, req.Path)
+	}
+
+	rest := tokens[3:]
+	if len(rest) > 0 {
+		if status, err := strconv.Atoi(rest[0]); err == nil {
+			if status < 100 || status > 599 {
+				return HealthCheckRequest{}, fmt.Errorf("%w: status %d out of range", ErrInvalidHealthCheckRequest, status)
+			}
+			req.Status = status
+			rest = rest[1:]
+		}
+	}
+
+	for _, header := range rest {
+		name, value, ok := strings.Cut(header, ":")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" || strings.ContainsAny(name, " \t") {
+			return HealthCheckRequest{}, fmt.Errorf("%w: header %q must be written as \"Name: value\"", ErrInvalidHealthCheckRequest, header)
+		}
+		req.Headers[http.CanonicalHeaderKey(name)] = strings.TrimSpace(value)
+	}
+
+	return req, nil
+}
+
+// Accepts reports whether a response with status passes the check
+func (r HealthCheckRequest) Accepts(status int) bool {
+	if r.Status == 0 {
+		return status >= 200 && status < 300
+	}
+
+	return status == r.Status
+}
+
+// splitHealthCheckRequest splits s on whitespace, keeping quoted tokens
+// together
+func splitHealthCheckRequest(s string) ([]string, error) {
+	var tokens []string
+	var token strings.Builder
+	var quote rune
+	inToken := false
+
+	for _, r := range s {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else {
+				token.WriteRune(r)
+			}
+		case r == '\'' || r == '"':
+			quote = r
+			inToken = true
+		case r == ' ' || r == '\t':
+			if inToken {
+				tokens = append(tokens, token.String())
+				token.Reset()
+				inToken = false
+			}
+		default:
+			token.WriteRune(r)
+			inToken = true
+		}
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("%w: unterminated quote in %q", ErrInvalidHealthCheckRequest, s)
+	}
+	if inToken {
+		tokens = append(tokens, token.String())
+	}
+
+	return tokens, nil
+}
@@ -0,0 +1,68 @@
+package ark
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func Test_ParseHealthCheckRequest(t *testing.T) {
+	tests := []struct {
+		name    string
+		request string
+		want    HealthCheckRequest
+		wantErr error
+	}{
+		{
+			"default",
+			DefaultHealthCheckRequest,
+			HealthCheckRequest{Method: "GET", Path: "/", Headers: map[string]string{}},
+			nil,
+		},
+		{
+			"status_and_headers",
+			`http head /up 204 'authorization: Bearer abc 123' X-Probe:ark`,
+			HealthCheckRequest{
+				Method: "HEAD",
+				Path:   "/up",
+				Status: 204,
+				Headers: map[string]string{
+					"Authorization": "Bearer abc 123",
+					"X-Probe":       "ark",
+				},
+			},
+			nil,
+		},
+		{"missing_path", "http GET", HealthCheckRequest{}, ErrInvalidHealthCheckRequest},
+		{"unsupported_protocol", "tcp GET /", HealthCheckRequest{}, ErrInvalidHealthCheckRequest},
+		{"unsupported_method", "http FETCH /", HealthCheckRequest{}, ErrInvalidHealthCheckRequest},
+		{"relative_path", "http GET up", HealthCheckRequest{}, ErrInvalidHealthCheckRequest},
+		{"status_out_of_range", "http GET / 999", HealthCheckRequest{}, ErrInvalidHealthCheckRequest},
+		{"bad_header", "http GET / X-Probe", HealthCheckRequest{}, ErrInvalidHealthCheckRequest},
+		{"unterminated_quote", `http GET / "X-Probe: ark`, HealthCheckRequest{}, ErrInvalidHealthCheckRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseHealthCheckRequest(tt.request)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("ParseHealthCheckRequest() error = %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantErr == nil && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseHealthCheckRequest() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_HealthCheckRequest_Accepts(t *testing.T) {
+	anyOk := HealthCheckRequest{}
+	if !anyOk.Accepts(200) || !anyOk.Accepts(204) || anyOk.Accepts(301) || anyOk.Accepts(500) {
+		t.Errorf("request without status should accept exactly 2xx")
+	}
+
+	noContent := HealthCheckRequest{Status: 204}
+	if !noContent.Accepts(204) || noContent.Accepts(200) {
+		t.Errorf("request with status 204 should accept exactly 204")
+	}
+}
@@ -0,0 +1,80 @@
+package ark
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// looseInt decodes a JSON number or a string holding one. definitions
+// stored before container_port and disk sizes were numbers have them as
+// strings.
+type looseInt int
+
+func (n *looseInt) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		var i int
+		if err := json.Unmarshal(data, &i); err != nil {
+			return err
+		}
+		*n = looseInt(i)
+		return nil
+	}
+
+	s = strings.TrimSpace(s)
+	if s == "" {
+		*n = 0
+		return nil
+	}
+	i, err := strconv.Atoi(s)
+	if err != nil {
+		return fmt.Errorf("invalid number %q", s)
+	}
+	*n = looseInt(i)
+
+	return nil
+}
+
+func (d *AppDiskDefinition) UnmarshalJSON(data []byte) error {
+	type plain AppDiskDefinition
+	var v struct {
+		plain
+		Size looseInt
+	}
+	if err := decodeStrict(data, &v); err != nil {
+		return err
+	}
+
+	*d = AppDiskDefinition(v.plain)
+	d.Size = int(v.Size)
+
+	return nil
+}
+
+func (h *AppHttpServiceDefinition) UnmarshalJSON(data []byte) error {
+	type plain AppHttpServiceDefinition
+	var v struct {
+		plain
+		ContainerPort looseInt
+	}
+	if err := decodeStrict(data, &v); err != nil {
+		return err
+	}
+
+	*h = AppHttpServiceDefinition(v.plain)
+	h.ContainerPort = int(v.ContainerPort)
+
+	return nil
+}
+
+// decodeStrict keeps rejecting unknown fields inside the types with their
+// own UnmarshalJSON, which the outer decoder's setting doesn't reach
+func decodeStrict(data []byte, v any) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+
+	return dec.Decode(v)
+}
@@ -0,0 +1,55 @@
+package ark
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func Test_StackDefinition_UnmarshalJSON(t *testing.T) {
+	tests := []struct {
+		name     string
+		raw      string
+		wantPort int
+		wantSize int
+		wantErr  bool
+	}{
+		{"numbers", `{"HttpService": {"ContainerPort": 8080}, "Disks": {"data": {"MountPath": "/data", "Size": 5}}}`, 8080, 5, false},
+		{"stored as strings", `{"HttpService": {"ContainerPort": "8080"}, "Disks": {"data": {"MountPath": "/data", "Size": "5"}}}`, 8080, 5, false},
+		{"empty strings", `{"HttpService": {"ContainerPort": ""}, "Disks": {"data": {"MountPath": "/data", "Size": ""}}}`, 0, 0, false},
+		{"not a number", `{"HttpService": {"ContainerPort": "http"}}`, 0, 0, true},
+		{"unknown field", `{"Disks": {"data": {"MountPath": "/data", "Sise": 5}}}`, 0, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var app AppDefinition
+			err := json.Unmarshal([]byte(tt.raw), &app)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Unmarshal() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+
+			if app.HttpService.ContainerPort != tt.wantPort || app.Disks["data"].Size != tt.wantSize {
+				t.Errorf("port, size = %d, %d, want %d, %d", app.HttpService.ContainerPort, app.Disks["data"].Size, tt.wantPort, tt.wantSize)
+			}
+			if app.Disks["data"].MountPath != "/data" {
+				t.Errorf("mount path = %q, want /data", app.Disks["data"].MountPath)
+			}
+		})
+	}
+
+	// definitions round trip through the API and the database as JSON
+	def := StackDefinition{Apps: map[string]AppDefinition{"web": {HttpService: AppHttpServiceDefinition{ContainerPort: 3000, KeepAlive: true}}}}
+	raw, err := json.Marshal(def)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got StackDefinition
+	if err := json.Unmarshal(raw, &got); err != nil {
+		t.Fatal(err)
+	}
+	if hs := got.Apps["web"].HttpService; hs.ContainerPort != 3000 || !hs.KeepAlive {
+		t.Errorf("round trip http service = %+v", hs)
+	}
+}
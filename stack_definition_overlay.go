@@ -0,0 +1,176 @@
+package ark
+
+import (
+	"fmt"
+	"maps"
+)
+
+// ForDeployment returns the definition with the overlay for deployedFor
+// merged into it. the merge rules are
+//
+//   - cpu, mem and count replace the base value when set
+//   - env and build args are merged key by key, the overlay wins
+//   - disks are merged by disk name. mount_path and size replace the base
+//     values when set, disks only in the overlay are added
+//
+// Overlays are removed from the result. A deployedFor without an overlay
+// returns a copy of the base definition.
+func (sd StackDefinition) ForDeployment(deployedFor string) (StackDefinition, error) {
+	merged := sd.clone()
+	merged.Deployments = nil
+
+	overlay, ok := sd.Deployments[deployedFor]
+	if !ok {
+		return merged, nil
+	}
+
+	for _, name := range sortedKeys(overlay.Apps) {
+		app, ok := merged.Apps[name]
+		if !ok {
+			return StackDefinition{}, fmt.Errorf("deployments.%s.apps.%s: app %q is not defined", deployedFor, name, name)
+		}
+
+		ov := overlay.Apps[name]
+		if ov.Cpu != 0 {
+			app.Cpu = ov.Cpu
+		}
+		if ov.Mem != 0 {
+			app.Mem = ov.Mem
+		}
+		if ov.Count != 0 {
+			app.Count = ov.Count
+		}
+		app.Build.Args = mergeStrings(app.Build.Args, ov.Build.Args)
+		app.Env = mergeStrings(app.Env, ov.Env)
+		app.Disks = mergeDisks(app.Disks, ov.Disks)
+
+		merged.Apps[name] = app
+	}
+
+	for _, name := range sortedKeys(overlay.Services) {
+		srv, ok := merged.Services[name]
+		if !ok {
+			return StackDefinition{}, fmt.Errorf("deployments.%s.services.%s: service %q is not defined", deployedFor, name, name)
+		}
+
+		ov := overlay.Services[name]
+		srv.Env = mergeStrings(srv.Env, ov.Env)
+		srv.Disks = mergeDisks(srv.Disks, ov.Disks)
+
+		merged.Services[name] = srv
+	}
+
+	return merged, nil
+}
+
+// clone copies the definition deep enough that merging into it leaves sd
+// untouched
+func (sd StackDefinition) clone() StackDefinition {
+	c := sd
+
+	c.Apps = make(map[string]AppDefinition, len(sd.Apps))
+	for name, app := range sd.Apps {
+		app.Env = maps.Clone(app.Env)
+		app.Build.Args = maps.Clone(app.Build.Args)
+		app.Disks = maps.Clone(app.Disks)
+		c.Apps[name] = app
+	}
+
+	c.Services = make(map[string]ServiceDefinition, len(sd.Services))
+	for name, srv := range sd.Services {
+		srv.Env = maps.Clone(srv.Env)
+		srv.Disks = maps.Clone(srv.Disks)
+		c.Services[name] = srv
+	}
+
+	return c
+}
+
+func mergeStrings(base, overlay map[string]string) map[string]string {
+	if len(overlay) == 0 {
+		return base
+	}
+	if base == nil {
+		base = make(map[string]string, len(overlay))
+	}
+
+	maps.Copy(base, overlay)
+	return base
+}
+
+func mergeDisks(base, overlay map[string]AppDiskDefinition) map[string]AppDiskDefinition {
+	if len(overlay) == 0 {
+		return base
+	}
+	if base == nil {
+		base = make(map[string]AppDiskDefinition, len(overlay))
+	}
+
+	for name, ov := range overlay {
+		disk := base[name]
+		if ov.MountPath != "" {
+			disk.MountPath = ov.MountPath
+		}
+		if ov.Size != 0 {
+			disk.Size = ov.Size
+		}
+		base[name] = disk
+	}
+
+	return base
+}
+
+// validateOverlays checks every overlay against the base definition by
+// validating the merged result of the parts it overrides
+func validateOverlays(verr *ValidationError, sd StackDefinition) {
+	for _, deployedFor := range sortedKeys(sd.Deployments) {
+		path := "deployments." + deployedFor
+		validateName(verr, path, deployedFor)
+
+		overlay := sd.Deployments[deployedFor]
+		for _, name := range sortedKeys(overlay.Apps) {
+			if _, ok := sd.Apps[name]; !ok {
+				verr.add(path+".apps."+name, "app %q is not defined", name)
+			}
+		}
+		for _, name := range sortedKeys(overlay.Services) {
+			if _, ok := sd.Services[name]; !ok {
+				verr.add(path+".services."+name, "service %q is not defined", name)
+			}
+		}
+
+		merged, err := sd.ForDeployment(deployedFor)
+		if err != nil {
+			continue
+		}
+
+		for _, name := range sortedKeys(overlay.Apps) {
+			ov, app := overlay.Apps[name], merged.Apps[name]
+			appPath := path + ".apps." + name
+
+			if ov.Cpu < 0 {
+				verr.add(appPath+".cpu", "must not be negative")
+			}
+			if ov.Mem < 0 {
+				verr.add(appPath+".mem", "must not be negative")
+			}
+			if ov.Count != 0 {
+				validateCount(verr, appPath+".count", app)
+			}
+			for _, diskName := range sortedKeys(ov.Disks) {
+				validateDisk(verr, appPath+".disks."+diskName, diskName, app.Disks[diskName])
+			}
+			validateEnv(verr, appPath+".env", ov.Env, sd)
+		}
+
+		for _, name := range sortedKeys(overlay.Services) {
+			ov, srv := overlay.Services[name], merged.Services[name]
+			srvPath := path + ".services." + name
+
+			for _, diskName := range sortedKeys(ov.Disks) {
+				validateDisk(verr, srvPath+".disks."+diskName, diskName, srv.Disks[diskName])
+			}
+			validateEnv(verr, srvPath+".env", ov.Env, sd)
+		}
+	}
+}
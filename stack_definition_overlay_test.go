@@ -0,0 +1,79 @@
+package ark
+
+import (
+	"reflect"
+	"testing"
+)
+
+func Test_StackDefinition_ForDeployment(t *testing.T) {
+	def, err := ParseStackDefinition([]byte(`
+file_version = "1"
+stack = "babies-first-ark"
+root_app = "web"
+
+[apps.web]
+  type = "web"
+  cpu = 0.5
+  [apps.web.build.args]
+    ENV = "preview"
+  [apps.web.env]
+    LOG_LEVEL = "debug"
+    REGION = "us"
+  [apps.web.http_service]
+    container_port = 8080
+
+[services.postgres]
+  image = "postgres"
+  [services.postgres.disks.pgdata]
+    mount_path = "/data"
+    size = 5
+
+[deployments.production.apps.web]
+  cpu = 2
+  [deployments.production.apps.web.build.args]
+    ENV = "production"
+  [deployments.production.apps.web.env]
+    LOG_LEVEL = "info"
+
+[deployments.production.services.postgres.disks.pgdata]
+  size = 50
+`))
+	if err != nil {
+		t.Fatalf("ParseStackDefinition() error = %v", err)
+	}
+
+	prod, err := def.ForDeployment("production")
+	if err != nil {
+		t.Fatalf("ForDeployment() error = %v", err)
+	}
+
+	web := prod.Apps["web"]
+	if web.Cpu != 2 {
+		t.Errorf("web cpu = %v, want 2", web.Cpu)
+	}
+	if want := map[string]string{"ENV": "production"}; !reflect.DeepEqual(web.Build.Args, want) {
+		t.Errorf("web build args = %v, want %v", web.Build.Args, want)
+	}
+	if want := map[string]string{"LOG_LEVEL": "info", "REGION": "us"}; !reflect.DeepEqual(web.Env, want) {
+		t.Errorf("web env = %v, want %v", web.Env, want)
+	}
+	if want := (AppDiskDefinition{MountPath: "/data", Size: 50}); prod.Services["postgres"].Disks["pgdata"] != want {
+		t.Errorf("pgdata disk = %v, want %v", prod.Services["postgres"].Disks["pgdata"], want)
+	}
+	if prod.Deployments != nil {
+		t.Errorf("ForDeployment() kept overlays")
+	}
+
+	// the base definition is left untouched
+	if def.Apps["web"].Env["LOG_LEVEL"] != "debug" || def.Services["postgres"].Disks["pgdata"].Size != 5 {
+		t.Errorf("ForDeployment() modified the base definition")
+	}
+
+	preview, err := def.ForDeployment("preview")
+	if err != nil {
+		t.Fatalf("ForDeployment() error = %v", err)
+	}
+	if preview.Apps["web"].Cpu != 0.5 {
+		t.Errorf("deployment without overlay cpu = %v, want 0.5", preview.Apps["web"].Cpu)
+	}
+}
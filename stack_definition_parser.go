@@ -0,0 +1,351 @@
+package ark
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+)
+
+const (
+	AppTypeWeb    = "web"
+	AppTypePserv  = "pserv"
+	AppTypeWorker = "worker"
+	AppTypeCron   = "cron"
+)
+
+var appTypes = []string{AppTypeWeb, AppTypePserv, AppTypeWorker, AppTypeCron}
+
+const (
+	RestartNever     = "never"
+	RestartOnFailure = "on-failure"
+	RestartAlways    = "always"
+)
+
+var restartPolicies = []string{RestartNever, RestartOnFailure, RestartAlways}
+
+// app and service names end up in container names and internal domains, so
+// they are restricted to lowercase dns labels
+var namePattern = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]*[a-z0-9])?$`)
+
+// stop signals are passed to docker by name
+var signalPattern = regexp.MustCompile(`^SIG[A-Z0-9]+$`)
+
+// FieldError is a single problem found in a stack definition. Path is the
+// TOML key path of the offending field, e.g. apps.frontend.http_service.container_port
+type FieldError struct {
+	Path    string `json:"path"`
+	Message string `json:"message"`
+}
+
+func (e FieldError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Path, e.Message)
+}
+
+// ValidationError collects every FieldError found in a stack definition so
+// they can all be reported at once.
+type ValidationError struct {
+	Errors []FieldError `json:"errors"`
+}
+
+func (e *ValidationError) Error() string {
+	msgs := make([]string, 0, len(e.Errors))
+	for _, fe := range e.Errors {
+		msgs = append(msgs, fe.Error())
+	}
+
+	return "invalid stack definition: " + strings.Join(msgs, "; ")
+}
+
+func (e *ValidationError) add(path, format string, args ...any) {
+	e.Errors = append(e.Errors, FieldError{Path: path, Message: fmt.Sprintf(format, args...)})
+}
+
+func (e *ValidationError) errOrNil() error {
+	if len(e.Errors) == 0 {
+		return nil
+	}
+
+	return e
+}
+
+// ParseStackDefinition decodes a stack_definition.toml and validates it.
+// Older file versions are upgraded first. Unknown keys are rejected. App and
+// service names are filled in from their table keys.
+func ParseStackDefinition(data []byte) (StackDefinition, error) {
+	def, _, err := ParseAndUpgradeStackDefinition(data)
+	return def, err
+}
+
+// ParseAndUpgradeStackDefinition is ParseStackDefinition, also reporting the
+// upgrades applied to bring the definition to CurrentFileVersion.
+func ParseAndUpgradeStackDefinition(data []byte) (StackDefinition, []AppliedUpgrade, error) {
+	upgraded, applied, err := UpgradeStackDefinition(data)
+	if err != nil {
+		return StackDefinition{}, nil, err
+	}
+
+	def, err := parseStackDefinition(upgraded)
+	return def, applied, err
+}
+
+func parseStackDefinition(data []byte) (StackDefinition, error) {
+	var def StackDefinition
+	md, err := toml.Decode(string(data), &def)
+	if err != nil {
+		return StackDefinition{}, fmt.Errorf("could not decode stack definition: %w", err)
+	}
+
+	verr := &ValidationError{}
+
+	// only report the outermost unknown key, its children are implied
+	var unknown []toml.Key
+	for _, key := range md.Undecoded() {
+		if len(unknown) > 0 && isKeyPrefix(unknown[len(unknown)-1], key) {
+			continue
+		}
+		unknown = append(unknown, key)
+		verr.add(key.String(), "unknown key")
+	}
+
+	def.setNames()
+
+	if err := def.Validate(); err != nil {
+		verr.Errors = append(verr.Errors, err.(*ValidationError).Errors...)
+	}
+
+	return def, verr.errOrNil()
+}
+
+// Validate checks the definition against the rules in docs/stack_definition.md.
+// The returned error is a *ValidationError holding every problem found.
+func (sd StackDefinition) Validate() error {
+	verr := &ValidationError{}
+
+	if sd.FileVersion != "" && sd.FileVersion != CurrentFileVersion {
+		verr.add("file_version", "must be %q, upgrade the definition with arkctl upgrade", CurrentFileVersion)
+	}
+
+	if sd.StackName == "" {
+		verr.add("stack", "is required")
+	} else if !namePattern.MatchString(sd.StackName) {
+		verr.add("stack", "must be lowercase alphanumeric characters or '-'")
+	}
+
+	if sd.RootApp == "" {
+		verr.add("root_app", "is required")
+	} else if _, ok := sd.Apps[sd.RootApp]; !ok {
+		verr.add("root_app", "app %q is not defined", sd.RootApp)
+	}
+
+	for _, name := range sortedKeys(sd.Apps) {
+		validateApp(verr, "apps."+name, name, sd.Apps[name])
+		validateEnv(verr, "apps."+name+".env", sd.Apps[name].Env, sd)
+	}
+
+	for _, name := range sortedKeys(sd.Services) {
+		// apps and services share a namespace on the deployment's network
+		if _, ok := sd.Apps[name]; ok {
+			verr.add("services."+name, "name %q is already used by an app", name)
+		}
+
+		validateService(verr, "services."+name, name, sd.Services[name])
+		validateEnv(verr, "services."+name+".env", sd.Services[name].Env, sd)
+	}
+
+	validateDependencies(verr, sd)
+	validateOverlays(verr, sd)
+
+	return verr.errOrNil()
+}
+
+func validateApp(verr *ValidationError, path, name string, app AppDefinition) {
+	validateName(verr, path, name)
+
+	switch app.Type {
+	case "":
+		verr.add(path+".type", "is required")
+	case AppTypeWeb, AppTypePserv:
+		if app.HttpService.ContainerPort == 0 {
+			verr.add(path+".http_service.container_port", "is required for %s apps", app.Type)
+		}
+	case AppTypeWorker, AppTypeCron:
+		if app.HttpService != (AppHttpServiceDefinition{}) {
+			verr.add(path+".http_service", "is only valid for web or pserv apps")
+		}
+	default:
+		verr.add(path+".type", "must be one of %s", strings.Join(appTypes, ", "))
+	}
+
+	if app.Type == AppTypeCron {
+		if app.Schedule == "" {
+			verr.add(path+".schedule", "is required for cron apps")
+		} else if len(strings.Fields(app.Schedule)) != 5 {
+			verr.add(path+".schedule", "must be a cron expression with 5 fields")
+		}
+	} else if app.Schedule != "" {
+		verr.add(path+".schedule", "is only valid for cron apps")
+	}
+
+	if app.Cpu < 0 {
+		verr.add(path+".cpu", "must not be negative")
+	}
+	if app.Mem < 0 {
+		verr.add(path+".mem", "must not be negative")
+	}
+
+	if app.Min < 0 {
+		verr.add(path+".min", "must not be negative")
+	}
+	if app.Max < 0 {
+		verr.add(path+".max", "must not be negative")
+	}
+	if app.Min > 0 && app.Max > 0 && app.Min > app.Max {
+		verr.add(path+".min", "must not be greater than max")
+	}
+	validateCount(verr, path+".count", app)
+
+	if p := app.HttpService.ContainerPort; p < 0 || p > 65535 {
+		verr.add(path+".http_service.container_port", "must be between 1 and 65535")
+	}
+
+	validateDuration(verr, path+".http_service.idle_timeout", app.HttpService.IdleTimeout)
+
+	if s := app.Deploy.StopSignal; s != "" && !signalPattern.MatchString(s) {
+		verr.add(path+".deploy.stop_signal", "invalid signal %q, e.g. SIGTERM", s)
+	}
+	validateDuration(verr, path+".deploy.stop_grace_period", app.Deploy.StopGracePeriod)
+	if r := app.Deploy.Restart; r != "" && !slices.Contains(restartPolicies, r) {
+		verr.add(path+".deploy.restart", "must be one of %s", strings.Join(restartPolicies, ", "))
+	}
+	if app.Deploy.MaxRetries < 0 {
+		verr.add(path+".deploy.max_retries", "must not be negative")
+	} else if app.Deploy.MaxRetries > 0 && app.Deploy.Restart == RestartNever {
+		verr.add(path+".deploy.max_retries", "is only valid if restart is on-failure or always")
+	}
+
+	hc := app.HealthCheck
+	validateDuration(verr, path+".health_check.grace_period", hc.GracePeriod)
+	validateDuration(verr, path+".health_check.interval", hc.Interval)
+	validateDuration(verr, path+".health_check.timeout", hc.Timeout)
+	if hc.Command != "" && hc.Request != "" {
+		verr.add(path+".health_check", "only one of command or request may be set")
+	}
+	if hc.Request != "" {
+		if _, err := ParseHealthCheckRequest(hc.Request); err != nil {
+			verr.add(path+".health_check.request", "%s", err)
+		} else if app.HttpService.ContainerPort == 0 {
+			verr.add(path+".health_check.request", "requires http_service.container_port")
+		}
+	}
+
+	for _, diskName := range sortedKeys(app.Disks) {
+		validateDisk(verr, path+".disks."+diskName, diskName, app.Disks[diskName])
+	}
+}
+
+func validateCount(verr *ValidationError, path string, app AppDefinition) {
+	switch {
+	case app.Count < 0:
+		verr.add(path, "must not be negative")
+	case app.Min > 0 && app.Replicas() < app.Min:
+		verr.add(path, "must be at least min (%d)", app.Min)
+	case app.Max > 0 && app.Replicas() > app.Max:
+		verr.add(path, "must be at most max (%d)", app.Max)
+	case app.Replicas() > 1 && len(app.Disks) > 0:
+		verr.add(path, "must be 1 for apps with disks, a disk is attached to a single task")
+	}
+}
+
+func validateService(verr *ValidationError, path, name string, srv ServiceDefinition) {
+	validateName(verr, path, name)
+
+	if srv.Image == "" && srv.Dockerfile == "" {
+		verr.add(path, "one of image or dockerfile is required")
+	}
+	if srv.Image != "" && srv.Dockerfile != "" {
+		verr.add(path, "only one of image or dockerfile may be set")
+	}
+	if srv.Dockerfile != "" && srv.RepoUrl == "" {
+		verr.add(path+".repo_url", "is required when dockerfile is set")
+	}
+
+	for _, diskName := range sortedKeys(srv.Disks) {
+		validateDisk(verr, path+".disks."+diskName, diskName, srv.Disks[diskName])
+	}
+}
+
+func validateDisk(verr *ValidationError, path, name string, disk AppDiskDefinition) {
+	validateName(verr, path, name)
+
+	if disk.MountPath == "" {
+		verr.add(path+".mount_path", "is required")
+	} else if !strings.HasPrefix(disk.MountPath, "/") {
+		verr.add(path+".mount_path", "must be an absolute path")
+	}
+
+	if disk.Size <= 0 {
+		verr.add(path+".size", "must be a positive number of GB")
+	}
+}
+
+func validateName(verr *ValidationError, path, name string) {
+	if !namePattern.MatchString(name) {
+		verr.add(path, "name %q must be lowercase alphanumeric characters or '-'", name)
+	}
+}
+
+func validateDuration(verr *ValidationError, path, value string) {
+	if value == "" {
+		return
+	}
+
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		verr.add(path, "invalid duration %q", value)
+		return
+	}
+	if d < 0 {
+		verr.add(path, "must not be negative")
+	}
+}
+
+func (sd *StackDefinition) setNames() {
+	for name, app := range sd.Apps {
+		app.Name = name
+		sd.Apps[name] = app
+	}
+
+	for name, srv := range sd.Services {
+		srv.Name = name
+		sd.Services[name] = srv
+	}
+}
+
+func isKeyPrefix(prefix, key toml.Key) bool {
+	if len(prefix) > len(key) {
+		return false
+	}
+
+	for i := range prefix {
+		if prefix[i] != key[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+func sortedKeys[T any](m map[string]T) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
@@ -0,0 +1,205 @@
+package ark
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func Test_ParseStackDefinition(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  []FieldError
+	}{
+		{
+			"valid",
+			`
+stack = "babies-first-ark"
+root_app = "frontend"
+
+[apps.frontend]
+  type = "web"
+  [apps.frontend.http_service]
+    container_port = 8080
+  [apps.frontend.health_check]
+    interval = "30s"
+
+[services.postgres]
+  image = "postgres"
+  [services.postgres.disks.pgdata]
+    mount_path = "/var/lib/postgresql/data/pgdata"
+    size = 5
+`,
+			nil,
+		},
+		{
+			"all_errors_reported",
+			`
+stack = "babies-first-ark"
+root_app = "missing"
+
+[apps.frontend]
+  type = "web"
+  colour = "blue"
+  [apps.frontend.health_check]
+    timeout = "soon"
+
+[apps.jobs]
+  type = "batch"
+
+[services.postgres]
+  [services.postgres.volumes.pgdata]
+    path = "/data"
+`,
+			[]FieldError{
+				{"apps.frontend.colour", "unknown key"},
+				{"services.postgres.volumes.pgdata", "unknown key"},
+				{"root_app", `app "missing" is not defined`},
+				{"apps.frontend.http_service.container_port", "is required for web apps"},
+				{"apps.frontend.health_check.timeout", `invalid duration "soon"`},
+				{"apps.jobs.type", "must be one of web, pserv, worker, cron"},
+				{"services.postgres", "one of image or dockerfile is required"},
+			},
+		},
+		{
+			"stop_signal",
+			`
+stack = "babies-first-ark"
+root_app = "frontend"
+
+[apps.frontend]
+  type = "web"
+  [apps.frontend.http_service]
+    container_port = 8080
+  [apps.frontend.deploy]
+    stop_signal = "SIGQUIT"
+    stop_grace_period = "30s"
+
+[apps.worker]
+  type = "worker"
+  [apps.worker.deploy]
+    stop_signal = "quit"
+    stop_grace_period = "a while"
+`,
+			[]FieldError{
+				{"apps.worker.deploy.stop_signal", `invalid signal "quit", e.g. SIGTERM`},
+				{"apps.worker.deploy.stop_grace_period", `invalid duration "a while"`},
+			},
+		},
+		{
+			"restart",
+			`
+stack = "babies-first-ark"
+root_app = "frontend"
+
+[apps.frontend]
+  type = "web"
+  [apps.frontend.http_service]
+    container_port = 8080
+  [apps.frontend.deploy]
+    restart = "always"
+    max_retries = 3
+
+[apps.worker]
+  type = "worker"
+  [apps.worker.deploy]
+    restart = "sometimes"
+
+[apps.sweeper]
+  type = "worker"
+  [apps.sweeper.deploy]
+    restart = "never"
+    max_retries = 2
+`,
+			[]FieldError{
+				{"apps.sweeper.deploy.max_retries", "is only valid if restart is on-failure or always"},
+				{"apps.worker.deploy.restart", "must be one of never, on-failure, always"},
+			},
+		},
+		{
+			"cron_schedule",
+			`
+stack = "babies-first-ark"
+root_app = "frontend"
+
+[apps.frontend]
+  type = "web"
+  schedule = "0 * * * *"
+  [apps.frontend.http_service]
+    container_port = 8080
+
+[apps.nightly]
+  type = "cron"
+  cpu = 0.5
+  mem = 128
+`,
+			[]FieldError{
+				{"apps.frontend.schedule", "is only valid for cron apps"},
+				{"apps.nightly.schedule", "is required for cron apps"},
+			},
+		},
+		{
+			"replica_bounds",
+			`
+stack = "babies-first-ark"
+root_app = "frontend"
+
+[apps.frontend]
+  type = "web"
+  count = 5
+  min = 2
+  max = 4
+  [apps.frontend.http_service]
+    container_port = 8080
+
+[apps.worker]
+  type = "worker"
+  min = 3
+  max = 2
+`,
+			[]FieldError{
+				{"apps.frontend.count", "must be at most max (4)"},
+				{"apps.worker.min", "must not be greater than max"},
+				{"apps.worker.count", "must be at least min (3)"},
+			},
+		},
+		{
+			"replicated_disk",
+			`
+stack = "babies-first-ark"
+root_app = "frontend"
+
+[apps.frontend]
+  type = "web"
+  count = 2
+  [apps.frontend.http_service]
+    container_port = 8080
+  [apps.frontend.disks.uploads]
+    mount_path = "/uploads"
+    size = 1
+`,
+			[]FieldError{
+				{"apps.frontend.count", "must be 1 for apps with disks, a disk is attached to a single task"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseStackDefinition([]byte(tt.input))
+
+			var got []FieldError
+			var verr *ValidationError
+			if errors.As(err, &verr) {
+				got = verr.Errors
+			} else if err != nil {
+				t.Fatalf("ParseStackDefinition() unexpected error = %v", err)
+			}
+
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseStackDefinition() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,202 @@
+package ark
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+const jsonSchemaDraft = "https://json-schema.org/draft/2020-12/schema"
+
+// matches anything time.ParseDuration accepts, e.g. 10s, 1m30s or 500ms
+const durationPattern = `^([0-9]+(\.[0-9]+)?(ns|us|µs|ms|s|m|h))+$`
+// five whitespace separated cron fields
+const cronPattern = `^\S+(\s+\S+){4}$`
+
+// JSONSchema is the subset of JSON Schema (draft 2020-12) needed to describe
+// a stack definition
+type JSONSchema struct {
+	Schema               string                 `json:"$schema,omitempty"`
+	Title                string                 `json:"title,omitempty"`
+	Description          string                 `json:"description,omitempty"`
+	Type                 string                 `json:"type,omitempty"`
+	Properties           map[string]*JSONSchema `json:"properties,omitempty"`
+	AdditionalProperties any                    `json:"additionalProperties,omitempty"`
+	PropertyNames        *JSONSchema            `json:"propertyNames,omitempty"`
+	Items                *JSONSchema            `json:"items,omitempty"`
+	Required             []string               `json:"required,omitempty"`
+	Enum                 []string               `json:"enum,omitempty"`
+	Pattern              string                 `json:"pattern,omitempty"`
+	Minimum              *float64               `json:"minimum,omitempty"`
+	Maximum              *float64               `json:"maximum,omitempty"`
+}
+
+type schemaAnnotation struct {
+	description string
+	required    bool
+	enum        []string
+	pattern     string
+	min, max    *float64
+}
+
+func bound(f float64) *float64 { return &f }
+
+// schemaAnnotations are keyed by TOML key path, with * standing in for app,
+// service, disk and env names. descriptions follow docs/stack_definition.md.
+var schemaAnnotations = map[string]schemaAnnotation{
+	"file_version": {description: "Version of the stack definition format."},
+	"version":      {description: "Version of the stack."},
+	"stack":        {description: "Name of the stack, must be globally unique.", required: true, pattern: namePattern.String()},
+	"root_app":     {description: "App that handles HTTP requests to stack-name.ark-root-domain.tld.", required: true},
+	"apps":         {description: "Apps of the stack, keyed by app name."},
+
+	"apps.*.type":                        {description: "Kind of app: web, pserv, worker, or cron.", required: true, enum: appTypes},
+	"apps.*.repo_url":                    {description: "Repository the app is built from."},
+	"apps.*.cpu":                         {description: "CPUs requested for each task. Defaults to the worker's default task cpu.", min: bound(0)},
+	"apps.*.mem":                         {description: "Memory requested for each task, in MB. Defaults to the worker's default task memory.", min: bound(0)},
+	"apps.*.count":                       {description: "Number of tasks to run per deployment, spread across workers where possible. Defaults to 1.", min: bound(0)},
+	"apps.*.min":                         {description: "Lower bound for count.", min: bound(0)},
+	"apps.*.max":                         {description: "Upper bound for count.", min: bound(0)},
+	"apps.*.depends_on":                  {description: "Apps and services that have to be healthy before this app starts."},
+	"apps.*.depends_on.*":                {description: "Name of an app or service.", pattern: namePattern.String()},
+	"apps.*.schedule":                    {description: "Cron schedule. Only valid if type = \"cron\".", pattern: cronPattern},
+	"apps.*.build":                       {description: "How the app's image is built."},
+	"apps.*.build.dockerfile":            {description: "Path to the Dockerfile within the repo."},
+	"apps.*.build.ignorefile":            {description: "Path to the ignore file. Looks for .dockerignore by default."},
+	"apps.*.build.build_target":          {description: "Target stage for multi-stage Dockerfiles."},
+	"apps.*.build.args":                  {description: "Docker build args."},
+	"apps.*.build.args.*":                {description: "Value of the build arg."},
+	"apps.*.deploy":                      {description: "How the app is run."},
+	"apps.*.deploy.command":              {description: "Command the app's container runs."},
+	"apps.*.deploy.release_command":      {description: "Command run before a new release starts, e.g. database migrations."},
+	"apps.*.deploy.stop_signal":          {description: "Signal sent to stop the app's containers. Defaults to SIGTERM.", pattern: signalPattern.String()},
+	"apps.*.deploy.stop_grace_period":    {description: "Time given to exit after the stop signal before the container is killed. Defaults to 10s.", pattern: durationPattern},
+	"apps.*.deploy.restart":              {description: "When tasks are restarted after their container exits. Defaults to on-failure, never for cron apps.", enum: restartPolicies},
+	"apps.*.deploy.max_retries":          {description: "Restarts in a row before a task counts as crash looping and is marked crashed. Defaults to 5.", min: bound(0)},
+	"apps.*.env":                         {description: "Environment variables of the app."},
+	"apps.*.env.*":                       {description: "Value of the environment variable. May contain ${...} references."},
+	"apps.*.http_service":                {description: "Only valid if type = \"web\" or type = \"pserv\"."},
+	"apps.*.http_service.container_port": {description: "Port the app listens on inside its container.", min: bound(1), max: bound(65535)},
+	"apps.*.http_service.keep_alive":     {description: "Keep tasks running while they receive no traffic."},
+	"apps.*.http_service.idle_timeout":   {description: "Time without traffic before a task is suspended, unless keep_alive is set. Tasks are only suspended if it is set.", pattern: durationPattern},
+	"apps.*.health_check":                {description: "How the app's health is checked."},
+	"apps.*.health_check.grace_period":   {description: "Time after start before failing checks count.", pattern: durationPattern},
+	"apps.*.health_check.interval":       {description: "Time between checks.", pattern: durationPattern},
+	"apps.*.health_check.timeout":        {description: "Time before a single check fails.", pattern: durationPattern},
+	"apps.*.health_check.command":        {description: "Command run in the container via docker exec."},
+	"apps.*.health_check.request":        {description: "HTTP request to check. Defaults to an http GET request, e.g. \"http GET /\"."},
+	"apps.*.disks":                       {description: "Persistent disks of the app, keyed by disk name."},
+	"apps.*.disks.*.mount_path":          {description: "Absolute path the disk is mounted at in the container.", pattern: "^/"},
+	"apps.*.disks.*.size":                {description: "Size of the disk, in GB.", min: bound(1)},
+	"services":                           {description: "Services of the stack, keyed by service name."},
+	"services.*.image":                   {description: "Image the service runs. Either image or dockerfile is required."},
+	"services.*.repo_url":                {description: "Repository the service is built from."},
+	"services.*.dockerfile":              {description: "Path to the Dockerfile within the repo."},
+	"services.*.depends_on":              {description: "Apps and services that have to be healthy before this service starts."},
+	"services.*.depends_on.*":            {description: "Name of an app or service.", pattern: namePattern.String()},
+	"services.*.env":                     {description: "Environment variables of the service."},
+	"services.*.env.*":                   {description: "Value of the environment variable. May contain ${...} references."},
+	"services.*.disks":                   {description: "Persistent disks of the service, keyed by disk name."},
+	"services.*.disks.*.mount_path":      {description: "Absolute path the disk is mounted at in the container.", pattern: "^/"},
+	"services.*.disks.*.size":            {description: "Size of the disk, in GB.", min: bound(1)},
+
+	"deployments":                                 {description: "Overrides applied to deployments, keyed by what the deployment is deployed for, e.g. preview or production."},
+	"deployments.*.apps":                          {description: "App overrides, keyed by app name."},
+	"deployments.*.apps.*.cpu":                    {description: "Replaces the app's cpu.", min: bound(0)},
+	"deployments.*.apps.*.mem":                    {description: "Replaces the app's mem, in MB.", min: bound(0)},
+	"deployments.*.apps.*.count":                  {description: "Replaces the app's count.", min: bound(0)},
+	"deployments.*.apps.*.build":                  {description: "Build overrides."},
+	"deployments.*.apps.*.build.args":             {description: "Merged into the app's build args, overriding keys win."},
+	"deployments.*.apps.*.build.args.*":           {description: "Value of the build arg."},
+	"deployments.*.apps.*.env":                    {description: "Merged into the app's env, overriding keys win."},
+	"deployments.*.apps.*.env.*":                  {description: "Value of the environment variable. May contain ${...} references."},
+	"deployments.*.apps.*.disks":                  {description: "Merged into the app's disks by disk name."},
+	"deployments.*.apps.*.disks.*.mount_path":     {description: "Replaces the disk's mount path.", pattern: "^/"},
+	"deployments.*.apps.*.disks.*.size":           {description: "Replaces the disk's size, in GB.", min: bound(1)},
+	"deployments.*.services":                      {description: "Service overrides, keyed by service name."},
+	"deployments.*.services.*.env":                {description: "Merged into the service's env, overriding keys win."},
+	"deployments.*.services.*.env.*":              {description: "Value of the environment variable. May contain ${...} references."},
+	"deployments.*.services.*.disks":              {description: "Merged into the service's disks by disk name."},
+	"deployments.*.services.*.disks.*.mount_path": {description: "Replaces the disk's mount path.", pattern: "^/"},
+	"deployments.*.services.*.disks.*.size":       {description: "Replaces the disk's size, in GB.", min: bound(1)},
+}
+
+// StackDefinitionSchema returns a JSON Schema describing stack_definition.toml,
+// generated from StackDefinition and its nested types.
+func StackDefinitionSchema() *JSONSchema {
+	s := schemaFor(reflect.TypeOf(StackDefinition{}), "")
+	s.Schema = jsonSchemaDraft
+	s.Title = "Ark stack definition"
+	s.Description = "Definition of an ark stack, usually stored as stack_definition.toml."
+
+	return s
+}
+
+func schemaFor(t reflect.Type, path string) *JSONSchema {
+	var s *JSONSchema
+
+	switch t.Kind() {
+	case reflect.Struct:
+		s = &JSONSchema{
+			Type:                 "object",
+			Properties:           make(map[string]*JSONSchema),
+			AdditionalProperties: false,
+		}
+
+		for i := 0; i < t.NumField(); i++ {
+			key := t.Field(i).Tag.Get("toml")
+			if key == "" || key == "-" {
+				continue
+			}
+
+			fieldPath := joinSchemaPath(path, key)
+			s.Properties[key] = schemaFor(t.Field(i).Type, fieldPath)
+			if schemaAnnotations[fieldPath].required {
+				s.Required = append(s.Required, key)
+			}
+		}
+	case reflect.Map:
+		s = &JSONSchema{
+			Type:                 "object",
+			AdditionalProperties: schemaFor(t.Elem(), joinSchemaPath(path, "*")),
+		}
+
+		// apps, services and disks are named with dns labels
+		if t.Elem().Kind() == reflect.Struct {
+			s.PropertyNames = &JSONSchema{Pattern: namePattern.String()}
+		}
+	case reflect.Slice:
+		s = &JSONSchema{
+			Type:  "array",
+			Items: schemaFor(t.Elem(), joinSchemaPath(path, "*")),
+		}
+	case reflect.String:
+		s = &JSONSchema{Type: "string"}
+	case reflect.Int:
+		s = &JSONSchema{Type: "integer"}
+	case reflect.Float64:
+		s = &JSONSchema{Type: "number"}
+	case reflect.Bool:
+		s = &JSONSchema{Type: "boolean"}
+	default:
+		panic(fmt.Sprintf("stack definition schema: unsupported kind %s at %s", t.Kind(), path))
+	}
+
+	if a, ok := schemaAnnotations[path]; ok {
+		s.Description = a.description
+		s.Enum = a.enum
+		s.Pattern = a.pattern
+		s.Minimum = a.min
+		s.Maximum = a.max
+	}
+
+	return s
+}
+
+func joinSchemaPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+
+	return strings.Join([]string{path, key}, ".")
+}
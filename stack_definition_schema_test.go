@@ -0,0 +1,39 @@
+package ark
+
+import "testing"
+
+// keeps schemaAnnotations in sync with the StackDefinition structs: every
+// annotation must point at a field and every field must be described
+func Test_StackDefinitionSchema(t *testing.T) {
+	paths := make(map[string]*JSONSchema)
+	collectSchemaPaths(StackDefinitionSchema(), "", paths)
+
+	for path := range schemaAnnotations {
+		if _, ok := paths[path]; !ok {
+			t.Errorf("annotation %s does not match any stack definition field", path)
+		}
+	}
+
+	for path, s := range paths {
+		if path == "" || path[len(path)-1] == '*' {
+			continue
+		}
+		if s.Description == "" {
+			t.Errorf("field %s has no description in schemaAnnotations", path)
+		}
+	}
+}
+
+func collectSchemaPaths(s *JSONSchema, path string, paths map[string]*JSONSchema) {
+	paths[path] = s
+
+	for key, prop := range s.Properties {
+		collectSchemaPaths(prop, joinSchemaPath(path, key), paths)
+	}
+	if elem, ok := s.AdditionalProperties.(*JSONSchema); ok {
+		collectSchemaPaths(elem, joinSchemaPath(path, "*"), paths)
+	}
+	if s.Items != nil {
+		collectSchemaPaths(s.Items, joinSchemaPath(path, "*"), paths)
+	}
+}
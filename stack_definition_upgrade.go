@@ -0,0 +1,316 @@
+package ark
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+)
+
+// CurrentFileVersion is the stack definition format written by this version
+// of ark. definitions without a file_version are treated as version 0.
+const CurrentFileVersion = "1"
+
+var ErrUnsupportedFileVersion = errors.New("unsupported stack definition file_version")
+
+// AppliedUpgrade describes one step of the upgrade chain that was applied
+// to a stack definition
+type AppliedUpgrade struct {
+	From        string   `json:"from"`
+	To          string   `json:"to"`
+	Description string   `json:"description"`
+	Changes     []string `json:"changes"`
+}
+
+// upgradeStep turns a definition at version from into version to. steps edit
+// the document line by line so comments and layout survive a rewrite.
+type upgradeStep struct {
+	from, to    string
+	description string
+	apply       func(doc *tomlDoc)
+}
+
+// upgradeSteps is the migration chain, ordered by version. each step must
+// pick up where the previous one left off.
+var upgradeSteps = []upgradeStep{
+	{
+		from:        "0",
+		to:          "1",
+		description: "snake_case keys and numeric ports and disk sizes",
+		apply: func(doc *tomlDoc) {
+			doc.renameKey("apps.*.build.build-target", "build_target")
+			doc.renameKey("apps.*.health_check.intervale", "interval")
+			doc.rewriteValue("apps.*.http_service.container_port", unquoteInt)
+			doc.rewriteValue("apps.*.disks.*.size", unquoteInt)
+			doc.rewriteValue("services.*.disks.*.size", unquoteInt)
+		},
+	},
+}
+
+// UpgradeStackDefinition brings a stack_definition.toml to CurrentFileVersion
+// and returns the upgraded document along with the steps applied. it returns
+// data as is if no upgrade is needed.
+func UpgradeStackDefinition(data []byte) ([]byte, []AppliedUpgrade, error) {
+	var header struct {
+		FileVersion any `toml:"file_version"`
+	}
+	if _, err := toml.Decode(string(data), &header); err != nil {
+		return nil, nil, fmt.Errorf("could not decode stack definition: %w", err)
+	}
+
+	// file_version is a string, but an integer is common enough to accept
+	// and quote on the way through
+	version := "0"
+	quoted := true
+	switch v := header.FileVersion.(type) {
+	case nil:
+	case string:
+		version = v
+	case int64:
+		version = strconv.FormatInt(v, 10)
+		quoted = false
+	default:
+		return nil, nil, fmt.Errorf("%w: %v, must be a string", ErrUnsupportedFileVersion, v)
+	}
+	if version == CurrentFileVersion && quoted {
+		return data, nil, nil
+	}
+
+	doc := parseTomlDoc(string(data))
+	applied := make([]AppliedUpgrade, 0)
+
+	for _, step := range upgradeSteps {
+		if step.from != version {
+			continue
+		}
+
+		doc.changes = nil
+		step.apply(doc)
+		applied = append(applied, AppliedUpgrade{
+			From:        step.from,
+			To:          step.to,
+			Description: step.description,
+			Changes:     doc.changes,
+		})
+		version = step.to
+	}
+
+	if version != CurrentFileVersion {
+		return nil, nil, fmt.Errorf("%w: %q", ErrUnsupportedFileVersion, version)
+	}
+
+	doc.setRootValue("file_version", strconv.Quote(CurrentFileVersion))
+
+	return []byte(doc.String()), applied, nil
+}
+
+var (
+	tomlHeaderPattern = regexp.MustCompile(`^\s*\[\[?\s*([^\[\]]+?)\s*\]\]?\s*(#.*)?$`)
+	tomlKeyPattern    = regexp.MustCompile(`^(\s*)([A-Za-z0-9_\-."]+?)(\s*=\s*)(.*)$`)
+)
+
+// tomlDoc is a line based view of a TOML document, just enough to rename
+// keys and rewrite simple values in place
+type tomlDoc struct {
+	lines   []tomlLine
+	changes []string
+}
+
+type tomlLine struct {
+	text string
+	// full key path of a header or key/value line, nil for anything else
+	path     []string
+	isHeader bool
+}
+
+func parseTomlDoc(src string) *tomlDoc {
+	doc := &tomlDoc{}
+
+	var table []string
+	var multilineDelim string
+	arrayDepth := 0
+
+	for _, text := range strings.Split(src, "\n") {
+		line := tomlLine{text: text}
+
+		switch {
+		case multilineDelim != "":
+			// inside a multi-line string
+			if strings.Contains(text, multilineDelim) {
+				multilineDelim = ""
+			}
+		case arrayDepth > 0:
+			// inside a multi-line array
+			arrayDepth += bracketDepth(text)
+		default:
+			if m := tomlHeaderPattern.FindStringSubmatch(text); m != nil {
+				table = splitTomlKey(m[1])
+				line.path = table
+				line.isHeader = true
+			} else if m := tomlKeyPattern.FindStringSubmatch(text); m != nil {
+				line.path = append(append([]string{}, table...), splitTomlKey(m[2])...)
+
+				value := tomlValue(m[4])
+				for _, delim := range []string{`"""`, `'''`} {
+					if strings.HasPrefix(value, delim) && strings.Count(value, delim) == 1 {
+						multilineDelim = delim
+					}
+				}
+				arrayDepth = bracketDepth(value)
+			}
+		}
+
+		doc.lines = append(doc.lines, line)
+	}
+
+	return doc
+}
+
+// renameKey renames the segment matched by the last part of pattern in
+// every key or table path starting with pattern
+func (doc *tomlDoc) renameKey(pattern, newName string) {
+	patternParts := strings.Split(pattern, ".")
+	idx := len(patternParts) - 1
+
+	for i, line := range doc.lines {
+		if len(line.path) < len(patternParts) || !matchKeyPath(patternParts, line.path[:len(patternParts)]) {
+			continue
+		}
+
+		oldPath := strings.Join(line.path, ".")
+		newPath := append([]string{}, line.path...)
+		newPath[idx] = newName
+		doc.lines[i].path = newPath
+
+		if line.isHeader {
+			m := tomlHeaderPattern.FindStringSubmatchIndex(line.text)
+			doc.lines[i].text = line.text[:m[2]] + strings.Join(newPath, ".") + line.text[m[3]:]
+		} else {
+			m := tomlKeyPattern.FindStringSubmatchIndex(line.text)
+			tableLen := len(line.path) - len(splitTomlKey(line.text[m[4]:m[5]]))
+			if tableLen > idx {
+				// the renamed segment is part of the table header, which is
+				// rewritten on its own line
+				continue
+			}
+			doc.lines[i].text = line.text[:m[4]] + strings.Join(newPath[tableLen:], ".") + line.text[m[5]:]
+		}
+
+		doc.changes = append(doc.changes, fmt.Sprintf("line %d: renamed %s to %s", i+1, oldPath, strings.Join(newPath, ".")))
+	}
+}
+
+// rewriteValue replaces the value of every key matching pattern when fn
+// returns ok. trailing comments are kept.
+func (doc *tomlDoc) rewriteValue(pattern string, fn func(raw string) (string, bool)) {
+	patternParts := strings.Split(pattern, ".")
+
+	for i, line := range doc.lines {
+		if line.isHeader || !matchKeyPath(patternParts, line.path) {
+			continue
+		}
+
+		m := tomlKeyPattern.FindStringSubmatchIndex(line.text)
+		rest := line.text[m[8]:]
+		raw := tomlValue(rest)
+
+		newRaw, ok := fn(raw)
+		if !ok || newRaw == raw {
+			continue
+		}
+
+		doc.lines[i].text = line.text[:m[8]] + newRaw + rest[len(raw):]
+		doc.changes = append(doc.changes, fmt.Sprintf("line %d: changed %s from %s to %s", i+1, strings.Join(line.path, "."), raw, newRaw))
+	}
+}
+
+// setRootValue sets a key of the root table, adding it at the top of the
+// document if it is missing
+func (doc *tomlDoc) setRootValue(key, raw string) {
+	for _, line := range doc.lines {
+		if line.isHeader {
+			break
+		}
+		if len(line.path) == 1 && line.path[0] == key {
+			doc.rewriteValue(key, func(string) (string, bool) { return raw, true })
+			return
+		}
+	}
+
+	line := tomlLine{text: key + " = " + raw, path: []string{key}}
+	doc.lines = append([]tomlLine{line, {text: ""}}, doc.lines...)
+}
+
+func (doc *tomlDoc) String() string {
+	texts := make([]string, len(doc.lines))
+	for i, line := range doc.lines {
+		texts[i] = line.text
+	}
+
+	return strings.Join(texts, "\n")
+}
+
+func matchKeyPath(pattern, path []string) bool {
+	if len(pattern) != len(path) {
+		return false
+	}
+
+	for i := range pattern {
+		if pattern[i] != "*" && pattern[i] != path[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+func splitTomlKey(key string) []string {
+	parts := strings.Split(key, ".")
+	for i, p := range parts {
+		parts[i] = strings.Trim(strings.TrimSpace(p), `"'`)
+	}
+
+	return parts
+}
+
+// tomlValue returns the raw value at the start of s, without any trailing
+// comment or whitespace
+func tomlValue(s string) string {
+	var quote rune
+	for i, r := range s {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			}
+		case r == '"' || r == '\'':
+			quote = r
+		case r == '#':
+			return strings.TrimSpace(s[:i])
+		}
+	}
+
+	return strings.TrimSpace(s)
+}
+
+func bracketDepth(s string) int {
+	return strings.Count(s, "[") - strings.Count(s, "]")
+}
+
+// unquoteInt turns "5" or "5GB" into 5
+func unquoteInt(raw string) (string, bool) {
+	s, err := strconv.Unquote(raw)
+	if err != nil {
+		return raw, false
+	}
+
+	s = strings.TrimSuffix(strings.TrimSpace(s), "GB")
+	if _, err := strconv.Atoi(s); err != nil {
+		return raw, false
+	}
+
+	return s, true
+}
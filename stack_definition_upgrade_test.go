@@ -0,0 +1,79 @@
+package ark
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func Test_UpgradeStackDefinition(t *testing.T) {
+	v0 := `# my stack
+stack = "old-stack"
+root_app = "web"
+
+[apps.web]
+  type = "web" # the frontend
+  [apps.web.build]
+    build-target = "app" # multi-stage
+  [apps.web.http_service]
+    container_port = "8080"
+
+[services.db]
+  image = "postgres"
+  [services.db.disks.data]
+    mount_path = "/data"
+    size = "5GB"
+`
+	want := `file_version = "1"
+
+# my stack
+stack = "old-stack"
+root_app = "web"
+
+[apps.web]
+  type = "web" # the frontend
+  [apps.web.build]
+    build_target = "app" # multi-stage
+  [apps.web.http_service]
+    container_port = 8080
+
+[services.db]
+  image = "postgres"
+  [services.db.disks.data]
+    mount_path = "/data"
+    size = 5
+`
+
+	got, applied, err := UpgradeStackDefinition([]byte(v0))
+	if err != nil {
+		t.Fatalf("UpgradeStackDefinition() error = %v", err)
+	}
+	if string(got) != want {
+		t.Errorf("UpgradeStackDefinition() = %s, want %s", got, want)
+	}
+	if len(applied) != 1 || len(applied[0].Changes) != 3 {
+		t.Errorf("UpgradeStackDefinition() applied = %v, want 1 upgrade with 3 changes", applied)
+	}
+
+	if _, err := ParseStackDefinition([]byte(v0)); err != nil {
+		t.Errorf("ParseStackDefinition() of upgraded definition error = %v", err)
+	}
+
+	again, applied, err := UpgradeStackDefinition(got)
+	if err != nil || string(again) != string(got) || len(applied) != 0 {
+		t.Errorf("UpgradeStackDefinition() of current version changed it: %v, %v", applied, err)
+	}
+
+	integer := strings.Replace(want, `file_version = "1"`, `file_version = 1`, 1)
+	got, applied, err = UpgradeStackDefinition([]byte(integer))
+	if err != nil || string(got) != want || len(applied) != 0 {
+		t.Errorf("UpgradeStackDefinition() of integer file_version = %s, %v, %v", got, applied, err)
+	}
+	if _, err := ParseStackDefinition([]byte(integer)); err != nil {
+		t.Errorf("ParseStackDefinition() of integer file_version error = %v", err)
+	}
+
+	if _, _, err := UpgradeStackDefinition([]byte("file_version = 1.5\n")); !errors.Is(err, ErrUnsupportedFileVersion) {
+		t.Errorf("UpgradeStackDefinition() of float file_version error = %v, want ErrUnsupportedFileVersion", err)
+	}
+}